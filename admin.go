@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// AdminServer serves moderation endpoints to operators. Requests must
+// carry the admin token as a bearer token.
+type AdminServer struct {
+	hub   *Hub
+	token string
+}
+
+// NewAdminServer creates admin endpoints guarded by token, which must not
+// be empty
+func NewAdminServer(hub *Hub, token string) *AdminServer {
+	return &AdminServer{hub: hub, token: token}
+}
+
+// authorize checks the request's bearer token, answering 401 if it is
+// missing or wrong
+func (s *AdminServer) authorize(w http.ResponseWriter, r *http.Request) bool {
+	header := r.Header.Get("Authorization")
+	token := strings.TrimPrefix(header, "Bearer ")
+	if token == header || s.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// HandleSpamDecisions lists spam escalations, newest first. The user
+// parameter narrows them to one display name and limit caps how many are
+// returned.
+func (s *AdminServer) HandleSpamDecisions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorize(w, r) {
+		return
+	}
+
+	limit, ok := parseLimit(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled":   s.hub.spamConfig.enabled(),
+		"decisions": s.hub.SpamDecisions(r.URL.Query().Get("user"), limit),
+	})
+}
+
+// HandleWebhookDeadLetters lists webhook deliveries that were given up on,
+// newest first. The limit parameter caps how many are returned.
+func (s *AdminServer) HandleWebhookDeadLetters(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorize(w, r) {
+		return
+	}
+	limit, ok := parseLimit(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"webhooks":     len(s.hub.webhooks),
+		"dead_letters": s.hub.WebhookDeadLetters(limit),
+	})
+}
+
+// parseLimit reads the optional limit parameter, answering 400 if it is
+// not a non-negative number
+func parseLimit(w http.ResponseWriter, r *http.Request) (int, bool) {
+	value := r.URL.Query().Get("limit")
+	if value == "" {
+		return 0, true
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		http.Error(w, "Invalid limit", http.StatusBadRequest)
+		return 0, false
+	}
+	return n, true
+}
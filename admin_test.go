@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminServer_Authorization(t *testing.T) {
+	admin := NewAdminServer(NewHub(), "s3cret")
+
+	tests := []struct {
+		name   string
+		header string
+		want   int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"wrong token", "Bearer guess", http.StatusUnauthorized},
+		{"token without scheme", "s3cret", http.StatusUnauthorized},
+		{"valid token", "Bearer s3cret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest("GET", "/admin/spam", nil)
+			if tt.header != "" {
+				request.Header.Set("Authorization", tt.header)
+			}
+			recorder := httptest.NewRecorder()
+			admin.HandleSpamDecisions(recorder, request)
+			if recorder.Code != tt.want {
+				t.Errorf("Expected %d, got %d", tt.want, recorder.Code)
+			}
+		})
+	}
+
+	recorder := httptest.NewRecorder()
+	admin.HandleSpamDecisions(recorder, httptest.NewRequest("POST", "/admin/spam", nil))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected POST to be refused, got %d", recorder.Code)
+	}
+}
+
+func TestAdminServer_SpamDecisions(t *testing.T) {
+	hub := NewHub()
+	hub.SetSpamDetection(DefaultSpamConfig())
+	hub.spamLog.add(SpamDecision{User: "Ann", Action: SpamWarn, Reasons: []string{"new connection"}})
+	hub.spamLog.add(SpamDecision{User: "Bob", Action: SpamMute})
+	hub.spamLog.add(SpamDecision{User: "Ann", Action: SpamDisconnect})
+	admin := NewAdminServer(hub, "s3cret")
+
+	get := func(query string) (int, map[string]json.RawMessage) {
+		request := httptest.NewRequest("GET", "/admin/spam"+query, nil)
+		request.Header.Set("Authorization", "Bearer s3cret")
+		recorder := httptest.NewRecorder()
+		admin.HandleSpamDecisions(recorder, request)
+		var body map[string]json.RawMessage
+		json.Unmarshal(recorder.Body.Bytes(), &body)
+		return recorder.Code, body
+	}
+
+	_, body := get("?user=Ann")
+	var decisions []map[string]interface{}
+	json.Unmarshal(body["decisions"], &decisions)
+	if len(decisions) != 2 || decisions[0]["action"] != "disconnect" || decisions[1]["action"] != "warn" {
+		t.Errorf("Expected Ann's decisions newest first, got %s", body["decisions"])
+	}
+	if string(body["enabled"]) != "true" {
+		t.Errorf("Expected detection to be reported on, got %s", body["enabled"])
+	}
+
+	_, body = get("?limit=1")
+	json.Unmarshal(body["decisions"], &decisions)
+	if len(decisions) != 1 || decisions[0]["user"] != "Ann" {
+		t.Errorf("Expected only the newest decision, got %s", body["decisions"])
+	}
+
+	if code, _ := get("?limit=-1"); code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid limit to be refused, got %d", code)
+	}
+}
+
+func TestAdminServer_WebhookDeadLetters(t *testing.T) {
+	hub := NewHub()
+	hub.webhookDeadLetters = &webhookDeadLetterLog{}
+	hub.webhookDeadLetters.add(WebhookDeadLetter{Event: WebhookEventJoin, Payload: json.RawMessage(`{"user":"Ann"}`)})
+	hub.webhookDeadLetters.add(WebhookDeadLetter{Event: WebhookEventLeave, Payload: json.RawMessage(`{"user":"Ann"}`)})
+	admin := NewAdminServer(hub, "s3cret")
+
+	request := httptest.NewRequest("GET", "/admin/webhooks/dead-letters?limit=1", nil)
+	request.Header.Set("Authorization", "Bearer s3cret")
+	recorder := httptest.NewRecorder()
+	admin.HandleWebhookDeadLetters(recorder, request)
+	var body struct {
+		DeadLetters []WebhookDeadLetter `json:"dead_letters"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Expected JSON, got %s", recorder.Body)
+	}
+	if len(body.DeadLetters) != 1 || body.DeadLetters[0].Event != WebhookEventLeave {
+		t.Errorf("Expected the newest dead letter, got %+v", body.DeadLetters)
+	}
+
+	recorder = httptest.NewRecorder()
+	admin.HandleWebhookDeadLetters(recorder, httptest.NewRequest("GET", "/admin/webhooks/dead-letters", nil))
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a request without the token to be refused, got %d", recorder.Code)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sort"
+)
+
+// Block lists are keyed by display name, which is the only identity the
+// server has. They last as long as the name is held: every node clears a
+// name's list when its holder leaves, so the next user to take the name
+// does not inherit it. Changes are copied to the other nodes.
+
+// Block stops target from sending private messages to blocker and flags
+// target's public messages for blocker
+func (h *Hub) Block(blocker, target string) error {
+	if blocker == target {
+		return errors.New("cannot block yourself")
+	}
+	if err := validateDisplayName(target); err != nil {
+		return errors.New("invalid user to block: " + err.Error())
+	}
+
+	h.setBlocked(blocker, target, true)
+	h.publish(BrokerEvent{Kind: BrokerEventBlock, Content: blockAdd, To: target, Message: Message{From: blocker}})
+	log.Printf("[BLOCK] %s blocked %s", blocker, target)
+	return nil
+}
+
+// Unblock removes target from blocker's block list
+func (h *Hub) Unblock(blocker, target string) {
+	h.setBlocked(blocker, target, false)
+	h.publish(BrokerEvent{Kind: BrokerEventBlock, Content: blockRemove, To: target, Message: Message{From: blocker}})
+	log.Printf("[BLOCK] %s unblocked %s", blocker, target)
+}
+
+// setBlocked adds target to or removes it from blocker's block list
+func (h *Hub) setBlocked(blocker, target string, blocked bool) {
+	h.blocksMu.Lock()
+	defer h.blocksMu.Unlock()
+
+	list, ok := h.blocks[blocker]
+	if blocked {
+		if !ok {
+			list = make(map[string]bool)
+			h.blocks[blocker] = list
+		}
+		list[target] = true
+		return
+	}
+	if ok {
+		delete(list, target)
+		if len(list) == 0 {
+			delete(h.blocks, blocker)
+		}
+	}
+}
+
+// clearBlocks drops the block list of a name whose holder left
+func (h *Hub) clearBlocks(name string) {
+	h.blocksMu.Lock()
+	defer h.blocksMu.Unlock()
+	delete(h.blocks, name)
+}
+
+// IsBlocked reports whether blocker has blocked sender
+func (h *Hub) IsBlocked(blocker, sender string) bool {
+	h.blocksMu.RLock()
+	defer h.blocksMu.RUnlock()
+	return h.blocks[blocker][sender]
+}
+
+// BlockedUsers returns blocker's block list in sorted order
+func (h *Hub) BlockedUsers(blocker string) []string {
+	h.blocksMu.RLock()
+	defer h.blocksMu.RUnlock()
+
+	users := make([]string, 0, len(h.blocks[blocker]))
+	for name := range h.blocks[blocker] {
+		users = append(users, name)
+	}
+	sort.Strings(users)
+	return users
+}
+
+// blockersOf returns the users who have blocked sender
+func (h *Hub) blockersOf(sender string) []string {
+	h.blocksMu.RLock()
+	defer h.blocksMu.RUnlock()
+
+	blockers := make([]string, 0)
+	for blocker, blocked := range h.blocks {
+		if blocked[sender] {
+			blockers = append(blockers, blocker)
+		}
+	}
+	return blockers
+}
+
+// withoutBlockers filters out recipients who have blocked sender
+func (h *Hub) withoutBlockers(sender string, names []string) []string {
+	filtered := make([]string, 0, len(names))
+	for _, name := range names {
+		if !h.IsBlocked(name, sender) {
+			filtered = append(filtered, name)
+		}
+	}
+	return filtered
+}
+
+// handleBlock processes block and unblock requests and replies with the
+// client's updated block list
+func (c *Client) handleBlock(message *Message) {
+	if c.displayName == "" {
+		c.sendError("Must join chat before blocking users")
+		return
+	}
+
+	target := message.To
+	if message.Type == MessageTypeBlock {
+		if err := c.hub.Block(c.displayName, target); err != nil {
+			c.sendError("Block failed: " + err.Error())
+			return
+		}
+	} else {
+		c.hub.Unblock(c.displayName, target)
+	}
+
+	response := &Message{
+		Type:  MessageTypeBlockList,
+		Users: c.hub.BlockedUsers(c.displayName),
+	}
+	response.SetTimestampAt(c.now())
+	response.SanitizeInput()
+	c.sendMessage(response)
+}
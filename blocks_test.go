@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHub_BlockAndUnblock(t *testing.T) {
+	hub := NewHub()
+
+	if err := hub.Block("Alice", "Alice"); err == nil {
+		t.Error("Expected blocking yourself to fail")
+	}
+	if err := hub.Block("Alice", ""); err == nil {
+		t.Error("Expected blocking an empty name to fail")
+	}
+
+	hub.Block("Alice", "Mallory")
+	hub.Block("Alice", "Eve")
+	if !hub.IsBlocked("Alice", "Mallory") {
+		t.Error("Expected Mallory to be blocked by Alice")
+	}
+	if hub.IsBlocked("Mallory", "Alice") {
+		t.Error("Blocking should not be symmetric")
+	}
+	if got := hub.BlockedUsers("Alice"); !reflect.DeepEqual(got, []string{"Eve", "Mallory"}) {
+		t.Errorf("Expected sorted block list, got %v", got)
+	}
+
+	hub.Unblock("Alice", "Mallory")
+	if hub.IsBlocked("Alice", "Mallory") {
+		t.Error("Expected Mallory to be unblocked")
+	}
+}
+
+func TestHub_BlockListClearedWhenNameReleased(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	defer hub.Stop()
+
+	alice := &Client{hub: hub, send: make(chan outboundFrame, 10), displayName: "Alice"}
+	hub.RegisterClient(alice, "Alice")
+	hub.Block("Alice", "Mallory")
+
+	hub.UnregisterClient(alice)
+	if !waitUntil(time.Second, func() bool { return hub.GetClientCount() == 0 }) {
+		t.Fatal("Expected Alice to leave")
+	}
+
+	// The next user to join as Alice starts with an empty list
+	if !waitUntil(time.Second, func() bool { return len(hub.BlockedUsers("Alice")) == 0 }) {
+		t.Errorf("Expected Alice's block list to be cleared, got %v", hub.BlockedUsers("Alice"))
+	}
+}
+
+func TestHub_SendPrivateMessage_Blocked(t *testing.T) {
+	hub := NewHub()
+	alice := &Client{hub: hub, send: make(chan outboundFrame, 10), displayName: "Alice"}
+	mallory := &Client{hub: hub, send: make(chan outboundFrame, 10), displayName: "Mallory"}
+	hub.UpdateClientName(alice, "Alice")
+	hub.UpdateClientName(mallory, "Mallory")
+
+	hub.Block("Alice", "Mallory")
+
+	message := Message{Type: MessageTypePrivate, From: "Mallory", To: "Alice", Content: "hello"}
+	err := hub.SendPrivateMessage("Mallory", "Alice", message)
+	if err == nil || err.Error() != "recipient not found or offline" {
+		t.Errorf("Expected neutral offline error, got %v", err)
+	}
+
+	select {
+	case <-alice.send:
+		t.Error("Blocked sender's private message was delivered")
+	default:
+	}
+
+	// The blocked user can still be messaged by the blocker
+	reply := Message{Type: MessageTypePrivate, From: "Alice", To: "Mallory", Content: "go away"}
+	if err := hub.SendPrivateMessage("Alice", "Mallory", reply); err != nil {
+		t.Errorf("Expected blocker to reach blocked user, got %v", err)
+	}
+}
+
+func TestHub_BroadcastMessage_FlagsBlockedSender(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	defer hub.Stop()
+
+	alice := &Client{hub: hub, send: make(chan outboundFrame, 10), displayName: "Alice"}
+	bob := &Client{hub: hub, send: make(chan outboundFrame, 10), displayName: "Bob"}
+	hub.mu.Lock()
+	hub.userList[alice] = "Alice"
+	hub.userList[bob] = "Bob"
+	hub.mu.Unlock()
+	hub.assignShard(alice)
+	hub.assignShard(bob)
+
+	hub.Block("Alice", "Mallory")
+
+	message := Message{Type: MessageTypeChat, From: "Mallory", Content: "spam"}
+	message.SetTimestamp()
+	hub.BroadcastMessage(message)
+
+	for client, wantBlocked := range map[*Client]bool{alice: true, bob: false} {
+		select {
+		case frame := <-client.send:
+			data := frame.data
+			var received Message
+			json.Unmarshal(data, &received)
+			if received.Blocked != wantBlocked {
+				t.Errorf("%s: expected blocked=%t, got %t", client.displayName, wantBlocked, received.Blocked)
+			}
+			if received.Content != "spam" {
+				t.Errorf("%s: expected message content to be kept", client.displayName)
+			}
+		case <-time.After(200 * time.Millisecond):
+			t.Errorf("%s did not receive broadcast", client.displayName)
+		}
+	}
+}
+
+func TestClient_HandleBlock(t *testing.T) {
+	hub := NewHub()
+	client := &Client{hub: hub, send: make(chan outboundFrame, 10), displayName: "Alice"}
+
+	client.handleBlock(&Message{Type: MessageTypeBlock, To: "Mallory"})
+	select {
+	case frame := <-client.send:
+		data := frame.data
+		var response Message
+		json.Unmarshal(data, &response)
+		if response.Type != MessageTypeBlockList || !reflect.DeepEqual(response.Users, []string{"Mallory"}) {
+			t.Errorf("Unexpected block response %+v", response)
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("Client did not receive block list")
+	}
+
+	client.handleBlock(&Message{Type: MessageTypeUnblock, To: "Mallory"})
+	select {
+	case frame := <-client.send:
+		data := frame.data
+		var response Message
+		json.Unmarshal(data, &response)
+		if len(response.Users) != 0 {
+			t.Errorf("Expected empty block list, got %v", response.Users)
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("Client did not receive block list")
+	}
+}
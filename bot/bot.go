@@ -0,0 +1,340 @@
+// Package bot is a client for writing chat bots in Go. Bots connect to the
+// server's /ws endpoint and speak the same protocol as the web UI: a hello
+// declaring the protocol version, a join, then JSON messages, which the
+// server may batch into one frame, one per line.
+//
+// A bot joins under the name of a bot account configured on the server,
+// authenticating with the account's token. It is listed among the bots in
+// user lists, its messages are labelled as bot messages and it is held to
+// the server's bot rate limits.
+package bot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ProtocolVersion is the chat protocol version the bot declares
+const ProtocolVersion = 1
+
+// Message types a bot sends or commonly handles
+const (
+	TypeChat     = "chat"
+	TypePrivate  = "private"
+	TypeSystem   = "system"
+	TypeUserList = "user_list"
+	TypeError    = "error"
+	TypeMention  = "mention"
+	TypeJoin     = "join"
+	TypeHello    = "hello"
+)
+
+// Message is a chat protocol message
+type Message struct {
+	ID        string    `json:"id,omitempty"`
+	Type      string    `json:"type"`
+	From      string    `json:"from,omitempty"`
+	To        string    `json:"to,omitempty"`
+	Content   string    `json:"content,omitempty"`
+	Users     []string  `json:"users,omitempty"`
+	Bots      []string  `json:"bots,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+
+	// Threads: ReplyTo is the message answered and ThreadID the root of
+	// its thread
+	ReplyTo  string `json:"reply_to,omitempty"`
+	ThreadID string `json:"thread_id,omitempty"`
+
+	// Mentions lists the users a public message mentions
+	Mentions []string `json:"mentions,omitempty"`
+
+	// Bot marks messages from bots
+	Bot bool `json:"bot,omitempty"`
+
+	// RetryAfter is how many seconds to wait after being rate limited
+	RetryAfter int `json:"retry_after,omitempty"`
+
+	// Hello and join fields
+	Version      int      `json:"version,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+	Token        string   `json:"token,omitempty"`
+}
+
+// Handler is called with each message of the type it was registered for
+type Handler func(b *Bot, m Message)
+
+// Config says where a bot connects and who it joins as
+type Config struct {
+	// URL of the server's WebSocket endpoint, e.g. ws://localhost:8080/ws
+	URL string
+
+	// Name and Token of the bot account to join as
+	Name  string
+	Token string
+
+	// Reconnects wait MinBackoff, doubling after each failure up to
+	// MaxBackoff, as the web UI does. They default to 1s and 30s.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// Dialer opens connections; websocket.DefaultDialer if nil
+	Dialer *websocket.Dialer
+}
+
+// ErrNotConnected is returned when sending while the bot is disconnected
+var ErrNotConnected = errors.New("bot: not connected")
+
+// JoinError is returned by Run when the server refuses the bot's first
+// join, e.g. for a wrong token. Refusals after a reconnect are retried.
+type JoinError struct {
+	Reason string
+}
+
+func (e *JoinError) Error() string {
+	return "bot: join refused: " + e.Reason
+}
+
+// How long a connection may go without any frame, pings included
+const readTimeout = 2 * time.Minute
+
+// Bot is a connection to the chat that reconnects until stopped. Handlers
+// run one at a time on the goroutine reading messages, so they must not
+// block; Send and its helpers may be called from any goroutine.
+type Bot struct {
+	config Config
+
+	mu        sync.Mutex
+	handlers  map[string][]Handler
+	onConnect []func(*Bot)
+	conn      *websocket.Conn
+
+	// Held while writing, as connections allow one writer at a time
+	writeMu sync.Mutex
+}
+
+// New creates a bot. Register handlers, then call Run.
+func New(config Config) *Bot {
+	if config.MinBackoff <= 0 {
+		config.MinBackoff = time.Second
+	}
+	if config.MaxBackoff < config.MinBackoff {
+		config.MaxBackoff = 30 * time.Second
+		if config.MaxBackoff < config.MinBackoff {
+			config.MaxBackoff = config.MinBackoff
+		}
+	}
+	if config.Dialer == nil {
+		config.Dialer = websocket.DefaultDialer
+	}
+	return &Bot{config: config, handlers: make(map[string][]Handler)}
+}
+
+// Name returns the display name the bot joins as
+func (b *Bot) Name() string {
+	return b.config.Name
+}
+
+// On registers a handler for messages of a type, e.g. TypeChat. Chat and
+// private messages the bot sent itself are not handled.
+func (b *Bot) On(messageType string, handler Handler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers[messageType] = append(b.handlers[messageType], handler)
+}
+
+// OnConnect registers a function called each time the bot has joined,
+// after every reconnect too
+func (b *Bot) OnConnect(fn func(*Bot)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.onConnect = append(b.onConnect, fn)
+}
+
+// Run connects and handles messages until ctx is done, reconnecting with
+// backoff whenever the connection is lost. It returns ctx's error, or a
+// JoinError if the server refuses the first join.
+func (b *Bot) Run(ctx context.Context) error {
+	backoff := b.config.MinBackoff
+	everJoined := false
+	for {
+		joined, err := b.session(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var joinErr *JoinError
+		if errors.As(err, &joinErr) && !everJoined {
+			return err
+		}
+		if joined {
+			everJoined = true
+			backoff = b.config.MinBackoff
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+		backoff *= 2
+		if backoff > b.config.MaxBackoff {
+			backoff = b.config.MaxBackoff
+		}
+	}
+}
+
+// session runs one connection until it fails or ctx is done, reporting
+// whether the bot got to join
+func (b *Bot) session(ctx context.Context) (joined bool, err error) {
+	conn, _, err := b.config.Dialer.DialContext(ctx, b.config.URL, nil)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	// Leave cleanly when stopped
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	conn.SetReadDeadline(time.Now().Add(readTimeout))
+	conn.SetPingHandler(func(data string) error {
+		conn.SetReadDeadline(time.Now().Add(readTimeout))
+		return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(10*time.Second))
+	})
+
+	b.setConn(conn)
+	defer b.setConn(nil)
+	hello := Message{Type: TypeHello, Version: ProtocolVersion, Capabilities: []string{"reactions", "threads", "mentions", "bots", "rate_limits", "batching"}}
+	if err := b.Send(hello); err != nil {
+		return false, err
+	}
+	join := Message{Type: TypeJoin, From: b.config.Name, Content: b.config.Name, Token: b.config.Token}
+	if err := b.Send(join); err != nil {
+		return false, err
+	}
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return joined, err
+		}
+		conn.SetReadDeadline(time.Now().Add(readTimeout))
+
+		// Queued messages arrive together, one per line
+		for _, line := range bytes.Split(data, []byte("\n")) {
+			if len(line) == 0 {
+				continue
+			}
+			var message Message
+			if err := json.Unmarshal(line, &message); err != nil {
+				continue
+			}
+			if !joined {
+				switch {
+				case message.Type == TypeError && strings.HasPrefix(message.Error, "Display name error"):
+					return false, &JoinError{Reason: message.Error}
+				case message.Type == TypeUserList && contains(message.Users, b.config.Name):
+					joined = true
+					b.connected()
+				}
+			}
+			b.dispatch(message)
+		}
+	}
+}
+
+// setConn records the connection messages are sent on
+func (b *Bot) setConn(conn *websocket.Conn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.conn = conn
+}
+
+// connected runs the OnConnect functions
+func (b *Bot) connected() {
+	b.mu.Lock()
+	fns := append([]func(*Bot){}, b.onConnect...)
+	b.mu.Unlock()
+	for _, fn := range fns {
+		fn(b)
+	}
+}
+
+// dispatch hands a message to the handlers for its type
+func (b *Bot) dispatch(message Message) {
+	if (message.Type == TypeChat || message.Type == TypePrivate) && message.From == b.config.Name {
+		return
+	}
+	b.mu.Lock()
+	handlers := append([]Handler{}, b.handlers[message.Type]...)
+	b.mu.Unlock()
+	for _, handler := range handlers {
+		handler(b, message)
+	}
+}
+
+// Send writes a message to the server
+func (b *Bot) Send(message Message) error {
+	b.mu.Lock()
+	conn := b.conn
+	b.mu.Unlock()
+	if conn == nil {
+		return ErrNotConnected
+	}
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	b.writeMu.Lock()
+	defer b.writeMu.Unlock()
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// SendChat sends a message to everyone in the chat
+func (b *Bot) SendChat(content string) error {
+	return b.Send(Message{Type: TypeChat, From: b.config.Name, Content: content})
+}
+
+// SendPrivate sends a message to one user
+func (b *Bot) SendPrivate(to, content string) error {
+	return b.Send(Message{Type: TypePrivate, From: b.config.Name, To: to, Content: content})
+}
+
+// Reply answers a message where it was sent: privately for private
+// messages, otherwise in the chat, threaded under the original
+func (b *Bot) Reply(to Message, content string) error {
+	if to.Type == TypePrivate {
+		return b.SendPrivate(to.From, content)
+	}
+	return b.Send(Message{Type: TypeChat, From: b.config.Name, Content: content, ReplyTo: to.ID})
+}
+
+// contains reports whether names includes name
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
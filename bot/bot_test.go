@@ -0,0 +1,137 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakeServer accepts one bot at a time, checks its hello and join, then
+// sends it the frame given
+func fakeServer(t *testing.T, frame string) (string, <-chan Message) {
+	upgrader := websocket.Upgrader{}
+	joins := make(chan Message, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var hello, join Message
+		if conn.ReadJSON(&hello) != nil || conn.ReadJSON(&join) != nil {
+			return
+		}
+		if hello.Type != TypeHello || hello.Version != ProtocolVersion {
+			t.Errorf("Expected a hello first, got %+v", hello)
+		}
+		joins <- join
+		conn.WriteMessage(websocket.TextMessage, []byte(frame))
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http"), joins
+}
+
+func encode(t *testing.T, messages ...Message) string {
+	lines := make([]string, len(messages))
+	for i, m := range messages {
+		data, err := json.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines[i] = string(data)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestBot_JoinsAndDispatchesBatches(t *testing.T) {
+	frame := encode(t,
+		Message{Type: TypeUserList, Users: []string{"Ann", "Helper"}, Bots: []string{"Helper"}},
+		Message{Type: TypeChat, From: "Helper", Content: "my own"},
+		Message{Type: TypeChat, From: "Ann", Content: "hi"},
+	)
+	url, joins := fakeServer(t, frame)
+	b := New(Config{URL: url, Name: "Helper", Token: "secret"})
+
+	chats := make(chan Message, 10)
+	b.On(TypeChat, func(b *Bot, m Message) { chats <- m })
+	connected := make(chan struct{}, 1)
+	b.OnConnect(func(*Bot) { connected <- struct{}{} })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- b.Run(ctx) }()
+
+	join := <-joins
+	if join.Type != TypeJoin || join.Content != "Helper" || join.Token != "secret" {
+		t.Errorf("Expected a join with the token, got %+v", join)
+	}
+	select {
+	case <-connected:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the bot to join on its user list")
+	}
+	select {
+	case m := <-chats:
+		if m.From != "Ann" {
+			t.Errorf("Expected the bot's own message to be skipped, got %+v", m)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected Ann's message")
+	}
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Expected Run to return the context's error, got %v", err)
+	}
+	if err := b.SendChat("gone"); err != ErrNotConnected {
+		t.Errorf("Expected ErrNotConnected after stopping, got %v", err)
+	}
+}
+
+func TestBot_RetriesUntilJoined(t *testing.T) {
+	// Connections that never confirm the join are retried with backoff
+	url, joins := fakeServer(t, encode(t, Message{Type: TypeSystem, Content: "welcome"}))
+	b := New(Config{URL: url, Name: "Helper", MinBackoff: 10 * time.Millisecond})
+	if b.config.MaxBackoff != 30*time.Second {
+		t.Errorf("Expected the default maximum backoff, got %v", b.config.MaxBackoff)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	go b.Run(ctx)
+	<-joins
+
+	// The server keeps the first connection open, so drop it
+	b.mu.Lock()
+	b.conn.Close()
+	b.mu.Unlock()
+	select {
+	case <-joins:
+	case <-ctx.Done():
+		t.Fatal("Expected the bot to reconnect")
+	}
+}
+
+func TestBot_FirstJoinRefused(t *testing.T) {
+	url, _ := fakeServer(t, encode(t, Message{Type: TypeError, Error: "Display name error: name reserved for a bot"}))
+	b := New(Config{URL: url, Name: "Helper"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	err := b.Run(ctx)
+	joinErr, ok := err.(*JoinError)
+	if !ok || joinErr.Reason != "Display name error: name reserved for a bot" {
+		t.Errorf("Expected a JoinError, got %v", err)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"time"
+)
+
+// BotAccount lets a program join the chat as a bot. It joins like any
+// client, with the account's token in the join message's token field.
+type BotAccount struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+}
+
+// DefaultBotRateLimitConfig returns budgets four times the default ones,
+// for bots that answer many users at once
+func DefaultBotRateLimitConfig() RateLimitConfig {
+	config := DefaultRateLimitConfig()
+	config.Budgets = map[RateLimitKind]RateBudget{
+		RateLimitChat:     {Burst: 120, Refill: 500 * time.Millisecond},
+		RateLimitPrivate:  {Burst: 120, Refill: 500 * time.Millisecond},
+		RateLimitTyping:   {Burst: 12, Refill: 500 * time.Millisecond},
+		RateLimitReaction: {Burst: 80, Refill: 250 * time.Millisecond},
+	}
+	return config
+}
+
+// LoadBotAccounts reads bot accounts from a JSON file holding an array of
+// {"name", "token"} objects
+func LoadBotAccounts(path string) ([]BotAccount, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var accounts []BotAccount
+	if err := json.Unmarshal(data, &accounts); err != nil {
+		return nil, errors.New("invalid bot accounts file: " + err.Error())
+	}
+	return accounts, nil
+}
+
+// SetBotAccounts replaces the bot accounts. Their names are reserved for
+// clients holding the tokens, and may not be incoming webhook names. It must
+// be called before clients connect.
+func (h *Hub) SetBotAccounts(accounts []BotAccount) error {
+	byName := make(map[string]string, len(accounts))
+	tokens := make(map[string]bool, len(accounts))
+	for _, account := range accounts {
+		if err := validateDisplayName(account.Name); err != nil {
+			return errors.New("bot account name invalid: " + err.Error())
+		}
+		name := strings.TrimSpace(account.Name)
+		if _, ok := byName[name]; ok {
+			return errors.New("bot account name used twice: " + name)
+		}
+		if h.isBotName(name) {
+			return errors.New("bot account name already used by an incoming webhook: " + name)
+		}
+		if len(account.Token) < minIncomingWebhookToken {
+			return errors.New("bot account tokens must be at least 16 characters")
+		}
+		if tokens[account.Token] {
+			return errors.New("bot account token used twice")
+		}
+		byName[name] = account.Token
+		tokens[account.Token] = true
+	}
+	h.botAccounts = byName
+	return nil
+}
+
+// SetBotRateLimits replaces the budgets bots are held to in place of the
+// ones for users. It must be called before clients connect.
+func (h *Hub) SetBotRateLimits(config RateLimitConfig) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	h.botRateLimits = config
+	return nil
+}
+
+// isBotAccount reports whether a display name belongs to a bot account
+func (h *Hub) isBotAccount(name string) bool {
+	_, ok := h.botAccounts[name]
+	return ok
+}
+
+// authenticateBot checks a join under a bot account's name carries the
+// account's token. Joins under other names must not carry a token.
+func (h *Hub) authenticateBot(name, token string) (bot bool, err error) {
+	expected, ok := h.botAccounts[name]
+	if !ok {
+		if token != "" {
+			return false, errors.New("no bot account named " + name)
+		}
+		return false, nil
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+		return false, errors.New("name reserved for a bot")
+	}
+	return true, nil
+}
+
+// botsAmong returns the users that are bots, for user lists. Only clients
+// holding a bot account's token can join under its name.
+func (h *Hub) botsAmong(users []string) []string {
+	var bots []string
+	for _, name := range users {
+		if h.isBotAccount(name) {
+			bots = append(bots, name)
+		}
+	}
+	return bots
+}
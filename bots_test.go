@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"realtime-chatroom/bot"
+)
+
+const (
+	helperToken   = "helper-0123456789abcdef"
+	reminderToken = "reminder-0123456789abcdef"
+)
+
+// joinBot connects a client and joins under a bot account's name
+func (h *chatHarness) joinBot(name, token string) *fakeClient {
+	fake := h.connect()
+	fake.name = name
+	fake.send(Message{Type: MessageTypeJoin, Content: name, Token: token})
+	fake.waitFor(func(m Message) bool {
+		return m.Type == MessageTypeUserList && contains(m.Users, name)
+	})
+	return fake
+}
+
+func TestSetBotAccounts(t *testing.T) {
+	hub := NewHub()
+	if err := hub.SetBotAccounts([]BotAccount{{Name: " Helper ", Token: helperToken}}); err != nil {
+		t.Fatalf("Expected valid accounts: %v", err)
+	}
+	if !hub.isBotAccount("Helper") || hub.isBotAccount("Ann") {
+		t.Error("Expected only the trimmed bot name to be an account")
+	}
+
+	invalid := [][]BotAccount{
+		{{Name: "Helper", Token: "short"}},
+		{{Name: "", Token: helperToken}},
+		{{Name: "Helper", Token: helperToken}, {Name: "Helper", Token: reminderToken}},
+		{{Name: "Helper", Token: helperToken}, {Name: "Reminder", Token: helperToken}},
+	}
+	for i, accounts := range invalid {
+		if err := hub.SetBotAccounts(accounts); err == nil {
+			t.Errorf("Expected invalid accounts %d to be refused", i)
+		}
+	}
+}
+
+func TestBotAccounts_IncomingWebhookNamesOverlap(t *testing.T) {
+	hub := NewHub()
+	if err := hub.SetIncomingWebhooks([]IncomingWebhook{{Token: ciToken, Name: "CI"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := hub.SetBotAccounts([]BotAccount{{Name: " CI ", Token: helperToken}}); err == nil {
+		t.Error("Expected a bot account named like an incoming webhook to be refused")
+	}
+	if err := hub.SetBotAccounts([]BotAccount{{Name: "Helper", Token: helperToken}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := hub.SetIncomingWebhooks([]IncomingWebhook{{Token: deployToken, Name: "Helper"}}); err == nil {
+		t.Error("Expected an incoming webhook named like a bot account to be refused")
+	}
+}
+
+func TestLoadBotAccounts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bots.json")
+	os.WriteFile(path, []byte(`[{"name": "Helper", "token": "`+helperToken+`"}]`), 0600)
+	accounts, err := LoadBotAccounts(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(accounts) != 1 || accounts[0].Name != "Helper" || accounts[0].Token != helperToken {
+		t.Errorf("Unexpected accounts %+v", accounts)
+	}
+
+	os.WriteFile(path, []byte(`{"name": "Helper"}`), 0600)
+	if _, err := LoadBotAccounts(path); err == nil {
+		t.Error("Expected a file that is not an array to be refused")
+	}
+}
+
+func TestBotAccounts_Join(t *testing.T) {
+	h := newChatHarness(t)
+	if err := h.hub.SetBotAccounts([]BotAccount{{Name: "Helper", Token: helperToken}}); err != nil {
+		t.Fatal(err)
+	}
+	human := h.join("Ann")
+
+	// Only the token holder joins under the bot's name, and is listed as a bot
+	refusals := []struct {
+		name, token, want string
+	}{
+		{"Helper", "", "Display name error: name reserved for a bot"},
+		{"Helper", "helper-wrong-token-0000", "Display name error: name reserved for a bot"},
+		{"Bob", helperToken, "Display name error: no bot account named Bob"},
+	}
+	for _, tt := range refusals {
+		impostor := h.connect()
+		impostor.send(Message{Type: MessageTypeJoin, Content: tt.name, Token: tt.token})
+		impostor.waitFor(func(m Message) bool { return m.Type == MessageTypeError && m.Error == tt.want })
+	}
+
+	helper := h.joinBot("Helper", helperToken)
+	human.waitFor(func(m Message) bool {
+		return m.Type == MessageTypeUserList && len(m.Users) == 2 && len(m.Bots) == 1 && m.Bots[0] == "Helper"
+	})
+
+	// Bot messages are labelled, and tokens are never echoed
+	helper.send(Message{Type: MessageTypeChat, From: "Helper", Content: "beep", Token: helperToken})
+	human.waitFor(func(m Message) bool {
+		return m.Type == MessageTypeChat && m.From == "Helper" && m.Bot && m.Token == ""
+	})
+	human.send(Message{Type: MessageTypeChat, From: "Ann", Content: "boop"})
+	helper.waitFor(func(m Message) bool { return m.Type == MessageTypeChat && m.From == "Ann" })
+	if n := helper.count(func(m Message) bool { return m.From == "Ann" && m.Bot }); n != 0 {
+		t.Error("Expected human messages not to be labelled as bot messages")
+	}
+}
+
+func TestBotAccounts_SeparateRateLimits(t *testing.T) {
+	h := newChatHarness(t)
+	if err := h.hub.SetBotAccounts([]BotAccount{{Name: "Helper", Token: helperToken}}); err != nil {
+		t.Fatal(err)
+	}
+	config := DefaultRateLimitConfig()
+	config.Budgets[RateLimitChat] = RateBudget{Burst: 2, Refill: time.Minute}
+	if err := h.hub.SetRateLimits(config); err != nil {
+		t.Fatal(err)
+	}
+	isRateLimited := func(m Message) bool {
+		return m.Type == MessageTypeError && strings.Contains(m.Error, "Rate limit exceeded")
+	}
+
+	human := h.join("Ann")
+	helper := h.joinBot("Helper", helperToken)
+	for i := 0; i < 3; i++ {
+		human.send(Message{Type: MessageTypeChat, From: "Ann", Content: fmt.Sprintf("human %d", i)})
+		helper.send(Message{Type: MessageTypeChat, From: "Helper", Content: fmt.Sprintf("bot %d", i)})
+	}
+	human.waitFor(isRateLimited)
+	human.waitForN(func(m Message) bool { return m.From == "Helper" && m.Type == MessageTypeChat }, 3)
+	if helper.count(isRateLimited) != 0 {
+		t.Error("Expected the bot to be held to the bot budgets only")
+	}
+
+	if err := h.hub.SetBotRateLimits(RateLimitConfig{}); err == nil {
+		t.Error("Expected invalid bot rate limits to be refused")
+	}
+}
+
+func TestBotAccounts_ExemptFromSpamDetection(t *testing.T) {
+	h := newChatHarness(t)
+	if err := h.hub.SetBotAccounts([]BotAccount{{Name: "Helper", Token: helperToken}}); err != nil {
+		t.Fatal(err)
+	}
+	config := spamTestConfig()
+	config.DuplicatePoints = config.Threshold
+	if err := h.hub.SetSpamDetection(config); err != nil {
+		t.Fatal(err)
+	}
+
+	// The same announcement over and over is a bot's job, not spam
+	human := h.join("Ann")
+	helper := h.joinBot("Helper", helperToken)
+	for i := 0; i < 5; i++ {
+		helper.send(Message{Type: MessageTypeChat, From: "Helper", Content: "Deploy finished on staging"})
+	}
+	human.waitForN(func(m Message) bool { return m.From == "Helper" && m.Type == MessageTypeChat }, 5)
+	if n := helper.count(func(m Message) bool { return m.Type == MessageTypeError }); n != 0 {
+		t.Errorf("Expected the bot not to be warned or muted, got %d errors", n)
+	}
+	if decisions := h.hub.SpamDecisions("Helper", 0); len(decisions) != 0 {
+		t.Errorf("Expected no spam decisions about the bot, got %+v", decisions)
+	}
+}
+
+// botServer runs a hub with bot accounts behind a WebSocket endpoint and
+// returns the server and the URL bots connect to
+func botServer(t *testing.T) (*Hub, *httptest.Server, string) {
+	hub := NewHub()
+	accounts := []BotAccount{{Name: "Helper", Token: helperToken}, {Name: "Reminder", Token: reminderToken}}
+	if err := hub.SetBotAccounts(accounts); err != nil {
+		t.Fatal(err)
+	}
+	go hub.Run()
+	t.Cleanup(hub.Stop)
+	server := newNodeServer(hub)
+	t.Cleanup(server.Close)
+	return hub, server, "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+}
+
+// runBot runs a bot until the test ends and returns what Run returned
+func runBot(t *testing.T, b *bot.Bot) <-chan error {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	stopped := make(chan struct{})
+	go func() {
+		done <- b.Run(ctx)
+		close(stopped)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		select {
+		case <-stopped:
+		case <-time.After(2 * time.Second):
+			t.Error("Expected the bot to stop")
+		}
+	})
+	return done
+}
+
+// received reports whether a test client gets a matching message
+func received(tc *PrivateTestClient, match func(Message) bool) bool {
+	return waitUntil(2*time.Second, func() bool {
+		for _, m := range tc.GetMessages() {
+			if match(m) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func TestBotSDK_ChatAndPrivate(t *testing.T) {
+	_, server, url := botServer(t)
+	b := bot.New(bot.Config{URL: url, Name: "Reminder", Token: reminderToken})
+	if err := b.SendChat("too early"); err != bot.ErrNotConnected {
+		t.Errorf("Expected ErrNotConnected before running, got %v", err)
+	}
+
+	// An echo and reminder bot
+	b.On(bot.TypeChat, func(b *bot.Bot, m bot.Message) {
+		if strings.HasPrefix(m.Content, "!remind ") {
+			text, from := strings.TrimPrefix(m.Content, "!remind "), m.From
+			b.Reply(m, "noted")
+			time.AfterFunc(20*time.Millisecond, func() { b.SendPrivate(from, "Reminder: "+text) })
+		}
+	})
+	b.On(bot.TypePrivate, func(b *bot.Bot, m bot.Message) {
+		b.Reply(m, "echo: "+m.Content)
+	})
+	connected := make(chan struct{}, 1)
+	b.OnConnect(func(*bot.Bot) { connected <- struct{}{} })
+	runBot(t, b)
+	select {
+	case <-connected:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the bot to join")
+	}
+
+	ann := NewPrivateTestClient(t, server, "Ann")
+	defer ann.Close()
+	ann.SendMessage(Message{Type: MessageTypeHello, Version: protocolVersion, Capabilities: []string{CapabilityThreads, CapabilityBots}})
+	ann.SendMessage(Message{Type: MessageTypeJoin, Content: "Ann"})
+	if !received(ann, func(m Message) bool {
+		return m.Type == MessageTypeUserList && len(m.Users) == 2 && len(m.Bots) == 1 && m.Bots[0] == "Reminder"
+	}) {
+		t.Fatal("Expected the bot to be listed as one")
+	}
+
+	if err := b.SendChat("hello, humans"); err != nil {
+		t.Fatalf("SendChat failed: %v", err)
+	}
+	if !received(ann, func(m Message) bool { return m.Type == MessageTypeChat && m.From == "Reminder" && m.Bot }) {
+		t.Error("Expected Ann to get the bot's chat message")
+	}
+
+	ann.SendMessage(Message{Type: MessageTypePrivate, From: "Ann", To: "Reminder", Content: "ping"})
+	if !received(ann, func(m Message) bool { return m.Type == MessageTypePrivate && m.Content == "echo: ping" && m.Bot }) {
+		t.Error("Expected the bot to echo Ann's private message")
+	}
+
+	ann.SendMessage(Message{Type: MessageTypeChat, From: "Ann", Content: "!remind stand-up"})
+	if !received(ann, func(m Message) bool { return m.Type == MessageTypeChat && m.Content == "noted" && m.ThreadID != "" }) {
+		t.Error("Expected the bot to reply in a thread")
+	}
+	if !received(ann, func(m Message) bool { return m.Type == MessageTypePrivate && m.Content == "Reminder: stand-up" }) {
+		t.Error("Expected the bot to send the reminder privately")
+	}
+}
+
+func TestBotSDK_Reconnects(t *testing.T) {
+	hub, _, url := botServer(t)
+	b := bot.New(bot.Config{URL: url, Name: "Helper", Token: helperToken, MinBackoff: 20 * time.Millisecond})
+	var mu sync.Mutex
+	joins := 0
+	b.OnConnect(func(*bot.Bot) {
+		mu.Lock()
+		joins++
+		mu.Unlock()
+	})
+	runBot(t, b)
+
+	joinsAtLeast := func(n int) func() bool {
+		return func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return joins >= n
+		}
+	}
+	if !waitUntil(2*time.Second, joinsAtLeast(1)) {
+		t.Fatal("Expected the bot to join")
+	}
+
+	// The server dropping the connection only interrupts the bot
+	client, ok := hub.GetClientByName("Helper")
+	if !ok {
+		t.Fatal("Expected the bot to be registered")
+	}
+	client.conn.Close()
+	if !waitUntil(2*time.Second, joinsAtLeast(2)) {
+		t.Fatal("Expected the bot to reconnect and join again")
+	}
+	if !waitUntil(2*time.Second, func() bool { return b.SendChat("back") == nil }) {
+		t.Error("Expected the bot to send after reconnecting")
+	}
+}
+
+func TestBotSDK_JoinRefused(t *testing.T) {
+	_, _, url := botServer(t)
+	b := bot.New(bot.Config{URL: url, Name: "Helper", Token: "helper-wrong-token-0000"})
+
+	var joinErr *bot.JoinError
+	select {
+	case err := <-runBot(t, b):
+		if !errors.As(err, &joinErr) || joinErr.Reason != "Display name error: name reserved for a bot" {
+			t.Errorf("Expected the join to be refused, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected Run to return when the first join is refused")
+	}
+}
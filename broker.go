@@ -0,0 +1,354 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+)
+
+// Broker event kinds
+const (
+	// A room message to deliver to every local client
+	BrokerEventBroadcast = "broadcast"
+
+	// A private message for the user named in To
+	BrokerEventPrivate = "private"
+
+	// The outcome of a private message, sent back to the sender's node:
+	// Content holds the error if it was not delivered
+	BrokerEventPrivateResult = "private_result"
+
+	// A message for the local clients among the users named in Users
+	BrokerEventDirect = "direct"
+
+	// A user joined (Content "join") or left (Content "leave") a node
+	BrokerEventPresence = "presence"
+
+	// A newly connected node asks the others to announce their users
+	BrokerEventSync = "sync"
+
+	// A node's complete list of users, renewing their directory leases
+	BrokerEventHeartbeat = "heartbeat"
+
+	// A user's reaction (Content "add" or "remove") for the node the
+	// message was posted on, which counts it and sends the counts to all
+	BrokerEventReaction = "reaction"
+
+	// A group conversation was created, or users named in Users were added
+	// to or left it, per Content
+	BrokerEventConversation = "conversation"
+
+	// Message.From blocked (Content "add") or unblocked (Content "remove")
+	// the user named in To
+	BrokerEventBlock = "block"
+)
+
+// blockable lists the targeted messages that users who blocked the sender
+// are not sent
+var blockable = map[string]bool{
+	MessageTypeGroupMessage: true,
+	MessageTypeMention:      true,
+	MessageTypeThreadReply:  true,
+}
+
+// Presence actions carried in BrokerEvent.Content
+const (
+	presenceJoin  = "join"
+	presenceLeave = "leave"
+)
+
+// Reaction actions carried in BrokerEvent.Content
+const (
+	reactionAdd    = "add"
+	reactionRemove = "remove"
+)
+
+// Block actions carried in BrokerEvent.Content
+const (
+	blockAdd    = "add"
+	blockRemove = "remove"
+)
+
+// Conversation actions carried in BrokerEvent.Content
+const (
+	conversationCreate = "create"
+	conversationAdd    = "add"
+	conversationLeave  = "leave"
+)
+
+// BrokerEvent is a hub event exchanged between server instances. Events
+// with a Target are meant for that node only.
+type BrokerEvent struct {
+	Kind    string   `json:"kind"`
+	Node    string   `json:"node"`
+	Target  string   `json:"target,omitempty"`
+	To      string   `json:"to,omitempty"`
+	Users   []string `json:"users,omitempty"`
+	Content string   `json:"content,omitempty"`
+	Message Message  `json:"message"`
+}
+
+// Broker carries hub events between server instances. Publish must not wait
+// on slow subscribers. Subscribers may also receive their own node's events;
+// the hub ignores those by node ID.
+type Broker interface {
+	// Publish sends an event to every subscribed node
+	Publish(event BrokerEvent) error
+
+	// Subscribe registers a handler for published events
+	Subscribe(handler func(BrokerEvent)) error
+
+	// Close releases the broker's resources
+	Close() error
+}
+
+// eventQueue is an unbounded FIFO that hands events to a handler on its own
+// goroutine, so publishers never wait on a slow subscriber
+type eventQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	events  []BrokerEvent
+	closed  bool
+	handler func(BrokerEvent)
+}
+
+// newEventQueue starts a queue delivering to handler
+func newEventQueue(handler func(BrokerEvent)) *eventQueue {
+	q := &eventQueue{handler: handler}
+	q.cond = sync.NewCond(&q.mu)
+	go q.run()
+	return q
+}
+
+// push appends an event to the queue
+func (q *eventQueue) push(event BrokerEvent) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	q.events = append(q.events, event)
+	q.cond.Signal()
+}
+
+// close stops delivery once the queue drains
+func (q *eventQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Signal()
+}
+
+// run delivers queued events in order
+func (q *eventQueue) run() {
+	for {
+		q.mu.Lock()
+		for len(q.events) == 0 && !q.closed {
+			q.cond.Wait()
+		}
+		if len(q.events) == 0 && q.closed {
+			q.mu.Unlock()
+			return
+		}
+		event := q.events[0]
+		q.events = q.events[1:]
+		q.mu.Unlock()
+
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("[BROKER] Event handler panic recovered: kind=%s error=%v", event.Kind, r)
+				}
+			}()
+			q.handler(event)
+		}()
+	}
+}
+
+// MemoryBroker is an in-process broker connecting hubs in the same process
+type MemoryBroker struct {
+	mu     sync.RWMutex
+	queues []*eventQueue
+	closed bool
+}
+
+// NewMemoryBroker creates an in-process broker
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{}
+}
+
+// Publish queues the event for every subscriber
+func (b *MemoryBroker) Publish(event BrokerEvent) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		return errors.New("broker closed")
+	}
+	for _, q := range b.queues {
+		q.push(event)
+	}
+	return nil
+}
+
+// Subscribe registers a handler for published events
+func (b *MemoryBroker) Subscribe(handler func(BrokerEvent)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return errors.New("broker closed")
+	}
+	b.queues = append(b.queues, newEventQueue(handler))
+	return nil
+}
+
+// Close stops delivery to all subscribers
+func (b *MemoryBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for _, q := range b.queues {
+		q.close()
+	}
+	return nil
+}
+
+// SetBroker connects the hub to other server instances through broker.
+// nodeID must be unique per instance; message IDs are prefixed with it so
+// they stay unique across the cluster.
+func (h *Hub) SetBroker(nodeID string, broker Broker) error {
+	h.nodeID = nodeID
+	h.broker = broker
+	h.store.SetIDPrefix(nodeID + "-")
+
+	if err := broker.Subscribe(h.handleBrokerEvent); err != nil {
+		return err
+	}
+
+	// Ask the other nodes who is online there and keep our own leases alive
+	h.publish(BrokerEvent{Kind: BrokerEventSync})
+	go h.runPresenceHeartbeat()
+	return nil
+}
+
+// publish sends an event to the other nodes, if clustered
+func (h *Hub) publish(event BrokerEvent) {
+	if h.broker == nil {
+		return
+	}
+	event.Node = h.nodeID
+	if err := h.broker.Publish(event); err != nil {
+		log.Printf("[BROKER] Publish failed: kind=%s error=%v", event.Kind, err)
+	}
+}
+
+// publishPresence announces a local user joining or leaving
+func (h *Hub) publishPresence(name, action string) {
+	h.publish(BrokerEvent{Kind: BrokerEventPresence, Users: []string{name}, Content: action})
+}
+
+// handleBrokerEvent applies an event published by another node
+func (h *Hub) handleBrokerEvent(event BrokerEvent) {
+	if event.Node == h.nodeID || (event.Target != "" && event.Target != h.nodeID) {
+		return
+	}
+
+	switch event.Kind {
+	case BrokerEventBroadcast:
+		h.recordRemote(event.Message)
+		h.broadcastLocal(event.Message)
+
+	case BrokerEventPrivate:
+		result := BrokerEvent{Kind: BrokerEventPrivateResult, Target: event.Node, To: event.To, Message: event.Message}
+		if err := h.deliverPrivateLocal(event.Message.From, event.To, event.Message); err != nil {
+			log.Printf("[BROKER] Remote private message not delivered: from=%s to=%s error=%v",
+				event.Message.From, event.To, err)
+			result.Content = err.Error()
+		}
+		h.publish(result)
+
+	case BrokerEventPrivateResult:
+		h.completeRemotePrivate(event.To, event.Message, event.Content)
+
+	case BrokerEventDirect:
+		recipients := event.Users
+		if blockable[event.Message.Type] {
+			// Blocks are held on the blocker's node, which the sender's
+			// node may not be
+			recipients = h.withoutBlockers(event.Message.From, recipients)
+		}
+		if event.Message.Type == MessageTypeGroupMessage {
+			h.recordRemote(event.Message)
+		}
+		h.sendToLocalUsers(event.Message, recipients...)
+
+	case BrokerEventReaction:
+		h.applyRemoteReaction(event.Message, event.Content == reactionAdd)
+
+	case BrokerEventConversation:
+		h.applyRemoteConversation(event.Content, event.Message.ConversationID, event.Message.From, event.Users)
+
+	case BrokerEventBlock:
+		h.setBlocked(event.Message.From, event.To, event.Content == blockAdd)
+
+	case BrokerEventPresence:
+		if event.Content == presenceLeave {
+			changed := false
+			for _, name := range event.Users {
+				if h.directory.Release(name, event.Node) {
+					h.clearBlocks(name)
+					changed = true
+				}
+			}
+			if changed {
+				h.BroadcastUserList()
+			}
+		} else {
+			h.applyPresence(event.Node, event.Users, false)
+		}
+
+	case BrokerEventHeartbeat:
+		h.applyPresence(event.Node, event.Users, true)
+
+	case BrokerEventSync:
+		h.publish(BrokerEvent{Kind: BrokerEventHeartbeat, Users: h.localUsers()})
+	}
+}
+
+// recordRemote stores a message posted on another node under its ID, so
+// users here can react and reply to it
+func (h *Hub) recordRemote(message Message) {
+	if message.ID == "" {
+		return
+	}
+	if _, ok := h.store.Get(message.ID); !ok {
+		h.store.Insert(message)
+	}
+}
+
+// completeRemotePrivate finishes a private message forwarded to another
+// node once it reports back: delivered messages are echoed and recorded,
+// refused ones reported to the sender as if the recipient were local
+func (h *Hub) completeRemotePrivate(to string, message Message, refusal string) {
+	if refusal != "" {
+		h.notifyPrivateFailure(message.From, to, errors.New(refusal))
+		return
+	}
+	jsonData, err := message.ToJSON()
+	if err != nil {
+		log.Printf("[BROKER] Remote private message echo failed: from=%s to=%s error=%v", message.From, to, err)
+		return
+	}
+	h.confirmPrivateMessage(message.From, to, message, jsonData)
+}
+
+// localUsers returns the display names of users connected to this node
+func (h *Hub) localUsers() []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	users := make([]string, 0, len(h.userList))
+	for _, displayName := range h.userList {
+		users = append(users, displayName)
+	}
+	return users
+}
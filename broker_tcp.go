@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// Time allowed to write an event to a broker connection
+	brokerWriteWait = 10 * time.Second
+)
+
+// TCPBrokerServer is a reference relay for running several server instances
+// locally. Events are exchanged as newline-delimited JSON; each event read
+// from one connection is forwarded to every other connection.
+type TCPBrokerServer struct {
+	listener net.Listener
+	mu       sync.Mutex
+	conns    map[net.Conn]*eventQueue
+	closed   bool
+}
+
+// NewTCPBrokerServer starts a relay listening on addr
+func NewTCPBrokerServer(addr string) (*TCPBrokerServer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &TCPBrokerServer{
+		listener: listener,
+		conns:    make(map[net.Conn]*eventQueue),
+	}
+	go server.acceptLoop()
+
+	log.Printf("[BROKER] Relay listening on %s", listener.Addr())
+	return server, nil
+}
+
+// Addr returns the address the relay listens on
+func (s *TCPBrokerServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// acceptLoop accepts node connections until the relay is closed
+func (s *TCPBrokerServer) acceptLoop() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		encoder := json.NewEncoder(conn)
+		queue := newEventQueue(func(event BrokerEvent) {
+			conn.SetWriteDeadline(time.Now().Add(brokerWriteWait))
+			if err := encoder.Encode(event); err != nil {
+				log.Printf("[BROKER] Relay write failed: remote=%s error=%v", conn.RemoteAddr(), err)
+				conn.Close()
+			}
+		})
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			queue.close()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = queue
+		s.mu.Unlock()
+
+		go s.readLoop(conn)
+	}
+}
+
+// readLoop forwards events from one node to all the others
+func (s *TCPBrokerServer) readLoop(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		if queue, ok := s.conns[conn]; ok {
+			queue.close()
+			delete(s.conns, conn)
+		}
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	decoder := json.NewDecoder(conn)
+	for {
+		var event BrokerEvent
+		if err := decoder.Decode(&event); err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		for other, queue := range s.conns {
+			if other != conn {
+				queue.push(event)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Close stops the relay and disconnects all nodes
+func (s *TCPBrokerServer) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for conn, queue := range s.conns {
+		queue.close()
+		conn.Close()
+	}
+	s.conns = make(map[net.Conn]*eventQueue)
+	s.mu.Unlock()
+
+	return s.listener.Close()
+}
+
+// TCPBroker is a Broker client connected to a TCPBrokerServer
+type TCPBroker struct {
+	conn net.Conn
+
+	writeMu sync.Mutex
+	encoder *json.Encoder
+
+	mu     sync.Mutex
+	queues []*eventQueue
+	closed bool
+}
+
+// DialTCPBroker connects to the relay at addr
+func DialTCPBroker(addr string) (*TCPBroker, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	broker := &TCPBroker{
+		conn:    conn,
+		encoder: json.NewEncoder(conn),
+	}
+	go broker.readLoop()
+	return broker, nil
+}
+
+// readLoop hands events from the relay to the subscribers
+func (b *TCPBroker) readLoop() {
+	decoder := json.NewDecoder(b.conn)
+	for {
+		var event BrokerEvent
+		if err := decoder.Decode(&event); err != nil {
+			b.mu.Lock()
+			closed := b.closed
+			b.mu.Unlock()
+			if !closed {
+				log.Printf("[BROKER] Connection to relay lost: %v", err)
+			}
+			return
+		}
+
+		b.mu.Lock()
+		for _, queue := range b.queues {
+			queue.push(event)
+		}
+		b.mu.Unlock()
+	}
+}
+
+// Publish sends an event to the relay
+func (b *TCPBroker) Publish(event BrokerEvent) error {
+	b.writeMu.Lock()
+	defer b.writeMu.Unlock()
+
+	b.conn.SetWriteDeadline(time.Now().Add(brokerWriteWait))
+	return b.encoder.Encode(event)
+}
+
+// Subscribe registers a handler for events from other nodes
+func (b *TCPBroker) Subscribe(handler func(BrokerEvent)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return errors.New("broker closed")
+	}
+	b.queues = append(b.queues, newEventQueue(handler))
+	return nil
+}
+
+// Close disconnects from the relay
+func (b *TCPBroker) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	for _, queue := range b.queues {
+		queue.close()
+	}
+	b.mu.Unlock()
+
+	return b.conn.Close()
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitUntil polls cond until it holds or the timeout expires
+func waitUntil(timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return cond()
+}
+
+// newNodeServer serves the WebSocket endpoint of a hub for integration tests
+func newNodeServer(hub *Hub) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		handleWebSocket(hub, w, r)
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestMemoryBroker_DeliversInOrder(t *testing.T) {
+	broker := NewMemoryBroker()
+	defer broker.Close()
+
+	var mu sync.Mutex
+	received := make([]string, 0)
+	broker.Subscribe(func(event BrokerEvent) {
+		mu.Lock()
+		received = append(received, event.Content)
+		mu.Unlock()
+	})
+
+	for _, content := range []string{"a", "b", "c"} {
+		if err := broker.Publish(BrokerEvent{Kind: BrokerEventBroadcast, Content: content}); err != nil {
+			t.Fatalf("Publish failed: %v", err)
+		}
+	}
+
+	ok := waitUntil(time.Second, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received) == 3
+	})
+	if !ok {
+		t.Fatalf("Expected 3 events, got %v", received)
+	}
+	if received[0] != "a" || received[1] != "b" || received[2] != "c" {
+		t.Errorf("Expected events in publish order, got %v", received)
+	}
+
+	broker.Close()
+	if err := broker.Publish(BrokerEvent{Kind: BrokerEventBroadcast}); err == nil {
+		t.Error("Expected publish on closed broker to fail")
+	}
+}
+
+func TestHub_MemoryBrokerPresenceAndRouting(t *testing.T) {
+	broker := NewMemoryBroker()
+	defer broker.Close()
+
+	hub1 := NewHub()
+	hub2 := NewHub()
+	go hub1.Run()
+	go hub2.Run()
+	defer hub1.Stop()
+	defer hub2.Stop()
+	hub1.SetBroker("node1", broker)
+	hub2.SetBroker("node2", broker)
+
+	alice := &Client{hub: hub1, send: make(chan outboundFrame, 50), displayName: "Alice"}
+	bob := &Client{hub: hub2, send: make(chan outboundFrame, 50), displayName: "Bob"}
+	negotiateContent(alice, bob)
+	hub1.RegisterClient(alice, "Alice")
+	hub2.RegisterClient(bob, "Bob")
+
+	ok := waitUntil(time.Second, func() bool {
+		users := hub1.GetConnectedUsers()
+		sort.Strings(users)
+		return len(users) == 2 && users[0] == "Alice" && users[1] == "Bob"
+	})
+	if !ok {
+		t.Fatalf("Expected node1 to see both users, got %v", hub1.GetConnectedUsers())
+	}
+	if node, ok := hub1.remoteNodeOf("Bob"); !ok || node != "node2" {
+		t.Errorf("Expected Bob on node2, got %q", node)
+	}
+
+	// Targeted deliveries reach users on other nodes
+	drainMessages(bob)
+	notification := Message{Type: MessageTypeMention, From: "Alice", Content: "@Bob", Mentions: []string{"Bob"}}
+	hub1.sendToUsers(notification, "Bob")
+
+	ok = waitUntil(time.Second, func() bool {
+		for _, message := range drainMessages(bob) {
+			if message.Type == MessageTypeMention {
+				return true
+			}
+		}
+		return false
+	})
+	if !ok {
+		t.Error("Remote user did not receive targeted delivery")
+	}
+
+	// Message IDs stay unique across nodes
+	first := &Message{Type: MessageTypeChat, Content: "one"}
+	second := &Message{Type: MessageTypeChat, Content: "two"}
+	hub1.store.Add(first)
+	hub2.store.Add(second)
+	if first.ID == second.ID {
+		t.Errorf("Expected distinct message IDs across nodes, both were %s", first.ID)
+	}
+}
+
+func TestMultiNodeIntegration(t *testing.T) {
+	relay, err := NewTCPBrokerServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start relay: %v", err)
+	}
+	defer relay.Close()
+
+	hubs := make([]*Hub, 2)
+	servers := make([]*httptest.Server, 2)
+	for i, nodeID := range []string{"node1", "node2"} {
+		broker, err := DialTCPBroker(relay.Addr())
+		if err != nil {
+			t.Fatalf("Failed to connect to relay: %v", err)
+		}
+		defer broker.Close()
+
+		hubs[i] = NewHub()
+		if err := hubs[i].SetBroker(nodeID, broker); err != nil {
+			t.Fatalf("SetBroker failed: %v", err)
+		}
+		go hubs[i].Run()
+		defer hubs[i].Stop()
+
+		servers[i] = newNodeServer(hubs[i])
+		defer servers[i].Close()
+	}
+
+	alice := NewPrivateTestClient(t, servers[0], "Alice")
+	defer alice.Close()
+	bob := NewPrivateTestClient(t, servers[1], "Bob")
+	defer bob.Close()
+
+	alice.SendMessage(Message{Type: MessageTypeJoin, Content: "Alice"})
+	alice.WaitForMessageType(MessageTypeUserList, 2*time.Second)
+	bob.SendMessage(Message{Type: MessageTypeJoin, Content: "Bob"})
+
+	t.Run("User list spans nodes", func(t *testing.T) {
+		ok := waitUntil(2*time.Second, func() bool {
+			messages := alice.GetMessages()
+			for i := len(messages) - 1; i >= 0; i-- {
+				if messages[i].Type == MessageTypeUserList {
+					return len(messages[i].Users) == 2
+				}
+			}
+			return false
+		})
+		if !ok {
+			t.Error("Alice's user list does not include Bob on the other node")
+		}
+	})
+
+	t.Run("Public messages cross nodes", func(t *testing.T) {
+		alice.SendMessage(Message{Type: MessageTypeChat, From: "Alice", Content: "hello from node1"})
+
+		ok := waitUntil(2*time.Second, func() bool {
+			for _, message := range bob.GetMessages() {
+				if message.Type == MessageTypeChat && message.From == "Alice" && message.Content == "hello from node1" {
+					return true
+				}
+			}
+			return false
+		})
+		if !ok {
+			t.Error("Bob did not receive Alice's public message from the other node")
+		}
+	})
+
+	t.Run("Private messages cross nodes", func(t *testing.T) {
+		bob.SendMessage(Message{Type: MessageTypePrivate, From: "Bob", To: "Alice", Content: "psst from node2"})
+
+		received := alice.WaitForPrivateMessage("Bob", 2*time.Second)
+		if received == nil || received.Content != "psst from node2" {
+			t.Fatalf("Alice did not receive Bob's private message, got %+v", received)
+		}
+		if echo := bob.WaitForPrivateMessage("Bob", 2*time.Second); echo == nil {
+			t.Error("Bob did not receive the echo of his private message")
+		}
+	})
+
+	t.Run("Blocked private messages are refused across nodes", func(t *testing.T) {
+		hubs[0].Block("Alice", "Bob")
+		defer hubs[0].Unblock("Alice", "Bob")
+		bob.SendMessage(Message{Type: MessageTypePrivate, From: "Bob", To: "Alice", Content: "let me in"})
+
+		refused := waitUntil(2*time.Second, func() bool {
+			for _, message := range bob.GetMessages() {
+				if message.Type == MessageTypeError && message.Error == "Failed to send private message: recipient not found or offline" {
+					return true
+				}
+			}
+			return false
+		})
+		if !refused {
+			t.Error("Bob was not told his message was refused, as he would be on Alice's node")
+		}
+		for _, message := range append(alice.GetMessages(), bob.GetMessages()...) {
+			if message.Content == "let me in" {
+				t.Errorf("Expected the refused message to be neither delivered nor echoed, got %+v", message)
+			}
+		}
+	})
+}
+
+// newMemoryCluster starts two hubs joined by a memory broker with one
+// client on each
+func newMemoryCluster(t *testing.T) (hub1, hub2 *Hub, alice, bob *Client) {
+	broker := NewMemoryBroker()
+	t.Cleanup(func() { broker.Close() })
+
+	hub1 = NewHub()
+	hub2 = NewHub()
+	for _, hub := range []*Hub{hub1, hub2} {
+		go hub.Run()
+		t.Cleanup(hub.Stop)
+	}
+	hub1.SetBroker("node1", broker)
+	hub2.SetBroker("node2", broker)
+
+	alice = &Client{hub: hub1, send: make(chan outboundFrame, 50), displayName: "Alice"}
+	bob = &Client{hub: hub2, send: make(chan outboundFrame, 50), displayName: "Bob"}
+	negotiateContent(alice, bob)
+	hub1.RegisterClient(alice, "Alice")
+	hub2.RegisterClient(bob, "Bob")
+	if !waitUntil(time.Second, func() bool { return len(hub1.GetConnectedUsers()) == 2 && len(hub2.GetConnectedUsers()) == 2 }) {
+		t.Fatal("Expected both nodes to see both users")
+	}
+	return hub1, hub2, alice, bob
+}
+
+// waitForMessage drains a client's queue until a message matches
+func waitForMessage(client *Client, match func(Message) bool) bool {
+	return waitUntil(time.Second, func() bool {
+		for _, message := range drainMessages(client) {
+			if match(message) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func TestCluster_RemoteMessagesAcceptReactionsAndReplies(t *testing.T) {
+	hub1, hub2, alice, bob := newMemoryCluster(t)
+
+	message := Message{Type: MessageTypeChat, From: "Alice", Content: "hello from node1"}
+	hub1.store.Add(&message)
+	hub1.BroadcastMessage(message)
+	if !waitUntil(time.Second, func() bool { _, ok := hub2.store.Get(message.ID); return ok }) {
+		t.Fatalf("Expected node2 to record %s", message.ID)
+	}
+
+	// Both nodes count reactions made on either
+	if err := hub2.ApplyReaction("Bob", message.ID, "👍", true); err != nil {
+		t.Fatalf("Reacting on the other node failed: %v", err)
+	}
+	if err := hub1.ApplyReaction("Alice", message.ID, "👍", true); err != nil {
+		t.Fatalf("ApplyReaction failed: %v", err)
+	}
+	for _, client := range []*Client{alice, bob} {
+		if !waitForMessage(client, func(m Message) bool {
+			return m.Type == MessageTypeReaction && m.Reactions["👍"] == 2 && m.ReactionVersion == 2
+		}) {
+			t.Errorf("%s did not see both reactions", client.displayName)
+		}
+	}
+
+	reply := Message{Type: MessageTypeChat, From: "Bob", Content: "hi back", ReplyTo: message.ID}
+	if err := hub2.PrepareReply("Bob", &reply); err != nil {
+		t.Fatalf("Replying on the other node failed: %v", err)
+	}
+	if reply.ThreadID != message.ID {
+		t.Errorf("Expected the reply in thread %s, got %q", message.ID, reply.ThreadID)
+	}
+}
+
+func TestCluster_ConcurrentReactionsConverge(t *testing.T) {
+	hub1, hub2, alice, bob := newMemoryCluster(t)
+
+	message := Message{Type: MessageTypeChat, From: "Alice", Content: "react to me"}
+	hub1.store.Add(&message)
+	hub1.BroadcastMessage(message)
+	if !waitUntil(time.Second, func() bool { _, ok := hub2.store.Get(message.ID); return ok }) {
+		t.Fatalf("Expected node2 to record %s", message.ID)
+	}
+
+	// Both nodes react at once; the node that owns the message numbers
+	// every update, so both clients end on the same counts and version
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		for _, hub := range []*Hub{hub1, hub2} {
+			wg.Add(1)
+			go func(hub *Hub, user string) {
+				defer wg.Done()
+				if err := hub.ApplyReaction(user, message.ID, "👍", true); err != nil {
+					t.Errorf("ApplyReaction failed: %v", err)
+				}
+			}(hub, fmt.Sprintf("%s-user%d", hub.nodeID, i))
+		}
+	}
+	wg.Wait()
+
+	for _, client := range []*Client{alice, bob} {
+		if !waitForMessage(client, func(m Message) bool {
+			return m.Type == MessageTypeReaction && m.Reactions["👍"] == 10 && m.ReactionVersion == 10
+		}) {
+			t.Errorf("%s did not converge on all ten reactions", client.displayName)
+		}
+	}
+}
+
+func TestCluster_ReactionsReachNodesWithoutTheMessage(t *testing.T) {
+	hub1, hub2, _, bob := newMemoryCluster(t)
+
+	// Stored on node1 only, as if posted before node2 joined
+	message := Message{Type: MessageTypeChat, From: "Alice", Content: "before your time"}
+	hub1.store.Add(&message)
+	if _, ok := hub2.store.Get(message.ID); ok {
+		t.Fatal("Expected node2 to have no copy of the message")
+	}
+
+	if err := hub1.ApplyReaction("Alice", message.ID, "👍", true); err != nil {
+		t.Fatalf("ApplyReaction failed: %v", err)
+	}
+	if !waitForMessage(bob, func(m Message) bool {
+		return m.Type == MessageTypeReaction && m.MessageID == message.ID && m.Reactions["👍"] == 1 && m.ReactionVersion == 1
+	}) {
+		t.Error("Expected Bob to receive node1's counts for a message node2 never recorded")
+	}
+}
+
+func TestCluster_GroupConversationsSpanNodes(t *testing.T) {
+	hub1, hub2, alice, _ := newMemoryCluster(t)
+	carol := &Client{hub: hub2, send: make(chan outboundFrame, 50), displayName: "Carol"}
+	negotiateContent(carol)
+	hub2.RegisterClient(carol, "Carol")
+	if !waitUntil(time.Second, func() bool { _, ok := hub1.LocateUser("Carol"); return ok }) {
+		t.Fatal("Expected node1 to see Carol")
+	}
+
+	conv, err := hub1.CreateConversation("Alice", []string{"Bob", "Carol"})
+	if err != nil {
+		t.Fatalf("Creating a group with users on another node failed: %v", err)
+	}
+	if !strings.HasPrefix(conv.ID, "node1-") {
+		t.Errorf("Expected a node-prefixed conversation ID, got %s", conv.ID)
+	}
+	if !waitUntil(time.Second, func() bool { _, ok := hub2.GetConversation(conv.ID); return ok }) {
+		t.Fatal("Expected node2 to learn about the conversation")
+	}
+
+	other, err := hub2.CreateConversation("Bob", []string{"Alice", "Carol"})
+	if err != nil {
+		t.Fatalf("CreateConversation failed: %v", err)
+	}
+	if other.ID == conv.ID {
+		t.Errorf("Expected distinct conversation IDs across nodes, both were %s", conv.ID)
+	}
+
+	// A participant on the other node posts, and the creator reacts to it
+	message := Message{Type: MessageTypeGroupMessage, From: "Bob", ConversationID: conv.ID, Content: "hi all"}
+	message.SetTimestamp()
+	if err := hub2.SendGroupMessage(message); err != nil {
+		t.Fatalf("Sending to the group from the other node failed: %v", err)
+	}
+	var posted Message
+	if !waitForMessage(alice, func(m Message) bool {
+		posted = m
+		return m.Type == MessageTypeGroupMessage && m.Content == "hi all"
+	}) {
+		t.Fatal("Alice did not receive the group message from the other node")
+	}
+	if err := hub1.ApplyReaction("Alice", posted.ID, "🎉", true); err != nil {
+		t.Fatalf("Reacting to the remote group message failed: %v", err)
+	}
+	if !waitForMessage(carol, func(m Message) bool { return m.Type == MessageTypeReaction && m.Reactions["🎉"] == 1 }) {
+		t.Error("Carol did not see the reaction made on the other node")
+	}
+
+	if err := hub2.LeaveConversation("Bob", conv.ID); err != nil {
+		t.Fatalf("LeaveConversation failed: %v", err)
+	}
+	if !waitUntil(time.Second, func() bool { c, _ := hub1.GetConversation(conv.ID); return !c.hasParticipant("Bob") }) {
+		t.Error("Expected node1 to drop Bob from the conversation")
+	}
+}
+
+func TestCluster_RemoteBlockerIsNotSentTargetedMessages(t *testing.T) {
+	hub1, hub2, _, bob := newMemoryCluster(t)
+	carol := &Client{hub: hub2, send: make(chan outboundFrame, 50), displayName: "Carol"}
+	negotiateContent(carol)
+	hub2.RegisterClient(carol, "Carol")
+	if !waitUntil(time.Second, func() bool { _, ok := hub1.LocateUser("Carol"); return ok }) {
+		t.Fatal("Expected node1 to see Carol")
+	}
+
+	conv, err := hub1.CreateConversation("Alice", []string{"Bob", "Carol"})
+	if err != nil {
+		t.Fatalf("CreateConversation failed: %v", err)
+	}
+	if !waitUntil(time.Second, func() bool { _, ok := hub2.GetConversation(conv.ID); return ok }) {
+		t.Fatal("Expected node2 to learn about the conversation")
+	}
+
+	// Bob blocks Alice on his own node
+	hub2.blocksMu.Lock()
+	hub2.blocks["Bob"] = map[string]bool{"Alice": true}
+	hub2.blocksMu.Unlock()
+	drainMessages(bob)
+
+	message := Message{Type: MessageTypeGroupMessage, From: "Alice", ConversationID: conv.ID, Content: "hi all"}
+	message.SetTimestamp()
+	if err := hub1.SendGroupMessage(message); err != nil {
+		t.Fatalf("SendGroupMessage failed: %v", err)
+	}
+	hub1.notifyMentions(Message{Type: MessageTypeChat, ID: "m1", From: "Alice", Content: "@Bob @Carol", Mentions: []string{"Bob", "Carol"}})
+	hub1.sendToUsers(Message{Type: MessageTypeThreadReply, From: "Alice", Content: "reply", ThreadID: "m1"}, "Bob", "Carol")
+
+	seen := make(map[string]bool)
+	if !waitUntil(time.Second, func() bool {
+		for _, received := range drainMessages(carol) {
+			seen[received.Type] = true
+		}
+		return seen[MessageTypeGroupMessage] && seen[MessageTypeMention] && seen[MessageTypeThreadReply]
+	}) {
+		t.Fatalf("Expected Carol to receive every message, got %v", seen)
+	}
+	for _, received := range drainMessages(bob) {
+		if blockable[received.Type] {
+			t.Errorf("Expected Bob not to be sent %s messages from Alice, got %+v", received.Type, received)
+		}
+	}
+}
+
+func TestCluster_BlockListsFollowTheName(t *testing.T) {
+	hub1, hub2, _, bob := newMemoryCluster(t)
+
+	if err := hub2.Block("Bob", "Alice"); err != nil {
+		t.Fatalf("Block failed: %v", err)
+	}
+	if !waitUntil(time.Second, func() bool { return hub1.IsBlocked("Bob", "Alice") }) {
+		t.Fatal("Expected the block to reach the other node")
+	}
+	hub2.Unblock("Bob", "Alice")
+	if !waitUntil(time.Second, func() bool { return !hub1.IsBlocked("Bob", "Alice") }) {
+		t.Fatal("Expected the unblock to reach the other node")
+	}
+
+	// Once Bob leaves, no node keeps his list for the next holder of the name
+	hub2.Block("Bob", "Alice")
+	if !waitUntil(time.Second, func() bool { return hub1.IsBlocked("Bob", "Alice") }) {
+		t.Fatal("Expected the block to reach the other node")
+	}
+	hub2.UnregisterClient(bob)
+	for _, hub := range []*Hub{hub1, hub2} {
+		if !waitUntil(time.Second, func() bool { return !hub.IsBlocked("Bob", "Alice") }) {
+			t.Errorf("Expected %s to forget Bob's block list", hub.nodeID)
+		}
+	}
+}
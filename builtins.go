@@ -0,0 +1,264 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strings"
+)
+
+// builtinHooks returns the checks every connection, join and message goes
+// through before plugins see it, in order. Joins spend an attempt before
+// anything else, so refused names count against the limit too.
+func builtinHooks() []Plugin {
+	return []Plugin{
+		{Name: "joinlimit", OnJoin: limitJoin},
+		{Name: "validate", OnJoin: validateJoin, BeforeMessage: validateMessage},
+		{Name: "activity", BeforeMessage: recordActivity},
+		{Name: "membership", BeforeMessage: checkMembership},
+		{Name: "ratelimit", BeforeMessage: limitMessage},
+		{Name: "content", BeforeMessage: validateContent},
+		{Name: "filter", BeforeMessage: applyContentFilters},
+		{Name: "spam", BeforeMessage: detectSpam},
+		{Name: "stamp", BeforeMessage: stampMessage},
+		{Name: "notify", AfterBroadcast: notifyReplyAndMentions},
+		{Name: "webhooks", AfterBroadcast: sendMessageWebhooks},
+	}
+}
+
+// sanitizeHooks returns the hook that runs after every plugin
+func sanitizeHooks() Plugin {
+	return Plugin{Name: "sanitize", BeforeMessage: sanitizeMessage}
+}
+
+// isContentMessage reports whether a message type carries content for other
+// users
+func isContentMessage(messageType string) bool {
+	return messageType == MessageTypeChat || messageType == MessageTypePrivate || messageType == MessageTypeGroupMessage
+}
+
+// validateJoin checks the requested display name and that nobody else
+// holds it
+func validateJoin(join *JoinContext) error {
+	if err := validateDisplayName(join.Name); err != nil {
+		log.Printf("Display name validation error from client: %v", err)
+		return errors.New("Display name error: " + err.Error())
+	}
+	join.Name = strings.TrimSpace(join.Name)
+
+	// Bots' names are theirs alone
+	if join.Client.hub.isBotName(join.Name) {
+		log.Printf("Display name %s reserved for a bot", join.Name)
+		return errors.New("Display name error: name reserved for a bot")
+	}
+	bot, err := join.Client.hub.authenticateBot(join.Name, join.Token)
+	if err != nil {
+		log.Printf("Bot authentication failed for %s from %s: %v", join.Name, join.Client.remoteAddress(), err)
+		return errors.New("Display name error: " + err.Error())
+	}
+	join.Bot = bot
+
+	// Names are unique across every node in the cluster
+	if join.Client.hub.nameInUse(join.Name, join.Client) {
+		log.Printf("Display name %s already in use", join.Name)
+		return errors.New("Display name error: name already in use")
+	}
+	return nil
+}
+
+// validateMessage checks a message's structure
+func validateMessage(ctx *MessageContext) error {
+	if err := ctx.Message.Validate(); err != nil {
+		log.Printf("Message validation error from client %s: %v", ctx.Client.GetDisplayName(), err)
+		return errors.New("Message validation failed: " + err.Error())
+	}
+	return nil
+}
+
+// recordActivity keeps the client from being cleaned up as idle
+func recordActivity(ctx *MessageContext) error {
+	ctx.Client.updateActivity()
+	return nil
+}
+
+// joinRequired maps the message types only members may send to the error
+// telling others to join first
+var joinRequired = map[string]string{
+	MessageTypeChat:         "Must join chat before sending messages",
+	MessageTypePrivate:      "Must join chat before sending private messages",
+	MessageTypeGroupCreate:  "Must join chat before using group conversations",
+	MessageTypeGroupAdd:     "Must join chat before using group conversations",
+	MessageTypeGroupLeave:   "Must join chat before using group conversations",
+	MessageTypeGroupMessage: "Must join chat before using group conversations",
+	MessageTypeReact:        "Must join chat before reacting to messages",
+	MessageTypeUnreact:      "Must join chat before reacting to messages",
+}
+
+// checkMembership requires clients to join before they take part, and
+// private messages to go to someone else
+func checkMembership(ctx *MessageContext) error {
+	c, message := ctx.Client, ctx.Message
+	if c.displayName == "" {
+		// Typing notifications are best-effort and dropped quietly
+		if message.Type == MessageTypeTyping {
+			return ErrRejectSilently
+		}
+		if text, ok := joinRequired[message.Type]; ok {
+			if message.Type == MessageTypePrivate {
+				log.Printf("[PRIVATE_MSG] Validation failed: error=unauthenticated_sender client_addr=%s",
+					c.remoteAddress())
+			}
+			return errors.New(text)
+		}
+		return nil
+	}
+
+	if message.Type != MessageTypePrivate {
+		return nil
+	}
+	if message.To == "" {
+		log.Printf("[PRIVATE_MSG] Validation failed: from=%s error=missing_recipient",
+			c.displayName)
+		return errors.New("Private message must have a recipient")
+	}
+	if message.To == c.displayName {
+		log.Printf("[PRIVATE_MSG] Validation failed: from=%s to=%s error=self_messaging_attempt",
+			c.displayName, message.To)
+		return errors.New("Cannot send private message to yourself")
+	}
+	return nil
+}
+
+// messageRateLimits maps message types to the budget they spend
+var messageRateLimits = map[string]RateLimitKind{
+	MessageTypeChat:         RateLimitChat,
+	MessageTypePrivate:      RateLimitPrivate,
+	MessageTypeGroupMessage: RateLimitPrivate,
+	MessageTypeTyping:       RateLimitTyping,
+	MessageTypeReact:        RateLimitReaction,
+	MessageTypeUnreact:      RateLimitReaction,
+}
+
+// limitJoin spends one of the client address's join attempts
+func limitJoin(join *JoinContext) error {
+	if !join.Client.allowJoin() {
+		return ErrRejectSilently
+	}
+	return nil
+}
+
+// limitMessage spends a token from the budget of the message's type.
+// checkRateLimit tells the client itself.
+func limitMessage(ctx *MessageContext) error {
+	kind, ok := messageRateLimits[ctx.Message.Type]
+	if !ok || ctx.Client.checkRateLimit(kind) {
+		return nil
+	}
+	if ctx.Message.Type == MessageTypePrivate {
+		log.Printf("[PRIVATE_MSG] Validation failed: from=%s to=%s error=rate_limit_exceeded",
+			ctx.Client.displayName, ctx.Message.To)
+	}
+	return ErrRejectSilently
+}
+
+// validateContent checks the content of chat and private messages
+func validateContent(ctx *MessageContext) error {
+	c, message := ctx.Client, ctx.Message
+	if message.Type != MessageTypeChat && message.Type != MessageTypePrivate {
+		return nil
+	}
+	if err := validateMessageContent(message.Content); err != nil {
+		if message.Type == MessageTypePrivate {
+			log.Printf("[PRIVATE_MSG] Validation failed: from=%s to=%s error=content_validation content_length=%d validation_error=%v",
+				c.displayName, message.To, len(message.Content), err)
+		} else {
+			log.Printf("Message content validation error from client %s: %v", c.displayName, err)
+		}
+		return errors.New("Message validation failed: " + err.Error())
+	}
+	return nil
+}
+
+// applyContentFilters runs the hub's content filters, which may mask the
+// message or shadow it. filterContent tells the client of rejections.
+func applyContentFilters(ctx *MessageContext) error {
+	if !isContentMessage(ctx.Message.Type) {
+		return nil
+	}
+	shadow, ok := ctx.Client.filterContent(ctx.Message)
+	if !ok {
+		return ErrRejectSilently
+	}
+	ctx.Shadow = ctx.Shadow || shadow
+	return nil
+}
+
+// detectSpam scores the message against the sender's recent ones.
+// checkSpam tells the client of mutes. Bots are held to their own rate
+// limits instead, since repeating themselves to many users is their job.
+func detectSpam(ctx *MessageContext) error {
+	if ctx.Client.bot {
+		return nil
+	}
+	message := ctx.Message
+	var recipient string
+	switch message.Type {
+	case MessageTypeChat:
+		recipient = spamRecipientPublic
+	case MessageTypePrivate:
+		recipient = message.To
+	case MessageTypeGroupMessage:
+		recipient = "group:" + message.ConversationID
+	default:
+		return nil
+	}
+	if !ctx.Client.checkSpam(message, recipient) {
+		return ErrRejectSilently
+	}
+	return nil
+}
+
+// stampMessage sets the fields the server owns: sender, time, thread and,
+// for public messages, mentions resolved against the raw content
+func stampMessage(ctx *MessageContext) error {
+	c, message := ctx.Client, ctx.Message
+	if !isContentMessage(message.Type) {
+		return nil
+	}
+	message.resetServerFields()
+	message.From = c.displayName
+	message.Bot = c.bot
+	message.Token = ""
+	if message.Type == MessageTypeGroupMessage {
+		message.To = ""
+	}
+	message.SetTimestampAt(c.now())
+
+	// Attach replies to their thread
+	if err := c.hub.PrepareReply(c.displayName, message); err != nil {
+		return errors.New("Reply failed: " + err.Error())
+	}
+
+	if message.Type == MessageTypeChat {
+		c.hub.ResolveMentions(c.displayName, message)
+	}
+	return nil
+}
+
+// sanitizeMessage HTML-escapes content for delivery
+func sanitizeMessage(ctx *MessageContext) error {
+	if isContentMessage(ctx.Message.Type) {
+		ctx.Message.SanitizeInput()
+	}
+	return nil
+}
+
+// notifyReplyAndMentions tells thread participants and mentioned users
+// about a public message. Private and group replies notify their thread
+// as they are delivered.
+func notifyReplyAndMentions(ctx *MessageContext) {
+	if ctx.Message.Type != MessageTypeChat {
+		return
+	}
+	ctx.Client.hub.notifyThread(*ctx.Message)
+	ctx.Client.hub.notifyMentions(*ctx.Message)
+}
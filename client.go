@@ -3,6 +3,7 @@ package main
 import (
 	"log"
 	"net/http"
+	"net/netip"
 	"strings"
 	"sync"
 	"time"
@@ -22,10 +23,6 @@ const (
 
 	// Maximum message size allowed from peer
 	maxMessageSize = 1024
-
-	// Rate limiting constants
-	maxMessagesPerMinute = 30
-	rateLimitWindow      = time.Minute
 )
 
 var upgrader = websocket.Upgrader{
@@ -42,23 +39,56 @@ type Client struct {
 	// The hub that manages this client
 	hub *Hub
 
-	// The WebSocket connection
-	conn *websocket.Conn
+	// The connection, a WebSocket or one of the HTTP fallback transports
+	conn Transport
 
 	// Buffered channel of outbound messages
-	send chan []byte
+	send chan outboundFrame
 
-	// Display name for this client
+	// Display name for this client, and whether it joined as a bot
 	displayName string
+	bot         bool
+
+	// Client IP, resolved through trusted proxies; invalid for in-memory
+	// connections
+	ip netip.Addr
 
-	// Rate limiting fields
-	messageTimestamps []time.Time
-	rateLimitMu       sync.Mutex
+	// Token buckets and penalties for the rate-limited message types
+	limiter rateLimiter
 
 	// Connection metadata for monitoring
 	connectedAt time.Time
 	lastActivity time.Time
 	activityMu   sync.RWMutex
+
+	// Slow-consumer state: messages dropped while the send buffer was full,
+	// a user list held back until it drains and whether the client is being
+	// disconnected, with the close frame to send
+	missed          int64
+	pendingPresence *outboundFrame
+	pendingMu       sync.Mutex
+	evicting        int32
+	closeMessage    []byte
+
+	// permessage-deflate: whether to compress and the smallest payload worth
+	// compressing
+	compress        bool
+	compressMinSize int
+
+	// Wire format negotiated via Sec-WebSocket-Protocol; nil means JSON
+	codec Codec
+
+	// Protocol version and capabilities from the client's hello, and the
+	// users in the last user list written to clients sent presence diffs
+	protocol      clientProtocol
+	presenceUsers map[string]bool
+
+	// Content profile the hub counts the client under, guarded by the
+	// hub's clientsMu
+	trackedProfile string
+
+	// Clock for connection deadlines; nil means the system clock
+	clock Clock
 }
 
 // SetDisplayName validates and sets the display name for the client
@@ -81,7 +111,7 @@ func (c *Client) GetDisplayName() string {
 // updateActivity updates the last activity timestamp
 func (c *Client) updateActivity() {
 	c.activityMu.Lock()
-	c.lastActivity = time.Now()
+	c.lastActivity = c.now()
 	c.activityMu.Unlock()
 }
 
@@ -97,58 +127,6 @@ func (c *Client) GetConnectedAt() time.Time {
 	return c.connectedAt
 }
 
-// checkRateLimit checks if the client is within rate limits
-func (c *Client) checkRateLimit() bool {
-	c.rateLimitMu.Lock()
-	defer c.rateLimitMu.Unlock()
-
-	now := time.Now()
-	
-	// Remove timestamps older than the rate limit window
-	cutoff := now.Add(-rateLimitWindow)
-	validTimestamps := make([]time.Time, 0, len(c.messageTimestamps))
-	
-	for _, timestamp := range c.messageTimestamps {
-		if timestamp.After(cutoff) {
-			validTimestamps = append(validTimestamps, timestamp)
-		}
-	}
-	
-	c.messageTimestamps = validTimestamps
-	
-	// Check if we're at the limit
-	if len(c.messageTimestamps) >= maxMessagesPerMinute {
-		return false
-	}
-	
-	// Add current timestamp
-	c.messageTimestamps = append(c.messageTimestamps, now)
-	return true
-}
-
-// getRemainingRateLimit returns how many messages the client can send
-func (c *Client) getRemainingRateLimit() int {
-	c.rateLimitMu.Lock()
-	defer c.rateLimitMu.Unlock()
-
-	now := time.Now()
-	cutoff := now.Add(-rateLimitWindow)
-	
-	// Count valid timestamps
-	validCount := 0
-	for _, timestamp := range c.messageTimestamps {
-		if timestamp.After(cutoff) {
-			validCount++
-		}
-	}
-	
-	remaining := maxMessagesPerMinute - validCount
-	if remaining < 0 {
-		return 0
-	}
-	return remaining
-}
-
 // ReadPump pumps messages from the WebSocket connection to the hub
 func (c *Client) ReadPump() {
 	defer func() {
@@ -157,12 +135,14 @@ func (c *Client) ReadPump() {
 		}
 		c.hub.unregister <- c
 		c.conn.Close()
+		c.hub.releaseConnection(c)
+		c.runLeaveHooks()
 	}()
 
 	c.conn.SetReadLimit(maxMessageSize)
-	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetReadDeadline(c.now().Add(pongWait))
 	c.conn.SetPongHandler(func(string) error {
-		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+		c.conn.SetReadDeadline(c.now().Add(pongWait))
 		return nil
 	})
 
@@ -176,182 +156,69 @@ func (c *Client) ReadPump() {
 		}
 
 		// Parse the incoming message with enhanced error handling
-		message, err := MessageFromJSON(messageData)
+		message, err := c.wireCodec().Decode(messageData)
 		if err != nil {
-			log.Printf("JSON parsing error from client %s: %v", c.GetDisplayName(), err)
+			log.Printf("Message parsing error from client %s: %v", c.GetDisplayName(), err)
 			// Send detailed error message back to client
 			errorMsg := &Message{
 				Type:  MessageTypeError,
 				Error: "Invalid message format: " + err.Error(),
 			}
-			errorMsg.SetTimestamp()
+			errorMsg.SetTimestampAt(c.now())
 			c.sendErrorMessage(errorMsg)
 			continue
 		}
 
-		// Validate message structure
-		if err := message.Validate(); err != nil {
-			log.Printf("Message validation error from client %s: %v", c.GetDisplayName(), err)
-			errorMsg := &Message{
-				Type:  MessageTypeError,
-				Error: "Message validation failed: " + err.Error(),
-			}
-			errorMsg.SetTimestamp()
-			c.sendErrorMessage(errorMsg)
+		// Run the message through the built-in checks and plugins
+		ctx := &MessageContext{Client: c, Message: message}
+		if err := c.runMessageHooks(ctx); err != nil {
+			c.reportRejection(err)
 			continue
 		}
 
-		// Update activity timestamp
-		c.updateActivity()
-
 		// Handle different message types with enhanced error handling
 		switch message.Type {
+		case MessageTypeHello:
+			c.handleHello(message)
+
+		case MessageTypeTyping:
+			c.handleTyping()
+
 		case MessageTypeJoin:
-			// Set display name from join message
-			if err := c.SetDisplayName(message.Content); err != nil {
-				log.Printf("Display name validation error from client: %v", err)
-				errorMsg := &Message{
-					Type:  MessageTypeError,
-					Error: "Display name error: " + err.Error(),
-				}
-				errorMsg.SetTimestamp()
-				c.sendErrorMessage(errorMsg)
+			join := &JoinContext{Client: c, Name: message.Content, Token: message.Token}
+			if err := c.runJoinHooks(join); err != nil {
+				c.reportRejection(err)
 				continue
 			}
+			c.displayName = join.Name
+			c.bot = join.Bot
 
 			// Register client with hub
 			log.Printf("Client %s joining chat", c.displayName)
 			c.hub.RegisterClient(c, c.displayName)
 
 		case MessageTypeChat:
-			// Additional validation for chat messages
-			if c.displayName == "" {
-				errorMsg := &Message{
-					Type:  MessageTypeError,
-					Error: "Must join chat before sending messages",
-				}
-				errorMsg.SetTimestamp()
-				c.sendErrorMessage(errorMsg)
+			// Shadow-dropped messages look sent to their sender alone
+			if ctx.Shadow {
+				c.sendMessage(message)
 				continue
 			}
 
-			// Check rate limiting
-			if !c.checkRateLimit() {
-				remaining := c.getRemainingRateLimit()
-				log.Printf("Rate limit exceeded for client %s, remaining: %d", c.displayName, remaining)
-				errorMsg := &Message{
-					Type:  MessageTypeError,
-					Error: "Rate limit exceeded. Please slow down your messages.",
-				}
-				errorMsg.SetTimestamp()
-				c.sendErrorMessage(errorMsg)
-				continue
-			}
-
-			// Validate message content using enhanced validation
-			if err := validateMessageContent(message.Content); err != nil {
-				log.Printf("Message content validation error from client %s: %v", c.displayName, err)
-				errorMsg := &Message{
-					Type:  MessageTypeError,
-					Error: "Message validation failed: " + err.Error(),
-				}
-				errorMsg.SetTimestamp()
-				c.sendErrorMessage(errorMsg)
-				continue
-			}
-
-			// Set sender and timestamp
-			message.From = c.displayName
-			message.SetTimestamp()
-
-			// Sanitize input to prevent XSS
-			message.SanitizeInput()
+			// Record the message so it can be referenced by reactions and replies
+			c.hub.store.Add(message)
 
 			// Broadcast message through hub
-			log.Printf("Broadcasting message from %s (remaining rate limit: %d)", c.displayName, c.getRemainingRateLimit())
+			log.Printf("Broadcasting message from %s (remaining rate limit: %d)", c.displayName, c.getRemainingRateLimit(RateLimitChat))
 			c.hub.BroadcastMessage(*message)
+			c.runAfterBroadcastHooks(ctx)
 
 		case MessageTypePrivate:
-			// Validate sender is authenticated (displayName not empty)
-			if c.displayName == "" {
-				// Log authentication validation failure with context
-				log.Printf("[PRIVATE_MSG] Validation failed: error=unauthenticated_sender client_addr=%s", 
-					c.conn.RemoteAddr().String())
-				errorMsg := &Message{
-					Type:  MessageTypeError,
-					Error: "Must join chat before sending private messages",
-				}
-				errorMsg.SetTimestamp()
-				c.sendErrorMessage(errorMsg)
+			// Shadow-dropped messages look sent to their sender alone
+			if ctx.Shadow {
+				c.sendMessage(message)
 				continue
 			}
 
-			// Validate To field is not empty
-			if message.To == "" {
-				// Log missing recipient validation failure with context
-				log.Printf("[PRIVATE_MSG] Validation failed: from=%s error=missing_recipient", 
-					c.displayName)
-				errorMsg := &Message{
-					Type:  MessageTypeError,
-					Error: "Private message must have a recipient",
-				}
-				errorMsg.SetTimestamp()
-				c.sendErrorMessage(errorMsg)
-				continue
-			}
-
-			// Validate To field is not equal to From (prevent self-messaging)
-			if message.To == c.displayName {
-				// Log self-messaging validation failure with context
-				log.Printf("[PRIVATE_MSG] Validation failed: from=%s to=%s error=self_messaging_attempt", 
-					c.displayName, message.To)
-				errorMsg := &Message{
-					Type:  MessageTypeError,
-					Error: "Cannot send private message to yourself",
-				}
-				errorMsg.SetTimestamp()
-				c.sendErrorMessage(errorMsg)
-				continue
-			}
-
-			// Check rate limiting for private messages
-			if !c.checkRateLimit() {
-				remaining := c.getRemainingRateLimit()
-				// Log rate limit validation failure with context
-				log.Printf("[PRIVATE_MSG] Validation failed: from=%s to=%s error=rate_limit_exceeded remaining=%d", 
-					c.displayName, message.To, remaining)
-				errorMsg := &Message{
-					Type:  MessageTypeError,
-					Error: "Rate limit exceeded. Please slow down your messages.",
-				}
-				errorMsg.SetTimestamp()
-				c.sendErrorMessage(errorMsg)
-				continue
-			}
-
-			// Validate message content using existing validateMessageContent
-			if err := validateMessageContent(message.Content); err != nil {
-				// Log content validation failure with context
-				log.Printf("[PRIVATE_MSG] Validation failed: from=%s to=%s error=content_validation content_length=%d validation_error=%v", 
-					c.displayName, message.To, len(message.Content), err)
-				errorMsg := &Message{
-					Type:  MessageTypeError,
-					Error: "Message validation failed: " + err.Error(),
-				}
-				errorMsg.SetTimestamp()
-				c.sendErrorMessage(errorMsg)
-				continue
-			}
-
-			// Set message From field to client's displayName
-			message.From = c.displayName
-
-			// Set message timestamp
-			message.SetTimestamp()
-
-			// Sanitize message input
-			message.SanitizeInput()
-
 			// Create PrivateMessageRequest and send to hub.privateMessage channel
 			privateReq := PrivateMessageRequest{
 				From:    c.displayName,
@@ -361,13 +228,14 @@ func (c *Client) ReadPump() {
 			
 			// Log successful validation and routing attempt
 			log.Printf("[PRIVATE_MSG] Validation passed: from=%s to=%s content_length=%d remaining_rate_limit=%d", 
-				c.displayName, message.To, len(message.Content), c.getRemainingRateLimit())
+				c.displayName, message.To, len(message.Content), c.getRemainingRateLimit(RateLimitPrivate))
 			
 			select {
 			case c.hub.privateMessage <- privateReq:
 				// Successfully queued private message
 				log.Printf("[PRIVATE_MSG] Queued successfully: from=%s to=%s", 
 					c.displayName, message.To)
+				c.runAfterBroadcastHooks(ctx)
 			default:
 				// Log queue failure with context
 				log.Printf("[PRIVATE_MSG] Queue failed: from=%s to=%s error=channel_full", 
@@ -376,10 +244,22 @@ func (c *Client) ReadPump() {
 					Type:  MessageTypeError,
 					Error: "Failed to send private message - server busy",
 				}
-				errorMsg.SetTimestamp()
+				errorMsg.SetTimestampAt(c.now())
 				c.sendErrorMessage(errorMsg)
 			}
 
+		case MessageTypeReact, MessageTypeUnreact:
+			c.handleReaction(message)
+
+		case MessageTypeGetThread:
+			c.handleGetThread(message)
+
+		case MessageTypeGroupCreate, MessageTypeGroupAdd, MessageTypeGroupLeave, MessageTypeGroupMessage:
+			c.handleGroupMessage(ctx)
+
+		case MessageTypeBlock, MessageTypeUnblock:
+			c.handleBlock(message)
+
 		default:
 			// Unknown message type
 			log.Printf("Unknown message type '%s' from client %s", message.Type, c.GetDisplayName())
@@ -387,7 +267,7 @@ func (c *Client) ReadPump() {
 				Type:  MessageTypeError,
 				Error: "Unknown message type: " + message.Type,
 			}
-			errorMsg.SetTimestamp()
+			errorMsg.SetTimestampAt(c.now())
 			c.sendErrorMessage(errorMsg)
 		}
 	}
@@ -395,7 +275,7 @@ func (c *Client) ReadPump() {
 
 // WritePump pumps messages from the hub to the WebSocket connection
 func (c *Client) WritePump() {
-	ticker := time.NewTicker(pingPeriod)
+	ticker := c.clockOrSystem().NewTicker(pingPeriod)
 	defer func() {
 		if r := recover(); r != nil {
 			log.Printf("WritePump panic recovered for client %s: %v", c.GetDisplayName(), r)
@@ -406,35 +286,44 @@ func (c *Client) WritePump() {
 
 	for {
 		select {
-		case message, ok := <-c.send:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+		case frame, ok := <-c.send:
+			c.conn.SetWriteDeadline(c.now().Add(writeWait))
 			if !ok {
 				// The hub closed the channel
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
-
-			// Send the message directly as a single WebSocket text message
-			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				c.conn.WriteMessage(websocket.CloseMessage, c.closeMessage)
 				return
 			}
 
-			// Process any additional queued messages individually
+			// A lone message reuses its prepared frame; messages queued
+			// behind it are written together as one newline-separated frame
+			// for clients that negotiated batching
+			frame, keep := c.adapt(frame)
 			n := len(c.send)
-			for i := 0; i < n; i++ {
-				select {
-				case queuedMessage := <-c.send:
-					c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-					if err := c.conn.WriteMessage(websocket.TextMessage, queuedMessage); err != nil {
-						return
-					}
-				default:
-					break
+			switch {
+			case !keep:
+				// A feature the client did not negotiate; nothing to write
+			case n == 0 || !c.canBatch():
+				if err := c.writeFrame(frame); err != nil {
+					return
+				}
+			default:
+				closed, err := c.writeBatch(frame, n)
+				if err != nil {
+					return
+				}
+				if closed {
+					c.conn.WriteMessage(websocket.CloseMessage, c.closeMessage)
+					return
 				}
 			}
 
-		case <-ticker.C:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			// Catch up on anything held back while the buffer was full
+			if err := c.writeDeferred(); err != nil {
+				return
+			}
+
+		case <-ticker.C():
+			c.conn.SetWriteDeadline(c.now().Add(writeWait))
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
 			}
@@ -453,27 +342,38 @@ func (c *Client) Close() {
 
 // sendErrorMessage safely sends an error message to the client
 func (c *Client) sendErrorMessage(errorMsg *Message) {
-	if jsonData, jsonErr := errorMsg.ToJSON(); jsonErr == nil {
-		select {
-		case c.send <- jsonData:
-		default:
-			log.Printf("Failed to send error message to client %s: send channel full", c.GetDisplayName())
-			// Don't close the connection here, just log the failure
+	c.sendMessage(errorMsg)
+}
+
+// sendMessage safely sends a message to this client only
+func (c *Client) sendMessage(message *Message) {
+	if jsonData, jsonErr := message.ToJSON(); jsonErr == nil {
+		if !c.hub.deliver(c, newFrame(jsonData)) {
+			log.Printf("Failed to send %s message to client %s: send channel full", message.Type, c.GetDisplayName())
 		}
 	} else {
-		log.Printf("Failed to marshal error message for client %s: %v", c.GetDisplayName(), jsonErr)
+		log.Printf("Failed to marshal %s message for client %s: %v", message.Type, c.GetDisplayName(), jsonErr)
+	}
+}
+
+// sendError sends an error message with the given text to the client
+func (c *Client) sendError(text string) {
+	errorMsg := &Message{
+		Type:  MessageTypeError,
+		Error: text,
 	}
+	errorMsg.SetTimestampAt(c.now())
+	c.sendErrorMessage(errorMsg)
 }
 
 // NewClient creates a new client instance
-func NewClient(hub *Hub, conn *websocket.Conn) *Client {
-	now := time.Now()
-	return &Client{
+func NewClient(hub *Hub, conn Transport) *Client {
+	client := &Client{
 		hub:               hub,
 		conn:              conn,
-		send:              make(chan []byte, 256),
-		messageTimestamps: make([]time.Time, 0),
-		connectedAt:       now,
-		lastActivity:      now,
+		send:              make(chan outboundFrame, 256),
 	}
+	client.connectedAt = client.now()
+	client.lastActivity = client.connectedAt
+	return client
 }
@@ -41,7 +41,7 @@ func TestClientSendErrorMessage(t *testing.T) {
 	hub := NewHub()
 	client := &Client{
 		hub:         hub,
-		send:        make(chan []byte, 1),
+		send:        make(chan outboundFrame, 1),
 		displayName: "test-user",
 	}
 	
@@ -56,7 +56,8 @@ func TestClientSendErrorMessage(t *testing.T) {
 	
 	// Check if message was sent
 	select {
-	case data := <-client.send:
+	case frame := <-client.send:
+		data := frame.data
 		// Verify the message was properly formatted
 		message, err := MessageFromJSON(data)
 		if err != nil {
@@ -80,12 +81,12 @@ func TestClientSendErrorMessageFullChannel(t *testing.T) {
 	hub := NewHub()
 	client := &Client{
 		hub:         hub,
-		send:        make(chan []byte, 1), // Small buffer
+		send:        make(chan outboundFrame, 1), // Small buffer
 		displayName: "test-user",
 	}
 	
 	// Fill the channel
-	client.send <- []byte("blocking message")
+	client.send <- newFrame([]byte("blocking message"))
 	
 	errorMsg := &Message{
 		Type:  MessageTypeError,
@@ -98,7 +99,8 @@ func TestClientSendErrorMessageFullChannel(t *testing.T) {
 	
 	// Channel should still have the original message
 	select {
-	case data := <-client.send:
+	case frame := <-client.send:
+		data := frame.data
 		if string(data) != "blocking message" {
 			t.Error("Original message was not preserved when error send failed")
 		}
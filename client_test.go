@@ -1,6 +1,8 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -120,8 +122,10 @@ func TestClient_GetDisplayName(t *testing.T) {
 func TestNewClient(t *testing.T) {
 	hub := NewHub()
 
-	// Create a test WebSocket connection
+	// Create a test WebSocket connection; done closes once its checks ran
+	done := make(chan struct{})
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(done)
 		conn, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
 			t.Fatalf("Failed to upgrade connection: %v", err)
@@ -148,7 +152,7 @@ func TestNewClient(t *testing.T) {
 		// Fill the channel to test capacity
 		for i := 0; i < 256; i++ {
 			select {
-			case client.send <- []byte("test"):
+			case client.send <- newFrame([]byte("test")):
 			default:
 				t.Errorf("Send channel should have capacity of 256, failed at %d", i)
 				return
@@ -157,7 +161,7 @@ func TestNewClient(t *testing.T) {
 
 		// This should not block since we're at capacity
 		select {
-		case client.send <- []byte("overflow"):
+		case client.send <- newFrame([]byte("overflow")):
 			t.Error("Send channel should be at capacity")
 		default:
 			// Expected behavior
@@ -176,14 +180,20 @@ func TestNewClient(t *testing.T) {
 	defer conn.Close()
 
 	// Wait for the test to complete
-	time.Sleep(100 * time.Millisecond)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Handler did not finish")
+	}
 }
 
 func TestClient_Close(t *testing.T) {
 	hub := NewHub()
 
-	// Create a test WebSocket connection
+	// Create a test WebSocket connection; done closes once its checks ran
+	done := make(chan struct{})
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(done)
 		conn, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
 			t.Fatalf("Failed to upgrade connection: %v", err)
@@ -217,15 +227,22 @@ func TestClient_Close(t *testing.T) {
 	defer conn.Close()
 
 	// Wait for the test to complete
-	time.Sleep(100 * time.Millisecond)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Handler did not finish")
+	}
 }
 
 // Test client lifecycle management
 func TestClient_Lifecycle(t *testing.T) {
 	hub := NewHub()
 
-	// Test server that handles WebSocket connections
+	// Test server that handles WebSocket connections; done closes once its
+	// checks ran
+	done := make(chan struct{})
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(done)
 		conn, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
 			t.Fatalf("Failed to upgrade connection: %v", err)
@@ -265,165 +282,128 @@ func TestClient_Lifecycle(t *testing.T) {
 	defer conn.Close()
 
 	// Wait for the test to complete
-	time.Sleep(100 * time.Millisecond)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Handler did not finish")
+	}
 }
 
 // Test client rate limiting
 func TestClient_RateLimit(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1700000000, 0))
+	conn, _ := NewPipe(clock)
 	hub := NewHub()
+	hub.SetClock(clock)
+	client := NewClient(hub, conn)
+	client.SetDisplayName("TestUser")
+	budget := DefaultRateLimitConfig().Budgets[RateLimitChat]
 	
-	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		conn, err := upgrader.Upgrade(w, r, nil)
-		if err != nil {
-			t.Fatal("Failed to upgrade connection:", err)
-		}
-		defer conn.Close()
-		
-		client := NewClient(hub, conn)
-		client.SetDisplayName("TestUser")
-		
-		// Test initial rate limit
-		remaining := client.getRemainingRateLimit()
-		if remaining != maxMessagesPerMinute {
-			t.Errorf("Initial rate limit = %d, want %d", remaining, maxMessagesPerMinute)
-		}
-		
-		// Send messages up to the limit
-		for i := 0; i < maxMessagesPerMinute; i++ {
-			if !client.checkRateLimit() {
-				t.Errorf("checkRateLimit() failed at message %d", i)
-			}
-		}
-		
-		// Next message should be rate limited
-		if client.checkRateLimit() {
-			t.Error("checkRateLimit() should return false after reaching limit")
-		}
-		
-		// Verify remaining is 0
-		remaining = client.getRemainingRateLimit()
-		if remaining != 0 {
-			t.Errorf("Remaining rate limit = %d, want 0", remaining)
+	// Test initial rate limit
+	remaining := client.getRemainingRateLimit(RateLimitChat)
+	if remaining != budget.Burst {
+		t.Errorf("Initial rate limit = %d, want %d", remaining, budget.Burst)
+	}
+	
+	// Send a full burst
+	for i := 0; i < budget.Burst; i++ {
+		if !client.checkRateLimit(RateLimitChat) {
+			t.Errorf("checkRateLimit() failed at message %d", i)
 		}
-	}))
-	defer server.Close()
+	}
 	
-	url := "ws" + strings.TrimPrefix(server.URL, "http")
-	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
-	if err != nil {
-		t.Fatal("Failed to connect:", err)
+	// Next message should be rate limited, with a hint when to retry
+	if client.checkRateLimit(RateLimitChat) {
+		t.Error("checkRateLimit() should return false after reaching limit")
+	}
+	frame := <-client.send
+	var errorMsg Message
+	json.Unmarshal(frame.data, &errorMsg)
+	if errorMsg.Type != MessageTypeError || errorMsg.RetryAfter != int(budget.Refill/time.Second) {
+		t.Errorf("Expected a rate limit error with retry_after %v, got %+v", budget.Refill, errorMsg)
 	}
-	defer conn.Close()
 	
-	time.Sleep(100 * time.Millisecond)
+	// Other budgets are separate
+	if !client.checkRateLimit(RateLimitPrivate) {
+		t.Error("Chat messages should not use up the private message budget")
+	}
+	
+	// One token comes back per refill period
+	clock.Advance(budget.Refill)
+	remaining = client.getRemainingRateLimit(RateLimitChat)
+	if remaining != 1 {
+		t.Errorf("Remaining rate limit = %d, want 1", remaining)
+	}
+	if !client.checkRateLimit(RateLimitChat) {
+		t.Error("checkRateLimit() should allow a message once a token is refilled")
+	}
+	if client.checkRateLimit(RateLimitChat) {
+		t.Error("checkRateLimit() should only allow one message per refill")
+	}
 }
 
 // Test private message rate limiting
 func TestClient_PrivateMessageRateLimit(t *testing.T) {
-	hub := NewHub()
-	go hub.Run()
+	h := newChatHarness(t)
+	alice := h.join("Alice")
+	bob := h.join("Bob")
+	budget := DefaultRateLimitConfig().Budgets[RateLimitPrivate]
 	
-	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		conn, err := upgrader.Upgrade(w, r, nil)
-		if err != nil {
-			t.Fatal("Failed to upgrade connection:", err)
-		}
-		defer conn.Close()
-		
-		client := NewClient(hub, conn)
-		client.SetDisplayName("Alice")
-		hub.UpdateClientName(client, "Alice")
-		
-		// Create recipient
-		recipientConn, _ := upgrader.Upgrade(w, r, nil)
-		if recipientConn == nil {
-			recipientConn = conn
-		}
-		recipient := NewClient(hub, recipientConn)
-		recipient.SetDisplayName("Bob")
-		hub.UpdateClientName(recipient, "Bob")
-		
-		// Fill up rate limit with private messages
-		for i := 0; i < maxMessagesPerMinute; i++ {
-			if !client.checkRateLimit() {
-				t.Errorf("Rate limit check failed at message %d", i)
-			}
-		}
-		
-		// Next private message should be rate limited
-		if client.checkRateLimit() {
-			t.Error("Private message should be rate limited after reaching limit")
-		}
-		
-		// Verify error handling for rate limited message
-		remaining := client.getRemainingRateLimit()
-		if remaining != 0 {
-			t.Errorf("Expected 0 remaining messages, got %d", remaining)
-		}
-	}))
-	defer server.Close()
-	
-	url := "ws" + strings.TrimPrefix(server.URL, "http")
-	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
-	if err != nil {
-		t.Fatal("Failed to connect:", err)
+	// Fill up rate limit with private messages, one at a time since the
+	// hub's private message queue is small
+	isPrivate := func(m Message) bool { return m.Type == MessageTypePrivate && m.From == "Alice" }
+	for i := 0; i < budget.Burst; i++ {
+		alice.send(Message{Type: MessageTypePrivate, From: "Alice", To: "Bob", Content: fmt.Sprintf("psst %d", i)})
+		bob.waitForN(isPrivate, i+1)
 	}
-	defer conn.Close()
 	
-	time.Sleep(100 * time.Millisecond)
+	// Next private message should be rate limited
+	alice.send(Message{Type: MessageTypePrivate, From: "Alice", To: "Bob", Content: "one too many"})
+	alice.waitFor(func(m Message) bool {
+		return m.Type == MessageTypeError && strings.Contains(m.Error, "Rate limit exceeded") && m.RetryAfter > 0
+	})
+	
+	// A token is refilled and Alice may write again
+	h.clock.Advance(budget.Refill)
+	alice.send(Message{Type: MessageTypePrivate, From: "Alice", To: "Bob", Content: "hello again"})
+	bob.waitFor(func(m Message) bool { return isPrivate(m) && m.Content == "hello again" })
+	
+	if bob.count(func(m Message) bool { return isPrivate(m) && m.Content == "one too many" }) != 0 {
+		t.Error("Rate limited private message should not be delivered")
+	}
 }
 
 // Test Client activity tracking
 func TestClient_ActivityTracking(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1700000000, 0))
+	conn, _ := NewPipe(clock)
 	hub := NewHub()
+	hub.SetClock(clock)
+	client := NewClient(hub, conn)
 	
-	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		conn, err := upgrader.Upgrade(w, r, nil)
-		if err != nil {
-			t.Fatal("Failed to upgrade connection:", err)
-		}
-		defer conn.Close()
-		
-		client := NewClient(hub, conn)
-		
-		// Test initial timestamps
-		connectedAt := client.GetConnectedAt()
-		lastActivity := client.GetLastActivity()
-		
-		if connectedAt.IsZero() {
-			t.Error("ConnectedAt should not be zero")
-		}
-		
-		if lastActivity.IsZero() {
-			t.Error("LastActivity should not be zero")
-		}
-		
-		if !connectedAt.Equal(lastActivity) {
-			t.Error("Initial ConnectedAt and LastActivity should be equal")
-		}
-		
-		// Wait a bit and update activity
-		time.Sleep(10 * time.Millisecond)
-		client.updateActivity()
-		
-		newLastActivity := client.GetLastActivity()
-		if !newLastActivity.After(lastActivity) {
-			t.Error("LastActivity should be updated after updateActivity()")
-		}
-		
-		// ConnectedAt should remain unchanged
-		if !client.GetConnectedAt().Equal(connectedAt) {
-			t.Error("ConnectedAt should not change after updateActivity()")
-		}
-	}))
-	defer server.Close()
+	// Test initial timestamps
+	connectedAt := client.GetConnectedAt()
+	lastActivity := client.GetLastActivity()
 	
-	url := "ws" + strings.TrimPrefix(server.URL, "http")
-	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
-	if err != nil {
-		t.Fatal("Failed to connect:", err)
+	if connectedAt.IsZero() {
+		t.Error("ConnectedAt should not be zero")
+	}
+	
+	if !connectedAt.Equal(lastActivity) {
+		t.Error("Initial ConnectedAt and LastActivity should be equal")
 	}
-	defer conn.Close()
 	
-	time.Sleep(100 * time.Millisecond)
+	// Move the clock and update activity
+	clock.Advance(10 * time.Second)
+	client.updateActivity()
+	
+	newLastActivity := client.GetLastActivity()
+	if !newLastActivity.Equal(lastActivity.Add(10 * time.Second)) {
+		t.Errorf("LastActivity = %v, want %v", newLastActivity, lastActivity.Add(10*time.Second))
+	}
+	
+	// ConnectedAt should remain unchanged
+	if !client.GetConnectedAt().Equal(connectedAt) {
+		t.Error("ConnectedAt should not change after updateActivity()")
+	}
 }
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ParseTrustedProxies reads comma-separated CIDRs or single addresses of
+// the proxies allowed to report client addresses
+func ParseTrustedProxies(spec string) ([]netip.Prefix, error) {
+	var proxies []netip.Prefix
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if strings.Contains(entry, "/") {
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, errors.New("invalid trusted proxy range: " + entry)
+			}
+			proxies = append(proxies, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, errors.New("invalid trusted proxy address: " + entry)
+		}
+		addr = addr.Unmap()
+		proxies = append(proxies, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return proxies, nil
+}
+
+// SetTrustedProxies sets the proxies whose Forwarded and X-Forwarded-For
+// headers are believed. It must be called before clients connect.
+func (h *Hub) SetTrustedProxies(proxies []netip.Prefix) {
+	h.trustedProxies = proxies
+}
+
+// isTrustedProxy reports whether an address belongs to a trusted proxy
+func (h *Hub) isTrustedProxy(addr netip.Addr) bool {
+	for _, proxy := range h.trustedProxies {
+		if proxy.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRemoteIP returns the IP of a host:port or bare address, or the zero
+// Addr if there is none, as for in-memory connections
+func parseRemoteIP(remoteAddr string) netip.Addr {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	addr, err := netip.ParseAddr(strings.Trim(host, "[]"))
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addr.Unmap()
+}
+
+// clientIP resolves the address of the client behind a request. Proxy
+// headers are only believed when the request comes from a trusted proxy,
+// and are read from the right, past any further trusted proxies, so a
+// client cannot choose its own address by sending them. The standard
+// Forwarded header is preferred to X-Forwarded-For.
+func (h *Hub) clientIP(r *http.Request) netip.Addr {
+	addr := parseRemoteIP(r.RemoteAddr)
+	if !addr.IsValid() || !h.isTrustedProxy(addr) {
+		return addr
+	}
+
+	hops := forwardedFor(r.Header.Values("Forwarded"))
+	if hops == nil {
+		hops = strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		// Obfuscated and unknown hops end the walk
+		hop := parseRemoteIP(strings.TrimSpace(hops[i]))
+		if !hop.IsValid() {
+			break
+		}
+		addr = hop
+		if !h.isTrustedProxy(hop) {
+			break
+		}
+	}
+	return addr
+}
+
+// forwardedFor returns the for= parameter of each element of Forwarded
+// headers (RFC 7239), or nil if there are none. Elements without one are
+// returned as "" so they stop the walk.
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			hop := ""
+			for _, pair := range strings.Split(element, ";") {
+				name, param, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(name, "for") {
+					hop = strings.Trim(param, `"`)
+				}
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// remoteAddress returns the client's resolved IP for logs, or the
+// transport's address if it has none
+func (c *Client) remoteAddress() string {
+	if c.ip.IsValid() {
+		return c.ip.String()
+	}
+	if c.conn != nil {
+		return c.conn.RemoteAddr().String()
+	}
+	return "unknown"
+}
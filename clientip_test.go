@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	proxies, err := ParseTrustedProxies(" 10.0.0.0/8, 192.0.2.10 ,2001:db8::/32, ::ffff:198.51.100.1")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	want := []string{"10.0.0.0/8", "192.0.2.10/32", "2001:db8::/32", "198.51.100.1/32"}
+	if len(proxies) != len(want) {
+		t.Fatalf("Expected %d proxies, got %v", len(want), proxies)
+	}
+	for i := range want {
+		if proxies[i].String() != want[i] {
+			t.Errorf("Proxy %d: expected %s, got %s", i, want[i], proxies[i])
+		}
+	}
+
+	for _, spec := range []string{"10.0.0.0/33", "not-an-address"} {
+		if _, err := ParseTrustedProxies(spec); err == nil {
+			t.Errorf("Expected %q to be rejected", spec)
+		}
+	}
+}
+
+func TestHub_ClientIP(t *testing.T) {
+	hub := NewHub()
+	proxies, _ := ParseTrustedProxies("10.0.0.0/8")
+	hub.SetTrustedProxies(proxies)
+
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor []string
+		forwarded    []string
+		want         string
+	}{
+		{"direct client", "203.0.113.5:4000", nil, nil, "203.0.113.5"},
+		{"untrusted peer cannot claim an address", "203.0.113.5:4000", []string{"198.51.100.1"}, nil, "203.0.113.5"},
+		{"trusted proxy", "10.0.0.2:80", []string{"198.51.100.1"}, nil, "198.51.100.1"},
+		{"forged hop before the real client", "10.0.0.2:80", []string{"1.2.3.4, 198.51.100.1"}, nil, "198.51.100.1"},
+		{"chain of trusted proxies", "10.0.0.2:80", []string{"198.51.100.1, 10.0.0.7", "10.0.0.8"}, nil, "198.51.100.1"},
+		{"garbage hop stops the walk", "10.0.0.2:80", []string{"198.51.100.1, unknown"}, nil, "10.0.0.2"},
+		{"trusted proxy without header", "10.0.0.2:80", nil, nil, "10.0.0.2"},
+		{"IPv6 peer", "[2001:db8::1]:443", nil, nil, "2001:db8::1"},
+		{"Forwarded header", "10.0.0.2:80", nil, []string{`for=198.51.100.1;proto=https`}, "198.51.100.1"},
+		{"Forwarded preferred to X-Forwarded-For", "10.0.0.2:80", []string{"1.2.3.4"}, []string{`for=198.51.100.1`}, "198.51.100.1"},
+		{"Forwarded IPv6 with port", "10.0.0.2:80", nil, []string{`for="[2001:db8::7]:4711", for=10.0.0.9`}, "2001:db8::7"},
+		{"Forwarded obfuscated hop", "10.0.0.2:80", nil, []string{`for=198.51.100.1, for=_hidden`}, "10.0.0.2"},
+		{"Forwarded element without for", "10.0.0.2:80", nil, []string{`for=198.51.100.1, proto=http`}, "10.0.0.2"},
+		{"IPv4-mapped peer", "[::ffff:203.0.113.5]:443", nil, nil, "203.0.113.5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest("GET", "/ws", nil)
+			request.RemoteAddr = tt.remoteAddr
+			for _, value := range tt.forwardedFor {
+				request.Header.Add("X-Forwarded-For", value)
+			}
+			for _, value := range tt.forwarded {
+				request.Header.Add("Forwarded", value)
+			}
+			if got := hub.clientIP(request); got != netip.MustParseAddr(tt.want) {
+				t.Errorf("Expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+
+	client := &Client{hub: hub, ip: netip.MustParseAddr("198.51.100.1")}
+	if addr := client.remoteAddress(); addr != "198.51.100.1" {
+		t.Errorf("Expected the resolved address in logs, got %s", addr)
+	}
+	serverEnd, _ := NewPipe(nil)
+	if addr := NewClient(hub, serverEnd).remoteAddress(); addr != "pipe-client" {
+		t.Errorf("Expected the transport address without a resolved IP, got %s", addr)
+	}
+
+	if addr := parseRemoteIP("pipe-client"); addr.IsValid() {
+		t.Errorf("Expected no address for an in-memory connection, got %s", addr)
+	}
+}
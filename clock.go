@@ -0,0 +1,83 @@
+package main
+
+import "time"
+
+// Clock tells the time and schedules timers. The real clock is used in
+// production; tests substitute a fake clock they advance by hand.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer fires once on its channel unless stopped
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// Ticker fires on its channel every period until stopped. Like
+// time.Ticker, it drops ticks a slow receiver misses.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// realClock is the system clock
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTimer(d time.Duration) Timer { return realTimer{time.NewTimer(d)} }
+
+func (realClock) NewTicker(d time.Duration) Ticker { return realTicker{time.NewTicker(d)} }
+
+// realTimer adapts *time.Timer to Timer
+type realTimer struct{ timer *time.Timer }
+
+func (t realTimer) C() <-chan time.Time { return t.timer.C }
+func (t realTimer) Stop() bool          { return t.timer.Stop() }
+
+// realTicker adapts *time.Ticker to Ticker
+type realTicker struct{ ticker *time.Ticker }
+
+func (t realTicker) C() <-chan time.Time { return t.ticker.C }
+func (t realTicker) Stop()               { t.ticker.Stop() }
+
+// systemClock is the clock used unless another is injected
+var systemClock Clock = realClock{}
+
+// SetClock replaces the clock used for timestamps, rate limits, idle
+// cleanup and presence. It must be called before Run.
+func (h *Hub) SetClock(clock Clock) {
+	h.clock = clock
+	h.cleanupTicker.Stop()
+	h.cleanupTicker = clock.NewTicker(cleanupInterval)
+}
+
+// now returns the current time on the hub's clock
+func (h *Hub) now() time.Time {
+	return h.clock.Now()
+}
+
+// clockSource returns the hub's clock, for timers
+func (h *Hub) clockSource() Clock {
+	return h.clock
+}
+
+// now returns the current time on the client's clock
+func (c *Client) now() time.Time {
+	return c.clockOrSystem().Now()
+}
+
+// clockOrSystem returns the client's clock, falling back to its hub's and
+// then to the system clock
+func (c *Client) clockOrSystem() Clock {
+	switch {
+	case c.clock != nil:
+		return c.clock
+	case c.hub != nil && c.hub.clock != nil:
+		return c.hub.clock
+	}
+	return systemClock
+}
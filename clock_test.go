@@ -0,0 +1,222 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// FakeClock is a Clock that only moves when advanced. Timers and tickers
+// fire when the clock reaches their deadline.
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	timers  map[*fakeTimer]bool
+	tickers map[*fakeTicker]bool
+}
+
+// NewFakeClock creates a fake clock set to start
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{
+		now:     start,
+		timers:  make(map[*fakeTimer]bool),
+		tickers: make(map[*fakeTicker]bool),
+	}
+}
+
+// Now returns the fake time
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NewTimer creates a timer that fires once the clock is advanced by d
+func (c *FakeClock) NewTimer(d time.Duration) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	timer := &fakeTimer{clock: c, at: c.now.Add(d), ch: make(chan time.Time, 1)}
+	if d <= 0 {
+		timer.ch <- c.now
+	} else {
+		c.timers[timer] = true
+	}
+	return timer
+}
+
+// NewTicker creates a ticker that fires each time the clock passes
+// another period
+func (c *FakeClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ticker := &fakeTicker{clock: c, period: d, next: c.now.Add(d), ch: make(chan time.Time, 1)}
+	c.tickers[ticker] = true
+	return ticker
+}
+
+// Advance moves the clock forward and fires the timers and tickers that
+// are due
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	for timer := range c.timers {
+		if !timer.at.After(c.now) {
+			timer.ch <- c.now
+			delete(c.timers, timer)
+		}
+	}
+	for ticker := range c.tickers {
+		if ticker.next.After(c.now) {
+			continue
+		}
+		select {
+		case ticker.ch <- c.now:
+		default:
+		}
+		for !ticker.next.After(c.now) {
+			ticker.next = ticker.next.Add(ticker.period)
+		}
+	}
+}
+
+// Timers returns the number of timers waiting to fire, so tests can wait
+// for goroutines to start waiting before advancing
+func (c *FakeClock) Timers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// fakeTimer is a timer on a FakeClock
+type fakeTimer struct {
+	clock *FakeClock
+	at    time.Time
+	ch    chan time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.ch }
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	pending := t.clock.timers[t]
+	delete(t.clock.timers, t)
+	return pending
+}
+
+// fakeTicker is a ticker on a FakeClock
+type fakeTicker struct {
+	clock  *FakeClock
+	period time.Duration
+	next   time.Time
+	ch     chan time.Time
+}
+
+func (t *fakeTicker) C() <-chan time.Time { return t.ch }
+
+func (t *fakeTicker) Stop() {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	delete(t.clock.tickers, t)
+}
+
+func TestFakeClock_TimerFiresAtDeadline(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	timer := clock.NewTimer(10 * time.Second)
+
+	clock.Advance(9 * time.Second)
+	select {
+	case <-timer.C():
+		t.Fatal("Timer fired early")
+	default:
+	}
+
+	clock.Advance(time.Second)
+	select {
+	case at := <-timer.C():
+		if !at.Equal(time.Unix(1010, 0)) {
+			t.Errorf("Expected the timer to fire at 1010, got %v", at.Unix())
+		}
+	default:
+		t.Fatal("Expected the timer to fire")
+	}
+	if timer.Stop() {
+		t.Error("Stop should report a fired timer as not pending")
+	}
+}
+
+func TestFakeClock_StoppedTimerNeverFires(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	timer := clock.NewTimer(time.Second)
+
+	if !timer.Stop() {
+		t.Error("Stop should report a pending timer")
+	}
+	if clock.Timers() != 0 {
+		t.Errorf("Expected no pending timers, got %d", clock.Timers())
+	}
+	clock.Advance(time.Minute)
+	select {
+	case <-timer.C():
+		t.Error("Stopped timer fired")
+	default:
+	}
+}
+
+func TestFakeClock_TickerDropsMissedTicks(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	ticker := clock.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	// Several periods at once deliver a single tick, like time.Ticker
+	clock.Advance(3500 * time.Millisecond)
+	<-ticker.C()
+	select {
+	case <-ticker.C():
+		t.Fatal("Expected missed ticks to be dropped")
+	default:
+	}
+
+	// The next tick is on the original schedule
+	clock.Advance(400 * time.Millisecond)
+	select {
+	case <-ticker.C():
+		t.Fatal("Ticker fired off schedule")
+	default:
+	}
+	clock.Advance(100 * time.Millisecond)
+	select {
+	case at := <-ticker.C():
+		if !at.Equal(time.Unix(1004, 0)) {
+			t.Errorf("Expected a tick at 1004, got %v", at)
+		}
+	default:
+		t.Fatal("Expected a tick at the fourth period")
+	}
+}
+
+func TestHub_SetClock(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1700000000, 0))
+	hub := NewHub()
+	hub.SetClock(clock)
+
+	message := &Message{Type: MessageTypeSystem}
+	message.SetTimestampAt(hub.now())
+	if !message.Timestamp.Equal(clock.Now()) {
+		t.Errorf("Expected timestamp %v, got %v", clock.Now(), message.Timestamp)
+	}
+
+	// Clients without their own clock follow the hub's
+	client := NewClient(hub, nil)
+	if !client.GetConnectedAt().Equal(clock.Now()) {
+		t.Errorf("Expected client to connect at %v, got %v", clock.Now(), client.GetConnectedAt())
+	}
+	clock.Advance(time.Hour)
+	if !client.now().Equal(clock.Now()) {
+		t.Error("Expected the client to use the hub's clock")
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"log"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Subprotocols clients offer in Sec-WebSocket-Protocol to pick a wire format
+const (
+	subprotocolJSON    = "chat.v1.json"
+	subprotocolMsgpack = "chat.v1.msgpack"
+)
+
+// Codec converts messages to and from one wire format
+type Codec interface {
+	// Subprotocol is the Sec-WebSocket-Protocol name that selects the codec
+	Subprotocol() string
+
+	// FrameType is the WebSocket message type frames are sent as
+	FrameType() int
+
+	Encode(message *Message) ([]byte, error)
+	Decode(data []byte) (*Message, error)
+}
+
+// JSONCodec is the default text format used by the web UI
+type JSONCodec struct{}
+
+// Subprotocol returns chat.v1.json
+func (JSONCodec) Subprotocol() string { return subprotocolJSON }
+
+// FrameType returns websocket.TextMessage
+func (JSONCodec) FrameType() int { return websocket.TextMessage }
+
+// Encode marshals a message to JSON
+func (JSONCodec) Encode(message *Message) ([]byte, error) { return message.ToJSON() }
+
+// Decode parses a JSON message
+func (JSONCodec) Decode(data []byte) (*Message, error) { return MessageFromJSON(data) }
+
+// MsgpackCodec is a compact binary format for mobile clients. Field names
+// match the JSON ones so both formats carry the same messages.
+type MsgpackCodec struct{}
+
+// Subprotocol returns chat.v1.msgpack
+func (MsgpackCodec) Subprotocol() string { return subprotocolMsgpack }
+
+// FrameType returns websocket.BinaryMessage
+func (MsgpackCodec) FrameType() int { return websocket.BinaryMessage }
+
+// Encode marshals a message to MessagePack
+func (MsgpackCodec) Encode(message *Message) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+	if err := enc.Encode(message); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decode parses a MessagePack message
+func (MsgpackCodec) Decode(data []byte) (*Message, error) {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	var message Message
+	if err := dec.Decode(&message); err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
+// defaultCodec is used by clients that do not negotiate a subprotocol
+var defaultCodec Codec = JSONCodec{}
+
+// codecs lists the supported codecs in order of server preference
+var codecs = []Codec{JSONCodec{}, MsgpackCodec{}}
+
+// supportedSubprotocols returns the subprotocols offered during the upgrade
+func supportedSubprotocols() []string {
+	names := make([]string, len(codecs))
+	for i, codec := range codecs {
+		names[i] = codec.Subprotocol()
+	}
+	return names
+}
+
+// codecForSubprotocol returns the codec negotiated for a connection,
+// falling back to JSON when none was
+func codecForSubprotocol(name string) Codec {
+	for _, codec := range codecs {
+		if codec.Subprotocol() == name {
+			return codec
+		}
+	}
+	return defaultCodec
+}
+
+// wireCodec returns the codec the client negotiated
+func (c *Client) wireCodec() Codec {
+	if c.codec == nil {
+		return defaultCodec
+	}
+	return c.codec
+}
+
+// trackCodec counts clients per codec so broadcasts are only encoded in
+// formats someone reads. The caller holds clientsMu.
+func (h *Hub) trackCodec(client *Client, delta int) {
+	name := client.wireCodec().Subprotocol()
+	h.codecsInUse[name] += delta
+	if h.codecsInUse[name] <= 0 {
+		delete(h.codecsInUse, name)
+	}
+}
+
+// extraCodecs returns the codecs other than the default that connected
+// clients use
+func (h *Hub) extraCodecs() []Codec {
+	h.clientsMu.RLock()
+	defer h.clientsMu.RUnlock()
+	var inUse []Codec
+	for _, codec := range codecs {
+		if codec != defaultCodec && h.codecsInUse[codec.Subprotocol()] > 0 {
+			inUse = append(inUse, codec)
+		}
+	}
+	return inUse
+}
+
+// trackProfile counts clients per content profile so broadcasts are only
+// stripped for profiles someone has. The caller holds clientsMu.
+func (h *Hub) trackProfile(client *Client, delta int) {
+	if delta > 0 {
+		client.trackedProfile = client.contentProfile()
+	}
+	name := client.trackedProfile
+	h.profilesInUse[name] += delta
+	if h.profilesInUse[name] <= 0 {
+		delete(h.profilesInUse, name)
+	}
+}
+
+// retrackProfile moves a registered client to the profile it negotiated
+// in hello
+func (h *Hub) retrackProfile(client *Client) {
+	h.clientsMu.Lock()
+	defer h.clientsMu.Unlock()
+	if !h.clients[client] {
+		return
+	}
+	h.trackProfile(client, -1)
+	h.trackProfile(client, 1)
+}
+
+// strippedProfiles returns the profiles of connected clients that did not
+// negotiate every content capability
+func (h *Hub) strippedProfiles() []string {
+	h.clientsMu.RLock()
+	defer h.clientsMu.RUnlock()
+	var inUse []string
+	for name := range h.profilesInUse {
+		if name != completeProfile {
+			inUse = append(inUse, name)
+		}
+	}
+	return inUse
+}
+
+// encodeBroadcast frames a message once per codec and content profile in
+// use. The JSON frame is always present; other formats ride along as
+// variants, and the message stripped for each profile as stripped.
+func (h *Hub) encodeBroadcast(message *Message) (outboundFrame, error) {
+	extra := h.extraCodecs()
+	frame, err := encodeFrame(message, extra)
+	if err != nil {
+		return outboundFrame{}, err
+	}
+	frame.adapted = true
+
+	for _, profile := range h.strippedProfiles() {
+		negotiated := profileCapabilities(profile)
+		if frame.capability != "" && !negotiated[frame.capability] {
+			// Never sent to this profile
+			continue
+		}
+		variant := frame
+		stripped := *message
+		if stripMessage(&stripped, negotiated) {
+			if variant, err = encodeFrame(&stripped, extra); err != nil {
+				log.Printf("Error encoding %s message for profile %q: %v", message.Type, profile, err)
+				continue
+			}
+		}
+		if frame.stripped == nil {
+			frame.stripped = make(map[string]outboundFrame)
+		}
+		frame.stripped[profile] = variant
+	}
+	return frame, nil
+}
+
+// encodeFrame prepares a message as JSON and in the given codecs
+func encodeFrame(message *Message, extra []Codec) (outboundFrame, error) {
+	jsonData, err := message.ToJSON()
+	if err != nil {
+		return outboundFrame{}, err
+	}
+	frame := newPreparedFrame(jsonData)
+	frame.presence = message.Type == MessageTypeUserList
+	frame.capability = requiredCapability(message)
+
+	for _, codec := range extra {
+		data, err := codec.Encode(message)
+		if err != nil {
+			log.Printf("Error encoding %s message as %s: %v", message.Type, codec.Subprotocol(), err)
+			continue
+		}
+		if frame.variants == nil {
+			frame.variants = make(map[string]outboundFrame)
+		}
+		variant := newPreparedFrameOfType(codec.FrameType(), data)
+		variant.presence = frame.presence
+		variant.capability = frame.capability
+		frame.variants[codec.Subprotocol()] = variant
+	}
+	return frame, nil
+}
+
+// frameFor returns the frame in the client's wire format. Frames built for
+// a single client are JSON and are transcoded here.
+func (c *Client) frameFor(frame outboundFrame) (outboundFrame, error) {
+	codec := c.wireCodec()
+	if codec == defaultCodec {
+		return frame, nil
+	}
+	if variant, ok := frame.variants[codec.Subprotocol()]; ok {
+		return variant, nil
+	}
+	message, err := MessageFromJSON(frame.data)
+	if err != nil {
+		return outboundFrame{}, err
+	}
+	data, err := codec.Encode(message)
+	if err != nil {
+		return outboundFrame{}, err
+	}
+	return outboundFrame{data: data, frameType: codec.FrameType(), presence: frame.presence, capability: frame.capability}, nil
+}
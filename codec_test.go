@@ -0,0 +1,274 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// codecTestMessages covers every field family the protocol uses
+func codecTestMessages() []*Message {
+	now := time.Date(2024, 5, 1, 12, 30, 45, 123456789, time.UTC)
+	return []*Message{
+		{Type: MessageTypeJoin, Content: "Alice", Timestamp: now},
+		{ID: "m1", Type: MessageTypeChat, From: "Alice", Content: "hello @Bob ✓", Mentions: []string{"Bob"}, Timestamp: now},
+		{Type: MessageTypePrivate, From: "Alice", To: "Bob", Content: "psst", Timestamp: now},
+		{Type: MessageTypeUserList, Users: []string{"Alice", "Bob"}, Timestamp: now},
+		{Type: MessageTypeError, Error: "Rate limit exceeded", Timestamp: now},
+		{ID: "m1", Type: MessageTypeChat, From: "Alice", Reactions: map[string]int{"👍": 2, "🎉": 1}, ReplyCount: 3, Blocked: true, Timestamp: now},
+		{Type: MessageTypeSystem, Content: "You missed 5 messages", Missed: 5, Timestamp: now},
+		{
+			Type:      MessageTypeChat,
+			ThreadID:  "m1",
+			ReplyTo:   "m1",
+			Timestamp: now,
+			Messages: []Message{
+				{ID: "m2", Type: MessageTypeChat, From: "Bob", Content: "reply", ThreadID: "m1", Timestamp: now},
+			},
+		},
+		{Type: MessageTypeChat, ConversationID: "g1", From: "Carol", Content: "group hi"},
+	}
+}
+
+// normalizeTimes makes timestamps comparable regardless of time zone
+func normalizeTimes(message *Message) {
+	message.Timestamp = message.Timestamp.UTC()
+	for i := range message.Messages {
+		normalizeTimes(&message.Messages[i])
+	}
+}
+
+func TestCodecs_RoundTripIdenticalSemantics(t *testing.T) {
+	for _, original := range codecTestMessages() {
+		decoded := make(map[string]*Message)
+		for _, codec := range codecs {
+			data, err := codec.Encode(original)
+			if err != nil {
+				t.Fatalf("%s: encode failed: %v", codec.Subprotocol(), err)
+			}
+			message, err := codec.Decode(data)
+			if err != nil {
+				t.Fatalf("%s: decode failed: %v", codec.Subprotocol(), err)
+			}
+			normalizeTimes(message)
+			decoded[codec.Subprotocol()] = message
+		}
+
+		viaJSON, viaMsgpack := decoded[subprotocolJSON], decoded[subprotocolMsgpack]
+		if !reflect.DeepEqual(viaJSON, viaMsgpack) {
+			t.Errorf("Codecs disagree:\njson:    %+v\nmsgpack: %+v", viaJSON, viaMsgpack)
+		}
+		if !viaMsgpack.Timestamp.Equal(original.Timestamp) {
+			t.Errorf("Timestamp changed: %v != %v", viaMsgpack.Timestamp, original.Timestamp)
+		}
+	}
+}
+
+func TestMsgpackCodec_IsSmallerThanJSON(t *testing.T) {
+	message := codecTestMessages()[1]
+	jsonData, _ := JSONCodec{}.Encode(message)
+	msgpackData, _ := MsgpackCodec{}.Encode(message)
+	if len(msgpackData) >= len(jsonData) {
+		t.Errorf("Expected msgpack to be smaller: msgpack=%d json=%d", len(msgpackData), len(jsonData))
+	}
+}
+
+func TestMsgpackCodec_RejectsGarbage(t *testing.T) {
+	if _, err := (MsgpackCodec{}).Decode([]byte{0xc1}); err == nil {
+		t.Error("Expected an invalid msgpack payload to be rejected")
+	}
+}
+
+func TestCodecForSubprotocol(t *testing.T) {
+	if codec := codecForSubprotocol(subprotocolMsgpack); codec.Subprotocol() != subprotocolMsgpack {
+		t.Errorf("Expected msgpack, got %s", codec.Subprotocol())
+	}
+	for _, name := range []string{"", "chat.v2.json", subprotocolJSON} {
+		if codec := codecForSubprotocol(name); codec != defaultCodec {
+			t.Errorf("%q: expected the default codec, got %s", name, codec.Subprotocol())
+		}
+	}
+}
+
+func TestHub_EncodeBroadcast_OncePerCodecInUse(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	defer hub.Stop()
+
+	message := codecTestMessages()[1]
+	frame, err := hub.encodeBroadcast(message)
+	if err != nil {
+		t.Fatalf("encodeBroadcast failed: %v", err)
+	}
+	if len(frame.variants) != 0 {
+		t.Errorf("Expected no variants without binary clients, got %d", len(frame.variants))
+	}
+
+	mobile := &Client{hub: hub, send: make(chan outboundFrame, 10), codec: MsgpackCodec{}}
+	hub.register <- mobile
+	time.Sleep(10 * time.Millisecond)
+
+	frame, _ = hub.encodeBroadcast(message)
+	variant, ok := frame.variants[subprotocolMsgpack]
+	if !ok || variant.prepared == nil || variant.frameType != websocket.BinaryMessage {
+		t.Fatalf("Expected a prepared binary variant, got %+v", frame.variants)
+	}
+	if got, _ := mobile.frameFor(frame); &got.data[0] != &variant.data[0] {
+		t.Error("Expected the msgpack client to reuse the shared variant")
+	}
+
+	hub.unregister <- mobile
+	time.Sleep(10 * time.Millisecond)
+	if frame, _ = hub.encodeBroadcast(message); len(frame.variants) != 0 {
+		t.Error("Expected the variant to stop once no client uses msgpack")
+	}
+}
+
+func TestClient_FrameFor_TranscodesSingleClientFrames(t *testing.T) {
+	client := &Client{codec: MsgpackCodec{}}
+	message := codecTestMessages()[2]
+	jsonData, _ := message.ToJSON()
+
+	frame, err := client.frameFor(newFrame(jsonData))
+	if err != nil {
+		t.Fatalf("frameFor failed: %v", err)
+	}
+	if frame.frameType != websocket.BinaryMessage {
+		t.Errorf("Expected a binary frame, got type %d", frame.frameType)
+	}
+	decoded, err := MsgpackCodec{}.Decode(frame.data)
+	if err != nil || decoded.Content != "psst" || decoded.To != "Bob" {
+		t.Errorf("Unexpected transcoded message %+v (%v)", decoded, err)
+	}
+}
+
+// codecTestClient is a WebSocket client speaking one codec
+type codecTestClient struct {
+	conn  *websocket.Conn
+	codec Codec
+
+	mu       sync.Mutex
+	messages []Message
+	frames   []int
+}
+
+func dialCodecTestClient(t *testing.T, url string, codec Codec) *codecTestClient {
+	dialer := websocket.Dialer{Subprotocols: []string{codec.Subprotocol()}}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(url, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	if conn.Subprotocol() != codec.Subprotocol() {
+		t.Fatalf("Expected %s to be negotiated, got %q", codec.Subprotocol(), conn.Subprotocol())
+	}
+	client := &codecTestClient{conn: conn, codec: codec}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		for {
+			frameType, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			payloads := [][]byte{data}
+			if frameType == websocket.TextMessage {
+				payloads = splitFrame(data)
+			}
+			for _, payload := range payloads {
+				message, err := codec.Decode(payload)
+				if err != nil {
+					continue
+				}
+				client.mu.Lock()
+				client.messages = append(client.messages, *message)
+				client.frames = append(client.frames, frameType)
+				client.mu.Unlock()
+			}
+		}
+	}()
+	return client
+}
+
+func (c *codecTestClient) send(t *testing.T, message *Message) {
+	data, err := c.codec.Encode(message)
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	if err := c.conn.WriteMessage(c.codec.FrameType(), data); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+}
+
+// find returns the first received message matching the predicate
+func (c *codecTestClient) find(match func(Message) bool) (Message, int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, message := range c.messages {
+		if match(message) {
+			return message, c.frames[i], true
+		}
+	}
+	return Message{}, 0, false
+}
+
+func (c *codecTestClient) waitFor(t *testing.T, match func(Message) bool) (Message, int) {
+	t.Helper()
+	var message Message
+	var frameType int
+	if !waitUntil(2*time.Second, func() bool {
+		var ok bool
+		message, frameType, ok = c.find(match)
+		return ok
+	}) {
+		t.Fatal("Timed out waiting for message")
+	}
+	return message, frameType
+}
+
+func TestCodecs_MixedClientsInteroperate(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	defer hub.Stop()
+
+	server := newNodeServer(hub)
+	defer server.Close()
+
+	web := dialCodecTestClient(t, server.URL, JSONCodec{})
+	mobile := dialCodecTestClient(t, server.URL, MsgpackCodec{})
+
+	web.send(t, &Message{Type: MessageTypeJoin, Content: "Web"})
+	mobile.send(t, &Message{Type: MessageTypeJoin, Content: "Mobile"})
+	_, frameType := mobile.waitFor(t, func(m Message) bool {
+		return m.Type == MessageTypeUserList && len(m.Users) == 2
+	})
+	if frameType != websocket.BinaryMessage {
+		t.Errorf("Expected binary frames for the msgpack client, got %d", frameType)
+	}
+
+	mobile.send(t, &Message{Type: MessageTypeChat, From: "Mobile", Content: "from the phone"})
+	fromPhone := func(m Message) bool { return m.Type == MessageTypeChat && m.Content == "from the phone" }
+	viaWeb, _ := web.waitFor(t, fromPhone)
+	viaMobile, _ := mobile.waitFor(t, fromPhone)
+	normalizeTimes(&viaWeb)
+	normalizeTimes(&viaMobile)
+	if !reflect.DeepEqual(viaWeb, viaMobile) {
+		t.Errorf("Clients saw different messages:\njson:    %+v\nmsgpack: %+v", viaWeb, viaMobile)
+	}
+
+	web.send(t, &Message{Type: MessageTypePrivate, From: "Web", To: "Mobile", Content: "just you"})
+	private, frameType := mobile.waitFor(t, func(m Message) bool { return m.Type == MessageTypePrivate })
+	if private.From != "Web" || private.Content != "just you" || frameType != websocket.BinaryMessage {
+		t.Errorf("Unexpected private message %+v (frame type %d)", private, frameType)
+	}
+}
+
+func TestHub_Upgrader_OffersCodecs(t *testing.T) {
+	offered := NewHub().upgrader().Subprotocols
+	if !reflect.DeepEqual(offered, []string{subprotocolJSON, subprotocolMsgpack}) {
+		t.Errorf("Unexpected subprotocols %v", offered)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"compress/flate"
+	"errors"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Default deflate level; favours CPU over ratio for chat traffic
+	defaultCompressionLevel = flate.BestSpeed
+
+	// Messages shorter than this are sent uncompressed by default
+	defaultCompressionMinSize = 256
+)
+
+// CompressionConfig controls permessage-deflate. Compression is only used
+// with clients that offer the extension during the handshake.
+type CompressionConfig struct {
+	Enabled bool
+
+	// Deflate level from flate.HuffmanOnly to flate.BestCompression
+	Level int
+
+	// Messages smaller than MinSize bytes are sent uncompressed
+	MinSize int
+}
+
+// DefaultCompressionConfig returns an enabled configuration with the
+// default level and threshold
+func DefaultCompressionConfig() CompressionConfig {
+	return CompressionConfig{
+		Enabled: true,
+		Level:   defaultCompressionLevel,
+		MinSize: defaultCompressionMinSize,
+	}
+}
+
+// Validate checks the compression level and threshold
+func (c CompressionConfig) Validate() error {
+	if c.Level < flate.HuffmanOnly || c.Level > flate.BestCompression {
+		return errors.New("compression level must be between -2 and 9")
+	}
+	if c.MinSize < 0 {
+		return errors.New("compression threshold cannot be negative")
+	}
+	return nil
+}
+
+// SetCompression configures permessage-deflate for new connections
+func (h *Hub) SetCompression(config CompressionConfig) error {
+	if config.Enabled {
+		if err := config.Validate(); err != nil {
+			return err
+		}
+	}
+	h.compression = config
+	return nil
+}
+
+// upgrader returns the WebSocket upgrader for new connections. It offers
+// the supported codecs as subprotocols and permessage-deflate when
+// compression is enabled.
+func (h *Hub) upgrader() *websocket.Upgrader {
+	configured := upgrader
+	configured.Subprotocols = supportedSubprotocols()
+	configured.EnableCompression = h.compression.Enabled
+	return &configured
+}
+
+// enableCompression applies the hub's compression settings to a newly
+// upgraded client. It has no effect if the client did not negotiate it.
+func (c *Client) enableCompression(config CompressionConfig) error {
+	conn, ok := c.conn.(compressingTransport)
+	if !config.Enabled || !ok {
+		return nil
+	}
+	if err := conn.SetCompressionLevel(config.Level); err != nil {
+		return err
+	}
+	c.compress = true
+	c.compressMinSize = config.MinSize
+	return nil
+}
+
+// useCompression turns compression on for the next write if the client
+// compresses, kept the compression capability and the payload is large
+// enough to benefit
+func (c *Client) useCompression(size int) {
+	if conn, ok := c.conn.(compressingTransport); ok && c.compress {
+		conn.EnableWriteCompression(size >= c.compressMinSize && c.hasCapability(CapabilityCompression))
+	}
+}
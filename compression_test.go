@@ -0,0 +1,168 @@
+package main
+
+import (
+	"compress/flate"
+	"context"
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// countingConn counts the bytes read from the network
+type countingConn struct {
+	net.Conn
+	read *int64
+}
+
+func (c countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(c.read, int64(n))
+	return n, err
+}
+
+// compressionTestClient is a WebSocket client that records received
+// messages and the raw bytes read off the wire
+type compressionTestClient struct {
+	conn      *websocket.Conn
+	extension string
+	bytesRead int64
+
+	mu       sync.Mutex
+	messages []Message
+}
+
+func dialCompressionTestClient(t *testing.T, url string, compress bool) *compressionTestClient {
+	client := &compressionTestClient{}
+	dialer := websocket.Dialer{
+		EnableCompression: compress,
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return countingConn{Conn: conn, read: &client.bytesRead}, nil
+		},
+	}
+
+	conn, resp, err := dialer.Dial("ws"+strings.TrimPrefix(url, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	client.conn = conn
+	client.extension = resp.Header.Get("Sec-WebSocket-Extensions")
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			for _, messageData := range splitFrame(data) {
+				var message Message
+				if json.Unmarshal(messageData, &message) == nil {
+					client.mu.Lock()
+					client.messages = append(client.messages, message)
+					client.mu.Unlock()
+				}
+			}
+		}
+	}()
+	return client
+}
+
+// hasChat reports whether the client received a chat message with content
+func (c *compressionTestClient) hasChat(content string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, message := range c.messages {
+		if message.Type == MessageTypeChat && message.Content == content {
+			return true
+		}
+	}
+	return false
+}
+
+func TestCompressionConfig_Validate(t *testing.T) {
+	if err := DefaultCompressionConfig().Validate(); err != nil {
+		t.Errorf("Expected default config to be valid, got %v", err)
+	}
+
+	hub := NewHub()
+	if err := hub.SetCompression(CompressionConfig{Enabled: true, Level: 12}); err == nil {
+		t.Error("Expected an out-of-range level to be rejected")
+	}
+	if err := hub.SetCompression(CompressionConfig{Enabled: true, Level: flate.BestSpeed, MinSize: -1}); err == nil {
+		t.Error("Expected a negative threshold to be rejected")
+	}
+	if hub.upgrader().EnableCompression {
+		t.Error("Expected compression to stay off after invalid settings")
+	}
+
+	if err := hub.SetCompression(DefaultCompressionConfig()); err != nil {
+		t.Fatalf("SetCompression failed: %v", err)
+	}
+	if !hub.upgrader().EnableCompression {
+		t.Error("Expected the upgrader to offer permessage-deflate")
+	}
+	if upgrader.EnableCompression {
+		t.Error("The shared upgrader should not be modified")
+	}
+}
+
+func TestCompression_MixedClientsInteroperate(t *testing.T) {
+	hub := NewHub()
+	hub.SetCompression(CompressionConfig{Enabled: true, Level: flate.BestSpeed, MinSize: 64})
+	go hub.Run()
+	defer hub.Stop()
+
+	server := newNodeServer(hub)
+	defer server.Close()
+
+	compressed := dialCompressionTestClient(t, server.URL, true)
+	plain := dialCompressionTestClient(t, server.URL, false)
+
+	if !strings.Contains(compressed.extension, "permessage-deflate") {
+		t.Errorf("Expected permessage-deflate to be negotiated, got %q", compressed.extension)
+	}
+	if plain.extension != "" {
+		t.Errorf("Expected no extension for the plain client, got %q", plain.extension)
+	}
+
+	compressed.conn.WriteJSON(Message{Type: MessageTypeHello, Version: protocolVersion, Capabilities: []string{CapabilityCompression}})
+	compressed.conn.WriteJSON(Message{Type: MessageTypeJoin, Content: "Zip"})
+	plain.conn.WriteJSON(Message{Type: MessageTypeJoin, Content: "Plain"})
+	time.Sleep(200 * time.Millisecond)
+
+	// A long, repetitive message crosses the threshold; a short one does not
+	long := strings.TrimSpace(strings.Repeat("compress me please ", 40))
+	compressedBefore := atomic.LoadInt64(&compressed.bytesRead)
+	plainBefore := atomic.LoadInt64(&plain.bytesRead)
+	compressed.conn.WriteJSON(Message{Type: MessageTypeChat, From: "Zip", Content: long})
+
+	for name, client := range map[string]*compressionTestClient{"compressed": compressed, "plain": plain} {
+		client := client
+		if !waitUntil(2*time.Second, func() bool { return client.hasChat(long) }) {
+			t.Fatalf("%s client did not receive the long message", name)
+		}
+	}
+	compressedBytes := atomic.LoadInt64(&compressed.bytesRead) - compressedBefore
+	plainBytes := atomic.LoadInt64(&plain.bytesRead) - plainBefore
+	if compressedBytes >= plainBytes {
+		t.Errorf("Expected the compressed client to read fewer bytes: compressed=%d plain=%d", compressedBytes, plainBytes)
+	}
+
+	plain.conn.WriteJSON(Message{Type: MessageTypeChat, From: "Plain", Content: "hi"})
+	for name, client := range map[string]*compressionTestClient{"compressed": compressed, "plain": plain} {
+		client := client
+		if !waitUntil(2*time.Second, func() bool { return client.hasChat("hi") }) {
+			t.Errorf("%s client did not receive the short message", name)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Errors returned when a connection is refused for its address
+var (
+	errTooManyConnections = errors.New("too many connections from your address")
+	errTooManyAttempts    = errors.New("too many connection attempts from your address")
+)
+
+// AddressLimits caps what a single address, or a single subnet, may do.
+// Zero leaves a limit off.
+type AddressLimits struct {
+	// Concurrent connections
+	Connections int
+
+	// Connection attempts and join attempts per minute
+	ConnectsPerMinute int
+	JoinsPerMinute    int
+}
+
+// ConnectionLimitConfig holds the limits per client IP and per subnet, the
+// subnet being the address's /24 for IPv4 or /64 for IPv6 by default
+type ConnectionLimitConfig struct {
+	PerIP     AddressLimits
+	PerSubnet AddressLimits
+
+	IPv4SubnetBits int
+	IPv6SubnetBits int
+}
+
+// DefaultConnectionLimitConfig returns limits loose enough for a household
+// or office behind one address, but well short of the hub's global cap
+func DefaultConnectionLimitConfig() ConnectionLimitConfig {
+	return ConnectionLimitConfig{
+		PerIP:          AddressLimits{Connections: 20, ConnectsPerMinute: 30, JoinsPerMinute: 10},
+		PerSubnet:      AddressLimits{Connections: 100, ConnectsPerMinute: 120, JoinsPerMinute: 40},
+		IPv4SubnetBits: 24,
+		IPv6SubnetBits: 64,
+	}
+}
+
+// Validate checks the limits and subnet sizes
+func (c ConnectionLimitConfig) Validate() error {
+	for _, limits := range []AddressLimits{c.PerIP, c.PerSubnet} {
+		if limits.Connections < 0 || limits.ConnectsPerMinute < 0 || limits.JoinsPerMinute < 0 {
+			return errors.New("connection limits cannot be negative")
+		}
+	}
+	if c.IPv4SubnetBits < 8 || c.IPv4SubnetBits > 32 {
+		return errors.New("IPv4 subnet size must be between /8 and /32")
+	}
+	if c.IPv6SubnetBits < 16 || c.IPv6SubnetBits > 128 {
+		return errors.New("IPv6 subnet size must be between /16 and /128")
+	}
+	return nil
+}
+
+// perMinute returns the token bucket allowing n events a minute
+func perMinute(n int) RateBudget {
+	return RateBudget{Burst: n, Refill: time.Minute / time.Duration(n)}
+}
+
+// addressScope is an address or subnet with the limits that apply to it
+type addressScope struct {
+	key    netip.Prefix
+	limits AddressLimits
+}
+
+// connectionLimiter counts connections and attempts per address and subnet
+type connectionLimiter struct {
+	mu       sync.Mutex
+	config   ConnectionLimitConfig
+	active   map[netip.Prefix]int
+	connects map[netip.Prefix]*tokenBucket
+	joins    map[netip.Prefix]*tokenBucket
+
+	// Connections and joins refused
+	rejected int64
+}
+
+// newConnectionLimiter creates a limiter with the given limits
+func newConnectionLimiter(config ConnectionLimitConfig) *connectionLimiter {
+	return &connectionLimiter{
+		config:   config,
+		active:   make(map[netip.Prefix]int),
+		connects: make(map[netip.Prefix]*tokenBucket),
+		joins:    make(map[netip.Prefix]*tokenBucket),
+	}
+}
+
+// scopes returns the address itself and its subnet
+func (l *connectionLimiter) scopes(ip netip.Addr) [2]addressScope {
+	bits := l.config.IPv6SubnetBits
+	if ip.Is4() {
+		bits = l.config.IPv4SubnetBits
+	}
+	subnet, _ := ip.Prefix(bits)
+	return [2]addressScope{
+		{key: netip.PrefixFrom(ip, ip.BitLen()), limits: l.config.PerIP},
+		{key: subnet, limits: l.config.PerSubnet},
+	}
+}
+
+// spend takes a token from each scope's bucket, or from none if any is
+// empty, in which case it returns how long until all have one
+func (l *connectionLimiter) spend(buckets map[netip.Prefix]*tokenBucket, scopes [2]addressScope, limit func(AddressLimits) int, now time.Time) time.Duration {
+	var wait time.Duration
+	for _, scope := range scopes {
+		if n := limit(scope.limits); n > 0 {
+			budget := perMinute(n)
+			b, ok := buckets[scope.key]
+			if !ok {
+				b = newTokenBucket(budget, now)
+				buckets[scope.key] = b
+			}
+			b.refill(budget, now)
+			if w := b.wait(budget); w > wait {
+				wait = w
+			}
+		}
+	}
+	if wait > 0 {
+		return wait
+	}
+	for _, scope := range scopes {
+		if limit(scope.limits) > 0 {
+			buckets[scope.key].tokens--
+		}
+	}
+	return 0
+}
+
+// admit counts a new connection from ip, or returns why it is refused and
+// how long to wait if waiting helps. Connections without an IP, such as
+// in-memory pipes, are not limited.
+func (l *connectionLimiter) admit(ip netip.Addr, now time.Time) (time.Duration, error) {
+	if !ip.IsValid() {
+		return 0, nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	scopes := l.scopes(ip)
+	for _, scope := range scopes {
+		if scope.limits.Connections > 0 && l.active[scope.key] >= scope.limits.Connections {
+			atomic.AddInt64(&l.rejected, 1)
+			return 0, errTooManyConnections
+		}
+	}
+	connects := func(limits AddressLimits) int { return limits.ConnectsPerMinute }
+	if wait := l.spend(l.connects, scopes, connects, now); wait > 0 {
+		atomic.AddInt64(&l.rejected, 1)
+		return wait, errTooManyAttempts
+	}
+	for _, scope := range scopes {
+		l.active[scope.key]++
+	}
+	return 0, nil
+}
+
+// release forgets a connection counted by admit
+func (l *connectionLimiter) release(ip netip.Addr) {
+	if !ip.IsValid() {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, scope := range l.scopes(ip) {
+		if l.active[scope.key]--; l.active[scope.key] <= 0 {
+			delete(l.active, scope.key)
+		}
+	}
+}
+
+// allowJoin spends a join attempt for ip, returning how long to wait if
+// none is left
+func (l *connectionLimiter) allowJoin(ip netip.Addr, now time.Time) (time.Duration, bool) {
+	if !ip.IsValid() {
+		return 0, true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	joins := func(limits AddressLimits) int { return limits.JoinsPerMinute }
+	if wait := l.spend(l.joins, l.scopes(ip), joins, now); wait > 0 {
+		atomic.AddInt64(&l.rejected, 1)
+		return wait, false
+	}
+	return 0, true
+}
+
+// prune drops attempt buckets untouched for a minute, which are full again
+func (l *connectionLimiter) prune(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, buckets := range []map[netip.Prefix]*tokenBucket{l.connects, l.joins} {
+		for key, b := range buckets {
+			if now.Sub(b.updated) >= time.Minute {
+				delete(buckets, key)
+			}
+		}
+	}
+}
+
+// SetConnectionLimits replaces the per-address limits. It must be called
+// before clients connect.
+func (h *Hub) SetConnectionLimits(config ConnectionLimitConfig) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	h.connLimits = newConnectionLimiter(config)
+	return nil
+}
+
+// admitConnection resolves the client address of a request and checks it
+// against the per-address limits before the connection is upgraded. On
+// refusal it writes a 429, with Retry-After if waiting helps, and returns
+// false. Callers release admitted addresses if the connection fails.
+func (h *Hub) admitConnection(w http.ResponseWriter, r *http.Request) (netip.Addr, bool) {
+	ip := h.clientIP(r)
+	wait, err := h.connLimits.admit(ip, h.now())
+	if err != nil {
+		log.Printf("[CONN_LIMIT] Rejecting connection from %s: %v", ip, err)
+		if wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+		}
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return ip, false
+	}
+	return ip, true
+}
+
+// releaseConnection gives back a client's place in its address limits once
+// its connection ends
+func (h *Hub) releaseConnection(client *Client) {
+	h.connLimits.release(client.ip)
+}
+
+// allowJoin spends one of the client address's join attempts, telling the
+// client when to retry if none is left
+func (c *Client) allowJoin() bool {
+	wait, ok := c.hub.connLimits.allowJoin(c.ip, c.now())
+	if !ok {
+		log.Printf("[CONN_LIMIT] Rejecting join from %s: too many join attempts", c.remoteAddress())
+		c.sendRateLimitError("Too many join attempts from your address. Please wait before trying again.", wait)
+	}
+	return ok
+}
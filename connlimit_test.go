@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestConnectionLimiter_ConcurrentPerIPAndSubnet(t *testing.T) {
+	config := DefaultConnectionLimitConfig()
+	config.PerIP = AddressLimits{Connections: 2}
+	config.PerSubnet = AddressLimits{Connections: 3}
+	limiter := newConnectionLimiter(config)
+	now := time.Unix(1700000000, 0)
+
+	admit := func(addr string) error {
+		_, err := limiter.admit(netip.MustParseAddr(addr), now)
+		return err
+	}
+
+	for _, addr := range []string{"192.0.2.1", "192.0.2.1", "192.0.2.2"} {
+		if err := admit(addr); err != nil {
+			t.Fatalf("Expected %s to be admitted: %v", addr, err)
+		}
+	}
+	if err := admit("192.0.2.1"); err != errTooManyConnections {
+		t.Errorf("Expected a third connection from one IP to be refused, got %v", err)
+	}
+	if err := admit("192.0.2.3"); err != errTooManyConnections {
+		t.Errorf("Expected a fourth connection from one /24 to be refused, got %v", err)
+	}
+	if err := admit("192.0.3.1"); err != nil {
+		t.Errorf("Expected another subnet to be unaffected: %v", err)
+	}
+
+	limiter.release(netip.MustParseAddr("192.0.2.1"))
+	if err := admit("192.0.2.3"); err != nil {
+		t.Errorf("Expected a released slot to be reusable: %v", err)
+	}
+
+	// IPv6 addresses share their /64
+	for _, addr := range []string{"2001:db8::1", "2001:db8::2", "2001:db8::3"} {
+		if err := admit(addr); err != nil {
+			t.Fatalf("Expected %s to be admitted: %v", addr, err)
+		}
+	}
+	if err := admit("2001:db8::4"); err != errTooManyConnections {
+		t.Errorf("Expected the /64 to be full, got %v", err)
+	}
+	if err := admit("2001:db8:0:1::1"); err != nil {
+		t.Errorf("Expected another /64 to be unaffected: %v", err)
+	}
+
+	// Connections without an address are not limited
+	for i := 0; i < 10; i++ {
+		if _, err := limiter.admit(netip.Addr{}, now); err != nil {
+			t.Fatalf("Expected connections without an address to be admitted: %v", err)
+		}
+	}
+}
+
+func TestConnectionLimiter_AttemptsPerMinute(t *testing.T) {
+	config := DefaultConnectionLimitConfig()
+	config.PerIP = AddressLimits{ConnectsPerMinute: 3, JoinsPerMinute: 2}
+	config.PerSubnet = AddressLimits{}
+	limiter := newConnectionLimiter(config)
+	ip := netip.MustParseAddr("198.51.100.7")
+	now := time.Unix(1700000000, 0)
+
+	for i := 0; i < 3; i++ {
+		if _, err := limiter.admit(ip, now); err != nil {
+			t.Fatalf("Expected attempt %d to be admitted: %v", i+1, err)
+		}
+		limiter.release(ip)
+	}
+	wait, err := limiter.admit(ip, now)
+	if err != errTooManyAttempts || wait != 20*time.Second {
+		t.Errorf("Expected a refusal with 20s to wait, got %v and %v", err, wait)
+	}
+	if _, err := limiter.admit(ip, now.Add(20*time.Second)); err != nil {
+		t.Errorf("Expected an attempt to be allowed after waiting: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, ok := limiter.allowJoin(ip, now); !ok {
+			t.Fatalf("Expected join %d to be allowed", i+1)
+		}
+	}
+	if wait, ok := limiter.allowJoin(ip, now); ok || wait != 30*time.Second {
+		t.Errorf("Expected a join refusal with 30s to wait, got %v and %v", ok, wait)
+	}
+
+	limiter.prune(now.Add(time.Minute))
+	if len(limiter.connects) != 1 || len(limiter.joins) != 0 {
+		t.Errorf("Expected only the recently used bucket to be kept, got %d and %d", len(limiter.connects), len(limiter.joins))
+	}
+}
+
+func TestConnectionLimitConfig_Validate(t *testing.T) {
+	if err := DefaultConnectionLimitConfig().Validate(); err != nil {
+		t.Fatalf("Default limits should be valid: %v", err)
+	}
+
+	config := DefaultConnectionLimitConfig()
+	config.PerSubnet.JoinsPerMinute = -1
+	if config.Validate() == nil {
+		t.Error("Expected negative limits to be rejected")
+	}
+
+	config = DefaultConnectionLimitConfig()
+	config.IPv6SubnetBits = 129
+	if config.Validate() == nil {
+		t.Error("Expected an impossible subnet size to be rejected")
+	}
+}
+
+// TestHandleWebSocket_RejectsBusyAddress tests that limits are applied before
+// the upgrade with a 429
+func TestHandleWebSocket_RejectsBusyAddress(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	defer hub.Stop()
+	config := DefaultConnectionLimitConfig()
+	config.PerIP = AddressLimits{Connections: 2, JoinsPerMinute: 1}
+	if err := hub.SetConnectionLimits(config); err != nil {
+		t.Fatal(err)
+	}
+	server := newNodeServer(hub)
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+
+	var conns []*websocket.Conn
+	for i := 0; i < 2; i++ {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+		if err != nil {
+			t.Fatalf("Failed to connect client %d: %v", i+1, err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("Expected a 429 for a third connection, got %v", err)
+	}
+
+	// readUntil returns the first message of a type on a connection
+	readUntil := func(conn *websocket.Conn, messageType string) Message {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatalf("Expected a %s message: %v", messageType, err)
+			}
+			for _, messageData := range splitFrame(data) {
+				var message Message
+				if json.Unmarshal(messageData, &message) == nil && message.Type == messageType {
+					return message
+				}
+			}
+		}
+	}
+
+	// Only one join a minute from this address; the refusal says when to
+	// retry to clients that ask for rate limits
+	conns[1].WriteJSON(Message{Type: MessageTypeHello, Version: protocolVersion, Capabilities: []string{CapabilityRateLimits}})
+	readUntil(conns[1], MessageTypeHello)
+	conns[0].WriteJSON(Message{Type: MessageTypeJoin, Content: "First"})
+	readUntil(conns[0], MessageTypeUserList)
+	conns[1].WriteJSON(Message{Type: MessageTypeJoin, Content: "Second"})
+	refusal := readUntil(conns[1], MessageTypeError)
+	if !strings.Contains(refusal.Error, "join attempts") || refusal.RetryAfter != 60 {
+		t.Errorf("Unexpected join refusal %+v", refusal)
+	}
+
+	// A closed connection frees its slot
+	conns[0].Close()
+	if !waitUntil(2*time.Second, func() bool {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}) {
+		t.Error("Expected a slot to free up once a connection closed")
+	}
+}
+
+// TestHandleWebSocket_RefusedJoinsSpendAttempts tests that names refused by
+// validation still count against the join limit, so names cannot be probed
+// without limit
+func TestHandleWebSocket_RefusedJoinsSpendAttempts(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	defer hub.Stop()
+	config := DefaultConnectionLimitConfig()
+	config.PerIP = AddressLimits{Connections: 2, JoinsPerMinute: 2}
+	if err := hub.SetConnectionLimits(config); err != nil {
+		t.Fatal(err)
+	}
+	server := newNodeServer(hub)
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+
+	holder, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer holder.Close()
+	prober, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer prober.Close()
+
+	// readUntil returns the first message of a type on a connection
+	readUntil := func(conn *websocket.Conn, messageType string) Message {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatalf("Expected a %s message: %v", messageType, err)
+			}
+			var message Message
+			if json.Unmarshal(data, &message) == nil && message.Type == messageType {
+				return message
+			}
+		}
+	}
+
+	holder.WriteJSON(Message{Type: MessageTypeJoin, Content: "Taken"})
+	readUntil(holder, MessageTypeUserList)
+	prober.WriteJSON(Message{Type: MessageTypeJoin, Content: "Taken"})
+	if refusal := readUntil(prober, MessageTypeError); !strings.Contains(refusal.Error, "already in use") {
+		t.Fatalf("Expected the taken name to be refused, got %q", refusal.Error)
+	}
+
+	// Both attempts from the address are spent, so even a free name is
+	// refused for the rate
+	prober.WriteJSON(Message{Type: MessageTypeJoin, Content: "Free"})
+	if refusal := readUntil(prober, MessageTypeError); !strings.Contains(refusal.Error, "join attempts") {
+		t.Errorf("Expected the refused join to have spent an attempt, got %q", refusal.Error)
+	}
+}
+
+// TestHTTPTransport_RejectsBusyAddress tests that fallback sessions count
+// against the same limits
+func TestHTTPTransport_RejectsBusyAddress(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	defer hub.Stop()
+	config := DefaultConnectionLimitConfig()
+	config.PerIP = AddressLimits{ConnectsPerMinute: 1}
+	hub.SetConnectionLimits(config)
+	handler := NewHTTPTransportServer(hub)
+
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, "/poll", nil)
+		handler.HandlePoll(recorder, request)
+		if recorder.Code != want {
+			t.Errorf("Session %d: expected status %d, got %d", i+1, want, recorder.Code)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Group conversations need more than two participants to differ from
+	// one-to-one private messages, and are capped to keep fan-out small
+	minGroupParticipants = 3
+	maxGroupParticipants = 20
+)
+
+// Conversation is an ad-hoc group direct message between named participants
+type Conversation struct {
+	ID           string
+	CreatedBy    string
+	Participants []string
+}
+
+// hasParticipant reports whether name takes part in the conversation
+func (conv *Conversation) hasParticipant(name string) bool {
+	for _, participant := range conv.Participants {
+		if participant == name {
+			return true
+		}
+	}
+	return false
+}
+
+// GetConversation returns a copy of the conversation with the given ID
+func (h *Hub) GetConversation(id string) (Conversation, bool) {
+	h.conversationsMu.RLock()
+	defer h.conversationsMu.RUnlock()
+
+	conv, ok := h.conversations[id]
+	if !ok {
+		return Conversation{}, false
+	}
+	copied := *conv
+	copied.Participants = append([]string(nil), conv.Participants...)
+	return copied, true
+}
+
+// CreateConversation starts a group conversation between the creator and the
+// given users online anywhere in the cluster
+func (h *Hub) CreateConversation(creator string, names []string) (Conversation, error) {
+	participants := []string{creator}
+	seen := map[string]bool{creator: true}
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if seen[name] {
+			continue
+		}
+		if _, ok := h.LocateUser(name); !ok {
+			return Conversation{}, errors.New("participant not found or offline: " + name)
+		}
+		seen[name] = true
+		participants = append(participants, name)
+	}
+
+	if len(participants) < minGroupParticipants {
+		return Conversation{}, errors.New("group conversations need at least " +
+			strconv.Itoa(minGroupParticipants) + " participants")
+	}
+	if len(participants) > maxGroupParticipants {
+		return Conversation{}, errors.New("group conversations are limited to " +
+			strconv.Itoa(maxGroupParticipants) + " participants")
+	}
+
+	h.conversationsMu.Lock()
+	h.nextConversationID++
+	conv := &Conversation{
+		ID:           h.conversationIDPrefix() + "g" + strconv.FormatUint(h.nextConversationID, 10),
+		CreatedBy:    creator,
+		Participants: participants,
+	}
+	h.conversations[conv.ID] = conv
+	h.conversationsMu.Unlock()
+
+	log.Printf("[GROUP] Created: id=%s creator=%s participants=%d", conv.ID, creator, len(participants))
+	h.publishConversation(conversationCreate, conv.ID, creator, participants)
+	h.sendConversationInfo(conv.ID, creator, creator+" started a group conversation")
+
+	copied, _ := h.GetConversation(conv.ID)
+	return copied, nil
+}
+
+// conversationIDPrefix keeps conversation IDs unique across the cluster, like
+// message IDs
+func (h *Hub) conversationIDPrefix() string {
+	if h.nodeID == "" {
+		return ""
+	}
+	return h.nodeID + "-"
+}
+
+// AddParticipants adds online users to a conversation the actor takes part in
+func (h *Hub) AddParticipants(actor, id string, names []string) error {
+	added := make([]string, 0, len(names))
+
+	h.conversationsMu.Lock()
+	conv, ok := h.conversations[id]
+	if !ok || !conv.hasParticipant(actor) {
+		h.conversationsMu.Unlock()
+		return errors.New("conversation not found")
+	}
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if conv.hasParticipant(name) {
+			continue
+		}
+		if _, online := h.LocateUser(name); !online {
+			h.conversationsMu.Unlock()
+			return errors.New("participant not found or offline: " + name)
+		}
+		if len(conv.Participants) >= maxGroupParticipants {
+			h.conversationsMu.Unlock()
+			return errors.New("group conversations are limited to " +
+				strconv.Itoa(maxGroupParticipants) + " participants")
+		}
+		conv.Participants = append(conv.Participants, name)
+		added = append(added, name)
+	}
+	h.conversationsMu.Unlock()
+
+	if len(added) == 0 {
+		return nil
+	}
+
+	log.Printf("[GROUP] Participants added: id=%s actor=%s added=%d", id, actor, len(added))
+	h.publishConversation(conversationAdd, id, actor, added)
+	h.sendConversationInfo(id, actor, actor+" added "+strings.Join(added, ", "))
+	return nil
+}
+
+// LeaveConversation removes a participant, deleting the conversation once
+// nobody is left
+func (h *Hub) LeaveConversation(name, id string) error {
+	h.conversationsMu.Lock()
+	conv, ok := h.conversations[id]
+	if !ok || !conv.hasParticipant(name) {
+		h.conversationsMu.Unlock()
+		return errors.New("conversation not found")
+	}
+	remaining := make([]string, 0, len(conv.Participants)-1)
+	for _, participant := range conv.Participants {
+		if participant != name {
+			remaining = append(remaining, participant)
+		}
+	}
+	conv.Participants = remaining
+	if len(remaining) == 0 {
+		delete(h.conversations, id)
+	}
+	h.conversationsMu.Unlock()
+
+	log.Printf("[GROUP] Participant left: id=%s name=%s remaining=%d", id, name, len(remaining))
+	h.publishConversation(conversationLeave, id, name, []string{name})
+
+	// The leaver gets the final participant list so clients can drop the group
+	h.sendConversationInfo(id, name, name+" left the conversation", name)
+	return nil
+}
+
+// publishConversation tells other nodes about a change to a conversation so
+// participants connected there can use it
+func (h *Hub) publishConversation(action, id, actor string, names []string) {
+	h.publish(BrokerEvent{Kind: BrokerEventConversation, Content: action, Users: names,
+		Message: Message{ConversationID: id, From: actor}})
+}
+
+// applyRemoteConversation applies a change made on another node to this
+// node's copy of a conversation. Participants are told by the node that
+// made the change.
+func (h *Hub) applyRemoteConversation(action, id, actor string, names []string) {
+	h.conversationsMu.Lock()
+	defer h.conversationsMu.Unlock()
+
+	conv, ok := h.conversations[id]
+	switch action {
+	case conversationCreate:
+		if !ok {
+			h.conversations[id] = &Conversation{ID: id, CreatedBy: actor, Participants: append([]string(nil), names...)}
+		}
+	case conversationAdd:
+		if !ok {
+			return
+		}
+		for _, name := range names {
+			if !conv.hasParticipant(name) {
+				conv.Participants = append(conv.Participants, name)
+			}
+		}
+	case conversationLeave:
+		if !ok {
+			return
+		}
+		leaving := make(map[string]bool, len(names))
+		for _, name := range names {
+			leaving[name] = true
+		}
+		remaining := make([]string, 0, len(conv.Participants))
+		for _, participant := range conv.Participants {
+			if !leaving[participant] {
+				remaining = append(remaining, participant)
+			}
+		}
+		conv.Participants = remaining
+		if len(remaining) == 0 {
+			delete(h.conversations, id)
+		}
+	}
+}
+
+// leaveAllConversations removes a disconnected user from every conversation
+// so a later user with the same display name cannot read along
+func (h *Hub) leaveAllConversations(name string) {
+	h.conversationsMu.RLock()
+	ids := make([]string, 0)
+	for id, conv := range h.conversations {
+		if conv.hasParticipant(name) {
+			ids = append(ids, id)
+		}
+	}
+	h.conversationsMu.RUnlock()
+
+	for _, id := range ids {
+		h.LeaveConversation(name, id)
+	}
+}
+
+// sendConversationInfo sends the current participant list of a conversation
+// to its participants and any extra recipients
+func (h *Hub) sendConversationInfo(id, actor, content string, extra ...string) {
+	participants := []string{}
+	if conv, ok := h.GetConversation(id); ok {
+		participants = conv.Participants
+	}
+
+	info := &Message{
+		Type:           MessageTypeGroupInfo,
+		From:           actor,
+		Content:        content,
+		ConversationID: id,
+		Users:          participants,
+	}
+	info.SetTimestampAt(h.now())
+	h.sendToUsers(*info, append(append([]string(nil), participants...), extra...)...)
+}
+
+// SendGroupMessage stores a group message and routes it to the online
+// participants of its conversation, including the sender as an echo
+func (h *Hub) SendGroupMessage(message Message) error {
+	conv, ok := h.GetConversation(message.ConversationID)
+	if !ok || !conv.hasParticipant(message.From) {
+		return errors.New("conversation not found")
+	}
+
+	h.store.Add(&message)
+	h.sendToUsers(message, h.withoutBlockers(message.From, conv.Participants)...)
+	h.notifyThread(message)
+
+	log.Printf("[GROUP] Delivered: id=%s from=%s participants=%d content_length=%d",
+		conv.ID, message.From, len(conv.Participants), len(message.Content))
+	return nil
+}
+
+// handleGroupMessage processes group conversation requests from the client.
+// Group messages arrive checked and stamped by the message hooks.
+func (c *Client) handleGroupMessage(ctx *MessageContext) {
+	message := ctx.Message
+	switch message.Type {
+	case MessageTypeGroupCreate:
+		if _, err := c.hub.CreateConversation(c.displayName, message.Users); err != nil {
+			c.sendError("Failed to create group conversation: " + err.Error())
+		}
+
+	case MessageTypeGroupAdd:
+		if err := c.hub.AddParticipants(c.displayName, message.ConversationID, message.Users); err != nil {
+			c.sendError("Failed to add participants: " + err.Error())
+		}
+
+	case MessageTypeGroupLeave:
+		if err := c.hub.LeaveConversation(c.displayName, message.ConversationID); err != nil {
+			c.sendError("Failed to leave conversation: " + err.Error())
+		}
+
+	case MessageTypeGroupMessage:
+		if ctx.Shadow {
+			c.sendMessage(message)
+			return
+		}
+		if err := c.hub.SendGroupMessage(*message); err != nil {
+			c.sendError("Failed to send group message: " + err.Error())
+			return
+		}
+		c.runAfterBroadcastHooks(ctx)
+	}
+}
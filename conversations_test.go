@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// newGroupTestHub creates a hub with the named users online
+func newGroupTestHub(names ...string) (*Hub, map[string]*Client) {
+	hub := NewHub()
+	clients := make(map[string]*Client)
+	for _, name := range names {
+		client := &Client{hub: hub, send: make(chan outboundFrame, 20), displayName: name}
+		negotiateContent(client)
+		hub.userList[client] = name
+		hub.UpdateClientName(client, name)
+		clients[name] = client
+	}
+	return hub, clients
+}
+
+// drainMessages returns the messages queued for a client
+func drainMessages(client *Client) []Message {
+	messages := make([]Message, 0)
+	for {
+		select {
+		case frame := <-client.send:
+			data := frame.data
+			var message Message
+			json.Unmarshal(data, &message)
+			messages = append(messages, message)
+		case <-time.After(20 * time.Millisecond):
+			return messages
+		}
+	}
+}
+
+func TestHub_CreateConversation(t *testing.T) {
+	hub, clients := newGroupTestHub("Alice", "Bob", "Carol", "Dave")
+
+	if _, err := hub.CreateConversation("Alice", []string{"Bob"}); err == nil {
+		t.Error("Expected group with two participants to be rejected")
+	}
+	if _, err := hub.CreateConversation("Alice", []string{"Bob", "Zed"}); err == nil {
+		t.Error("Expected offline participant to be rejected")
+	}
+
+	conv, err := hub.CreateConversation("Alice", []string{"Bob", "Carol", "Bob"})
+	if err != nil {
+		t.Fatalf("CreateConversation failed: %v", err)
+	}
+	if len(conv.Participants) != 3 {
+		t.Errorf("Expected 3 participants, got %v", conv.Participants)
+	}
+
+	for _, name := range []string{"Alice", "Bob", "Carol"} {
+		messages := drainMessages(clients[name])
+		if len(messages) != 1 || messages[0].Type != MessageTypeGroupInfo || messages[0].ConversationID != conv.ID {
+			t.Errorf("%s: expected group_info, got %+v", name, messages)
+		}
+	}
+	if messages := drainMessages(clients["Dave"]); len(messages) != 0 {
+		t.Errorf("Non-participant received %d messages", len(messages))
+	}
+}
+
+func TestHub_SendGroupMessage(t *testing.T) {
+	hub, clients := newGroupTestHub("Alice", "Bob", "Carol", "Dave")
+	conv, _ := hub.CreateConversation("Alice", []string{"Bob", "Carol"})
+	for _, client := range clients {
+		drainMessages(client)
+	}
+
+	message := Message{Type: MessageTypeGroupMessage, From: "Bob", ConversationID: conv.ID, Content: "hi all"}
+	if err := hub.SendGroupMessage(message); err != nil {
+		t.Fatalf("SendGroupMessage failed: %v", err)
+	}
+
+	for _, name := range []string{"Alice", "Bob", "Carol"} {
+		messages := drainMessages(clients[name])
+		if len(messages) != 1 || messages[0].Content != "hi all" || messages[0].ID == "" {
+			t.Errorf("%s: expected group message, got %+v", name, messages)
+		}
+	}
+	if messages := drainMessages(clients["Dave"]); len(messages) != 0 {
+		t.Error("Non-participant received group message")
+	}
+
+	outsider := Message{Type: MessageTypeGroupMessage, From: "Dave", ConversationID: conv.ID, Content: "let me in"}
+	if err := hub.SendGroupMessage(outsider); err == nil {
+		t.Error("Expected non-participant send to be rejected")
+	}
+}
+
+func TestHub_AddAndLeaveConversation(t *testing.T) {
+	hub, clients := newGroupTestHub("Alice", "Bob", "Carol", "Dave")
+	conv, _ := hub.CreateConversation("Alice", []string{"Bob", "Carol"})
+	for _, client := range clients {
+		drainMessages(client)
+	}
+
+	if err := hub.AddParticipants("Dave", conv.ID, []string{"Dave"}); err == nil {
+		t.Error("Expected non-participant to be unable to add people")
+	}
+	if err := hub.AddParticipants("Bob", conv.ID, []string{"Dave"}); err != nil {
+		t.Fatalf("AddParticipants failed: %v", err)
+	}
+
+	messages := drainMessages(clients["Dave"])
+	if len(messages) != 1 || len(messages[0].Users) != 4 {
+		t.Errorf("Expected new participant to receive group_info with 4 users, got %+v", messages)
+	}
+
+	if err := hub.LeaveConversation("Carol", conv.ID); err != nil {
+		t.Fatalf("LeaveConversation failed: %v", err)
+	}
+	messages = drainMessages(clients["Carol"])
+	if len(messages) != 2 {
+		t.Fatalf("Expected leaver to receive add and leave updates, got %d", len(messages))
+	}
+	for _, user := range messages[1].Users {
+		if user == "Carol" {
+			t.Error("Leaver still listed in participants")
+		}
+	}
+
+	message := Message{Type: MessageTypeGroupMessage, From: "Alice", ConversationID: conv.ID, Content: "bye Carol"}
+	hub.SendGroupMessage(message)
+	for _, received := range drainMessages(clients["Carol"]) {
+		if received.Type == MessageTypeGroupMessage {
+			t.Error("Former participant received group message")
+		}
+	}
+
+	// Conversations are removed once everyone has left
+	for _, name := range []string{"Alice", "Bob", "Dave"} {
+		hub.LeaveConversation(name, conv.ID)
+	}
+	if _, ok := hub.GetConversation(conv.ID); ok {
+		t.Error("Expected empty conversation to be deleted")
+	}
+}
+
+func TestHub_GroupMessageReactions(t *testing.T) {
+	hub, clients := newGroupTestHub("Alice", "Bob", "Carol", "Dave")
+	conv, _ := hub.CreateConversation("Alice", []string{"Bob", "Carol"})
+
+	message := Message{Type: MessageTypeGroupMessage, From: "Alice", ConversationID: conv.ID, Content: "vote"}
+	hub.SendGroupMessage(message)
+	for _, client := range clients {
+		drainMessages(client)
+	}
+
+	stored := hub.store.order[len(hub.store.order)-1]
+	if err := hub.ApplyReaction("Dave", stored, "👍", true); err == nil {
+		t.Error("Expected non-participant reaction to be rejected")
+	}
+	if err := hub.ApplyReaction("Carol", stored, "👍", true); err != nil {
+		t.Fatalf("ApplyReaction failed: %v", err)
+	}
+
+	for _, name := range []string{"Alice", "Bob", "Carol"} {
+		messages := drainMessages(clients[name])
+		if len(messages) != 1 || messages[0].Type != MessageTypeReaction {
+			t.Errorf("%s: expected reaction update, got %+v", name, messages)
+		}
+	}
+	if messages := drainMessages(clients["Dave"]); len(messages) != 0 {
+		t.Error("Non-participant received reaction update")
+	}
+}
+
+func TestMessage_ValidateGroup(t *testing.T) {
+	tests := []struct {
+		name    string
+		message Message
+		wantErr bool
+	}{
+		{"valid create", Message{Type: MessageTypeGroupCreate, Users: []string{"Bob", "Carol"}}, false},
+		{"create without users", Message{Type: MessageTypeGroupCreate}, true},
+		{"create with invalid name", Message{Type: MessageTypeGroupCreate, Users: []string{"<b>x</b>"}}, true},
+		{"message without conversation", Message{Type: MessageTypeGroupMessage, Content: "hi"}, true},
+		{"message without content", Message{Type: MessageTypeGroupMessage, ConversationID: "g1"}, true},
+		{"valid message", Message{Type: MessageTypeGroupMessage, ConversationID: "g1", Content: "hi"}, false},
+		{"leave without conversation", Message{Type: MessageTypeGroupLeave}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.message.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
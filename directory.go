@@ -0,0 +1,271 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// How often a node re-announces its users to the cluster
+	defaultPresenceInterval = 5 * time.Second
+
+	// How long a remote user stays listed without a heartbeat from its node
+	defaultPresenceLease = 3 * defaultPresenceInterval
+
+	// Time an evicted client gets to receive its error before disconnecting
+	nameConflictGrace = 100 * time.Millisecond
+)
+
+// directoryEntry is a lease on a display name held by a remote node
+type directoryEntry struct {
+	node    string
+	expires time.Time
+}
+
+// UserDirectory maps the display names of users connected to other nodes to
+// the node holding them. Entries are leases: a node that stops sending
+// heartbeats has its users expire from the directory.
+//
+// When two nodes claim the same name the node with the lower ID wins. The
+// rule needs no clock agreement, so every node settles on the same owner.
+type UserDirectory struct {
+	mu      sync.RWMutex
+	entries map[string]directoryEntry
+	lease   time.Duration
+}
+
+// NewUserDirectory creates a directory whose entries last for lease
+func NewUserDirectory(lease time.Duration) *UserDirectory {
+	return &UserDirectory{
+		entries: make(map[string]directoryEntry),
+		lease:   lease,
+	}
+}
+
+// claimWins reports whether node may take a name currently held by entry
+func (d *UserDirectory) claimWins(entry directoryEntry, exists bool, node string, now time.Time) bool {
+	return !exists || entry.node == node || !now.Before(entry.expires) || node < entry.node
+}
+
+// Claim records that node holds name, unless another node with a live lease
+// wins the name. It returns whether the claim was accepted.
+func (d *UserDirectory) Claim(name, node string, now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	entry, exists := d.entries[name]
+	if !d.claimWins(entry, exists, node, now) {
+		return false
+	}
+	d.entries[name] = directoryEntry{node: node, expires: now.Add(d.lease)}
+	return true
+}
+
+// Release removes name if it is held by node
+func (d *UserDirectory) Release(name, node string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if entry, ok := d.entries[name]; ok && entry.node == node {
+		delete(d.entries, name)
+		return true
+	}
+	return false
+}
+
+// Renew replaces the names held by node with names and extends their
+// leases. It returns whether the set of listed users changed.
+func (d *UserDirectory) Renew(node string, names []string, now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	current := make(map[string]bool, len(names))
+	changed := false
+	for _, name := range names {
+		entry, exists := d.entries[name]
+		if !d.claimWins(entry, exists, node, now) {
+			continue
+		}
+		if !exists || entry.node != node {
+			changed = true
+		}
+		d.entries[name] = directoryEntry{node: node, expires: now.Add(d.lease)}
+		current[name] = true
+	}
+
+	// Names the node no longer reports have left without a leave event
+	for name, entry := range d.entries {
+		if entry.node == node && !current[name] {
+			delete(d.entries, name)
+			changed = true
+		}
+	}
+	return changed
+}
+
+// Lookup returns the node holding name, if its lease is still live
+func (d *UserDirectory) Lookup(name string, now time.Time) (string, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	entry, ok := d.entries[name]
+	if !ok || !now.Before(entry.expires) {
+		return "", false
+	}
+	return entry.node, true
+}
+
+// Names returns the names with live leases, sorted
+func (d *UserDirectory) Names(now time.Time) []string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	names := make([]string, 0, len(d.entries))
+	for name, entry := range d.entries {
+		if now.Before(entry.expires) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Expire removes entries whose lease has run out and returns their names
+func (d *UserDirectory) Expire(now time.Time) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	expired := make([]string, 0)
+	for name, entry := range d.entries {
+		if !now.Before(entry.expires) {
+			delete(d.entries, name)
+			expired = append(expired, name)
+		}
+	}
+	sort.Strings(expired)
+	return expired
+}
+
+// SetPresenceTiming overrides how often this node sends presence heartbeats
+// and how long remote users stay listed without one. It must be called
+// before SetBroker.
+func (h *Hub) SetPresenceTiming(interval, lease time.Duration) {
+	h.presenceInterval = interval
+	h.directory = NewUserDirectory(lease)
+}
+
+// LocateUser returns the node a user is connected to, which is this node's
+// ID for local users
+func (h *Hub) LocateUser(name string) (string, bool) {
+	if _, ok := h.GetClientByName(name); ok {
+		return h.nodeID, true
+	}
+	return h.remoteNodeOf(name)
+}
+
+// nameInUse reports whether name is held anywhere in the cluster by a client
+// other than client
+func (h *Hub) nameInUse(name string, client *Client) bool {
+	if holder, ok := h.GetClientByName(name); ok && holder != client {
+		return true
+	}
+	_, remote := h.remoteNodeOf(name)
+	return remote
+}
+
+// remoteNodeOf returns the node a remote user is connected to
+func (h *Hub) remoteNodeOf(name string) (string, bool) {
+	return h.directory.Lookup(name, h.now())
+}
+
+// remoteUserNames returns the users connected to other nodes
+func (h *Hub) remoteUserNames() []string {
+	return h.directory.Names(h.now())
+}
+
+// applyPresence records users announced by another node. With replace set
+// the list is the node's complete set of users. Local users that lose a
+// name conflict to the other node are evicted.
+func (h *Hub) applyPresence(node string, names []string, replace bool) {
+	now := h.now()
+	changed := false
+
+	// Settle conflicts with local users first; names kept here are not
+	// recorded for the other node
+	accepted := make([]string, 0, len(names))
+	for _, name := range names {
+		if client, ok := h.GetClientByName(name); ok {
+			if node > h.nodeID {
+				continue
+			}
+			h.evictDuplicate(client, name, node)
+			changed = true
+		}
+		accepted = append(accepted, name)
+	}
+
+	if replace {
+		if h.directory.Renew(node, accepted, now) {
+			changed = true
+		}
+	} else {
+		for _, name := range accepted {
+			if h.directory.Claim(name, node, now) {
+				changed = true
+			}
+		}
+	}
+
+	if changed {
+		h.BroadcastUserList()
+	}
+}
+
+// evictDuplicate removes a local client whose name was taken on another node
+// at the same time. The client is told why and then disconnected.
+func (h *Hub) evictDuplicate(client *Client, name, node string) {
+	h.mu.Lock()
+	if h.userList[client] == name {
+		delete(h.userList, client)
+	}
+	if h.clientsByName[name] == client {
+		delete(h.clientsByName, name)
+	}
+	h.mu.Unlock()
+
+	h.leaveAllConversations(name)
+	log.Printf("[PRESENCE] Name conflict: name=%s winner=%s evicted_on=%s", name, node, h.nodeID)
+
+	client.sendError("Display name error: name already in use")
+	if client.conn != nil {
+		time.AfterFunc(nameConflictGrace, func() {
+			client.conn.Close()
+		})
+	}
+}
+
+// runPresenceHeartbeat announces local users and expires stale remote users
+// until the hub stops
+func (h *Hub) runPresenceHeartbeat() {
+	ticker := h.clock.NewTicker(h.presenceInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C():
+			h.publish(BrokerEvent{Kind: BrokerEventHeartbeat, Users: h.localUsers()})
+
+			if expired := h.directory.Expire(h.now()); len(expired) > 0 {
+				log.Printf("[PRESENCE] Leases expired: users=%v", expired)
+				for _, name := range expired {
+					h.clearBlocks(name)
+				}
+				h.BroadcastUserList()
+			}
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeNetwork connects in-process hubs and can cut nodes off from the rest
+type fakeNetwork struct {
+	mu          sync.Mutex
+	endpoints   map[string]*fakeEndpoint
+	partitioned map[string]bool
+}
+
+// fakeEndpoint is one node's Broker on a fakeNetwork
+type fakeEndpoint struct {
+	network *fakeNetwork
+	node    string
+	queues  []*eventQueue
+	closed  bool
+}
+
+var _ Broker = (*fakeEndpoint)(nil)
+
+func newFakeNetwork() *fakeNetwork {
+	return &fakeNetwork{
+		endpoints:   make(map[string]*fakeEndpoint),
+		partitioned: make(map[string]bool),
+	}
+}
+
+// join returns the broker for a node
+func (n *fakeNetwork) join(node string) *fakeEndpoint {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	endpoint := &fakeEndpoint{network: n, node: node}
+	n.endpoints[node] = endpoint
+	return endpoint
+}
+
+// partition drops all traffic to and from a node until heal is called
+func (n *fakeNetwork) partition(node string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.partitioned[node] = true
+}
+
+func (n *fakeNetwork) heal(node string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.partitioned, node)
+}
+
+func (e *fakeEndpoint) Publish(event BrokerEvent) error {
+	n := e.network
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if e.closed {
+		return errors.New("broker closed")
+	}
+	if n.partitioned[e.node] {
+		return nil
+	}
+	for node, endpoint := range n.endpoints {
+		if node == e.node || n.partitioned[node] || endpoint.closed {
+			continue
+		}
+		for _, q := range endpoint.queues {
+			q.push(event)
+		}
+	}
+	return nil
+}
+
+func (e *fakeEndpoint) Subscribe(handler func(BrokerEvent)) error {
+	e.network.mu.Lock()
+	defer e.network.mu.Unlock()
+	e.queues = append(e.queues, newEventQueue(handler))
+	return nil
+}
+
+func (e *fakeEndpoint) Close() error {
+	e.network.mu.Lock()
+	defer e.network.mu.Unlock()
+	e.closed = true
+	for _, q := range e.queues {
+		q.close()
+	}
+	return nil
+}
+
+// newTestCluster starts one hub per node ID on a fake network with fast
+// presence heartbeats
+func newTestCluster(t *testing.T, nodes ...string) (*fakeNetwork, map[string]*Hub) {
+	network := newFakeNetwork()
+	hubs := make(map[string]*Hub, len(nodes))
+	for _, node := range nodes {
+		hub := NewHub()
+		hub.SetPresenceTiming(20*time.Millisecond, 100*time.Millisecond)
+		go hub.Run()
+		if err := hub.SetBroker(node, network.join(node)); err != nil {
+			t.Fatalf("SetBroker failed: %v", err)
+		}
+		hubs[node] = hub
+	}
+	t.Cleanup(func() {
+		for _, hub := range hubs {
+			hub.Stop()
+		}
+	})
+	return network, hubs
+}
+
+// connectedUsers returns a hub's cluster-wide user list, sorted
+func connectedUsers(hub *Hub) []string {
+	users := hub.GetConnectedUsers()
+	sort.Strings(users)
+	return users
+}
+
+func TestUserDirectory_Leases(t *testing.T) {
+	directory := NewUserDirectory(time.Second)
+	start := time.Unix(1000, 0)
+
+	if !directory.Claim("Alice", "b", start) {
+		t.Fatal("Expected first claim to succeed")
+	}
+	if directory.Claim("Alice", "c", start) {
+		t.Error("Expected claim by a higher node ID to lose")
+	}
+	if !directory.Claim("Alice", "a", start) {
+		t.Error("Expected claim by a lower node ID to win")
+	}
+	if node, ok := directory.Lookup("Alice", start); !ok || node != "a" {
+		t.Errorf("Expected Alice on node a, got %q", node)
+	}
+
+	// Heartbeats replace a node's users and extend their leases
+	directory.Claim("Bob", "b", start)
+	later := start.Add(800 * time.Millisecond)
+	if !directory.Renew("b", []string{"Carol"}, later) {
+		t.Error("Expected renew to report a change")
+	}
+	if got := directory.Names(later); !reflect.DeepEqual(got, []string{"Alice", "Carol"}) {
+		t.Errorf("Expected Bob dropped and Carol added, got %v", got)
+	}
+
+	// Alice's lease runs out, Carol's was renewed
+	expiry := start.Add(1500 * time.Millisecond)
+	if _, ok := directory.Lookup("Alice", expiry); ok {
+		t.Error("Expected Alice's lease to have expired")
+	}
+	if expired := directory.Expire(expiry); !reflect.DeepEqual(expired, []string{"Alice"}) {
+		t.Errorf("Expected Alice to expire, got %v", expired)
+	}
+
+	// An expired holder no longer blocks other nodes
+	directory.Claim("Dave", "a", start)
+	if !directory.Claim("Dave", "z", expiry) {
+		t.Error("Expected claim on an expired lease to succeed")
+	}
+
+	if directory.Release("Carol", "a") {
+		t.Error("Expected release by another node to be ignored")
+	}
+	if !directory.Release("Carol", "b") {
+		t.Error("Expected release by the holding node to succeed")
+	}
+}
+
+func TestCluster_DirectoryRoutingAndExpiry(t *testing.T) {
+	network, hubs := newTestCluster(t, "a", "b", "c")
+
+	alice := &Client{hub: hubs["a"], send: make(chan outboundFrame, 256), displayName: "Alice"}
+	bob := &Client{hub: hubs["b"], send: make(chan outboundFrame, 256), displayName: "Bob"}
+	carol := &Client{hub: hubs["c"], send: make(chan outboundFrame, 256), displayName: "Carol"}
+	hubs["a"].RegisterClient(alice, "Alice")
+	hubs["b"].RegisterClient(bob, "Bob")
+	hubs["c"].RegisterClient(carol, "Carol")
+
+	everyone := []string{"Alice", "Bob", "Carol"}
+	for node, hub := range hubs {
+		hub := hub
+		if !waitUntil(time.Second, func() bool { return reflect.DeepEqual(connectedUsers(hub), everyone) }) {
+			t.Fatalf("Node %s sees %v, expected %v", node, connectedUsers(hub), everyone)
+		}
+	}
+
+	if node, ok := hubs["a"].LocateUser("Carol"); !ok || node != "c" {
+		t.Errorf("Expected Carol on node c, got %q", node)
+	}
+	if node, ok := hubs["a"].LocateUser("Alice"); !ok || node != "a" {
+		t.Errorf("Expected Alice on node a, got %q", node)
+	}
+
+	// Names are unique across the cluster
+	if !hubs["c"].nameInUse("Alice", &Client{hub: hubs["c"]}) {
+		t.Error("Expected Alice to be taken on node c")
+	}
+	if hubs["c"].nameInUse("Carol", carol) {
+		t.Error("A client's own name should not count as taken")
+	}
+
+	// Private messages are routed to the recipient's node
+	drainMessages(carol)
+	message := Message{Type: MessageTypePrivate, From: "Alice", To: "Carol", Content: "hi Carol"}
+	message.SetTimestamp()
+	if err := hubs["a"].SendPrivateMessage("Alice", "Carol", message); err != nil {
+		t.Fatalf("SendPrivateMessage failed: %v", err)
+	}
+	received := waitUntil(time.Second, func() bool {
+		for _, m := range drainMessages(carol) {
+			if m.Type == MessageTypePrivate && m.Content == "hi Carol" {
+				return true
+			}
+		}
+		return false
+	})
+	if !received {
+		t.Error("Carol did not receive the routed private message")
+	}
+
+	// A node that stops heartbeating has its users expire elsewhere
+	network.partition("c")
+	if !waitUntil(time.Second, func() bool { return !contains(connectedUsers(hubs["a"]), "Carol") }) {
+		t.Errorf("Expected Carol's lease to expire on node a, got %v", connectedUsers(hubs["a"]))
+	}
+	if err := hubs["a"].SendPrivateMessage("Alice", "Carol", message); err == nil {
+		t.Error("Expected private message to an expired user to fail")
+	}
+
+	network.heal("c")
+	if !waitUntil(time.Second, func() bool { return contains(connectedUsers(hubs["a"]), "Carol") }) {
+		t.Errorf("Expected Carol to reappear after the partition healed, got %v", connectedUsers(hubs["a"]))
+	}
+}
+
+func TestCluster_ConcurrentNameClaims(t *testing.T) {
+	network, hubs := newTestCluster(t, "a", "b")
+
+	// Both nodes accept the same name while unable to see each other
+	network.partition("b")
+	first := &Client{hub: hubs["a"], send: make(chan outboundFrame, 256), displayName: "Dana"}
+	second := &Client{hub: hubs["b"], send: make(chan outboundFrame, 256), displayName: "Dana"}
+	hubs["a"].RegisterClient(first, "Dana")
+	hubs["b"].RegisterClient(second, "Dana")
+	network.heal("b")
+
+	// The lower node ID keeps the name
+	settled := waitUntil(time.Second, func() bool {
+		_, stillLocal := hubs["b"].GetClientByName("Dana")
+		node, ok := hubs["b"].LocateUser("Dana")
+		return !stillLocal && ok && node == "a"
+	})
+	if !settled {
+		t.Fatal("Expected node b to give up Dana to node a")
+	}
+	if client, ok := hubs["a"].GetClientByName("Dana"); !ok || client != first {
+		t.Error("Expected node a to keep its client")
+	}
+
+	evicted := false
+	for _, m := range drainMessages(second) {
+		if m.Type == MessageTypeError && m.Error == "Display name error: name already in use" {
+			evicted = true
+		}
+	}
+	if !evicted {
+		t.Error("Expected the losing client to be told its name is in use")
+	}
+
+	if users := connectedUsers(hubs["b"]); !reflect.DeepEqual(users, []string{"Dana"}) {
+		t.Errorf("Expected one Dana in the cluster, got %v", users)
+	}
+}
+
+// contains reports whether names includes name
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
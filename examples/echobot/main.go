@@ -0,0 +1,86 @@
+// Command echobot is an example bot. It echoes private messages back to
+// their sender and answers "!remind <duration> <text>", in the chat or
+// privately, with a private reminder once the duration has passed.
+//
+// It joins as the bot account named by BOT_NAME (default EchoBot) with the
+// token in BOT_TOKEN, at the WebSocket endpoint in CHAT_URL (default
+// ws://localhost:8080/ws).
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"realtime-chatroom/bot"
+)
+
+// Longest reminder accepted
+const maxReminder = 24 * time.Hour
+
+func main() {
+	config := bot.Config{
+		URL:   getenv("CHAT_URL", "ws://localhost:8080/ws"),
+		Name:  getenv("BOT_NAME", "EchoBot"),
+		Token: os.Getenv("BOT_TOKEN"),
+	}
+	b := bot.New(config)
+
+	b.OnConnect(func(b *bot.Bot) {
+		log.Printf("[BOT] Joined as %s", b.Name())
+	})
+	b.On(bot.TypeChat, func(b *bot.Bot, m bot.Message) {
+		if strings.HasPrefix(m.Content, "!remind") {
+			remind(b, m)
+		}
+	})
+	b.On(bot.TypePrivate, func(b *bot.Bot, m bot.Message) {
+		if strings.HasPrefix(m.Content, "!remind") {
+			remind(b, m)
+			return
+		}
+		b.Reply(m, m.Content)
+	})
+	b.On(bot.TypeError, func(b *bot.Bot, m bot.Message) {
+		log.Printf("[BOT] Server error: %s", m.Error)
+	})
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if err := b.Run(ctx); err != nil && err != context.Canceled {
+		log.Fatal(err)
+	}
+}
+
+// remind schedules a private reminder for "!remind <duration> <text>"
+func remind(b *bot.Bot, m bot.Message) {
+	fields := strings.SplitN(m.Content, " ", 3)
+	if len(fields) < 3 {
+		b.SendPrivate(m.From, "Usage: !remind <duration> <text>, e.g. !remind 10m stand-up")
+		return
+	}
+	delay, err := time.ParseDuration(fields[1])
+	if err != nil || delay <= 0 || delay > maxReminder {
+		b.SendPrivate(m.From, "Reminders need a duration such as 90s or 2h, up to 24h")
+		return
+	}
+
+	text, from := fields[2], m.From
+	b.SendPrivate(from, "OK, I will remind you in "+delay.String())
+	time.AfterFunc(delay, func() {
+		if err := b.SendPrivate(from, "Reminder: "+text); err != nil {
+			log.Printf("[BOT] Reminder for %s lost: %v", from, err)
+		}
+	})
+}
+
+// getenv returns an environment variable, or fallback if it is unset
+func getenv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
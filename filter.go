@@ -0,0 +1,574 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// FilterAction is what a content filter does with a message it objects to
+type FilterAction int
+
+const (
+	// Rewrite the offending part and deliver the rest
+	FilterMask FilterAction = iota
+
+	// Refuse the message and tell the sender why
+	FilterReject
+
+	// Show the message to its sender only, who is not told it was dropped
+	FilterDrop
+)
+
+// filterActionNames maps configuration names to actions
+var filterActionNames = map[string]FilterAction{
+	"mask":   FilterMask,
+	"reject": FilterReject,
+	"drop":   FilterDrop,
+}
+
+// ParseFilterAction parses an action name such as "reject"
+func ParseFilterAction(name string) (FilterAction, error) {
+	action, ok := filterActionNames[strings.ToLower(strings.TrimSpace(name))]
+	if !ok {
+		return FilterMask, errors.New("unknown filter action: " + name)
+	}
+	return action, nil
+}
+
+// String returns the action's configuration name
+func (a FilterAction) String() string {
+	for name, action := range filterActionNames {
+		if action == a {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// FilterResult is a filter's verdict on a message's content
+type FilterResult struct {
+	// Content to deliver, masked where the filter objected
+	Content string
+
+	// Matched is set when the filter objected, with the action it took and
+	// why
+	Matched bool
+	Action  FilterAction
+	Reason  string
+}
+
+// ContentFilter inspects the content of chat, private and group messages
+// before they are delivered
+type ContentFilter interface {
+	Filter(content string) FilterResult
+}
+
+// FilterChain runs filters in order. Masks accumulate; the first filter
+// to reject or drop the message decides its fate.
+type FilterChain []ContentFilter
+
+// Filter runs every filter in the chain over the content
+func (chain FilterChain) Filter(content string) FilterResult {
+	result := FilterResult{Content: content}
+	var reasons []string
+	for _, filter := range chain {
+		verdict := filter.Filter(result.Content)
+		if !verdict.Matched {
+			continue
+		}
+		if verdict.Action != FilterMask {
+			return verdict
+		}
+		result.Content = verdict.Content
+		result.Matched = true
+		reasons = append(reasons, verdict.Reason)
+	}
+	result.Reason = strings.Join(reasons, "; ")
+	return result
+}
+
+// confusables maps letters that look like ASCII ones, mostly Cyrillic and
+// Greek, to the letters they imitate
+var confusables = map[rune]rune{
+	'а': 'a', 'в': 'b', 'е': 'e', 'ё': 'e', 'к': 'k', 'м': 'm', 'н': 'h', 'о': 'o',
+	'р': 'p', 'с': 'c', 'т': 't', 'у': 'y', 'х': 'x', 'ѕ': 's', 'і': 'i', 'ї': 'i',
+	'ј': 'j', 'ԁ': 'd', 'ԛ': 'q', 'ԝ': 'w', 'ɑ': 'a', 'ɡ': 'g', 'ı': 'i', 'ȷ': 'j',
+	'ℓ': 'l', 'ɩ': 'i', 'ʏ': 'y', 'ɴ': 'n', 'ʀ': 'r', 'ꜱ': 's', 'ᴅ': 'd', 'ᴇ': 'e',
+	'α': 'a', 'β': 'b', 'ε': 'e', 'η': 'n', 'ι': 'i', 'κ': 'k', 'ν': 'v', 'ο': 'o',
+	'ρ': 'p', 'τ': 't', 'υ': 'u', 'χ': 'x', 'ω': 'w', 'ϲ': 'c', 'ϳ': 'j',
+	'à': 'a', 'á': 'a', 'â': 'a', 'ã': 'a', 'ä': 'a', 'å': 'a', 'ā': 'a', 'ç': 'c',
+	'è': 'e', 'é': 'e', 'ê': 'e', 'ë': 'e', 'ē': 'e', 'ì': 'i', 'í': 'i', 'î': 'i',
+	'ï': 'i', 'ñ': 'n', 'ò': 'o', 'ó': 'o', 'ô': 'o', 'õ': 'o', 'ö': 'o', 'ø': 'o',
+	'ù': 'u', 'ú': 'u', 'û': 'u', 'ü': 'u', 'ý': 'y', 'ÿ': 'y',
+}
+
+// foldRune maps a rune to the lowercase ASCII letter or digit it imitates,
+// if any. Invisible format characters and combining marks, which can be
+// slipped inside a word to split it, are dropped.
+func foldRune(r rune) (rune, bool) {
+	switch {
+	case unicode.Is(unicode.Cf, r) || unicode.Is(unicode.Mn, r):
+		return 0, false
+	case r >= 0xFF01 && r <= 0xFF5E:
+		// Fullwidth forms
+		r -= 0xFEE0
+	case r >= 0x1D400 && r <= 0x1D6A3:
+		// Mathematical bold, italic, script and other letter styles
+		if n := (r - 0x1D400) % 52; n < 26 {
+			r = 'a' + n
+		} else {
+			r = 'a' + n - 26
+		}
+	case r >= 0x1D7CE && r <= 0x1D7FF:
+		// Mathematical digits
+		r = '0' + (r-0x1D7CE)%10
+	}
+	r = unicode.ToLower(r)
+	if folded, ok := confusables[r]; ok {
+		r = folded
+	}
+	return r, true
+}
+
+// foldConfusables returns the lowercase skeleton of s that filters match
+// against, so "ɑdmin" or "ＡＤＭＩＮ" reads as "admin"
+func foldConfusables(s string) string {
+	return string(newFoldedText(s).folded)
+}
+
+// foldedText is content alongside its skeleton, with each folded rune's
+// position in the original so matches can be masked there
+type foldedText struct {
+	original []rune
+	folded   []rune
+	origin   []int
+}
+
+// newFoldedText folds content rune by rune
+func newFoldedText(content string) *foldedText {
+	text := &foldedText{original: []rune(content)}
+	for i, r := range text.original {
+		if folded, ok := foldRune(r); ok {
+			text.folded = append(text.folded, folded)
+			text.origin = append(text.origin, i)
+		}
+	}
+	return text
+}
+
+// textSpan is a range of folded runes, end exclusive
+type textSpan struct {
+	start, end int
+}
+
+// replace rewrites the original content, replacing the runes behind each
+// span, including any dropped while folding, with the given text. Spans
+// must be in order and must not overlap.
+func (t *foldedText) replace(spans []textSpan, with func(textSpan) string) string {
+	var b strings.Builder
+	next := 0
+	for _, span := range spans {
+		from, to := t.origin[span.start], t.origin[span.end-1]+1
+		b.WriteString(string(t.original[next:from]))
+		b.WriteString(with(span))
+		next = to
+	}
+	b.WriteString(string(t.original[next:]))
+	return b.String()
+}
+
+// isWordRune reports whether r continues a word in folded text
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// BannedWordFilter matches whole words and phrases from a list, however
+// they are disguised with lookalike letters or invisible characters.
+// Masking replaces each letter with an asterisk.
+type BannedWordFilter struct {
+	words  [][]rune
+	action FilterAction
+}
+
+// NewBannedWordFilter creates a filter for the given words
+func NewBannedWordFilter(words []string, action FilterAction) *BannedWordFilter {
+	filter := &BannedWordFilter{action: action}
+	for _, word := range words {
+		if folded := []rune(foldConfusables(strings.TrimSpace(word))); len(folded) > 0 {
+			filter.words = append(filter.words, folded)
+		}
+	}
+	// Longer phrases win over words they start with
+	sort.SliceStable(filter.words, func(i, j int) bool {
+		return len(filter.words[i]) > len(filter.words[j])
+	})
+	return filter
+}
+
+// Filter masks, rejects or drops content containing a banned word
+func (f *BannedWordFilter) Filter(content string) FilterResult {
+	text := newFoldedText(content)
+	var spans []textSpan
+	for i := 0; i < len(text.folded); i++ {
+		if i > 0 && isWordRune(text.folded[i-1]) {
+			continue
+		}
+		for _, word := range f.words {
+			end := i + len(word)
+			if end > len(text.folded) || string(text.folded[i:end]) != string(word) {
+				continue
+			}
+			if end < len(text.folded) && isWordRune(text.folded[end]) {
+				continue
+			}
+			spans = append(spans, textSpan{i, end})
+			i = end - 1
+			break
+		}
+	}
+	if len(spans) == 0 {
+		return FilterResult{Content: content}
+	}
+
+	result := FilterResult{Content: content, Matched: true, Action: f.action, Reason: "contains a banned word"}
+	if f.action == FilterMask {
+		result.Content = text.replace(spans, func(span textSpan) string {
+			return strings.Repeat("*", span.end-span.start)
+		})
+	}
+	return result
+}
+
+// linkPattern finds URLs with a scheme, hosts starting with www., and bare
+// hosts such as evil.com, with the path that follows them if any. Bare
+// hosts are only links when followed by a path or ending in a top-level
+// domain in commonTLDs or a filtered domain, so a bare "file.txt" is not.
+var linkPattern = regexp.MustCompile(`\b(?:[a-z][a-z0-9+.-]*://([^\s/?#<>"']+)|(www\.[^\s/?#<>"']+)|([a-z0-9-]+(?:\.[a-z0-9-]+)*\.[a-z]{2,})\b(/)?)`)
+
+// commonTLDs are the top-level domains that make a bare host a link
+var commonTLDs = map[string]bool{
+	"com": true, "net": true, "org": true, "info": true, "biz": true, "edu": true, "gov": true,
+	"io": true, "co": true, "me": true, "ly": true, "gg": true, "tv": true, "cc": true, "to": true,
+	"app": true, "dev": true, "xyz": true, "top": true, "site": true, "online": true, "club": true,
+	"link": true, "click": true, "shop": true, "store": true, "live": true, "win": true, "tk": true,
+	"us": true, "uk": true, "ca": true, "au": true, "de": true, "fr": true, "nl": true, "eu": true,
+	"ru": true, "cn": true, "jp": true, "in": true, "br": true,
+}
+
+// LinkFilter enforces which domains messages may link to. Subdomains
+// count as their parent: denying example.com denies www.example.com.
+// Masking replaces the link with a placeholder.
+type LinkFilter struct {
+	allow  []string
+	deny   []string
+	action FilterAction
+}
+
+// NewLinkFilter creates a filter that refuses links to denied domains and,
+// if allow is not empty, to any domain not on it
+func NewLinkFilter(allow, deny []string, action FilterAction) *LinkFilter {
+	normalize := func(domains []string) []string {
+		var normalized []string
+		for _, domain := range domains {
+			domain = strings.TrimPrefix(foldConfusables(strings.TrimSpace(domain)), ".")
+			if domain != "" {
+				normalized = append(normalized, domain)
+			}
+		}
+		return normalized
+	}
+	return &LinkFilter{allow: normalize(allow), deny: normalize(deny), action: action}
+}
+
+// linkHost extracts the host of a link, without credentials or port
+func linkHost(authority string) string {
+	authority = strings.TrimRight(authority, ".,;:!?)}'\"")
+	if i := strings.LastIndex(authority, "@"); i >= 0 {
+		authority = authority[i+1:]
+	}
+	if i := strings.LastIndex(authority, ":"); i >= 0 && !strings.HasSuffix(authority, "]") {
+		authority = authority[:i]
+	}
+	return strings.TrimSuffix(authority, ".")
+}
+
+// inDomains reports whether host is one of the domains or a subdomain
+func inDomains(host string, domains []string) bool {
+	for _, domain := range domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// bareLink reports whether a bare host without a path is a link: one
+// ending in a common top-level domain or within a filtered domain
+func (f *LinkFilter) bareLink(host string) bool {
+	return commonTLDs[host[strings.LastIndex(host, ".")+1:]] || inDomains(host, f.allow) || inDomains(host, f.deny)
+}
+
+// allowed reports whether a link to host may be sent
+func (f *LinkFilter) allowed(host string) bool {
+	if inDomains(host, f.deny) {
+		return false
+	}
+	return len(f.allow) == 0 || inDomains(host, f.allow)
+}
+
+// Filter masks, rejects or drops content linking to a domain not allowed
+func (f *LinkFilter) Filter(content string) FilterResult {
+	text := newFoldedText(content)
+	skeleton := string(text.folded)
+
+	var spans []textSpan
+	var refused string
+	for _, match := range linkPattern.FindAllStringSubmatchIndex(skeleton, -1) {
+		var host string
+		for group := 1; group <= 3; group++ {
+			if match[2*group] >= 0 {
+				host = linkHost(skeleton[match[2*group]:match[2*group+1]])
+			}
+		}
+		if match[6] >= 0 && match[8] < 0 && !f.bareLink(host) {
+			continue
+		}
+		if f.allowed(host) {
+			continue
+		}
+		if refused == "" {
+			refused = host
+		}
+		// Mask through the end of the link, not just its host
+		end := len(skeleton)
+		if space := strings.IndexFunc(skeleton[match[1]:], unicode.IsSpace); space >= 0 {
+			end = match[1] + space
+		}
+		spans = append(spans, textSpan{
+			start: utf8.RuneCountInString(skeleton[:match[0]]),
+			end:   utf8.RuneCountInString(skeleton[:end]),
+		})
+	}
+	if len(spans) == 0 {
+		return FilterResult{Content: content}
+	}
+
+	result := FilterResult{Content: content, Matched: true, Action: f.action, Reason: "links to " + refused + " are not allowed"}
+	if f.action == FilterMask {
+		result.Content = text.replace(spans, func(textSpan) string { return "[link removed]" })
+	}
+	return result
+}
+
+// CapsFilter catches shouting: messages with at least minLetters letters
+// of which more than maxRatio are capitals. Masking lowercases them.
+type CapsFilter struct {
+	minLetters int
+	maxRatio   float64
+	action     FilterAction
+}
+
+// NewCapsFilter creates a filter for messages in capitals
+func NewCapsFilter(minLetters int, maxRatio float64, action FilterAction) *CapsFilter {
+	return &CapsFilter{minLetters: minLetters, maxRatio: maxRatio, action: action}
+}
+
+// Filter masks, rejects or drops content that is mostly capitals
+func (f *CapsFilter) Filter(content string) FilterResult {
+	letters, upper := 0, 0
+	for _, r := range content {
+		if unicode.IsLetter(r) {
+			letters++
+			if unicode.IsUpper(r) {
+				upper++
+			}
+		}
+	}
+	if letters < f.minLetters || float64(upper) <= f.maxRatio*float64(letters) {
+		return FilterResult{Content: content}
+	}
+
+	result := FilterResult{Content: content, Matched: true, Action: f.action, Reason: "too many capital letters"}
+	if f.action == FilterMask {
+		result.Content = strings.ToLower(content)
+	}
+	return result
+}
+
+// RepeatFilter catches runs of the same character longer than maxRun, as
+// in "noooooooo" or "!!!!!!!!!!". Masking shortens the runs to maxRun.
+type RepeatFilter struct {
+	maxRun int
+	action FilterAction
+}
+
+// NewRepeatFilter creates a filter for long runs of one character
+func NewRepeatFilter(maxRun int, action FilterAction) *RepeatFilter {
+	return &RepeatFilter{maxRun: maxRun, action: action}
+}
+
+// Filter masks, rejects or drops content with long runs of one character
+func (f *RepeatFilter) Filter(content string) FilterResult {
+	var b strings.Builder
+	matched := false
+	var previous rune
+	run := 0
+	for _, r := range content {
+		if r == previous {
+			run++
+		} else {
+			previous, run = r, 1
+		}
+		if run > f.maxRun {
+			matched = true
+			continue
+		}
+		b.WriteRune(r)
+	}
+	if !matched {
+		return FilterResult{Content: content}
+	}
+
+	result := FilterResult{Content: content, Matched: true, Action: f.action, Reason: "too many repeated characters"}
+	if f.action == FilterMask {
+		result.Content = b.String()
+	}
+	return result
+}
+
+// FilterConfig selects the content filters and what each does when it
+// matches. Empty lists and zero thresholds leave a filter off.
+type FilterConfig struct {
+	BannedWords      []string
+	BannedWordAction FilterAction
+
+	// Domains links may point to, if any are listed, and domains they may
+	// never point to
+	AllowedDomains []string
+	DeniedDomains  []string
+	LinkAction     FilterAction
+
+	// Messages with at least CapsMinLetters letters, more than CapsMaxRatio
+	// of them capitals
+	CapsMinLetters int
+	CapsMaxRatio   float64
+	CapsAction     FilterAction
+
+	// Longest run of one character allowed
+	MaxRepeat    int
+	RepeatAction FilterAction
+}
+
+// DefaultFilterConfig returns a configuration with every filter off, and
+// the actions that suit each once enabled: banned words, capitals and
+// repeats are masked, links to refused domains rejected
+func DefaultFilterConfig() FilterConfig {
+	return FilterConfig{
+		BannedWordAction: FilterMask,
+		LinkAction:       FilterReject,
+		CapsMaxRatio:     0.7,
+		CapsAction:       FilterMask,
+		RepeatAction:     FilterMask,
+	}
+}
+
+// Validate checks the thresholds and actions
+func (c FilterConfig) Validate() error {
+	for _, action := range []FilterAction{c.BannedWordAction, c.LinkAction, c.CapsAction, c.RepeatAction} {
+		if action.String() == "unknown" {
+			return fmt.Errorf("unknown filter action %d", action)
+		}
+	}
+	if c.CapsMinLetters < 0 || c.MaxRepeat < 0 {
+		return errors.New("filter thresholds cannot be negative")
+	}
+	if c.CapsMinLetters > 0 && (c.CapsMaxRatio <= 0 || c.CapsMaxRatio >= 1) {
+		return errors.New("capitals ratio must be between 0 and 1")
+	}
+	return nil
+}
+
+// NewFilterChain builds the filters a configuration enables. Repeats come
+// first, so they do not count the asterisks of masked words.
+func NewFilterChain(config FilterConfig) FilterChain {
+	var chain FilterChain
+	if config.MaxRepeat > 0 {
+		chain = append(chain, NewRepeatFilter(config.MaxRepeat, config.RepeatAction))
+	}
+	if len(config.BannedWords) > 0 {
+		chain = append(chain, NewBannedWordFilter(config.BannedWords, config.BannedWordAction))
+	}
+	if len(config.AllowedDomains) > 0 || len(config.DeniedDomains) > 0 {
+		chain = append(chain, NewLinkFilter(config.AllowedDomains, config.DeniedDomains, config.LinkAction))
+	}
+	if config.CapsMinLetters > 0 {
+		chain = append(chain, NewCapsFilter(config.CapsMinLetters, config.CapsMaxRatio, config.CapsAction))
+	}
+	return chain
+}
+
+// LoadWordList reads a list of words or phrases, one per line. Blank lines
+// and lines starting with # are skipped.
+func LoadWordList(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var words []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			words = append(words, line)
+		}
+	}
+	return words, scanner.Err()
+}
+
+// SetContentFilters replaces the content filters. It must be called before
+// clients connect.
+func (h *Hub) SetContentFilters(config FilterConfig) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	h.filters = NewFilterChain(config)
+	return nil
+}
+
+// filterContent runs the hub's content filters over a message, masking
+// its content in place. It returns false if the message was rejected,
+// having told the sender why, and shadow if it must be shown to its sender
+// only.
+func (c *Client) filterContent(message *Message) (shadow bool, ok bool) {
+	if len(c.hub.filters) == 0 {
+		return false, true
+	}
+	result := c.hub.filters.Filter(message.Content)
+	if !result.Matched {
+		return false, true
+	}
+
+	c.emitModeration("filter", result.Action.String(), result.Reason, message)
+	switch result.Action {
+	case FilterReject:
+		log.Printf("[FILTER] Rejected %s message from %s: %s", message.Type, c.displayName, result.Reason)
+		c.sendError("Message rejected: " + result.Reason)
+		return false, false
+	case FilterDrop:
+		log.Printf("[FILTER] Shadow-dropped %s message from %s: %s", message.Type, c.displayName, result.Reason)
+		return true, true
+	}
+	log.Printf("[FILTER] Masked %s message from %s: %s", message.Type, c.displayName, result.Reason)
+	message.Content = result.Content
+	return false, true
+}
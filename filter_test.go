@@ -0,0 +1,268 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFoldConfusables(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"admin", "admin"},
+		{"ɑdmin", "admin"},
+		{"АДМИН", "aдmиh"},
+		{"аdmіn", "admin"},
+		{"ＡＤＭＩＮ", "admin"},
+		{"𝐚𝐝𝐦𝐢𝐧", "admin"},
+		{"𝟏𝟐𝟑", "123"},
+		{"ad​min", "admin"},
+		{"ádmin", "admin"},
+		{"ádmín", "admin"},
+	}
+	for _, tt := range tests {
+		if got := foldConfusables(tt.input); got != tt.want {
+			t.Errorf("foldConfusables(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestParseFilterAction(t *testing.T) {
+	for name, want := range map[string]FilterAction{"mask": FilterMask, " Reject ": FilterReject, "DROP": FilterDrop} {
+		action, err := ParseFilterAction(name)
+		if err != nil || action != want {
+			t.Errorf("ParseFilterAction(%q) = %v, %v; want %v", name, action, err, want)
+		}
+	}
+	if _, err := ParseFilterAction("ban"); err == nil {
+		t.Error("Expected an unknown action to be refused")
+	}
+	if FilterDrop.String() != "drop" {
+		t.Errorf("Expected drop, got %s", FilterDrop)
+	}
+}
+
+func TestBannedWordFilter(t *testing.T) {
+	filter := NewBannedWordFilter([]string{"darn", "Heck", "darn it"}, FilterMask)
+
+	tests := []struct {
+		name    string
+		content string
+		want    string
+		matched bool
+	}{
+		{"clean", "hello there", "hello there", false},
+		{"word", "well darn", "well ****", true},
+		{"case", "HECK no", "**** no", true},
+		{"phrase before word", "darn it all", "******* all", true},
+		{"inside a word", "darnation and checkers", "darnation and checkers", false},
+		{"several", "darn, heck!", "****, ****!", true},
+		{"lookalikes", "dаrn", "****", true},
+		{"zero-width split", "he​ck", "****", true},
+		{"fullwidth", "ｄａｒｎ", "****", true},
+		{"next to punctuation", "(darn)", "(****)", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := filter.Filter(tt.content)
+			if result.Matched != tt.matched || result.Content != tt.want {
+				t.Errorf("Filter(%q) = %q matched=%v, want %q matched=%v", tt.content, result.Content, result.Matched, tt.want, tt.matched)
+			}
+		})
+	}
+
+	// Other actions leave the content alone and report the action
+	result := NewBannedWordFilter([]string{"darn"}, FilterReject).Filter("darn")
+	if !result.Matched || result.Action != FilterReject || result.Content != "darn" {
+		t.Errorf("Expected a rejection with content untouched, got %+v", result)
+	}
+}
+
+func TestLinkFilter(t *testing.T) {
+	deny := NewLinkFilter(nil, []string{"evil.com"}, FilterMask)
+	allow := NewLinkFilter([]string{"example.org", ".docs.io"}, nil, FilterReject)
+
+	tests := []struct {
+		name    string
+		filter  *LinkFilter
+		content string
+		matched bool
+		want    string
+	}{
+		{"no links", deny, "see file.txt for details", false, "see file.txt for details"},
+		{"denied", deny, "go to https://evil.com/win now", true, "go to [link removed] now"},
+		{"denied subdomain", deny, "http://www.evil.com", true, "[link removed]"},
+		{"denied www", deny, "www.evil.com!", true, "[link removed]"},
+		{"denied bare path", deny, "evil.com/x", true, "[link removed]"},
+		{"denied bare domain", deny, "visit evil.com", true, "visit [link removed]"},
+		{"denied bare subdomain", deny, "try login.evil.com.", true, "try [link removed]"},
+		{"denied with port and credentials", deny, "http://me@evil.com:8080/", true, "[link removed]"},
+		{"denied with lookalikes", deny, "https://еvil.com", true, "[link removed]"},
+		{"similar domain", deny, "https://notevil.com", false, "https://notevil.com"},
+		{"allowed", allow, "https://example.org/a and http://api.docs.io", false, "https://example.org/a and http://api.docs.io"},
+		{"not allowed", allow, "https://example.org and https://other.net", true, "https://example.org and https://other.net"},
+		{"bare domain not allowed", allow, "see example.org or other.net", true, "see example.org or other.net"},
+		{"bare file names", allow, "open notes.txt or main.go", false, "open notes.txt or main.go"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := tt.filter.Filter(tt.content)
+			if result.Matched != tt.matched || result.Content != tt.want {
+				t.Errorf("Filter(%q) = %q matched=%v, want %q matched=%v", tt.content, result.Content, result.Matched, tt.want, tt.matched)
+			}
+		})
+	}
+
+	if result := allow.Filter("read https://other.net"); result.Reason != "links to other.net are not allowed" {
+		t.Errorf("Expected the refused domain in the reason, got %q", result.Reason)
+	}
+}
+
+func TestCapsFilter(t *testing.T) {
+	filter := NewCapsFilter(10, 0.7, FilterMask)
+
+	if result := filter.Filter("WHY IS NOBODY ANSWERING"); !result.Matched || result.Content != "why is nobody answering" {
+		t.Errorf("Expected shouting to be lowercased, got %+v", result)
+	}
+	if result := filter.Filter("OK LOL"); result.Matched {
+		t.Error("Expected short messages to pass")
+	}
+	if result := filter.Filter("I met NASA and the FBI at the UN"); result.Matched {
+		t.Error("Expected mixed case to pass")
+	}
+}
+
+func TestRepeatFilter(t *testing.T) {
+	filter := NewRepeatFilter(3, FilterMask)
+
+	if result := filter.Filter("nooooooo!!!!!!"); !result.Matched || result.Content != "nooo!!!" {
+		t.Errorf("Expected runs to be shortened, got %+v", result)
+	}
+	if result := filter.Filter("bookkeeper ..."); result.Matched {
+		t.Errorf("Expected short runs to pass, got %+v", result)
+	}
+	if result := NewRepeatFilter(3, FilterDrop).Filter("😀😀😀😀"); !result.Matched || result.Action != FilterDrop {
+		t.Errorf("Expected repeated emoji to match, got %+v", result)
+	}
+}
+
+func TestFilterChain(t *testing.T) {
+	chain := FilterChain{
+		NewRepeatFilter(2, FilterMask),
+		NewBannedWordFilter([]string{"darn"}, FilterMask),
+		NewLinkFilter(nil, []string{"evil.com"}, FilterDrop),
+		NewCapsFilter(1, 0.5, FilterReject),
+	}
+
+	result := chain.Filter("darn it!!!!")
+	if !result.Matched || result.Action != FilterMask || result.Content != "**** it!!" {
+		t.Errorf("Expected masks from both filters, got %+v", result)
+	}
+	if result.Reason != "too many repeated characters; contains a banned word" {
+		t.Errorf("Expected both reasons, got %q", result.Reason)
+	}
+
+	// The first filter to refuse decides
+	result = chain.Filter("DARN https://evil.com")
+	if result.Action != FilterDrop {
+		t.Errorf("Expected the link filter to drop the message, got %+v", result)
+	}
+
+	if result := chain.Filter("hi"); result.Matched || result.Content != "hi" {
+		t.Errorf("Expected clean content to pass, got %+v", result)
+	}
+}
+
+func TestFilterConfig(t *testing.T) {
+	config := DefaultFilterConfig()
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Expected the defaults to be valid: %v", err)
+	}
+	if chain := NewFilterChain(config); len(chain) != 0 {
+		t.Errorf("Expected every filter off by default, got %d", len(chain))
+	}
+
+	config.BannedWords = []string{"darn"}
+	config.DeniedDomains = []string{"evil.com"}
+	config.CapsMinLetters = 10
+	config.MaxRepeat = 5
+	if chain := NewFilterChain(config); len(chain) != 4 {
+		t.Errorf("Expected four filters, got %d", len(chain))
+	}
+
+	invalid := []func(*FilterConfig){
+		func(c *FilterConfig) { c.LinkAction = FilterAction(9) },
+		func(c *FilterConfig) { c.MaxRepeat = -1 },
+		func(c *FilterConfig) { c.CapsMinLetters, c.CapsMaxRatio = 10, 1.5 },
+	}
+	for i, change := range invalid {
+		config := DefaultFilterConfig()
+		change(&config)
+		if err := config.Validate(); err == nil {
+			t.Errorf("Expected invalid config %d to be refused", i)
+		}
+	}
+}
+
+func TestLoadWordList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "words.txt")
+	os.WriteFile(path, []byte("# banned\ndarn\n\n  heck  \ndarn it\n"), 0o600)
+
+	words, err := LoadWordList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"darn", "heck", "darn it"}; !reflect.DeepEqual(words, want) {
+		t.Errorf("Expected %v, got %v", want, words)
+	}
+	if _, err := LoadWordList(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("Expected an error for a missing file")
+	}
+}
+
+func TestContentFilters_AppliedBeforeDelivery(t *testing.T) {
+	h := newChatHarness(t)
+	config := DefaultFilterConfig()
+	config.BannedWords = []string{"darn"}
+	config.DeniedDomains = []string{"evil.com"}
+	config.LinkAction = FilterDrop
+	config.MaxRepeat = 3
+	config.RepeatAction = FilterReject
+	if err := h.hub.SetContentFilters(config); err != nil {
+		t.Fatal(err)
+	}
+	alice := h.join("Alice")
+	bob := h.join("Bob")
+
+	// Masked messages are delivered masked
+	alice.send(Message{Type: MessageTypeChat, From: "Alice", Content: "well dаrn"})
+	bob.waitFor(func(m Message) bool { return m.Type == MessageTypeChat && m.Content == "well ****" })
+
+	// Rejected messages go nowhere and the sender is told why
+	alice.send(Message{Type: MessageTypeChat, From: "Alice", Content: "nooooooo"})
+	alice.waitFor(func(m Message) bool {
+		return m.Type == MessageTypeError && m.Error == "Message rejected: too many repeated characters"
+	})
+
+	// Shadow-dropped messages reach only their sender
+	alice.send(Message{Type: MessageTypeChat, From: "Alice", Content: "free stuff at evil.com/win"})
+	alice.waitFor(func(m Message) bool { return m.Type == MessageTypeChat && m.Content == "free stuff at evil.com/win" })
+	alice.send(Message{Type: MessageTypePrivate, From: "Alice", To: "Bob", Content: "psst https://evil.com"})
+	alice.waitFor(func(m Message) bool { return m.Type == MessageTypePrivate && m.Content == "psst https://evil.com" })
+
+	alice.send(Message{Type: MessageTypePrivate, From: "Alice", To: "Bob", Content: "darn"})
+	bob.waitFor(func(m Message) bool { return m.Type == MessageTypePrivate && m.Content == "****" })
+	if n := bob.count(func(m Message) bool {
+		return contains([]string{"nooooooo", "free stuff at evil.com/win", "psst https://evil.com"}, m.Content)
+	}); n != 0 {
+		t.Errorf("Expected refused messages to reach nobody else, Bob got %d", n)
+	}
+	if n := alice.count(func(m Message) bool {
+		return m.Type == MessageTypeError && m.Error != "Message rejected: too many repeated characters"
+	}); n != 0 {
+		t.Errorf("Expected the shadow-dropped messages to look sent, got %d errors", n)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"log"
+
+	"github.com/gorilla/websocket"
+)
+
+// frameSeparator joins messages batched into one WebSocket frame. Encoded
+// JSON never contains a raw newline, so clients split frames on it.
+var frameSeparator = []byte{'\n'}
+
+// outboundFrame is a message queued for a client's WritePump. Broadcasts
+// carry a prepared frame that is encoded once and shared by every recipient.
+type outboundFrame struct {
+	data     []byte
+	prepared *websocket.PreparedMessage
+
+	// frameType is the WebSocket message type; zero means text
+	frameType int
+
+	// presence marks user lists, which later ones supersede
+	presence bool
+
+	// capability names the feature a client must have negotiated to be
+	// sent the frame, if any
+	capability string
+
+	// variants holds the same message in other codecs, keyed by subprotocol
+	variants map[string]outboundFrame
+
+	// adapted marks broadcasts whose stripped holds the message as sent to
+	// each content profile in use, keyed by profile
+	adapted  bool
+	stripped map[string]outboundFrame
+}
+
+// newFrame wraps a message for a single client
+func newFrame(data []byte) outboundFrame {
+	return outboundFrame{data: data}
+}
+
+// newPreparedFrame frames a message once for delivery to many clients
+func newPreparedFrame(data []byte) outboundFrame {
+	return newPreparedFrameOfType(websocket.TextMessage, data)
+}
+
+// newPreparedFrameOfType prepares a text or binary frame
+func newPreparedFrameOfType(frameType int, data []byte) outboundFrame {
+	prepared, err := websocket.NewPreparedMessage(frameType, data)
+	if err != nil {
+		log.Printf("Failed to prepare broadcast frame: %v", err)
+		return outboundFrame{data: data, frameType: frameType}
+	}
+	return outboundFrame{data: data, prepared: prepared, frameType: frameType}
+}
+
+// writeFrame writes a single message in the client's wire format, reusing
+// its prepared frame if any
+func (c *Client) writeFrame(frame outboundFrame) error {
+	frame, err := c.frameFor(frame)
+	if err != nil {
+		log.Printf("Failed to encode message for %s: %v", c.GetDisplayName(), err)
+		return nil
+	}
+	c.useCompression(len(frame.data))
+	if conn, ok := c.conn.(preparedTransport); ok && frame.prepared != nil {
+		return conn.WritePreparedMessage(frame.prepared)
+	}
+	frameType := frame.frameType
+	if frameType == 0 {
+		frameType = websocket.TextMessage
+	}
+	return c.conn.WriteMessage(frameType, frame.data)
+}
+
+// canBatch reports whether several messages can share one frame. Clients
+// that did not negotiate batching in hello expect one message per frame.
+func (c *Client) canBatch() bool {
+	return c.hasCapability(CapabilityBatching)
+}
+
+// writeBatch writes first and up to n further queued messages as one
+// newline-separated frame, adapting each to what the client negotiated.
+// It reports whether the send channel was closed while batching. Batches
+// are compressed whenever the client compresses.
+func (c *Client) writeBatch(first outboundFrame, n int) (closed bool, err error) {
+	c.useCompression(c.compressMinSize)
+	w, err := c.conn.NextWriter(websocket.TextMessage)
+	if err != nil {
+		return false, err
+	}
+	if _, err := w.Write(first.data); err != nil {
+		return false, err
+	}
+
+	for i := 0; i < n; i++ {
+		frame, ok := <-c.send
+		if !ok {
+			closed = true
+			break
+		}
+		if frame, ok = c.adapt(frame); !ok {
+			continue
+		}
+		if _, err := w.Write(frameSeparator); err != nil {
+			return false, err
+		}
+		if _, err := w.Write(frame.data); err != nil {
+			return false, err
+		}
+	}
+	return closed, w.Close()
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// splitFrame returns the messages batched into a received frame
+func splitFrame(data []byte) [][]byte {
+	return bytes.Split(data, frameSeparator)
+}
+
+// newWritePumpPair returns a server-side client whose WritePump has not been
+// started yet and the browser side of its connection
+func newWritePumpPair(t *testing.T) (*Client, *websocket.Conn) {
+	serverConns := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("Upgrade failed: %v", err)
+			return
+		}
+		serverConns <- conn
+	}))
+	t.Cleanup(server.Close)
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	browser, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	t.Cleanup(func() { browser.Close() })
+
+	select {
+	case conn := <-serverConns:
+		return NewClient(NewHub(), conn), browser
+	case <-time.After(time.Second):
+		t.Fatal("Server did not accept the connection")
+	}
+	return nil, nil
+}
+
+func TestNewPreparedFrame(t *testing.T) {
+	frame := newPreparedFrame([]byte(`{"type":"system"}`))
+	if frame.prepared == nil {
+		t.Error("Expected broadcast frame to be prepared")
+	}
+	if string(frame.data) != `{"type":"system"}` {
+		t.Errorf("Expected raw data to be kept, got %s", frame.data)
+	}
+	if newFrame([]byte("x")).prepared != nil {
+		t.Error("Single-client frames should not be prepared")
+	}
+}
+
+func TestWritePump_WritesPreparedFrame(t *testing.T) {
+	client, browser := newWritePumpPair(t)
+	go client.WritePump()
+
+	client.send <- newPreparedFrame([]byte(`{"type":"system","content":"hi"}`))
+
+	browser.SetReadDeadline(time.Now().Add(time.Second))
+	_, data, err := browser.ReadMessage()
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if string(data) != `{"type":"system","content":"hi"}` {
+		t.Errorf("Unexpected frame %s", data)
+	}
+}
+
+// negotiateBatching marks a client as having asked for batching in hello
+func negotiateBatching(client *Client) {
+	client.protocol.version = protocolVersion
+	client.protocol.capabilities = map[string]bool{CapabilityBatching: true}
+}
+
+func TestWritePump_OneMessagePerFrameByDefault(t *testing.T) {
+	client, browser := newWritePumpPair(t)
+
+	// Clients that did not negotiate batching get queued messages one per
+	// frame, as before batching existed
+	client.send <- newPreparedFrame([]byte(`{"n":1}`))
+	client.send <- newFrame([]byte(`{"n":2}`))
+	go client.WritePump()
+
+	for _, want := range []string{`{"n":1}`, `{"n":2}`} {
+		browser.SetReadDeadline(time.Now().Add(time.Second))
+		_, data, err := browser.ReadMessage()
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		if string(data) != want {
+			t.Errorf("Expected frame %s, got %q", want, data)
+		}
+	}
+}
+
+func TestWritePump_BatchesQueuedFrames(t *testing.T) {
+	client, browser := newWritePumpPair(t)
+	negotiateBatching(client)
+
+	// Queue several messages before the pump starts so they are all waiting
+	client.send <- newPreparedFrame([]byte(`{"n":1}`))
+	client.send <- newFrame([]byte(`{"n":2}`))
+	client.send <- newFrame([]byte(`{"n":3}`))
+	go client.WritePump()
+
+	browser.SetReadDeadline(time.Now().Add(time.Second))
+	_, data, err := browser.ReadMessage()
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	messages := splitFrame(data)
+	if len(messages) != 3 {
+		t.Fatalf("Expected 3 messages in one frame, got %q", data)
+	}
+	for i, want := range []string{`{"n":1}`, `{"n":2}`, `{"n":3}`} {
+		if string(messages[i]) != want {
+			t.Errorf("Message %d: expected %s, got %s", i, want, messages[i])
+		}
+	}
+}
+
+func TestWritePump_ClosedWhileBatching(t *testing.T) {
+	client, browser := newWritePumpPair(t)
+	negotiateBatching(client)
+
+	client.send <- newFrame([]byte(`{"n":1}`))
+	client.send <- newFrame([]byte(`{"n":2}`))
+	close(client.send)
+	go client.WritePump()
+
+	browser.SetReadDeadline(time.Now().Add(time.Second))
+	_, data, err := browser.ReadMessage()
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if len(splitFrame(data)) != 2 {
+		t.Errorf("Expected queued messages to be flushed before closing, got %q", data)
+	}
+
+	if _, _, err := browser.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNoStatusReceived, websocket.CloseNormalClosure) {
+		t.Errorf("Expected close frame after the batch, got %v", err)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// chatHarness runs a hub whose clients are connected over in-memory pipes.
+// The hub, its clients and their connection deadlines all follow a fake
+// clock.
+type chatHarness struct {
+	t     *testing.T
+	hub   *Hub
+	clock *FakeClock
+}
+
+// newChatHarness starts a hub that is stopped when the test ends
+func newChatHarness(t *testing.T) *chatHarness {
+	clock := NewFakeClock(time.Unix(1700000000, 0))
+	hub := NewHub()
+	hub.SetClock(clock)
+	go hub.Run()
+	t.Cleanup(hub.Stop)
+	return &chatHarness{t: t, hub: hub, clock: clock}
+}
+
+// fakeClient is the far end of a harness connection. It records every
+// message the server sends it.
+type fakeClient struct {
+	t    *testing.T
+	conn *PipeConn
+	name string
+
+	// capabilities the client asks for in its hellos
+	capabilities []string
+
+	mu       sync.Mutex
+	messages []Message
+	changed  chan struct{}
+	done     chan struct{}
+}
+
+// connect attaches a new client to the hub without joining. It says hello
+// with every capability that adds message types or fields, but one message
+// per frame and full user lists as before hello existed.
+func (h *chatHarness) connect() *fakeClient {
+	fake := h.connectLegacy()
+	fake.capabilities = contentCapabilities
+	fake.hello()
+	return fake
+}
+
+// connectLegacy attaches a new client that never says hello
+func (h *chatHarness) connectLegacy() *fakeClient {
+	serverEnd, clientEnd := NewPipe(h.clock)
+	client := NewClient(h.hub, serverEnd)
+	serveClient(client)
+
+	fake := &fakeClient{
+		t:       h.t,
+		conn:    clientEnd,
+		changed: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	h.t.Cleanup(func() { clientEnd.Close() })
+	go fake.readLoop()
+	return fake
+}
+
+// join connects a client and waits until it is in the chat
+func (h *chatHarness) join(name string) *fakeClient {
+	fake := h.connect()
+	fake.name = name
+	fake.send(Message{Type: MessageTypeJoin, Content: name})
+	fake.waitFor(func(m Message) bool { return m.Type == MessageTypeUserList && contains(m.Users, name) })
+	return fake
+}
+
+// Clients joining at once in joinMany. Every join is announced to everyone,
+// so a wave must fit in the send buffers of the clients already there.
+const harnessJoinWave = 25
+
+// joinMany connects n clients named prefix-0 to prefix-(n-1), joining them
+// in concurrent waves, and waits until every one sees the complete user list
+func (h *chatHarness) joinMany(prefix string, n int) []*fakeClient {
+	clients := make([]*fakeClient, n)
+	for start := 0; start < n; start += harnessJoinWave {
+		wave := clients[start:]
+		if len(wave) > harnessJoinWave {
+			wave = wave[:harnessJoinWave]
+		}
+		for i := range wave {
+			wave[i] = h.connect()
+			wave[i].name = fmt.Sprintf("%s-%d", prefix, start+i)
+			wave[i].send(Message{Type: MessageTypeJoin, Content: wave[i].name})
+		}
+		for _, client := range wave {
+			name := client.name
+			client.waitFor(func(m Message) bool { return m.Type == MessageTypeUserList && contains(m.Users, name) })
+		}
+	}
+	for _, client := range clients {
+		client.waitFor(func(m Message) bool { return m.Type == MessageTypeUserList && len(m.Users) == n })
+	}
+	return clients
+}
+
+// readLoop records messages until the connection ends
+func (c *fakeClient) readLoop() {
+	defer close(c.done)
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		c.mu.Lock()
+		for _, messageData := range splitFrame(data) {
+			var message Message
+			if json.Unmarshal(messageData, &message) == nil {
+				c.messages = append(c.messages, message)
+			}
+		}
+		c.mu.Unlock()
+		select {
+		case c.changed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// send writes a message to the server
+func (c *fakeClient) send(message Message) {
+	data, _ := json.Marshal(message)
+	if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		c.t.Fatalf("%s: write failed: %v", c.name, err)
+	}
+}
+
+// count returns how many received messages match
+func (c *fakeClient) count(match func(Message) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, message := range c.messages {
+		if match(message) {
+			n++
+		}
+	}
+	return n
+}
+
+// waitFor blocks until a matching message arrives
+func (c *fakeClient) waitFor(match func(Message) bool) {
+	c.t.Helper()
+	c.waitForN(match, 1)
+}
+
+// waitForN blocks until n matching messages have arrived, failing the test
+// after a generous real-time limit
+func (c *fakeClient) waitForN(match func(Message) bool, n int) {
+	c.t.Helper()
+	limit := time.After(5 * time.Second)
+	for c.count(match) < n {
+		select {
+		case <-c.changed:
+		case <-c.done:
+			if c.count(match) < n {
+				c.t.Fatalf("%s: connection ended while waiting", c.name)
+			}
+		case <-limit:
+			c.t.Fatalf("%s: timed out waiting for message", c.name)
+		}
+	}
+}
+
+// hello negotiates the client's capabilities and waits for the reply
+func (c *fakeClient) hello() {
+	c.t.Helper()
+	isHello := func(m Message) bool { return m.Type == MessageTypeHello }
+	before := c.count(isHello)
+	c.send(Message{Type: MessageTypeHello, Version: protocolVersion, Capabilities: c.capabilities})
+	c.waitForN(isHello, before+1)
+}
+
+// keepAlive sends a pong, extending the server's read deadline, and waits
+// for the reply to a hello behind it so the pong is known to be handled
+// before the clock moves
+func (c *fakeClient) keepAlive() {
+	c.t.Helper()
+	c.conn.WriteMessage(websocket.PongMessage, nil)
+	c.hello()
+}
+
+// disconnected waits for the server to end the connection
+func (c *fakeClient) disconnected() bool {
+	select {
+	case <-c.done:
+		return true
+	case <-time.After(5 * time.Second):
+		return false
+	}
+}
+
+func TestHarness_HundredsOfClients(t *testing.T) {
+	h := newChatHarness(t)
+	clients := h.joinMany("user", 200)
+
+	if count := h.hub.GetClientCount(); count != 200 {
+		t.Fatalf("Expected 200 clients, got %d", count)
+	}
+
+	clients[0].send(Message{Type: MessageTypeChat, From: "user-0", Content: "hello everyone"})
+	greeting := func(m Message) bool { return m.Type == MessageTypeChat && m.Content == "hello everyone" }
+	for _, client := range clients {
+		client.waitFor(greeting)
+	}
+	for _, client := range clients {
+		if n := client.count(greeting); n != 1 {
+			t.Errorf("%s received the broadcast %d times", client.name, n)
+		}
+	}
+
+	clients[1].send(Message{Type: MessageTypePrivate, From: "user-1", To: "user-199", Content: "psst"})
+	clients[199].waitFor(func(m Message) bool { return m.Type == MessageTypePrivate && m.From == "user-1" })
+	for _, client := range clients[2:199] {
+		if client.count(func(m Message) bool { return m.Type == MessageTypePrivate }) != 0 {
+			t.Fatalf("%s saw a private message meant for someone else", client.name)
+		}
+	}
+}
+
+func TestHarness_SilentClientsTimeOutOnFakeClock(t *testing.T) {
+	h := newChatHarness(t)
+	alive := h.join("Alive")
+	silent := h.join("Silent")
+
+	alive.keepAlive()
+	h.clock.Advance(pongWait * 2 / 3)
+	alive.keepAlive()
+	h.clock.Advance(pongWait * 2 / 3)
+
+	if !silent.disconnected() {
+		t.Fatal("Expected the silent client to time out")
+	}
+	alive.waitFor(func(m Message) bool { return m.Type == MessageTypeSystem && m.Content == "Silent has left the chat" })
+
+	select {
+	case <-alive.done:
+		t.Error("Expected the client sending pongs to stay connected")
+	default:
+	}
+	if count := h.hub.GetClientCount(); count != 1 {
+		t.Errorf("Expected 1 client, got %d", count)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"log"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrRejectSilently rejects a connection, join or message without telling
+// the client why, for hooks that drop quietly or tell the client themselves
+var ErrRejectSilently = errors.New("rejected")
+
+// errHookPanicked is reported in place of a hook that panicked
+var errHookPanicked = errors.New("Internal server error")
+
+// JoinContext is a request to join the chat passing through the join
+// hooks. Hooks may change the name the client joins under.
+type JoinContext struct {
+	Client *Client
+	Name   string
+
+	// Token is the bot account token the client joined with, and Bot is
+	// set once it has been checked
+	Token string
+	Bot   bool
+}
+
+// MessageContext is a message from a client passing through the message
+// hooks. Hooks may change the message.
+type MessageContext struct {
+	Client  *Client
+	Message *Message
+
+	// Shadow shows the message to its sender only, who is not told it was
+	// not delivered
+	Shadow bool
+}
+
+// Plugin is a named set of hooks into the life of clients and their
+// messages. Any hook may be nil.
+//
+// Hooks of each kind run in order: first the built-in checks, then plugins
+// in the order they were registered, then the built-in sanitizer, which
+// HTML-escapes what the hooks before it produced. The first hook to return
+// an error stops the chain. Its text is sent to the client as an error
+// message, unless it is ErrRejectSilently. A hook that panics rejects with
+// a generic error.
+type Plugin struct {
+	Name string
+
+	// OnConnect runs when a client connects, before it can send anything.
+	// An error closes the connection, with the error's text as the close
+	// reason.
+	OnConnect func(c *Client) error
+
+	// OnJoin runs when a client asks to join. An error refuses the join.
+	OnJoin func(join *JoinContext) error
+
+	// BeforeMessage runs for every message a client sends, before it is
+	// handled. An error rejects the message.
+	BeforeMessage func(ctx *MessageContext) error
+
+	// AfterBroadcast runs once a chat, private or group message has been
+	// handed on for delivery. It does not run for shadowed messages.
+	AfterBroadcast func(ctx *MessageContext)
+
+	// OnLeave runs when the connection of a client that got past OnConnect
+	// ends. The display name is empty if the client never joined.
+	OnLeave func(c *Client)
+}
+
+// RegisterPlugin adds a plugin whose hooks run after those registered
+// before it. It must be called before clients connect.
+func (h *Hub) RegisterPlugin(plugin Plugin) error {
+	if plugin.Name == "" {
+		return errors.New("plugin must have a name")
+	}
+	for _, existing := range h.hooks {
+		if existing.Name == plugin.Name {
+			return errors.New("plugin already registered: " + plugin.Name)
+		}
+	}
+	h.plugins = append(h.plugins, plugin)
+	h.hooks = hookChain(h.plugins)
+	return nil
+}
+
+// hookChain places registered plugins between the built-in checks and the
+// built-in sanitizer
+func hookChain(plugins []Plugin) []Plugin {
+	chain := append(builtinHooks(), plugins...)
+	return append(chain, sanitizeHooks())
+}
+
+// Plugins returns the names of the hub's plugins, built-in ones included,
+// in the order their hooks run
+func (h *Hub) Plugins() []string {
+	names := make([]string, len(h.hooks))
+	for i, plugin := range h.hooks {
+		names[i] = plugin.Name
+	}
+	return names
+}
+
+// callHook runs a hook, turning a panic into an error so one faulty plugin
+// cannot take a client down
+func callHook(plugin string, hook func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("[HOOK] %s panicked: %v", plugin, r)
+			err = errHookPanicked
+		}
+	}()
+	return hook()
+}
+
+// runConnectHooks runs the connect hooks, stopping at the first error
+func (c *Client) runConnectHooks() error {
+	for _, plugin := range c.hub.hooks {
+		if plugin.OnConnect == nil {
+			continue
+		}
+		if err := callHook(plugin.Name, func() error { return plugin.OnConnect(c) }); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runJoinHooks runs the join hooks, stopping at the first error
+func (c *Client) runJoinHooks(join *JoinContext) error {
+	for _, plugin := range c.hub.hooks {
+		if plugin.OnJoin == nil {
+			continue
+		}
+		if err := callHook(plugin.Name, func() error { return plugin.OnJoin(join) }); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runMessageHooks runs the message hooks, stopping at the first error
+func (c *Client) runMessageHooks(ctx *MessageContext) error {
+	for _, plugin := range c.hub.hooks {
+		if plugin.BeforeMessage == nil {
+			continue
+		}
+		if err := callHook(plugin.Name, func() error { return plugin.BeforeMessage(ctx) }); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runAfterBroadcastHooks runs every after-broadcast hook
+func (c *Client) runAfterBroadcastHooks(ctx *MessageContext) {
+	for _, plugin := range c.hub.hooks {
+		if plugin.AfterBroadcast == nil {
+			continue
+		}
+		callHook(plugin.Name, func() error {
+			plugin.AfterBroadcast(ctx)
+			return nil
+		})
+	}
+}
+
+// runLeaveHooks runs every leave hook
+func (c *Client) runLeaveHooks() {
+	for _, plugin := range c.hub.hooks {
+		if plugin.OnLeave == nil {
+			continue
+		}
+		callHook(plugin.Name, func() error {
+			plugin.OnLeave(c)
+			return nil
+		})
+	}
+}
+
+// reportRejection tells the client why a hook rejected what it sent
+func (c *Client) reportRejection(err error) {
+	if err != ErrRejectSilently {
+		c.sendError(err.Error())
+	}
+}
+
+// refuseConnection closes a connection a connect hook rejected
+func (c *Client) refuseConnection(err error) {
+	log.Printf("[HOOK] Refusing connection from %s: %v", c.remoteAddress(), err)
+	if err != ErrRejectSilently {
+		reason := err.Error()
+		// Close reasons must fit in a control frame
+		if len(reason) > 120 {
+			reason = reason[:120]
+		}
+		c.conn.SetWriteDeadline(c.now().Add(writeWait))
+		c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason))
+	}
+	c.conn.Close()
+	c.hub.releaseConnection(c)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestHub_RegisterPlugin(t *testing.T) {
+	hub := NewHub()
+	builtins := []string{"joinlimit", "validate", "activity", "membership", "ratelimit", "content", "filter", "spam", "stamp", "notify", "webhooks", "sanitize"}
+	if names := hub.Plugins(); !reflect.DeepEqual(names, builtins) {
+		t.Fatalf("Expected the built-in hooks %v, got %v", builtins, names)
+	}
+
+	for _, name := range []string{"first", "second"} {
+		if err := hub.RegisterPlugin(Plugin{Name: name}); err != nil {
+			t.Fatalf("Failed to register %s: %v", name, err)
+		}
+	}
+	want := append(append(append([]string(nil), builtins[:11]...), "first", "second"), "sanitize")
+	if names := hub.Plugins(); !reflect.DeepEqual(names, want) {
+		t.Errorf("Expected plugins between the checks and the sanitizer, got %v", names)
+	}
+
+	for _, name := range []string{"", "first", "sanitize"} {
+		if err := hub.RegisterPlugin(Plugin{Name: name}); err == nil {
+			t.Errorf("Expected plugin name %q to be refused", name)
+		}
+	}
+}
+
+func TestHooks_BeforeMessage(t *testing.T) {
+	h := newChatHarness(t)
+	seen := make(chan string, 10)
+	err := h.hub.RegisterPlugin(Plugin{
+		Name: "editor",
+		BeforeMessage: func(ctx *MessageContext) error {
+			if ctx.Message.Type != MessageTypeChat {
+				return nil
+			}
+			seen <- ctx.Message.Content
+			switch ctx.Message.Content {
+			case "forbidden":
+				return errors.New("That is not allowed here")
+			case "quiet":
+				return ErrRejectSilently
+			case "boom":
+				panic("plugin bug")
+			}
+			ctx.Message.Content = "<i>" + ctx.Message.Content + "</i>"
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients := h.joinMany("user", 2)
+	sender, reader := clients[0], clients[1]
+	isError := func(text string) func(Message) bool {
+		return func(m Message) bool { return m.Type == MessageTypeError && m.Error == text }
+	}
+
+	// Plugins see the raw content, and what they write is escaped
+	sender.send(Message{Type: MessageTypeChat, From: "user-0", Content: "<b>hi</b>"})
+	reader.waitFor(func(m Message) bool {
+		return m.Type == MessageTypeChat && m.Content == "&lt;i&gt;&lt;b&gt;hi&lt;/b&gt;&lt;/i&gt;"
+	})
+	if got := <-seen; got != "<b>hi</b>" {
+		t.Errorf("Expected the plugin to see raw content, got %q", got)
+	}
+
+	sender.send(Message{Type: MessageTypeChat, From: "user-0", Content: "forbidden"})
+	sender.waitFor(isError("That is not allowed here"))
+	sender.send(Message{Type: MessageTypeChat, From: "user-0", Content: "boom"})
+	sender.waitFor(isError("Internal server error"))
+	sender.send(Message{Type: MessageTypeChat, From: "user-0", Content: "quiet"})
+	sender.send(Message{Type: MessageTypeChat, From: "user-0", Content: "still here"})
+	reader.waitFor(func(m Message) bool { return m.Content == "&lt;i&gt;still here&lt;/i&gt;" })
+
+	isChat := func(m Message) bool { return m.Type == MessageTypeChat }
+	if n := reader.count(isChat); n != 2 {
+		t.Errorf("Expected only the 2 accepted messages to be delivered, got %d", n)
+	}
+	if n := sender.count(func(m Message) bool { return m.Type == MessageTypeError }); n != 2 {
+		t.Errorf("Expected no error for the silent rejection, got %d errors", n)
+	}
+
+	// Built-in checks run before plugins
+	stranger := h.connect()
+	stranger.send(Message{Type: MessageTypeChat, From: "nobody", Content: "unjoined"})
+	stranger.waitFor(isError("Must join chat before sending messages"))
+	close(seen)
+	for content := range seen {
+		if content == "unjoined" {
+			t.Error("Expected the plugin not to see messages the built-in checks refused")
+		}
+	}
+}
+
+func TestHooks_ConnectAndJoin(t *testing.T) {
+	h := newChatHarness(t)
+	open := true
+	err := h.hub.RegisterPlugin(Plugin{
+		Name: "gatekeeper",
+		OnConnect: func(c *Client) error {
+			if !open {
+				return errors.New("Closed for maintenance")
+			}
+			return nil
+		},
+		OnJoin: func(join *JoinContext) error {
+			if strings.EqualFold(join.Name, "admin") {
+				return errors.New("Display name error: reserved")
+			}
+			join.Name = "guest-" + join.Name
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Joins can be renamed or refused
+	ann := h.connect()
+	ann.send(Message{Type: MessageTypeJoin, Content: "Ann"})
+	ann.waitFor(func(m Message) bool { return m.Type == MessageTypeUserList && contains(m.Users, "guest-Ann") })
+	ann.send(Message{Type: MessageTypeJoin, Content: "Admin"})
+	ann.waitFor(func(m Message) bool { return m.Type == MessageTypeError && m.Error == "Display name error: reserved" })
+
+	// Refused connections are closed with the hook's reason
+	open = false
+	serverEnd, clientEnd := NewPipe(h.clock)
+	serveClient(NewClient(h.hub, serverEnd))
+	_, _, err = clientEnd.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != websocket.ClosePolicyViolation || closeErr.Text != "Closed for maintenance" {
+		t.Errorf("Expected the connection to be closed with the hook's reason, got %v", err)
+	}
+}
+
+func TestHooks_AfterBroadcastAndLeave(t *testing.T) {
+	h := newChatHarness(t)
+	config := DefaultFilterConfig()
+	config.BannedWords = []string{"scam"}
+	config.BannedWordAction = FilterDrop
+	if err := h.hub.SetContentFilters(config); err != nil {
+		t.Fatal(err)
+	}
+	broadcasts := make(chan string, 10)
+	left := make(chan string, 10)
+	err := h.hub.RegisterPlugin(Plugin{
+		Name:           "audit",
+		AfterBroadcast: func(ctx *MessageContext) { broadcasts <- ctx.Message.Content },
+		OnLeave:        func(c *Client) { left <- c.GetDisplayName() },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients := h.joinMany("user", 2)
+
+	// Shadowed messages are never broadcast
+	clients[0].send(Message{Type: MessageTypeChat, From: "user-0", Content: "a scam"})
+	clients[0].waitFor(func(m Message) bool { return m.Content == "a scam" })
+	clients[0].send(Message{Type: MessageTypePrivate, From: "user-0", To: "user-1", Content: "hello"})
+	clients[1].waitFor(func(m Message) bool { return m.Type == MessageTypePrivate })
+	select {
+	case content := <-broadcasts:
+		if content != "hello" {
+			t.Errorf("Expected only the private message to be broadcast, got %q", content)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the after-broadcast hook to run")
+	}
+
+	clients[1].conn.Close()
+	select {
+	case name := <-left:
+		if name != "user-1" {
+			t.Errorf("Expected user-1 to leave, got %q", name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the leave hook to run")
+	}
+}
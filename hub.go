@@ -3,7 +3,10 @@ package main
 import (
 	"errors"
 	"log"
+	"net/netip"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -25,13 +28,28 @@ type PrivateMessageRequest struct {
 	Message Message
 }
 
+// outboundBroadcast is an encoded message queued for delivery to all clients
+type outboundBroadcast struct {
+	frame outboundFrame
+
+	// perUser replaces frame for specific display names
+	perUser map[string]outboundFrame
+}
+
 // Hub maintains the set of active clients and broadcasts messages to the clients
 type Hub struct {
 	// Registered clients
 	clients map[*Client]bool
 
-	// Inbound messages from the clients
-	broadcast chan []byte
+	// Shards owning the registered clients; broadcasts fan out in parallel
+	shards       []*hubShard
+	clientShards map[*Client]*hubShard
+	nextShard    int
+	clientsMu    sync.RWMutex
+	shardsOnce   sync.Once
+
+	// Serializes fan-out so broadcasts reach every shard in one order
+	fanOutMu sync.Mutex
 
 	// Register requests from the clients
 	register chan *Client
@@ -49,25 +67,128 @@ type Hub struct {
 	stop chan struct{}
 	
 	// Cleanup ticker for periodic maintenance
-	cleanupTicker *time.Ticker
+	cleanupTicker Ticker
+
+	// Clock for timestamps, idle tracking and presence leases
+	clock Clock
 	
 	// Private messaging support
 	privateMessage chan PrivateMessageRequest
 	clientsByName  map[string]*Client
+
+	// History of chat and private messages, used to resolve reactions
+	store *MessageStore
+
+	// Emoji accepted as reactions; nil allows any single grapheme cluster
+	allowedReactions map[string]bool
+
+	// Display names with moderator privileges
+	moderators map[string]bool
+
+	// Group conversations by ID
+	conversations      map[string]*Conversation
+	conversationsMu    sync.RWMutex
+	nextConversationID uint64
+
+	// Block lists: blocker -> set of blocked display names
+	blocks   map[string]map[string]bool
+	blocksMu sync.RWMutex
+
+	// Backplane connecting this hub to other server instances; nil when
+	// running as a single node
+	nodeID string
+	broker Broker
+
+	// Users connected to other nodes, kept alive by presence heartbeats
+	directory        *UserDirectory
+	presenceInterval time.Duration
+
+	// What to do with clients whose send buffer is full, and how often
+	// each action was taken
+	slowPolicy SlowConsumerPolicy
+	slowStats  slowConsumerStats
+
+	// permessage-deflate settings for new connections
+	compression CompressionConfig
+
+	// Per-client rate-limit budgets and penalties
+	rateLimits RateLimitConfig
+
+	// Per-address connection and join limits, and the proxies trusted to
+	// report client addresses
+	connLimits     *connectionLimiter
+	trustedProxies []netip.Prefix
+
+	// Filters applied to the content of chat, private and group messages
+	filters FilterChain
+
+	// Spam scoring weights, the senders scored and the escalations decided
+	// for review
+	spamConfig  SpamConfig
+	spamSenders *spamSenders
+	spamLog     *spamLog
+
+	// Registered plugins, and the hooks run for clients: built-in ones
+	// around the plugins'
+	plugins []Plugin
+	hooks   []Plugin
+
+	// Endpoints chat events are POSTed to, and the deliveries they failed
+	webhooks           []*webhook
+	webhookDeadLetters *webhookDeadLetterLog
+
+	// Incoming webhooks by token, through which external systems post as
+	// bots
+	incomingWebhooks map[string]*incomingWebhook
+
+	// Bot account tokens by name, and the budgets bots are held to
+	botAccounts   map[string]string
+	botRateLimits RateLimitConfig
+
+	// Registered clients per wire format and per content profile, guarded
+	// by clientsMu
+	codecsInUse   map[string]int
+	profilesInUse map[string]int
 }
 
-// NewHub creates a new Hub instance
+// NewHub creates a new Hub instance with one shard per CPU
 func NewHub() *Hub {
+	return NewShardedHub(defaultShardCount())
+}
+
+// NewShardedHub creates a new Hub instance whose clients are split across
+// the given number of shards
+func NewShardedHub(shards int) *Hub {
+	if shards < 1 {
+		shards = 1
+	}
 	hub := &Hub{
 		clients:        make(map[*Client]bool),
-		broadcast:      make(chan []byte),
+		clientShards:   make(map[*Client]*hubShard),
+		codecsInUse:    make(map[string]int),
+		profilesInUse:  make(map[string]int),
 		register:       make(chan *Client),
 		unregister:     make(chan *Client),
 		userList:       make(map[*Client]string),
 		stop:           make(chan struct{}),
-		cleanupTicker:  time.NewTicker(cleanupInterval),
+		cleanupTicker:  systemClock.NewTicker(cleanupInterval),
+		clock:          systemClock,
 		privateMessage: make(chan PrivateMessageRequest),
 		clientsByName:  make(map[string]*Client),
+		store:          NewMessageStore(defaultStoreLimit),
+		moderators:     make(map[string]bool),
+		conversations:  make(map[string]*Conversation),
+		blocks:         make(map[string]map[string]bool),
+		directory:        NewUserDirectory(defaultPresenceLease),
+		presenceInterval: defaultPresenceInterval,
+		rateLimits:       DefaultRateLimitConfig(),
+		botRateLimits:    DefaultBotRateLimitConfig(),
+		connLimits:       newConnectionLimiter(DefaultConnectionLimitConfig()),
+		hooks:            hookChain(nil),
+	}
+	hub.shards = make([]*hubShard, shards)
+	for i := range hub.shards {
+		hub.shards[i] = newHubShard(hub)
 	}
 	return hub
 }
@@ -82,6 +203,8 @@ func (h *Hub) Run() {
 			go h.Run()
 		}
 	}()
+	
+	h.startShards()
 
 	for {
 		select {
@@ -90,9 +213,14 @@ func (h *Hub) Run() {
 			log.Println("Hub stopping...")
 			h.cleanupTicker.Stop()
 			return
-		case <-h.cleanupTicker.C:
-			// Periodic cleanup of idle connections
+		case <-h.cleanupTicker.C():
+			// Periodic cleanup of idle connections, stale attempt counts and
+			// forgiven spam senders
 			h.cleanupIdleConnections()
+			h.connLimits.prune(h.now())
+			if h.spamSenders != nil {
+				h.spamSenders.prune(h.spamConfig, h.now())
+			}
 		case req := <-h.privateMessage:
 			func() {
 				defer func() {
@@ -114,31 +242,7 @@ func (h *Hub) Run() {
 						req.From, req.To, err.Error())
 					
 					// Send error message back to sender if routing fails
-					sender, ok := h.GetClientByName(req.From)
-					if ok {
-						errorMsg := &Message{
-							Type:  MessageTypeError,
-							Error: "Failed to send private message: " + err.Error(),
-						}
-						errorMsg.SetTimestamp()
-						errorData, jsonErr := errorMsg.ToJSON()
-						if jsonErr == nil {
-							select {
-							case sender.send <- errorData:
-								log.Printf("[PRIVATE_MSG] Error notification sent: from=%s to=%s", 
-									req.From, req.To)
-							default:
-								log.Printf("[PRIVATE_MSG] Error notification failed: from=%s to=%s reason=channel_full", 
-									req.From, req.To)
-							}
-						} else {
-							log.Printf("[PRIVATE_MSG] Error message marshal failed: from=%s to=%s error=%v", 
-								req.From, req.To, jsonErr)
-						}
-					} else {
-						log.Printf("[PRIVATE_MSG] Sender not found for error notification: from=%s to=%s", 
-							req.From, req.To)
-					}
+					h.notifyPrivateFailure(req.From, req.To, err)
 				}
 			}()
 		case client := <-h.register:
@@ -148,7 +252,7 @@ func (h *Hub) Run() {
 						log.Printf("Client registration panic recovered: %v", r)
 					}
 				}()
-				h.clients[client] = true
+				h.assignShard(client)
 				log.Printf("Client registered: %s", client.GetDisplayName())
 			}()
 
@@ -159,19 +263,8 @@ func (h *Hub) Run() {
 						log.Printf("Client unregistration panic recovered: %v", r)
 					}
 				}()
-				if _, ok := h.clients[client]; ok {
-					delete(h.clients, client)
-					
-					// Safely close the send channel
-					func() {
-						defer func() {
-							if r := recover(); r != nil {
-								log.Printf("Error closing client send channel: %v", r)
-							}
-						}()
-						close(client.send)
-					}()
-					
+				// The client's shard closes its send channel
+				if h.releaseShard(client) {
 					// Remove from user list and clientsByName map
 					h.mu.Lock()
 					displayName := h.userList[client]
@@ -179,7 +272,16 @@ func (h *Hub) Run() {
 					delete(h.clientsByName, displayName)
 					h.mu.Unlock()
 					
-					log.Printf("Client unregistered: %s", displayName)
+					log.Printf("Client unregistered: %s from %s", displayName, client.remoteAddress())
+					
+					// Drop the user from group conversations, forget their
+					// block list and tell other nodes and webhooks
+					if displayName != "" {
+						h.leaveAllConversations(displayName)
+						h.clearBlocks(displayName)
+						h.publishPresence(displayName, presenceLeave)
+						h.emitWebhook(WebhookPayload{Event: WebhookEventLeave, User: displayName})
+					}
 					
 					// Broadcast system message about user leaving
 					if displayName != "" {
@@ -187,7 +289,7 @@ func (h *Hub) Run() {
 							Type:    MessageTypeSystem,
 							Content: displayName + " has left the chat",
 						}
-						systemMsg.SetTimestamp()
+						systemMsg.SetTimestampAt(h.now())
 						h.BroadcastMessage(*systemMsg)
 					}
 					
@@ -196,36 +298,6 @@ func (h *Hub) Run() {
 				}
 			}()
 
-		case message := <-h.broadcast:
-			func() {
-				defer func() {
-					if r := recover(); r != nil {
-						log.Printf("Message broadcast panic recovered: %v", r)
-					}
-				}()
-				// Broadcast message to all clients
-				for client := range h.clients {
-					select {
-					case client.send <- message:
-					default:
-						// Client send channel is full or closed, clean up
-						func() {
-							defer func() {
-								if r := recover(); r != nil {
-									log.Printf("Error cleaning up client during broadcast: %v", r)
-								}
-							}()
-							close(client.send)
-							delete(h.clients, client)
-							h.mu.Lock()
-							displayName := h.userList[client]
-							delete(h.userList, client)
-							delete(h.clientsByName, displayName)
-							h.mu.Unlock()
-						}()
-					}
-				}
-			}()
 		}
 	}
 }
@@ -237,6 +309,13 @@ func (h *Hub) UpdateClientName(client *Client, name string) {
 	h.clientsByName[name] = client
 }
 
+// displayNameOf returns the display name a client registered with
+func (h *Hub) displayNameOf(client *Client) string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.userList[client]
+}
+
 // GetClientByName retrieves a client by display name
 func (h *Hub) GetClientByName(name string) (*Client, bool) {
 	h.mu.RLock()
@@ -245,23 +324,51 @@ func (h *Hub) GetClientByName(name string) (*Client, bool) {
 	return client, ok
 }
 
+// SetModerators replaces the set of display names with moderator privileges
+func (h *Hub) SetModerators(names []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.moderators = make(map[string]bool, len(names))
+	for _, name := range names {
+		if name = strings.TrimSpace(name); name != "" {
+			h.moderators[name] = true
+		}
+	}
+}
+
+// IsModerator reports whether a display name has moderator privileges
+func (h *Hub) IsModerator(name string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.moderators[name]
+}
+
 // SendPrivateMessage routes a private message to a specific user
 func (h *Hub) SendPrivateMessage(from, to string, message Message) error {
 	// Log private message routing attempt
 	log.Printf("[PRIVATE_MSG] Routing attempt: from=%s to=%s content_length=%d", 
 		from, to, len(message.Content))
 	
-	// Validate recipient exists
+	// Validate recipient exists, locally or on another node
 	recipient, ok := h.GetClientByName(to)
-	if !ok {
+	node, remote := h.LocateUser(to)
+	if !ok && !remote {
 		// Log recipient lookup failure with context
 		log.Printf("[PRIVATE_MSG] Recipient lookup failed: from=%s to=%s error=recipient_not_found", 
 			from, to)
 		return errors.New("recipient not found or offline")
 	}
 	
-	// Get sender for echo
-	sender, senderExists := h.GetClientByName(from)
+	// Blocked senders get the same neutral error as for offline recipients
+	if ok && h.IsBlocked(to, from) {
+		log.Printf("[PRIVATE_MSG] Delivery refused: from=%s to=%s reason=blocked", 
+			from, to)
+		return errors.New("recipient not found or offline")
+	}
+	
+	// The ID is assigned now so both copies carry it, but the message is
+	// only recorded once delivered
+	h.store.AssignID(&message)
 	
 	// Convert message to JSON
 	jsonData, err := message.ToJSON()
@@ -272,37 +379,116 @@ func (h *Hub) SendPrivateMessage(from, to string, message Message) error {
 		return err
 	}
 	
+	if !ok {
+		// Recipient is connected to another node, which reports back
+		// whether it delivered the message before it is echoed
+		h.publish(BrokerEvent{Kind: BrokerEventPrivate, Target: node, To: to, Message: message})
+		log.Printf("[PRIVATE_MSG] Forwarded to remote node: from=%s to=%s node=%s content_length=%d", 
+			from, to, node, len(message.Content))
+		return nil
+	}
+	
 	// Send message to recipient with error handling for closed channels
-	select {
-	case recipient.send <- jsonData:
+	if h.deliver(recipient, newFrame(jsonData)) {
 		// Log successful delivery with context
 		log.Printf("[PRIVATE_MSG] Delivered successfully: from=%s to=%s content_length=%d", 
 			from, to, len(message.Content))
-	default:
+	} else {
 		// Log delivery failure with context
 		log.Printf("[PRIVATE_MSG] Delivery failed: from=%s to=%s error=channel_full_or_closed", 
 			from, to)
 		return errors.New("failed to deliver message to recipient")
 	}
 	
+	h.confirmPrivateMessage(from, to, message, jsonData)
+	return nil
+}
+
+// confirmPrivateMessage records a delivered private message, echoes it to
+// its sender and notifies thread participants
+func (h *Hub) confirmPrivateMessage(from, to string, message Message, jsonData []byte) {
+	// Record the message so it can be referenced by reactions and replies
+	h.store.Insert(message)
+	
 	// Send echo copy to sender if sender exists
-	if senderExists {
-		select {
-		case sender.send <- jsonData:
+	if sender, ok := h.GetClientByName(from); ok {
+		if h.deliver(sender, newFrame(jsonData)) {
 			// Log successful echo with context
 			log.Printf("[PRIVATE_MSG] Echo sent: from=%s to=%s", from, to)
-		default:
+		} else {
 			// Log echo failure (non-critical) with context
 			log.Printf("[PRIVATE_MSG] Echo failed (non-critical): from=%s to=%s error=channel_full_or_closed", 
 				from, to)
 			// Don't return error for echo failure - message was delivered to recipient
 		}
+
+		// Senders that asked for receipts are told the message was delivered
+		receipt := &Message{Type: MessageTypeReceipt, MessageID: message.ID, To: to}
+		receipt.SetTimestampAt(h.now())
+		if receiptData, err := receipt.ToJSON(); err == nil {
+			h.deliver(sender, outboundFrame{data: receiptData, capability: CapabilityReceipts})
+		}
 	} else {
 		// Log sender not found for echo
 		log.Printf("[PRIVATE_MSG] Echo skipped: from=%s to=%s reason=sender_not_found", 
 			from, to)
 	}
 	
+	// Notify thread participants about the reply
+	h.notifyThread(message)
+}
+
+// notifyPrivateFailure tells the sender of a private message why it was not
+// delivered
+func (h *Hub) notifyPrivateFailure(from, to string, err error) {
+	sender, ok := h.GetClientByName(from)
+	if !ok {
+		log.Printf("[PRIVATE_MSG] Sender not found for error notification: from=%s to=%s", 
+			from, to)
+		return
+	}
+	errorMsg := &Message{
+		Type:  MessageTypeError,
+		Error: "Failed to send private message: " + err.Error(),
+	}
+	errorMsg.SetTimestampAt(h.now())
+	errorData, jsonErr := errorMsg.ToJSON()
+	if jsonErr != nil {
+		log.Printf("[PRIVATE_MSG] Error message marshal failed: from=%s to=%s error=%v", 
+			from, to, jsonErr)
+		return
+	}
+	if h.deliver(sender, newFrame(errorData)) {
+		log.Printf("[PRIVATE_MSG] Error notification sent: from=%s to=%s", 
+			from, to)
+	} else {
+		log.Printf("[PRIVATE_MSG] Error notification failed: from=%s to=%s reason=channel_full", 
+			from, to)
+	}
+}
+
+// deliverPrivateLocal delivers a private message forwarded by another node to
+// a recipient connected to this node. Blocked senders get the same neutral
+// error as for local messages.
+func (h *Hub) deliverPrivateLocal(from, to string, message Message) error {
+	recipient, ok := h.GetClientByName(to)
+	if !ok {
+		return errors.New("recipient not found or offline")
+	}
+	if h.IsBlocked(to, from) {
+		log.Printf("[PRIVATE_MSG] Remote delivery refused: from=%s to=%s reason=blocked", from, to)
+		return errors.New("recipient not found or offline")
+	}
+
+	jsonData, err := message.ToJSON()
+	if err != nil {
+		return err
+	}
+	if !h.deliver(recipient, newFrame(jsonData)) {
+		return errors.New("failed to deliver message to recipient")
+	}
+	h.recordRemote(message)
+	log.Printf("[PRIVATE_MSG] Delivered from remote node: from=%s to=%s", from, to)
 	return nil
 }
 
@@ -316,23 +502,23 @@ func (h *Hub) RegisterClient(client *Client, displayName string) {
 	// Update clientsByName mapping
 	h.UpdateClientName(client, displayName)
 	
-	// Register the client
-	h.register <- client
+	// Hand the client to its shard now, so it is there before the
+	// announcements below are fanned out
+	h.assignShard(client)
+	log.Printf("Client registered: %s from %s", displayName, client.remoteAddress())
 	
-	// Give a small delay to ensure registration is processed
-	time.Sleep(50 * time.Millisecond)
+	// Announce the user to other nodes and webhooks
+	h.publishPresence(displayName, presenceJoin)
+	h.emitWebhook(WebhookPayload{Event: WebhookEventJoin, User: displayName})
 	
 	// Broadcast system message about user joining
 	systemMsg := &Message{
 		Type:    MessageTypeSystem,
 		Content: displayName + " has joined the chat",
 	}
-	systemMsg.SetTimestamp()
+	systemMsg.SetTimestampAt(h.now())
 	h.BroadcastMessage(*systemMsg)
 	
-	// Give another small delay before broadcasting user list
-	time.Sleep(10 * time.Millisecond)
-	
 	// Broadcast updated user list to all clients
 	h.BroadcastUserList()
 }
@@ -342,53 +528,79 @@ func (h *Hub) UnregisterClient(client *Client) {
 	h.unregister <- client
 }
 
-// BroadcastMessage sends a message to all connected clients
+// BroadcastMessage sends a message to all connected clients, including those
+// on other nodes. User lists are built per node and never forwarded.
 func (h *Hub) BroadcastMessage(message Message) {
-	// Convert message to JSON
-	jsonData, err := message.ToJSON()
+	if message.Type != MessageTypeUserList {
+		h.publish(BrokerEvent{Kind: BrokerEventBroadcast, Message: message})
+	}
+	h.broadcastLocal(message)
+}
+
+// broadcastLocal sends a message to the clients connected to this node
+func (h *Hub) broadcastLocal(message Message) {
+	// Frame the message once per codec for every recipient
+	frame, err := h.encodeBroadcast(&message)
 	if err != nil {
 		log.Printf("Error converting message to JSON: %v", err)
 		return
 	}
+	outbound := outboundBroadcast{frame: frame}
+	
+	// Flag public messages for users who blocked the sender
+	if message.Type == MessageTypeChat && message.From != "" {
+		if blockers := h.blockersOf(message.From); len(blockers) > 0 {
+			message.Blocked = true
+			if flaggedFrame, err := h.encodeBroadcast(&message); err == nil {
+				outbound.perUser = make(map[string]outboundFrame, len(blockers))
+				for _, blocker := range blockers {
+					outbound.perUser[blocker] = flaggedFrame
+				}
+			}
+		}
+	}
 	
-	// Send to broadcast channel
-	h.broadcast <- jsonData
+	// Hand straight to the shards so broadcasting never waits on Run
+	h.fanOut(outbound)
 }
 
 // BroadcastUserList sends the current list of online users to all clients
 func (h *Hub) BroadcastUserList() {
-	h.mu.RLock()
-	users := make([]string, 0, len(h.userList))
-	for _, displayName := range h.userList {
-		users = append(users, displayName)
-	}
-	h.mu.RUnlock()
+	users := h.GetConnectedUsers()
 	
 	// Create user list message
 	userListMsg := &Message{
 		Type:  MessageTypeUserList,
 		Users: users,
+		Bots:  h.botsAmong(users),
 	}
-	userListMsg.SetTimestamp()
+	userListMsg.SetTimestampAt(h.now())
 	
 	// Broadcast the user list
 	h.BroadcastMessage(*userListMsg)
 }
 
-// GetConnectedUsers returns a slice of currently connected user display names
+// GetConnectedUsers returns a slice of currently connected user display names,
+// including users connected to other nodes
 func (h *Hub) GetConnectedUsers() []string {
-	h.mu.RLock()
-	defer h.mu.RUnlock()
+	users := h.localUsers()
 	
-	users := make([]string, 0, len(h.userList))
-	for _, displayName := range h.userList {
-		users = append(users, displayName)
+	seen := make(map[string]bool, len(users))
+	for _, displayName := range users {
+		seen[displayName] = true
+	}
+	for _, displayName := range h.remoteUserNames() {
+		if !seen[displayName] {
+			users = append(users, displayName)
+		}
 	}
 	return users
 }
 
 // GetClientCount returns the number of currently connected clients
 func (h *Hub) GetClientCount() int {
+	h.clientsMu.RLock()
+	defer h.clientsMu.RUnlock()
 	return len(h.clients)
 }
 
@@ -402,22 +614,30 @@ func (h *Hub) Stop() {
 
 // cleanupIdleConnections removes idle connections to free up resources
 func (h *Hub) cleanupIdleConnections() {
-	now := time.Now()
+	now := h.now()
 	idleClients := make([]*Client, 0)
 	
 	// Find idle clients
+	h.clientsMu.RLock()
 	for client := range h.clients {
 		if now.Sub(client.GetLastActivity()) > idleTimeout {
 			idleClients = append(idleClients, client)
 		}
 	}
+	h.clientsMu.RUnlock()
 	
-	// Remove idle clients
+	// Remove idle clients. This runs on the hub goroutine, which also
+	// serves unregister, so they leave through it asynchronously; the
+	// shard closes their send channels and WritePump the connections.
 	for _, client := range idleClients {
 		log.Printf("Removing idle client: %s (idle for %v)", 
 			client.GetDisplayName(), now.Sub(client.GetLastActivity()))
-		h.UnregisterClient(client)
-		client.Close()
+		go func(client *Client) {
+			select {
+			case h.unregister <- client:
+			case <-h.stop:
+			}
+		}(client)
 	}
 	
 	if len(idleClients) > 0 {
@@ -427,15 +647,17 @@ func (h *Hub) cleanupIdleConnections() {
 
 // CanAcceptNewConnection checks if the hub can accept a new connection
 func (h *Hub) CanAcceptNewConnection() bool {
-	return len(h.clients) < maxConcurrentConnections
+	return h.GetClientCount() < maxConcurrentConnections
 }
 
 // GetConnectionStats returns connection statistics for monitoring
 func (h *Hub) GetConnectionStats() map[string]interface{} {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
+	h.clientsMu.RLock()
+	defer h.clientsMu.RUnlock()
 	
-	now := time.Now()
+	now := h.now()
 	activeConnections := 0
 	idleConnections := 0
 	
@@ -452,6 +674,14 @@ func (h *Hub) GetConnectionStats() map[string]interface{} {
 		"active_connections": activeConnections,
 		"idle_connections":   idleConnections,
 		"max_connections":    maxConcurrentConnections,
+		"shards":             len(h.shards),
+		
+		"slow_consumer_policy":         h.slowPolicy.String(),
+		"slow_consumer_disconnects":    atomic.LoadInt64(&h.slowStats.disconnects),
+		"slow_consumer_dropped_oldest": atomic.LoadInt64(&h.slowStats.droppedOldest),
+		"slow_consumer_dropped_newest": atomic.LoadInt64(&h.slowStats.droppedNewest),
+		"slow_consumer_coalesced":      atomic.LoadInt64(&h.slowStats.coalesced),
+		"connections_rejected":         atomic.LoadInt64(&h.connLimits.rejected),
 		"users_online":       len(h.userList),
 	}
 }
\ No newline at end of file
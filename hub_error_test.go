@@ -20,7 +20,7 @@ func TestHubPanicRecovery(t *testing.T) {
 	mockClient := &Client{
 		hub:         hub,
 		conn:        nil, // This will cause issues
-		send:        make(chan []byte, 1),
+		send:        make(chan outboundFrame, 1),
 		displayName: "test-user",
 	}
 	
@@ -34,7 +34,7 @@ func TestHubPanicRecovery(t *testing.T) {
 	normalClient := &Client{
 		hub:         hub,
 		conn:        nil,
-		send:        make(chan []byte, 1),
+		send:        make(chan outboundFrame, 1),
 		displayName: "normal-user",
 	}
 	
@@ -60,7 +60,7 @@ func TestHubBroadcastPanicRecovery(t *testing.T) {
 	client := &Client{
 		hub:         hub,
 		conn:        nil,
-		send:        make(chan []byte, 1),
+		send:        make(chan outboundFrame, 1),
 		displayName: "panic-client",
 	}
 	
@@ -86,7 +86,7 @@ func TestHubBroadcastPanicRecovery(t *testing.T) {
 	normalClient := &Client{
 		hub:         hub,
 		conn:        nil,
-		send:        make(chan []byte, 1),
+		send:        make(chan outboundFrame, 1),
 		displayName: "normal-client",
 	}
 	
@@ -115,7 +115,7 @@ func TestConcurrentClientOperations(t *testing.T) {
 		client := &Client{
 			hub:         hub,
 			conn:        nil,
-			send:        make(chan []byte, 10), // Larger buffer
+			send:        make(chan outboundFrame, 10), // Larger buffer
 			displayName: "client-" + string(rune('A'+i)),
 		}
 		clients[i] = client
@@ -159,7 +159,7 @@ func TestHubUserListConsistency(t *testing.T) {
 	client := &Client{
 		hub:         hub,
 		conn:        nil,
-		send:        make(chan []byte, 1),
+		send:        make(chan outboundFrame, 1),
 		displayName: "test-user",
 	}
 	
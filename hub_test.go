@@ -32,10 +32,6 @@ func TestNewHub(t *testing.T) {
 		t.Error("Hub clients map not initialized")
 	}
 	
-	if hub.broadcast == nil {
-		t.Error("Hub broadcast channel not initialized")
-	}
-	
 	if hub.register == nil {
 		t.Error("Hub register channel not initialized")
 	}
@@ -518,11 +514,11 @@ func TestHub_SendPrivateMessage_ValidRecipient(t *testing.T) {
 		}
 		
 		sender := NewClient(hub, senderConn)
-		sender.send = make(chan []byte, 256)
+		sender.send = make(chan outboundFrame, 256)
 		hub.UpdateClientName(sender, "Alice")
 		
 		recipient := NewClient(hub, conn)
-		recipient.send = make(chan []byte, 256)
+		recipient.send = make(chan outboundFrame, 256)
 		hub.UpdateClientName(recipient, "Bob")
 		
 		// Create a private message
@@ -542,7 +538,8 @@ func TestHub_SendPrivateMessage_ValidRecipient(t *testing.T) {
 		
 		// Check recipient received message
 		select {
-		case msg := <-recipient.send:
+		case frame := <-recipient.send:
+			msg := frame.data
 			var receivedMsg Message
 			if err := json.Unmarshal(msg, &receivedMsg); err != nil {
 				t.Errorf("Failed to unmarshal received message: %v", err)
@@ -562,7 +559,8 @@ func TestHub_SendPrivateMessage_ValidRecipient(t *testing.T) {
 		
 		// Check sender received echo
 		select {
-		case msg := <-sender.send:
+		case frame := <-sender.send:
+			msg := frame.data
 			var echoMsg Message
 			if err := json.Unmarshal(msg, &echoMsg); err != nil {
 				t.Errorf("Failed to unmarshal echo message: %v", err)
@@ -605,7 +603,7 @@ func TestHub_SendPrivateMessage_OfflineRecipient(t *testing.T) {
 		defer conn.Close()
 		
 		sender := NewClient(hub, conn)
-		sender.send = make(chan []byte, 256)
+		sender.send = make(chan outboundFrame, 256)
 		hub.UpdateClientName(sender, "Alice")
 		
 		// Create a private message to non-existent recipient
@@ -655,15 +653,15 @@ func TestHub_PrivateMessage_NotBroadcast(t *testing.T) {
 		
 		// Create three clients
 		alice := NewClient(hub, conn)
-		alice.send = make(chan []byte, 256)
+		alice.send = make(chan outboundFrame, 256)
 		hub.UpdateClientName(alice, "Alice")
 		
 		bob := NewClient(hub, conn)
-		bob.send = make(chan []byte, 256)
+		bob.send = make(chan outboundFrame, 256)
 		hub.UpdateClientName(bob, "Bob")
 		
 		charlie := NewClient(hub, conn)
-		charlie.send = make(chan []byte, 256)
+		charlie.send = make(chan outboundFrame, 256)
 		hub.UpdateClientName(charlie, "Charlie")
 		
 		// Alice sends private message to Bob
@@ -693,7 +691,8 @@ func TestHub_PrivateMessage_NotBroadcast(t *testing.T) {
 		
 		// Bob should receive the message
 		select {
-		case msg := <-bob.send:
+		case frame := <-bob.send:
+			msg := frame.data
 			var receivedMsg Message
 			if err := json.Unmarshal(msg, &receivedMsg); err != nil {
 				t.Errorf("Failed to unmarshal Bob's message: %v", err)
@@ -733,11 +732,11 @@ func TestHub_PrivateMessage_SenderEcho(t *testing.T) {
 		defer conn.Close()
 		
 		sender := NewClient(hub, conn)
-		sender.send = make(chan []byte, 256)
+		sender.send = make(chan outboundFrame, 256)
 		hub.UpdateClientName(sender, "Alice")
 		
 		recipient := NewClient(hub, conn)
-		recipient.send = make(chan []byte, 256)
+		recipient.send = make(chan outboundFrame, 256)
 		hub.UpdateClientName(recipient, "Bob")
 		
 		// Send private message
@@ -756,7 +755,8 @@ func TestHub_PrivateMessage_SenderEcho(t *testing.T) {
 		
 		// Verify sender receives echo
 		select {
-		case msg := <-sender.send:
+		case frame := <-sender.send:
+			msg := frame.data
 			var echoMsg Message
 			if err := json.Unmarshal(msg, &echoMsg); err != nil {
 				t.Errorf("Failed to unmarshal echo: %v", err)
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// IncomingWebhook lets an external system, such as CI, post messages as a
+// bot by POSTing to /hooks/{Token}
+type IncomingWebhook struct {
+	Token string `json:"token"`
+
+	// Name is the bot display name the messages are sent under. Clients
+	// cannot join with it.
+	Name string `json:"name"`
+
+	// To sends the messages privately to one user; they go to the whole
+	// room if it is empty
+	To string `json:"to,omitempty"`
+}
+
+// IncomingWebhookPayload is the JSON body posted to an incoming webhook
+type IncomingWebhookPayload struct {
+	Content string `json:"content"`
+
+	// ReplyTo threads the message under an earlier one
+	ReplyTo string `json:"reply_to,omitempty"`
+}
+
+// Shortest token accepted, so tokens cannot be guessed
+const minIncomingWebhookToken = 16
+
+// errBotRecipientOffline is returned for private bot messages that could
+// not be delivered
+var errBotRecipientOffline = errors.New("recipient not found or offline")
+
+// incomingWebhook is a configured webhook and the rate limits its posts are
+// held to, as a client's would be
+type incomingWebhook struct {
+	IncomingWebhook
+	limiter rateLimiter
+}
+
+// LoadIncomingWebhooks reads incoming webhooks from a JSON file holding an
+// array of {"token", "name", "to"} objects
+func LoadIncomingWebhooks(path string) ([]IncomingWebhook, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var hooks []IncomingWebhook
+	if err := json.Unmarshal(data, &hooks); err != nil {
+		return nil, errors.New("invalid incoming webhooks file: " + err.Error())
+	}
+	return hooks, nil
+}
+
+// SetIncomingWebhooks replaces the incoming webhooks. Their names may not
+// be bot account names. It must be called before clients connect.
+func (h *Hub) SetIncomingWebhooks(hooks []IncomingWebhook) error {
+	byToken := make(map[string]*incomingWebhook, len(hooks))
+	for _, hook := range hooks {
+		if len(hook.Token) < minIncomingWebhookToken {
+			return errors.New("incoming webhook tokens must be at least " + strconv.Itoa(minIncomingWebhookToken) + " characters")
+		}
+		if byToken[hook.Token] != nil {
+			return errors.New("incoming webhook token used twice")
+		}
+		if err := validateDisplayName(hook.Name); err != nil {
+			return errors.New("incoming webhook name invalid: " + err.Error())
+		}
+		hook.Name = strings.TrimSpace(hook.Name)
+		if h.isBotAccount(hook.Name) {
+			return errors.New("incoming webhook name already used by a bot account: " + hook.Name)
+		}
+		if hook.To != "" {
+			if err := validateDisplayName(hook.To); err != nil {
+				return errors.New("incoming webhook recipient invalid: " + err.Error())
+			}
+			hook.To = strings.TrimSpace(hook.To)
+			if hook.To == hook.Name {
+				return errors.New("incoming webhook cannot send to itself")
+			}
+		}
+		byToken[hook.Token] = &incomingWebhook{IncomingWebhook: hook}
+	}
+	h.incomingWebhooks = byToken
+	return nil
+}
+
+// incomingWebhook returns the webhook a token belongs to, comparing
+// against every token in constant time
+func (h *Hub) incomingWebhook(token string) *incomingWebhook {
+	var found *incomingWebhook
+	for candidate, hook := range h.incomingWebhooks {
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(token)) == 1 {
+			found = hook
+		}
+	}
+	return found
+}
+
+// isBotName reports whether a display name belongs to an incoming webhook
+func (h *Hub) isBotName(name string) bool {
+	for _, hook := range h.incomingWebhooks {
+		if hook.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// PostBotMessage delivers a validated chat or private message from a bot,
+// labelled as such, to the room or its recipient. Its content goes through
+// the content filters as clients' does, and messages they reject or drop are
+// refused. It returns the stored message's ID for room messages.
+func (h *Hub) PostBotMessage(message *Message) (string, error) {
+	message.resetServerFields()
+	message.Bot = true
+	message.SetTimestampAt(h.now())
+	if err := h.PrepareReply(message.From, message); err != nil {
+		return "", err
+	}
+
+	if result := h.filters.Filter(message.Content); result.Matched {
+		h.emitModeration(message.From, "filter", result.Action.String(), result.Reason, message)
+		if result.Action != FilterMask {
+			log.Printf("[FILTER] Refused %s message from bot %s: %s", message.Type, message.From, result.Reason)
+			return "", errors.New("message rejected: " + result.Reason)
+		}
+		log.Printf("[FILTER] Masked %s message from bot %s: %s", message.Type, message.From, result.Reason)
+		message.Content = result.Content
+	}
+
+	if message.Type == MessageTypePrivate {
+		message.SanitizeInput()
+		if err := h.SendPrivateMessage(message.From, message.To, *message); err != nil {
+			log.Printf("[BOT] Private message from %s to %s failed: %v", message.From, message.To, err)
+			return "", errBotRecipientOffline
+		}
+		return "", nil
+	}
+
+	h.ResolveMentions(message.From, message)
+	message.SanitizeInput()
+	h.store.Add(message)
+	log.Printf("[BOT] Broadcasting message from %s", message.From)
+	h.BroadcastMessage(*message)
+	h.notifyThread(*message)
+	h.notifyMentions(*message)
+	h.emitMessageWebhooks(*message)
+	return message.ID, nil
+}
+
+// IncomingWebhookServer accepts messages from external systems at
+// /hooks/{token}
+type IncomingWebhookServer struct {
+	hub *Hub
+}
+
+// NewIncomingWebhookServer creates the endpoint for a hub's incoming
+// webhooks
+func NewIncomingWebhookServer(hub *Hub) *IncomingWebhookServer {
+	return &IncomingWebhookServer{hub: hub}
+}
+
+// HandleHook posts the message in the request body as the token's bot.
+// Messages are held to the same validation as clients' and to the rate
+// limits for bots.
+func (s *IncomingWebhookServer) HandleHook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	hook := s.hub.incomingWebhook(strings.TrimPrefix(r.URL.Path, "/hooks/"))
+	if hook == nil {
+		http.Error(w, "Unknown webhook", http.StatusNotFound)
+		return
+	}
+
+	var payload IncomingWebhookPayload
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxMessageSize)).Decode(&payload); err != nil {
+		http.Error(w, "Invalid message format: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	message := &Message{
+		Type:    MessageTypeChat,
+		From:    hook.Name,
+		Content: payload.Content,
+		ReplyTo: payload.ReplyTo,
+	}
+	kind := RateLimitChat
+	if hook.To != "" {
+		message.Type = MessageTypePrivate
+		message.To = hook.To
+		kind = RateLimitPrivate
+	}
+	if err := message.Validate(); err != nil {
+		http.Error(w, "Message validation failed: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if decision := hook.limiter.take(kind, s.hub.botRateLimits, s.hub.now()); !decision.allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(int((decision.retryAfter+time.Second-1)/time.Second)))
+		http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+		return
+	}
+
+	id, err := s.hub.PostBotMessage(message)
+	if err != nil {
+		log.Printf("[BOT] Refused message from %s: %v", hook.Name, err)
+		status := http.StatusBadRequest
+		if err == errBotRecipientOffline {
+			status = http.StatusConflict
+		}
+		http.Error(w, "Failed to send message: "+err.Error(), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(struct {
+		ID string `json:"id,omitempty"`
+	}{id})
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	ciToken     = "ci-0123456789abcdef"
+	deployToken = "deploy-0123456789abcdef"
+	pagerToken  = "pager-0123456789abcdef"
+)
+
+// postHook POSTs a body to an incoming webhook and returns the response
+func postHook(server *IncomingWebhookServer, method, token, body string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, "/hooks/"+token, strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	server.HandleHook(recorder, request)
+	return recorder
+}
+
+func TestSetIncomingWebhooks(t *testing.T) {
+	hub := NewHub()
+	if err := hub.SetIncomingWebhooks([]IncomingWebhook{{Token: ciToken, Name: " CI "}, {Token: deployToken, Name: "Deploy", To: "Ann"}}); err != nil {
+		t.Fatalf("Expected valid webhooks: %v", err)
+	}
+	if !hub.isBotName("CI") || hub.isBotName("Ann") {
+		t.Error("Expected only the trimmed bot names to be reserved")
+	}
+	if hook := hub.incomingWebhook(deployToken); hook == nil || hook.To != "Ann" {
+		t.Errorf("Expected the deploy webhook, got %+v", hook)
+	}
+	if hook := hub.incomingWebhook("ci-0123456789abcdeX"); hook != nil {
+		t.Errorf("Expected a wrong token to match nothing, got %+v", hook)
+	}
+
+	invalid := [][]IncomingWebhook{
+		{{Token: "short", Name: "CI"}},
+		{{Token: ciToken, Name: "CI"}, {Token: ciToken, Name: "Other"}},
+		{{Token: ciToken, Name: ""}},
+		{{Token: ciToken, Name: "<b>CI</b>"}},
+		{{Token: ciToken, Name: "CI", To: "CI"}},
+	}
+	for i, hooks := range invalid {
+		if err := hub.SetIncomingWebhooks(hooks); err == nil {
+			t.Errorf("Expected invalid webhooks %d to be refused", i)
+		}
+	}
+}
+
+func TestLoadIncomingWebhooks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hooks.json")
+	os.WriteFile(path, []byte(`[{"token": "`+ciToken+`", "name": "CI"}, {"token": "`+deployToken+`", "name": "Deploy", "to": "Ann"}]`), 0600)
+	hooks, err := LoadIncomingWebhooks(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hooks) != 2 || hooks[0].Name != "CI" || hooks[1].To != "Ann" {
+		t.Errorf("Unexpected webhooks %+v", hooks)
+	}
+
+	os.WriteFile(path, []byte(`{"token": "x"}`), 0600)
+	if _, err := LoadIncomingWebhooks(path); err == nil {
+		t.Error("Expected a file that is not an array to be refused")
+	}
+}
+
+func TestIncomingWebhook_PostsToRoom(t *testing.T) {
+	h := newChatHarness(t)
+	if err := h.hub.SetIncomingWebhooks([]IncomingWebhook{{Token: ciToken, Name: "CI"}}); err != nil {
+		t.Fatal(err)
+	}
+	server := NewIncomingWebhookServer(h.hub)
+	clients := h.joinMany("user", 2)
+
+	response := postHook(server, http.MethodPost, ciToken, `{"content": "Build <b>42</b> failed, @user-1"}`)
+	if response.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202, got %d: %s", response.Code, response.Body)
+	}
+	var body struct{ ID string }
+	json.Unmarshal(response.Body.Bytes(), &body)
+
+	isBotMessage := func(m Message) bool { return m.Type == MessageTypeChat && m.From == "CI" }
+	for _, client := range clients {
+		client.waitFor(isBotMessage)
+	}
+	clients[1].waitFor(func(m Message) bool { return m.Type == MessageTypeMention && m.From == "CI" })
+
+	clients[0].mu.Lock()
+	var message Message
+	for _, m := range clients[0].messages {
+		if isBotMessage(m) {
+			message = m
+		}
+	}
+	clients[0].mu.Unlock()
+	if !message.Bot || message.ID != body.ID || message.Content != "Build &lt;b&gt;42&lt;/b&gt; failed, @user-1" {
+		t.Errorf("Expected a labelled, escaped bot message with ID %q, got %+v", body.ID, message)
+	}
+
+	// Replies thread under earlier messages
+	response = postHook(server, http.MethodPost, ciToken, `{"content": "Fixed", "reply_to": "`+body.ID+`"}`)
+	if response.Code != http.StatusAccepted {
+		t.Fatalf("Expected the reply to be accepted, got %d: %s", response.Code, response.Body)
+	}
+	clients[0].waitFor(func(m Message) bool { return isBotMessage(m) && m.ThreadID == body.ID })
+}
+
+func TestIncomingWebhook_ContentFilters(t *testing.T) {
+	h := newChatHarness(t)
+	filters := DefaultFilterConfig()
+	filters.BannedWords = []string{"darn"}
+	filters.BannedWordAction = FilterDrop
+	filters.DeniedDomains = []string{"evil.com"}
+	if err := h.hub.SetContentFilters(filters); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.hub.SetIncomingWebhooks([]IncomingWebhook{{Token: ciToken, Name: "CI"}}); err != nil {
+		t.Fatal(err)
+	}
+	server := NewIncomingWebhookServer(h.hub)
+	client := h.join("Ann")
+
+	// Messages the filters reject or drop are refused
+	for _, content := range []string{"deploy from evil.com", "darn, the build broke"} {
+		response := postHook(server, http.MethodPost, ciToken, `{"content": "`+content+`"}`)
+		if response.Code != http.StatusBadRequest {
+			t.Errorf("Expected %q to be refused with 400, got %d: %s", content, response.Code, response.Body)
+		}
+	}
+	if response := postHook(server, http.MethodPost, ciToken, `{"content": "build fixed"}`); response.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202, got %d: %s", response.Code, response.Body)
+	}
+	client.waitFor(func(m Message) bool { return m.Type == MessageTypeChat && m.Content == "build fixed" })
+	if n := client.count(func(m Message) bool { return m.Type == MessageTypeChat && m.From == "CI" }); n != 1 {
+		t.Errorf("Expected only the clean message to be posted, got %d", n)
+	}
+}
+
+func TestIncomingWebhook_Refusals(t *testing.T) {
+	hub := NewHub()
+	config := DefaultBotRateLimitConfig()
+	config.Budgets[RateLimitChat] = RateBudget{Burst: 1, Refill: time.Minute}
+	if err := hub.SetBotRateLimits(config); err != nil {
+		t.Fatal(err)
+	}
+	// Webhooks are bots: the limits for users do not apply to them
+	users := DefaultRateLimitConfig()
+	users.Budgets[RateLimitChat] = RateBudget{Burst: 0, Refill: time.Minute}
+	hub.rateLimits = users
+	hooks := []IncomingWebhook{{Token: ciToken, Name: "CI"}, {Token: pagerToken, Name: "Pager", To: "Ann"}}
+	if err := hub.SetIncomingWebhooks(hooks); err != nil {
+		t.Fatal(err)
+	}
+	server := NewIncomingWebhookServer(hub)
+
+	tests := []struct {
+		name   string
+		method string
+		token  string
+		body   string
+		want   int
+	}{
+		{"wrong method", http.MethodGet, ciToken, "", http.StatusMethodNotAllowed},
+		{"unknown token", http.MethodPost, "nope", `{"content": "hi"}`, http.StatusNotFound},
+		{"invalid JSON", http.MethodPost, ciToken, `{"content": `, http.StatusBadRequest},
+		{"empty content", http.MethodPost, ciToken, `{"content": "  "}`, http.StatusBadRequest},
+		{"too large", http.MethodPost, ciToken, `{"content": "` + strings.Repeat("a", maxMessageSize) + `"}`, http.StatusBadRequest},
+		{"unknown reply", http.MethodPost, ciToken, `{"content": "hi", "reply_to": "missing"}`, http.StatusBadRequest},
+		{"over the rate limit", http.MethodPost, ciToken, `{"content": "hi"}`, http.StatusTooManyRequests},
+		{"recipient offline", http.MethodPost, pagerToken, `{"content": "wake up"}`, http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if response := postHook(server, tt.method, tt.token, tt.body); response.Code != tt.want {
+				t.Errorf("Expected %d, got %d: %s", tt.want, response.Code, response.Body)
+			}
+		})
+	}
+	if response := postHook(server, http.MethodPost, ciToken, `{"content": "hi"}`); response.Header().Get("Retry-After") != "60" {
+		t.Errorf("Expected to be told to retry in 60s, got %q", response.Header().Get("Retry-After"))
+	}
+}
+
+func TestIncomingWebhook_PrivateAndReservedNames(t *testing.T) {
+	h := newChatHarness(t)
+	if err := h.hub.SetIncomingWebhooks([]IncomingWebhook{{Token: pagerToken, Name: "Pager", To: "user-1"}}); err != nil {
+		t.Fatal(err)
+	}
+	server := NewIncomingWebhookServer(h.hub)
+	clients := h.joinMany("user", 2)
+
+	if response := postHook(server, http.MethodPost, pagerToken, `{"content": "disk full"}`); response.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202, got %d: %s", response.Code, response.Body)
+	}
+	clients[1].waitFor(func(m Message) bool {
+		return m.Type == MessageTypePrivate && m.From == "Pager" && m.Bot && m.Content == "disk full"
+	})
+
+	// Clients can neither take a bot's name nor pass as a bot
+	impostor := h.connect()
+	impostor.send(Message{Type: MessageTypeJoin, Content: "Pager"})
+	impostor.waitFor(func(m Message) bool {
+		return m.Type == MessageTypeError && m.Error == "Display name error: name reserved for a bot"
+	})
+	clients[0].send(Message{Type: MessageTypeChat, From: "user-0", Content: "I am a bot", Bot: true})
+	clients[1].waitFor(func(m Message) bool { return m.Content == "I am a bot" })
+	if n := clients[1].count(func(m Message) bool { return m.Content == "I am a bot" && m.Bot }); n != 0 {
+		t.Error("Expected a client's bot label to be cleared")
+	}
+}
@@ -83,6 +83,12 @@ func LogConnectionStats(hub *Hub) {
 		stats["idle_connections"],
 		stats["users_online"],
 		stats["max_connections"])
+	appLogger.Info("Slow Consumers: Policy=%s, Disconnected=%d, DroppedOldest=%d, DroppedNewest=%d, Coalesced=%d",
+		stats["slow_consumer_policy"],
+		stats["slow_consumer_disconnects"],
+		stats["slow_consumer_dropped_oldest"],
+		stats["slow_consumer_dropped_newest"],
+		stats["slow_consumer_coalesced"])
 }
 
 // LogRateLimit logs rate limiting events
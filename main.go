@@ -3,9 +3,12 @@ package main
 import (
 	"context"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -16,8 +19,225 @@ func main() {
 	// Initialize logger
 	InitLogger(INFO)
 	
-	// Create and start the hub
+	// Create and start the hub, split across CHAT_HUB_SHARDS shards if set
 	hub := NewHub()
+	if shards, err := strconv.Atoi(os.Getenv("CHAT_HUB_SHARDS")); err == nil && shards > 0 {
+		hub = NewShardedHub(shards)
+	}
+	
+	// Restrict reactions to a fixed emoji set if configured
+	if reactions := os.Getenv("CHAT_ALLOWED_REACTIONS"); reactions != "" {
+		hub.SetAllowedReactions(strings.Split(reactions, ","))
+	}
+	
+	// Compress messages for clients that support permessage-deflate
+	if enabled, _ := strconv.ParseBool(os.Getenv("CHAT_COMPRESSION")); enabled {
+		config := DefaultCompressionConfig()
+		if level, err := strconv.Atoi(os.Getenv("CHAT_COMPRESSION_LEVEL")); err == nil {
+			config.Level = level
+		}
+		if minSize, err := strconv.Atoi(os.Getenv("CHAT_COMPRESSION_MIN_SIZE")); err == nil {
+			config.MinSize = minSize
+		}
+		if err := hub.SetCompression(config); err != nil {
+			log.Fatalf("Invalid compression settings: %v", err)
+		}
+	}
+	
+	// Choose how clients that fall behind are handled
+	if policyName := os.Getenv("CHAT_SLOW_CONSUMER_POLICY"); policyName != "" {
+		policy, err := ParseSlowConsumerPolicy(policyName)
+		if err != nil {
+			log.Fatalf("Invalid CHAT_SLOW_CONSUMER_POLICY: %v", err)
+		}
+		hub.SetSlowConsumerPolicy(policy)
+	}
+	
+	// Rate-limit budgets, e.g. CHAT_RATE_LIMITS=chat=10/3s,typing=5/1s, and
+	// the mute penalty for repeat offenders
+	rateLimits := DefaultRateLimitConfig()
+	budgets, err := ParseRateBudgets(os.Getenv("CHAT_RATE_LIMITS"), rateLimits.Budgets)
+	if err != nil {
+		log.Fatalf("Invalid CHAT_RATE_LIMITS: %v", err)
+	}
+	rateLimits.Budgets = budgets
+	if muteAfter, err := strconv.Atoi(os.Getenv("CHAT_RATE_MUTE_AFTER")); err == nil {
+		rateLimits.MuteAfter = muteAfter
+	}
+	if mute, err := time.ParseDuration(os.Getenv("CHAT_RATE_MUTE_DURATION")); err == nil {
+		rateLimits.MuteDuration = mute
+		if rateLimits.MaxMuteDuration < mute {
+			rateLimits.MaxMuteDuration = mute
+		}
+	}
+	if err := hub.SetRateLimits(rateLimits); err != nil {
+		log.Fatalf("Invalid rate limits: %v", err)
+	}
+	
+	// Per-address connection limits; 0 turns a limit off
+	connLimits := DefaultConnectionLimitConfig()
+	for name, limit := range map[string]*int{
+		"CHAT_MAX_CONNECTIONS_PER_IP":         &connLimits.PerIP.Connections,
+		"CHAT_CONNECTS_PER_MINUTE_PER_IP":     &connLimits.PerIP.ConnectsPerMinute,
+		"CHAT_JOINS_PER_MINUTE_PER_IP":        &connLimits.PerIP.JoinsPerMinute,
+		"CHAT_MAX_CONNECTIONS_PER_SUBNET":     &connLimits.PerSubnet.Connections,
+		"CHAT_CONNECTS_PER_MINUTE_PER_SUBNET": &connLimits.PerSubnet.ConnectsPerMinute,
+		"CHAT_JOINS_PER_MINUTE_PER_SUBNET":    &connLimits.PerSubnet.JoinsPerMinute,
+	} {
+		if n, err := strconv.Atoi(os.Getenv(name)); err == nil {
+			*limit = n
+		}
+	}
+	if err := hub.SetConnectionLimits(connLimits); err != nil {
+		log.Fatalf("Invalid connection limits: %v", err)
+	}
+	
+	// Believe Forwarded, X-Forwarded-For and PROXY headers only from these
+	// proxies
+	proxies, err := ParseTrustedProxies(os.Getenv("CHAT_TRUSTED_PROXIES"))
+	if err != nil {
+		log.Fatalf("Invalid CHAT_TRUSTED_PROXIES: %v", err)
+	}
+	hub.SetTrustedProxies(proxies)
+
+	// Content filters: banned words from CHAT_BANNED_WORDS and one per line
+	// in CHAT_BANNED_WORDS_FILE, link domains, shouting and repeats
+	filters := DefaultFilterConfig()
+	if words := os.Getenv("CHAT_BANNED_WORDS"); words != "" {
+		filters.BannedWords = strings.Split(words, ",")
+	}
+	if path := os.Getenv("CHAT_BANNED_WORDS_FILE"); path != "" {
+		words, err := LoadWordList(path)
+		if err != nil {
+			log.Fatalf("Failed to read CHAT_BANNED_WORDS_FILE: %v", err)
+		}
+		filters.BannedWords = append(filters.BannedWords, words...)
+	}
+	if domains := os.Getenv("CHAT_LINK_ALLOW"); domains != "" {
+		filters.AllowedDomains = strings.Split(domains, ",")
+	}
+	if domains := os.Getenv("CHAT_LINK_DENY"); domains != "" {
+		filters.DeniedDomains = strings.Split(domains, ",")
+	}
+	if n, err := strconv.Atoi(os.Getenv("CHAT_CAPS_MIN_LETTERS")); err == nil {
+		filters.CapsMinLetters = n
+	}
+	if ratio, err := strconv.ParseFloat(os.Getenv("CHAT_CAPS_MAX_RATIO"), 64); err == nil {
+		filters.CapsMaxRatio = ratio
+	}
+	if n, err := strconv.Atoi(os.Getenv("CHAT_MAX_REPEAT")); err == nil {
+		filters.MaxRepeat = n
+	}
+	for name, action := range map[string]*FilterAction{
+		"CHAT_BANNED_WORD_ACTION": &filters.BannedWordAction,
+		"CHAT_LINK_ACTION":        &filters.LinkAction,
+		"CHAT_CAPS_ACTION":        &filters.CapsAction,
+		"CHAT_REPEAT_ACTION":      &filters.RepeatAction,
+	} {
+		if value := os.Getenv(name); value != "" {
+			parsed, err := ParseFilterAction(value)
+			if err != nil {
+				log.Fatalf("Invalid %s: %v", name, err)
+			}
+			*action = parsed
+		}
+	}
+	if err := hub.SetContentFilters(filters); err != nil {
+		log.Fatalf("Invalid content filters: %v", err)
+	}
+
+	// Score senders for spam, escalating from a warning to a mute to a
+	// disconnect
+	if enabled, _ := strconv.ParseBool(os.Getenv("CHAT_SPAM_DETECTION")); enabled {
+		config := DefaultSpamConfig()
+		if threshold, err := strconv.ParseFloat(os.Getenv("CHAT_SPAM_THRESHOLD"), 64); err == nil {
+			config.Threshold = threshold
+		}
+		if mute, err := time.ParseDuration(os.Getenv("CHAT_SPAM_MUTE_DURATION")); err == nil {
+			config.MuteDuration = mute
+		}
+		if err := hub.SetSpamDetection(config); err != nil {
+			log.Fatalf("Invalid spam detection settings: %v", err)
+		}
+	}
+
+	// Mirror chat events to webhooks, e.g. CHAT_WEBHOOK_URL=https://...,
+	// signed with CHAT_WEBHOOK_SECRET; several URLs may be comma-separated.
+	// CHAT_WEBHOOK_PRIVATE_CONTENT=true includes private and group content
+	// in moderation events.
+	if urls := os.Getenv("CHAT_WEBHOOK_URL"); urls != "" {
+		events, err := ParseWebhookEvents(os.Getenv("CHAT_WEBHOOK_EVENTS"))
+		if err != nil {
+			log.Fatalf("Invalid CHAT_WEBHOOK_EVENTS: %v", err)
+		}
+		privateContent, _ := strconv.ParseBool(os.Getenv("CHAT_WEBHOOK_PRIVATE_CONTENT"))
+		for _, endpoint := range strings.Split(urls, ",") {
+			config := DefaultWebhookConfig()
+			config.URL = strings.TrimSpace(endpoint)
+			config.Secret = os.Getenv("CHAT_WEBHOOK_SECRET")
+			config.Events = events
+			config.IncludePrivateContent = privateContent
+			if attempts, err := strconv.Atoi(os.Getenv("CHAT_WEBHOOK_MAX_ATTEMPTS")); err == nil {
+				config.MaxAttempts = attempts
+			}
+			if err := hub.AddWebhook(config); err != nil {
+				log.Fatalf("Invalid webhook %s: %v", config.URL, err)
+			}
+		}
+	}
+
+	// Let external systems post as bots through /hooks/{token}, with the
+	// tokens in a JSON file
+	if path := os.Getenv("CHAT_INCOMING_WEBHOOKS_FILE"); path != "" {
+		hooks, err := LoadIncomingWebhooks(path)
+		if err != nil {
+			log.Fatalf("Failed to load CHAT_INCOMING_WEBHOOKS_FILE: %v", err)
+		}
+		if err := hub.SetIncomingWebhooks(hooks); err != nil {
+			log.Fatalf("Invalid incoming webhooks: %v", err)
+		}
+	}
+
+	// Let programs join as bots, with their names and tokens in a JSON
+	// file, held to their own budgets, e.g. CHAT_BOT_RATE_LIMITS=chat=60/1s
+	if path := os.Getenv("CHAT_BOT_ACCOUNTS_FILE"); path != "" {
+		accounts, err := LoadBotAccounts(path)
+		if err != nil {
+			log.Fatalf("Failed to load CHAT_BOT_ACCOUNTS_FILE: %v", err)
+		}
+		if err := hub.SetBotAccounts(accounts); err != nil {
+			log.Fatalf("Invalid bot accounts: %v", err)
+		}
+	}
+	botRateLimits := DefaultBotRateLimitConfig()
+	botBudgets, err := ParseRateBudgets(os.Getenv("CHAT_BOT_RATE_LIMITS"), botRateLimits.Budgets)
+	if err != nil {
+		log.Fatalf("Invalid CHAT_BOT_RATE_LIMITS: %v", err)
+	}
+	botRateLimits.Budgets = botBudgets
+	if err := hub.SetBotRateLimits(botRateLimits); err != nil {
+		log.Fatalf("Invalid bot rate limits: %v", err)
+	}
+
+	// Grant moderator privileges to configured display names
+	if moderators := os.Getenv("CHAT_MODERATORS"); moderators != "" {
+		hub.SetModerators(strings.Split(moderators, ","))
+	}
+	
+	// Join other server instances through the broker, if configured
+	if broker := setupBroker(); broker != nil {
+		nodeID := os.Getenv("CHAT_NODE_ID")
+		if nodeID == "" {
+			hostname, _ := os.Hostname()
+			nodeID = hostname + "-" + strconv.Itoa(os.Getpid())
+		}
+		if err := hub.SetBroker(nodeID, broker); err != nil {
+			log.Fatalf("Failed to subscribe to broker: %v", err)
+		}
+		defer broker.Close()
+		log.Printf("Running as node %s", nodeID)
+	}
+	
 	go hub.Run()
 	
 	// Start periodic logging
@@ -28,6 +248,22 @@ func main() {
 		handleWebSocket(hub, w, r)
 	})
 
+	// Fallback for clients whose proxies block WebSockets
+	fallback := NewHTTPTransportServer(hub)
+	http.HandleFunc("/sse", fallback.HandleSSE)
+	http.HandleFunc("/poll", fallback.HandlePoll)
+	http.HandleFunc("/send", fallback.HandleSend)
+
+	// Messages posted by external systems
+	http.HandleFunc("/hooks/", NewIncomingWebhookServer(hub).HandleHook)
+
+	// Moderation endpoints, for operators holding CHAT_ADMIN_TOKEN
+	if token := os.Getenv("CHAT_ADMIN_TOKEN"); token != "" {
+		admin := NewAdminServer(hub, token)
+		http.HandleFunc("/admin/spam", admin.HandleSpamDecisions)
+		http.HandleFunc("/admin/webhooks/dead-letters", admin.HandleWebhookDeadLetters)
+	}
+
 	// Serve static files from the static directory
 	fs := http.FileServer(http.Dir("./static/"))
 	http.Handle("/", fs)
@@ -47,9 +283,22 @@ func main() {
 		Addr: ":" + port,
 	}
 
+	// Behind a TCP load balancer, read client addresses from the PROXY
+	// protocol header its connections start with
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		log.Fatalf("Server failed to start: %v", err)
+	}
+	if enabled, _ := strconv.ParseBool(os.Getenv("CHAT_PROXY_PROTOCOL")); enabled {
+		if len(proxies) == 0 {
+			log.Fatalf("CHAT_PROXY_PROTOCOL needs CHAT_TRUSTED_PROXIES to say which peers send the header")
+		}
+		listener = NewProxyListener(listener, proxies)
+	}
+
 	go func() {
 		log.Printf("Starting server on :%s", port)
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Server failed to start: %v", err)
 		}
 	}()
@@ -74,6 +323,35 @@ func main() {
 	}
 }
 
+// setupBroker starts the reference TCP relay when CHAT_BROKER_LISTEN is set
+// and connects to the relay at CHAT_BROKER_ADDR (or the local relay). It
+// returns nil when running as a single node.
+func setupBroker() Broker {
+	listenAddr := os.Getenv("CHAT_BROKER_LISTEN")
+	brokerAddr := os.Getenv("CHAT_BROKER_ADDR")
+
+	if listenAddr != "" {
+		relay, err := NewTCPBrokerServer(listenAddr)
+		if err != nil {
+			log.Fatalf("Failed to start broker relay: %v", err)
+		}
+		if brokerAddr == "" {
+			brokerAddr = relay.Addr()
+		}
+	}
+
+	if brokerAddr == "" {
+		return nil
+	}
+
+	broker, err := DialTCPBroker(brokerAddr)
+	if err != nil {
+		log.Fatalf("Failed to connect to broker at %s: %v", brokerAddr, err)
+	}
+	log.Printf("Connected to broker at %s", brokerAddr)
+	return broker
+}
+
 // handleWebSocket handles WebSocket upgrade requests and manages client connections
 func handleWebSocket(hub *Hub, w http.ResponseWriter, r *http.Request) {
 	defer func() {
@@ -82,26 +360,50 @@ func handleWebSocket(hub *Hub, w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
+	// Refuse addresses over their limits before upgrading
+	ip, ok := hub.admitConnection(w, r)
+	if !ok {
+		return
+	}
+
 	// Upgrade HTTP connection to WebSocket
-	conn, err := upgrader.Upgrade(w, r, nil)
+	conn, err := hub.upgrader().Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("WebSocket upgrade failed from %s: %v", r.RemoteAddr, err)
+		hub.connLimits.release(ip)
+		log.Printf("WebSocket upgrade failed from %s: %v", ip, err)
 		// Don't call http.Error after upgrader.Upgrade fails, as it may have already written headers
 		return
 	}
 
 	// Check connection limits
 	if !hub.CanAcceptNewConnection() {
-		log.Printf("Connection limit reached, rejecting connection from %s", r.RemoteAddr)
+		log.Printf("Connection limit reached, rejecting connection from %s", ip)
 		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "Server at capacity"))
 		conn.Close()
+		hub.connLimits.release(ip)
 		return
 	}
 
 	// Create new client
 	client := NewClient(hub, conn)
+	client.ip = ip
+	client.codec = codecForSubprotocol(conn.Subprotocol())
+	if err := client.enableCompression(hub.compression); err != nil {
+		log.Printf("Failed to enable compression for %s: %v", client.remoteAddress(), err)
+	}
+
+	serveClient(client)
+	LogClientActivity("connected", "unknown", client.remoteAddress())
+}
+
+// serveClient runs the connect hooks, then starts a client's goroutines
+// with panic recovery
+func serveClient(client *Client) {
+	if err := client.runConnectHooks(); err != nil {
+		client.refuseConnection(err)
+		return
+	}
 
-	// Start client goroutines with panic recovery
 	go func() {
 		defer func() {
 			if r := recover(); r != nil {
@@ -119,6 +421,4 @@ func handleWebSocket(hub *Hub, w http.ResponseWriter, r *http.Request) {
 		}()
 		client.ReadPump()
 	}()
-
-	LogClientActivity("connected", "unknown", r.RemoteAddr)
 }
\ No newline at end of file
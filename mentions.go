@@ -0,0 +1,135 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// mentionHere notifies everyone online and is reserved for moderators
+const mentionHere = "here"
+
+// parseMentions finds @name mentions of the given users in content. Longer
+// names win so "@Ann Lee" is not read as "@Ann". Names match
+// case-insensitively and must end at a word boundary.
+func parseMentions(content string, users []string) []string {
+	candidates := make([]string, 0, len(users)+1)
+	candidates = append(candidates, users...)
+	candidates = append(candidates, mentionHere)
+	sort.Slice(candidates, func(i, j int) bool {
+		return len(candidates[i]) > len(candidates[j])
+	})
+
+	seen := make(map[string]bool)
+	mentions := make([]string, 0)
+	for i := 0; i < len(content); i++ {
+		if content[i] != '@' || !mentionStartsAt(content, i) {
+			continue
+		}
+		rest := content[i+1:]
+		for _, name := range candidates {
+			if name == "" || len(rest) < len(name) || !strings.EqualFold(rest[:len(name)], name) {
+				continue
+			}
+			if !mentionEndsAt(rest, len(name)) {
+				continue
+			}
+			if !seen[name] {
+				seen[name] = true
+				mentions = append(mentions, name)
+			}
+			i += len(name)
+			break
+		}
+	}
+	return mentions
+}
+
+// mentionStartsAt reports whether the @ at index i begins a mention rather
+// than being part of a word such as an email address
+func mentionStartsAt(content string, i int) bool {
+	if i == 0 {
+		return true
+	}
+	r, _ := utf8.DecodeLastRuneInString(content[:i])
+	return !isMentionWordRune(r)
+}
+
+// mentionEndsAt reports whether a name of length n ends at a word boundary
+func mentionEndsAt(rest string, n int) bool {
+	if n == len(rest) {
+		return true
+	}
+	r, _ := utf8.DecodeRuneInString(rest[n:])
+	return !isMentionWordRune(r)
+}
+
+// isMentionWordRune reports whether r continues a word
+func isMentionWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+// ResolveMentions parses mentions of online users in a public message and
+// stores them on the message. @here is kept only for moderators.
+func (h *Hub) ResolveMentions(sender string, message *Message) {
+	message.Mentions = nil
+
+	mentions := parseMentions(message.Content, h.GetConnectedUsers())
+	resolved := make([]string, 0, len(mentions))
+	for _, name := range mentions {
+		if name == mentionHere && !h.IsModerator(sender) {
+			log.Printf("[MENTION] Ignoring @here from non-moderator %s", sender)
+			continue
+		}
+		resolved = append(resolved, name)
+	}
+
+	if len(resolved) > 0 {
+		message.Mentions = resolved
+	}
+}
+
+// notifyMentions sends a dedicated mention notification to every user
+// mentioned in a message, other than its sender
+func (h *Hub) notifyMentions(message Message) {
+	if len(message.Mentions) == 0 {
+		return
+	}
+
+	seen := map[string]bool{message.From: true}
+	recipients := make([]string, 0)
+	for _, name := range message.Mentions {
+		if name == mentionHere {
+			for _, user := range h.GetConnectedUsers() {
+				if !seen[user] {
+					seen[user] = true
+					recipients = append(recipients, user)
+				}
+			}
+			continue
+		}
+		if !seen[name] {
+			seen[name] = true
+			recipients = append(recipients, name)
+		}
+	}
+	recipients = h.withoutBlockers(message.From, recipients)
+	if len(recipients) == 0 {
+		return
+	}
+
+	notification := &Message{
+		Type:      MessageTypeMention,
+		From:      message.From,
+		Content:   message.Content,
+		MessageID: message.ID,
+		ThreadID:  message.ThreadID,
+		Mentions:  message.Mentions,
+	}
+	notification.SetTimestampAt(h.now())
+
+	log.Printf("[MENTION] Notifying %d users mentioned by %s", len(recipients), message.From)
+	h.sendToUsers(*notification, recipients...)
+}
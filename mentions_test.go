@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseMentions(t *testing.T) {
+	users := []string{"alice", "Ann", "Ann Lee", "bob_2"}
+
+	tests := []struct {
+		name     string
+		content  string
+		expected []string
+	}{
+		{"single mention", "hi @alice", []string{"alice"}},
+		{"case insensitive", "hi @ALICE!", []string{"alice"}},
+		{"longest name wins", "ping @Ann Lee please", []string{"Ann Lee"}},
+		{"shorter name at boundary", "ping @Ann, please", []string{"Ann"}},
+		{"multiple mentions", "@alice and @bob_2", []string{"alice", "bob_2"}},
+		{"duplicates collapsed", "@alice @alice", []string{"alice"}},
+		{"here", "@here standup", []string{"here"}},
+		{"unknown user", "@carol hi", []string{}},
+		{"prefix of longer word", "@alicea", []string{}},
+		{"email address", "mail alice@alice.com", []string{}},
+		{"punctuation separated", "@alice,@bob_2", []string{"alice", "bob_2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseMentions(tt.content, users)
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("parseMentions(%q) = %v, want %v", tt.content, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestHub_ResolveMentions_HereRequiresModerator(t *testing.T) {
+	hub := NewHub()
+	hub.SetModerators([]string{"Mod"})
+
+	message := &Message{Type: MessageTypeChat, Content: "@here meeting"}
+	hub.ResolveMentions("Alice", message)
+	if message.Mentions != nil {
+		t.Errorf("Expected @here ignored for non-moderator, got %v", message.Mentions)
+	}
+
+	message = &Message{Type: MessageTypeChat, Content: "@here meeting"}
+	hub.ResolveMentions("Mod", message)
+	if !reflect.DeepEqual(message.Mentions, []string{mentionHere}) {
+		t.Errorf("Expected @here kept for moderator, got %v", message.Mentions)
+	}
+}
+
+func TestHub_NotifyMentions(t *testing.T) {
+	hub := NewHub()
+
+	clients := make(map[string]*Client)
+	for _, name := range []string{"Alice", "Bob", "Carol"} {
+		client := &Client{hub: hub, send: make(chan outboundFrame, 10), displayName: name}
+		negotiateContent(client)
+		hub.userList[client] = name
+		hub.UpdateClientName(client, name)
+		clients[name] = client
+	}
+
+	message := &Message{Type: MessageTypeChat, From: "Alice", Content: "hey @Bob and @alice"}
+	hub.ResolveMentions("Alice", message)
+	hub.store.Add(message)
+	hub.notifyMentions(*message)
+
+	select {
+	case frame := <-clients["Bob"].send:
+		data := frame.data
+		var notification Message
+		json.Unmarshal(data, &notification)
+		if notification.Type != MessageTypeMention || notification.MessageID != message.ID {
+			t.Errorf("Unexpected mention notification %+v", notification)
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Error("Mentioned user did not receive notification")
+	}
+
+	for _, name := range []string{"Alice", "Carol"} {
+		select {
+		case <-clients[name].send:
+			t.Errorf("%s should not receive a mention notification", name)
+		default:
+		}
+	}
+}
+
+func TestHub_NotifyMentions_Here(t *testing.T) {
+	hub := NewHub()
+	hub.SetModerators([]string{"Mod"})
+
+	clients := make(map[string]*Client)
+	for _, name := range []string{"Mod", "Bob", "Carol"} {
+		client := &Client{hub: hub, send: make(chan outboundFrame, 10), displayName: name}
+		negotiateContent(client)
+		hub.userList[client] = name
+		hub.UpdateClientName(client, name)
+		clients[name] = client
+	}
+
+	message := &Message{Type: MessageTypeChat, From: "Mod", Content: "@here @Bob restart soon"}
+	hub.ResolveMentions("Mod", message)
+	hub.notifyMentions(*message)
+
+	for _, name := range []string{"Bob", "Carol"} {
+		select {
+		case <-clients[name].send:
+		case <-time.After(100 * time.Millisecond):
+			t.Errorf("%s did not receive @here notification", name)
+		}
+		// Each user is notified once even if mentioned twice
+		select {
+		case <-clients[name].send:
+			t.Errorf("%s received duplicate notification", name)
+		default:
+		}
+	}
+
+	select {
+	case <-clients["Mod"].send:
+		t.Error("Sender should not be notified of their own @here")
+	default:
+	}
+}
@@ -18,22 +18,128 @@ const (
 	MessageTypeUserList = "user_list"
 	MessageTypeError    = "error"
 	MessageTypeJoin     = "join"
+	MessageTypeReact    = "react"
+	MessageTypeUnreact  = "unreact"
+	MessageTypeReaction = "reaction"
+
+	// Thread message types
+	MessageTypeGetThread   = "get_thread"
+	MessageTypeThread      = "thread"
+	MessageTypeThreadReply = "thread_reply"
+
+	// Mention notification sent to mentioned users
+	MessageTypeMention = "mention"
+
+	// Block list message types
+	MessageTypeBlock     = "block"
+	MessageTypeUnblock   = "unblock"
+	MessageTypeBlockList = "block_list"
+
+	// Group conversation message types
+	MessageTypeGroupCreate  = "group_create"
+	MessageTypeGroupAdd     = "group_add"
+	MessageTypeGroupLeave   = "group_leave"
+	MessageTypeGroupMessage = "group_message"
+	MessageTypeGroupInfo    = "group_info"
+
+	// Handshake declaring protocol version and capabilities
+	MessageTypeHello = "hello"
+
+	// Typing notification, sent by a client while composing and relayed to
+	// everyone else
+	MessageTypeTyping = "typing"
+
+	// Delivery receipt telling a sender its private message was delivered
+	MessageTypeReceipt = "receipt"
+
+	// Users who joined (users) and left (left) since the last user list or
+	// presence message, for clients that asked for presence diffs
+	MessageTypePresence = "presence"
 )
 
 // Message represents a WebSocket message with JSON schema
 type Message struct {
+	ID        string    `json:"id,omitempty"`
 	Type      string    `json:"type"`
 	From      string    `json:"from,omitempty"`
 	To        string    `json:"to,omitempty"`
 	Content   string    `json:"content,omitempty"`
 	Users     []string  `json:"users,omitempty"`
+	Left      []string  `json:"left,omitempty"`
+	Bots      []string  `json:"bots,omitempty"`
 	Error     string    `json:"error,omitempty"`
 	Timestamp time.Time `json:"timestamp"`
+
+	// Reaction fields: MessageID targets a stored message, Emoji is the
+	// reaction being added or removed and Reactions carries the aggregated
+	// per-emoji counts for the target message. ReactionVersion orders the
+	// counts; clients ignore updates older than the last one applied.
+	MessageID       string         `json:"message_id,omitempty"`
+	Emoji           string         `json:"emoji,omitempty"`
+	Reactions       map[string]int `json:"reactions,omitempty"`
+	ReactionVersion int            `json:"reaction_version,omitempty"`
+
+	// Thread fields: ReplyTo is the message being answered, ThreadID the root
+	// of the thread it belongs to and ReplyCount the number of replies to a
+	// root. Messages carries a thread's history in thread responses.
+	ReplyTo    string    `json:"reply_to,omitempty"`
+	ThreadID   string    `json:"thread_id,omitempty"`
+	ReplyCount int       `json:"reply_count,omitempty"`
+	Messages   []Message `json:"messages,omitempty"`
+
+	// Mentions lists the users mentioned in a public message, or "here"
+	Mentions []string `json:"mentions,omitempty"`
+
+	// ConversationID addresses a group conversation
+	ConversationID string `json:"conversation_id,omitempty"`
+
+	// Blocked marks a public message from a user the recipient has blocked
+	Blocked bool `json:"blocked,omitempty"`
+
+	// Missed counts messages dropped because the recipient fell behind
+	Missed int `json:"missed,omitempty"`
+
+	// Hello fields: the protocol version and the capabilities requested by
+	// the client or granted by the server
+	Version      int      `json:"version,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+
+	// RetryAfter is how many seconds a rate-limited client should wait
+	// before sending again
+	RetryAfter int `json:"retry_after,omitempty"`
+
+	// Bot marks a message posted by a bot or an external system rather
+	// than a user
+	Bot bool `json:"bot,omitempty"`
+
+	// Token authenticates a join under a bot account's name
+	Token string `json:"token,omitempty"`
+}
+
+// resetServerFields clears fields that only the server may set so clients
+// cannot forge them on inbound messages
+func (m *Message) resetServerFields() {
+	m.ID = ""
+	m.Reactions = nil
+	m.ReactionVersion = 0
+	m.ThreadID = ""
+	m.ReplyCount = 0
+	m.Messages = nil
+	m.Mentions = nil
+	m.Blocked = false
+	m.Missed = 0
+	m.Bot = false
 }
 
 // SetTimestamp sets the current time as the message timestamp
 func (m *Message) SetTimestamp() {
-	m.Timestamp = time.Now()
+	m.SetTimestampAt(systemClock.Now())
+}
+
+// SetTimestampAt sets the message timestamp, normally from the hub's or
+// client's clock
+func (m *Message) SetTimestampAt(now time.Time) {
+	m.Timestamp = now
 }
 
 // Validate checks if the message has valid fields based on its type
@@ -44,7 +150,12 @@ func (m *Message) Validate() error {
 
 	// Validate message type is one of the allowed constants
 	switch m.Type {
-	case MessageTypeChat, MessageTypePrivate, MessageTypeSystem, MessageTypeUserList, MessageTypeError, MessageTypeJoin:
+	case MessageTypeChat, MessageTypePrivate, MessageTypeSystem, MessageTypeUserList, MessageTypeError, MessageTypeJoin,
+		MessageTypeReact, MessageTypeUnreact, MessageTypeReaction,
+		MessageTypeGetThread, MessageTypeThread, MessageTypeThreadReply, MessageTypeMention,
+		MessageTypeGroupCreate, MessageTypeGroupAdd, MessageTypeGroupLeave, MessageTypeGroupMessage, MessageTypeGroupInfo,
+		MessageTypeBlock, MessageTypeUnblock, MessageTypeBlockList, MessageTypeHello, MessageTypeTyping,
+		MessageTypeReceipt, MessageTypePresence:
 		// Valid type
 	default:
 		return errors.New("invalid message type")
@@ -87,6 +198,65 @@ func (m *Message) Validate() error {
 		if m.Users == nil {
 			return errors.New("user_list message must have users field")
 		}
+	case MessageTypeReact, MessageTypeUnreact:
+		if m.MessageID == "" {
+			return errors.New("reaction must target a message (message_id field)")
+		}
+		if err := validateReactionEmoji(m.Emoji); err != nil {
+			return err
+		}
+	case MessageTypeHello:
+		if m.Version <= 0 {
+			return errors.New("hello must declare a protocol version (version field)")
+		}
+	case MessageTypeReaction:
+		if m.MessageID == "" {
+			return errors.New("reaction update must have message_id field")
+		}
+	case MessageTypeGetThread, MessageTypeThread, MessageTypeThreadReply:
+		if m.MessageID == "" {
+			return errors.New("thread message must have message_id field")
+		}
+	case MessageTypeMention:
+		if len(m.Mentions) == 0 {
+			return errors.New("mention message must have mentions field")
+		}
+	case MessageTypeBlock, MessageTypeUnblock:
+		if err := validateDisplayName(m.To); err != nil {
+			return errors.New("block target invalid: " + err.Error())
+		}
+	case MessageTypeBlockList:
+		if m.Users == nil {
+			return errors.New("block_list message must have users field")
+		}
+	case MessageTypeGroupCreate:
+		if len(m.Users) == 0 {
+			return errors.New("group conversation must have participants (users field)")
+		}
+		if err := validateParticipants(m.Users); err != nil {
+			return err
+		}
+	case MessageTypeGroupAdd:
+		if m.ConversationID == "" {
+			return errors.New("group message must have conversation_id field")
+		}
+		if len(m.Users) == 0 {
+			return errors.New("group add must have participants (users field)")
+		}
+		if err := validateParticipants(m.Users); err != nil {
+			return err
+		}
+	case MessageTypeGroupLeave, MessageTypeGroupInfo:
+		if m.ConversationID == "" {
+			return errors.New("group message must have conversation_id field")
+		}
+	case MessageTypeGroupMessage:
+		if m.ConversationID == "" {
+			return errors.New("group message must have conversation_id field")
+		}
+		if err := validateMessageContent(m.Content); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -133,6 +303,19 @@ func validateDisplayName(name string) error {
 	return nil
 }
 
+// validateParticipants validates the display names of conversation participants
+func validateParticipants(names []string) error {
+	if len(names) > maxGroupParticipants {
+		return errors.New("too many participants")
+	}
+	for _, name := range names {
+		if err := validateDisplayName(name); err != nil {
+			return errors.New("participant name invalid: " + err.Error())
+		}
+	}
+	return nil
+}
+
 // validateMessageContent validates and sanitizes message content
 func validateMessageContent(content string) error {
 	// Trim whitespace
@@ -175,6 +358,9 @@ func (m *Message) SanitizeInput() {
 	for i, user := range m.Users {
 		m.Users[i] = html.EscapeString(strings.TrimSpace(user))
 	}
+	for i, user := range m.Mentions {
+		m.Mentions[i] = html.EscapeString(strings.TrimSpace(user))
+	}
 }
 
 // ToJSON converts the message to JSON bytes
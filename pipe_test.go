@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Messages each end of a pipe buffers before writes block
+const pipeBufferSize = 64
+
+// errPipeClosed is returned by operations on a closed pipe end
+var errPipeClosed = errors.New("pipe closed")
+
+// pipeTimeoutError is returned when a pipe deadline passes. Like the
+// network errors gorilla returns, it reports Timeout.
+type pipeTimeoutError struct{}
+
+func (pipeTimeoutError) Error() string   { return "pipe deadline exceeded" }
+func (pipeTimeoutError) Timeout() bool   { return true }
+func (pipeTimeoutError) Temporary() bool { return true }
+
+// pipeAddr is the address of a pipe end
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
+
+// pipeMessage is a data or control message in flight
+type pipeMessage struct {
+	messageType int
+	data        []byte
+}
+
+// PipeConn is one end of an in-memory WebSocket connection. It implements
+// Transport with WebSocket semantics: pings are answered with pongs when
+// the other end reads, close frames are echoed and reads fail once the
+// other end closes. Deadlines follow the pipe's clock, so a FakeClock can
+// time connections out deterministically.
+type PipeConn struct {
+	clock  Clock
+	name   string
+	in     chan pipeMessage
+	peer   *PipeConn
+	closed chan struct{}
+
+	closeOnce sync.Once
+
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readLimit     int64
+	pongHandler   func(string) error
+	closeErr      error
+}
+
+// NewPipe returns the two connected ends of an in-memory connection
+func NewPipe(clock Clock) (server, client *PipeConn) {
+	if clock == nil {
+		clock = systemClock
+	}
+	server = &PipeConn{clock: clock, name: "pipe-server", in: make(chan pipeMessage, pipeBufferSize), closed: make(chan struct{})}
+	client = &PipeConn{clock: clock, name: "pipe-client", in: make(chan pipeMessage, pipeBufferSize), closed: make(chan struct{})}
+	server.peer, client.peer = client, server
+	return server, client
+}
+
+// deadlineTimer returns a timer for the deadline on the pipe's clock, or a
+// nil channel if there is none. expired reports a deadline already passed.
+func (p *PipeConn) deadlineTimer(deadline time.Time) (c <-chan time.Time, stop func() bool, expired bool) {
+	if deadline.IsZero() {
+		return nil, func() bool { return false }, false
+	}
+	remaining := deadline.Sub(p.clock.Now())
+	if remaining <= 0 {
+		return nil, func() bool { return false }, true
+	}
+	timer := p.clock.NewTimer(remaining)
+	return timer.C(), timer.Stop, false
+}
+
+// ReadMessage returns the next data message, answering pings and running
+// the pong handler on the way. A deadline extended while waiting, as the
+// pong handler does, is honoured.
+func (p *PipeConn) ReadMessage() (int, []byte, error) {
+	for {
+		p.mu.Lock()
+		deadline, closeErr := p.readDeadline, p.closeErr
+		p.mu.Unlock()
+		if closeErr != nil {
+			return 0, nil, closeErr
+		}
+
+		var message pipeMessage
+		select {
+		case message = <-p.in:
+		default:
+			timer, stop, expired := p.deadlineTimer(deadline)
+			if expired {
+				return 0, nil, pipeTimeoutError{}
+			}
+			select {
+			case message = <-p.in:
+				stop()
+			case <-p.closed:
+				stop()
+				return 0, nil, errPipeClosed
+			case <-p.peer.closed:
+				stop()
+				// Deliver what the peer wrote before it went away
+				select {
+				case message = <-p.in:
+				default:
+					return 0, nil, &websocket.CloseError{Code: websocket.CloseAbnormalClosure, Text: io.ErrUnexpectedEOF.Error()}
+				}
+			case <-timer:
+				p.mu.Lock()
+				extended := p.readDeadline.After(deadline)
+				p.mu.Unlock()
+				if extended {
+					continue
+				}
+				return 0, nil, pipeTimeoutError{}
+			}
+		}
+
+		switch message.messageType {
+		case websocket.PingMessage:
+			p.WriteMessage(websocket.PongMessage, message.data)
+		case websocket.PongMessage:
+			p.mu.Lock()
+			handler := p.pongHandler
+			p.mu.Unlock()
+			if handler != nil {
+				if err := handler(string(message.data)); err != nil {
+					return 0, nil, err
+				}
+			}
+		case websocket.CloseMessage:
+			closeErr := &websocket.CloseError{Code: websocket.CloseNoStatusReceived}
+			if len(message.data) >= 2 {
+				closeErr.Code = int(binary.BigEndian.Uint16(message.data))
+				closeErr.Text = string(message.data[2:])
+			}
+			p.mu.Lock()
+			p.closeErr = closeErr
+			p.mu.Unlock()
+			p.WriteMessage(websocket.CloseMessage, message.data)
+			return 0, nil, closeErr
+		default:
+			p.mu.Lock()
+			limit := p.readLimit
+			p.mu.Unlock()
+			if limit > 0 && int64(len(message.data)) > limit {
+				p.Close()
+				return 0, nil, websocket.ErrReadLimit
+			}
+			return message.messageType, message.data, nil
+		}
+	}
+}
+
+// WriteMessage sends a message to the other end, waiting for buffer room
+// until the write deadline
+func (p *PipeConn) WriteMessage(messageType int, data []byte) error {
+	message := pipeMessage{messageType: messageType, data: append([]byte(nil), data...)}
+
+	p.mu.Lock()
+	deadline := p.writeDeadline
+	p.mu.Unlock()
+
+	select {
+	case <-p.closed:
+		return errPipeClosed
+	case <-p.peer.closed:
+		return errPipeClosed
+	default:
+	}
+
+	timer, stop, expired := p.deadlineTimer(deadline)
+	if expired {
+		return pipeTimeoutError{}
+	}
+	defer stop()
+	select {
+	case p.peer.in <- message:
+		return nil
+	case <-p.closed:
+		return errPipeClosed
+	case <-p.peer.closed:
+		return errPipeClosed
+	case <-timer:
+		return pipeTimeoutError{}
+	}
+}
+
+// pipeWriter buffers a message until it is closed
+type pipeWriter struct {
+	conn        *PipeConn
+	messageType int
+	buf         bytes.Buffer
+}
+
+func (w *pipeWriter) Write(p []byte) (int, error) { return w.buf.Write(p) }
+func (w *pipeWriter) Close() error                { return w.conn.WriteMessage(w.messageType, w.buf.Bytes()) }
+
+// NextWriter returns a writer that sends the message once closed
+func (p *PipeConn) NextWriter(messageType int) (io.WriteCloser, error) {
+	return &pipeWriter{conn: p, messageType: messageType}, nil
+}
+
+// SetReadLimit sets the largest message ReadMessage accepts
+func (p *PipeConn) SetReadLimit(limit int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.readLimit = limit
+}
+
+// SetReadDeadline sets when ReadMessage gives up, on the pipe's clock
+func (p *PipeConn) SetReadDeadline(deadline time.Time) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.readDeadline = deadline
+	return nil
+}
+
+// SetWriteDeadline sets when WriteMessage gives up, on the pipe's clock
+func (p *PipeConn) SetWriteDeadline(deadline time.Time) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.writeDeadline = deadline
+	return nil
+}
+
+// SetPongHandler sets the function called when a pong is read
+func (p *PipeConn) SetPongHandler(h func(string) error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pongHandler = h
+}
+
+// RemoteAddr names the other end of the pipe
+func (p *PipeConn) RemoteAddr() net.Addr { return pipeAddr(p.peer.name) }
+
+// Close closes this end; the other end's reads fail once drained
+func (p *PipeConn) Close() error {
+	p.closeOnce.Do(func() { close(p.closed) })
+	return nil
+}
+
+var _ Transport = (*PipeConn)(nil)
+
+func TestPipe_DeliversInOrder(t *testing.T) {
+	server, client := NewPipe(nil)
+	defer server.Close()
+	defer client.Close()
+
+	for _, data := range []string{"one", "two", "three"} {
+		if err := client.WriteMessage(websocket.TextMessage, []byte(data)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	for _, want := range []string{"one", "two", "three"} {
+		if _, data, err := server.ReadMessage(); err != nil || string(data) != want {
+			t.Errorf("Expected %s, got %q (%v)", want, data, err)
+		}
+	}
+}
+
+func TestPipe_PingPong(t *testing.T) {
+	server, client := NewPipe(nil)
+	defer server.Close()
+	defer client.Close()
+
+	pongs := make(chan string, 1)
+	server.SetPongHandler(func(data string) error {
+		pongs <- data
+		return nil
+	})
+
+	// The client answers the ping while reading; the server sees the pong
+	// while reading too
+	server.WriteMessage(websocket.PingMessage, []byte("are you there"))
+	go client.ReadMessage()
+	go server.ReadMessage()
+
+	select {
+	case data := <-pongs:
+		if data != "are you there" {
+			t.Errorf("Unexpected pong payload %q", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a pong")
+	}
+}
+
+func TestPipe_CloseFrameAndPeerClose(t *testing.T) {
+	server, client := NewPipe(nil)
+
+	server.WriteMessage(websocket.TextMessage, []byte("last words"))
+	server.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "busy"))
+	server.Close()
+
+	if _, data, err := client.ReadMessage(); err != nil || string(data) != "last words" {
+		t.Errorf("Expected queued data before the close, got %q (%v)", data, err)
+	}
+	_, _, err := client.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseTryAgainLater) {
+		t.Errorf("Expected the close frame, got %v", err)
+	}
+
+	if err := client.WriteMessage(websocket.TextMessage, []byte("anyone?")); err != errPipeClosed {
+		t.Errorf("Expected writes to a closed peer to fail, got %v", err)
+	}
+
+	other, peer := NewPipe(nil)
+	peer.Close()
+	_, _, err = other.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseAbnormalClosure) {
+		t.Errorf("Expected an abnormal closure, got %v", err)
+	}
+}
+
+func TestPipe_DeadlinesFollowFakeClock(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	server, client := NewPipe(clock)
+	defer server.Close()
+	defer client.Close()
+
+	server.SetReadDeadline(clock.Now().Add(time.Minute))
+	result := make(chan error, 1)
+	go func() {
+		_, _, err := server.ReadMessage()
+		result <- err
+	}()
+
+	waitUntil(time.Second, func() bool { return clock.Timers() == 1 })
+	clock.Advance(59 * time.Second)
+	select {
+	case err := <-result:
+		t.Fatalf("Read returned before the deadline: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	clock.Advance(time.Second)
+	select {
+	case err := <-result:
+		if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+			t.Errorf("Expected a timeout, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the read to time out")
+	}
+}
+
+func TestPipe_WriteBlocksUntilDeadline(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	server, client := NewPipe(clock)
+	defer server.Close()
+	defer client.Close()
+
+	for i := 0; i < pipeBufferSize; i++ {
+		server.WriteMessage(websocket.TextMessage, []byte("x"))
+	}
+
+	server.SetWriteDeadline(clock.Now().Add(10 * time.Second))
+	result := make(chan error, 1)
+	go func() { result <- server.WriteMessage(websocket.TextMessage, []byte("one too many")) }()
+
+	waitUntil(time.Second, func() bool { return clock.Timers() == 1 })
+	clock.Advance(10 * time.Second)
+	if err := <-result; err == nil {
+		t.Error("Expected the blocked write to time out")
+	}
+}
+
+func TestPipe_ReadLimit(t *testing.T) {
+	server, client := NewPipe(nil)
+	defer client.Close()
+
+	server.SetReadLimit(4)
+	client.WriteMessage(websocket.TextMessage, []byte("too long"))
+	if _, _, err := server.ReadMessage(); err != websocket.ErrReadLimit {
+		t.Errorf("Expected ErrReadLimit, got %v", err)
+	}
+}
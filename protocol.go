@@ -0,0 +1,345 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// Protocol versions this server speaks. Clients declare theirs in hello.
+const (
+	protocolVersion    = 1
+	minProtocolVersion = 1
+)
+
+// Capabilities a client can ask for in its hello. Each names the message
+// types and fields added to the protocol for a feature; clients that did
+// not ask for one are sent the messages they understand without them.
+const (
+	CapabilityReactions     = "reactions"
+	CapabilityThreads       = "threads"
+	CapabilityMentions      = "mentions"
+	CapabilityGroups        = "groups"
+	CapabilityBlocks        = "blocks"
+	CapabilityTyping        = "typing"
+	CapabilityBots          = "bots"
+	CapabilityRateLimits    = "rate_limits"
+	CapabilityMissed        = "missed"
+	CapabilityReceipts      = "receipts"
+	CapabilityPresenceDiffs = "presence_diffs"
+	CapabilityCompression   = "compression"
+	CapabilityBatching      = "batching"
+)
+
+// contentCapabilities are the capabilities that add message types or
+// fields. Clients with all of them are sent every message unchanged.
+var contentCapabilities = []string{
+	CapabilityReactions, CapabilityThreads, CapabilityMentions, CapabilityGroups, CapabilityBlocks,
+	CapabilityTyping, CapabilityBots, CapabilityRateLimits, CapabilityMissed, CapabilityReceipts,
+}
+
+// clientProtocol is what a client negotiated. Clients that never send hello
+// are legacy clients and are only sent the protocol as it was before hello
+// existed: one message per frame, with no new message types or fields.
+type clientProtocol struct {
+	mu           sync.RWMutex
+	version      int
+	capabilities map[string]bool
+
+	// complete is set when every content capability was negotiated
+	complete bool
+
+	// profile names the content capabilities negotiated, see contentProfile
+	profile string
+}
+
+// completeProfile is the profile of clients that negotiated every content
+// capability, which are sent broadcasts unchanged
+const completeProfile = "*"
+
+// hasCapability reports whether the client negotiated a feature
+func (c *Client) hasCapability(name string) bool {
+	c.protocol.mu.RLock()
+	defer c.protocol.mu.RUnlock()
+	return c.protocol.capabilities[name]
+}
+
+// hasAllContent reports whether the client negotiated every capability
+// that adds message types or fields
+func (c *Client) hasAllContent() bool {
+	c.protocol.mu.RLock()
+	defer c.protocol.mu.RUnlock()
+	return c.protocol.complete
+}
+
+// contentProfile names the set of content capabilities the client
+// negotiated. Broadcasts are stripped once per profile in use rather than
+// once per client.
+func (c *Client) contentProfile() string {
+	c.protocol.mu.RLock()
+	defer c.protocol.mu.RUnlock()
+	if c.protocol.complete {
+		return completeProfile
+	}
+	return c.protocol.profile
+}
+
+// profileCapabilities returns the content capabilities a profile names
+func profileCapabilities(profile string) map[string]bool {
+	negotiated := make(map[string]bool)
+	for _, name := range strings.Split(profile, ",") {
+		if name != "" {
+			negotiated[name] = true
+		}
+	}
+	return negotiated
+}
+
+// ProtocolVersion returns the version the client negotiated, or 0 if it
+// never sent hello
+func (c *Client) ProtocolVersion() int {
+	c.protocol.mu.RLock()
+	defer c.protocol.mu.RUnlock()
+	return c.protocol.version
+}
+
+// supportsCapability reports whether the server can provide a feature to
+// this client. Compression also needs permessage-deflate from the upgrade.
+func (c *Client) supportsCapability(name string) bool {
+	switch name {
+	case CapabilityCompression:
+		return c.compress
+	case CapabilityBatching:
+		// Only text codecs have a separator to split batches on
+		return c.wireCodec().FrameType() == websocket.TextMessage
+	case CapabilityPresenceDiffs:
+		return true
+	}
+	for _, content := range contentCapabilities {
+		if name == content {
+			return true
+		}
+	}
+	return false
+}
+
+// requiredCapability returns the capability a client needs to be sent a
+// message, or "" if every client gets it
+func requiredCapability(message *Message) string {
+	switch message.Type {
+	case MessageTypeReaction:
+		return CapabilityReactions
+	case MessageTypeThread, MessageTypeThreadReply:
+		return CapabilityThreads
+	case MessageTypeMention:
+		return CapabilityMentions
+	case MessageTypeGroupMessage, MessageTypeGroupInfo:
+		return CapabilityGroups
+	case MessageTypeBlockList:
+		return CapabilityBlocks
+	case MessageTypeTyping:
+		return CapabilityTyping
+	case MessageTypeReceipt:
+		return CapabilityReceipts
+	case MessageTypePresence:
+		return CapabilityPresenceDiffs
+	}
+	return ""
+}
+
+// stripUnnegotiated removes the fields of features the client did not ask
+// for from a message it is sent. It reports whether anything was removed.
+func (c *Client) stripUnnegotiated(m *Message) bool {
+	c.protocol.mu.RLock()
+	negotiated := c.protocol.capabilities
+	c.protocol.mu.RUnlock()
+	return stripMessage(m, negotiated)
+}
+
+// stripMessage removes the fields of features not in negotiated from a
+// message. It reports whether anything was removed.
+func stripMessage(m *Message, negotiated map[string]bool) bool {
+	stripped := *m
+	if !negotiated[CapabilityReactions] {
+		stripped.Reactions = nil
+		stripped.ReactionVersion = 0
+		stripped.Emoji = ""
+	}
+	if !negotiated[CapabilityThreads] {
+		stripped.ReplyTo = ""
+		stripped.ThreadID = ""
+		stripped.ReplyCount = 0
+		stripped.Messages = nil
+	}
+	if !negotiated[CapabilityReactions] && !negotiated[CapabilityThreads] && !negotiated[CapabilityReceipts] {
+		// IDs only serve to react to, reply to and acknowledge messages
+		stripped.ID = ""
+		stripped.MessageID = ""
+	}
+	if !negotiated[CapabilityMentions] {
+		stripped.Mentions = nil
+	}
+	if !negotiated[CapabilityGroups] {
+		stripped.ConversationID = ""
+	}
+	if !negotiated[CapabilityBlocks] {
+		stripped.Blocked = false
+	}
+	if !negotiated[CapabilityBots] {
+		stripped.Bot = false
+		stripped.Bots = nil
+	}
+	if !negotiated[CapabilityRateLimits] {
+		stripped.RetryAfter = 0
+	}
+	if !negotiated[CapabilityMissed] {
+		stripped.Missed = 0
+	}
+	if reflect.DeepEqual(&stripped, m) {
+		return false
+	}
+	*m = stripped
+	return true
+}
+
+// adapt fits a queued frame to what the client negotiated. It returns false
+// for messages of features the client did not ask for. Fields it did not
+// ask for are removed, and user lists become presence diffs for clients
+// that asked for them. Broadcasts carry a variant per profile in use, so
+// only frames built for one client and presence diffs are decoded here.
+func (c *Client) adapt(frame outboundFrame) (outboundFrame, bool) {
+	diffs := frame.presence && c.hasCapability(CapabilityPresenceDiffs)
+	if c.hasAllContent() && !diffs {
+		return frame, true
+	}
+	if frame.adapted {
+		if frame.capability != "" && !c.hasCapability(frame.capability) {
+			return frame, false
+		}
+		if variant, ok := frame.stripped[c.contentProfile()]; ok {
+			if !diffs {
+				return variant, true
+			}
+			frame = variant
+		}
+	}
+
+	message, err := MessageFromJSON(frame.data)
+	if err != nil {
+		return frame, true
+	}
+	if capability := requiredCapability(message); capability != "" && !c.hasCapability(capability) {
+		return frame, false
+	}
+	changed := false
+	if diffs {
+		if message, changed = c.presenceDiff(message); message == nil {
+			return frame, false
+		}
+	}
+	if c.stripUnnegotiated(message) {
+		changed = true
+	}
+	if !changed {
+		return frame, true
+	}
+
+	data, err := message.ToJSON()
+	if err != nil {
+		log.Printf("Failed to adapt %s message for %s: %v", message.Type, c.GetDisplayName(), err)
+		return frame, false
+	}
+	return outboundFrame{data: data, presence: frame.presence}, true
+}
+
+// presenceDiff turns a user list into a presence message listing who joined
+// and left since the last list written to the client, which only gets the
+// full list the first time. It returns nil if nobody came or went. Called
+// from WritePump only, so it sees lists in the order they are written.
+func (c *Client) presenceDiff(list *Message) (*Message, bool) {
+	users := make(map[string]bool, len(list.Users))
+	for _, name := range list.Users {
+		users[name] = true
+	}
+	previous := c.presenceUsers
+	c.presenceUsers = users
+	if previous == nil {
+		return list, false
+	}
+
+	diff := &Message{Type: MessageTypePresence, Timestamp: list.Timestamp}
+	for _, name := range list.Users {
+		if !previous[name] {
+			diff.Users = append(diff.Users, name)
+		}
+	}
+	for name := range previous {
+		if !users[name] {
+			diff.Left = append(diff.Left, name)
+		}
+	}
+	if len(diff.Users) == 0 && len(diff.Left) == 0 {
+		return nil, false
+	}
+	sort.Strings(diff.Left)
+	for _, name := range list.Bots {
+		if !previous[name] {
+			diff.Bots = append(diff.Bots, name)
+		}
+	}
+	return diff, true
+}
+
+// handleHello negotiates the protocol version and capabilities. The reply
+// lists the capabilities the server will use with this client.
+func (c *Client) handleHello(message *Message) {
+	if message.Version < minProtocolVersion || message.Version > protocolVersion {
+		log.Printf("[PROTOCOL] Rejected hello with version %d from %s", message.Version, c.GetDisplayName())
+		c.sendError(fmt.Sprintf("Unsupported protocol version %d: server supports versions %d to %d",
+			message.Version, minProtocolVersion, protocolVersion))
+		return
+	}
+
+	enabled := make(map[string]bool)
+	accepted := make([]string, 0, len(message.Capabilities))
+	for _, name := range message.Capabilities {
+		if !enabled[name] && c.supportsCapability(name) {
+			enabled[name] = true
+			accepted = append(accepted, name)
+		}
+	}
+
+	complete := true
+	var profile []string
+	for _, name := range contentCapabilities {
+		complete = complete && enabled[name]
+		if enabled[name] {
+			profile = append(profile, name)
+		}
+	}
+
+	c.protocol.mu.Lock()
+	c.protocol.version = message.Version
+	c.protocol.capabilities = enabled
+	c.protocol.complete = complete
+	c.protocol.profile = strings.Join(profile, ",")
+	c.protocol.mu.Unlock()
+	if c.hub != nil {
+		c.hub.retrackProfile(c)
+	}
+
+	log.Printf("[PROTOCOL] Client %s speaks version %d with %v", c.GetDisplayName(), message.Version, accepted)
+
+	reply := &Message{
+		Type:         MessageTypeHello,
+		Version:      message.Version,
+		Capabilities: accepted,
+	}
+	reply.SetTimestampAt(c.now())
+	c.sendMessage(reply)
+}
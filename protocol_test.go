@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// negotiateContent has clients negotiate every capability that adds message
+// types or fields, as current clients do
+func negotiateContent(clients ...*Client) {
+	for _, client := range clients {
+		client.protocol.version = protocolVersion
+		client.protocol.capabilities = make(map[string]bool)
+		for _, name := range contentCapabilities {
+			client.protocol.capabilities[name] = true
+		}
+		client.protocol.complete = true
+	}
+}
+
+func TestMessage_Validate_Hello(t *testing.T) {
+	if err := (&Message{Type: MessageTypeHello}).Validate(); err == nil {
+		t.Error("Expected hello without a version to be rejected")
+	}
+	if err := (&Message{Type: MessageTypeHello, Version: 1}).Validate(); err != nil {
+		t.Errorf("Expected hello to be valid, got %v", err)
+	}
+}
+
+func TestClient_HandleHello_NegotiatesCapabilities(t *testing.T) {
+	hub := NewHub()
+	client := &Client{hub: hub, send: make(chan outboundFrame, 10)}
+
+	client.handleHello(&Message{
+		Type:         MessageTypeHello,
+		Version:      protocolVersion,
+		Capabilities: []string{CapabilityReceipts, CapabilityReactions, CapabilityCompression, "teleport", CapabilityReactions},
+	})
+
+	replies := drainMessages(client)
+	if len(replies) != 1 || replies[0].Type != MessageTypeHello {
+		t.Fatalf("Expected a hello reply, got %+v", replies)
+	}
+	if replies[0].Version != protocolVersion {
+		t.Errorf("Expected version %d, got %d", protocolVersion, replies[0].Version)
+	}
+	// Compression was not negotiated during the upgrade, so only receipts
+	// and reactions are granted
+	if !reflect.DeepEqual(replies[0].Capabilities, []string{CapabilityReceipts, CapabilityReactions}) {
+		t.Errorf("Unexpected capabilities %v", replies[0].Capabilities)
+	}
+	if client.ProtocolVersion() != protocolVersion || !client.hasCapability(CapabilityReactions) || client.hasCapability(CapabilityCompression) {
+		t.Error("Expected the negotiated capabilities to be recorded")
+	}
+}
+
+func TestClient_HandleHello_RejectsUnknownVersion(t *testing.T) {
+	hub := NewHub()
+	client := &Client{hub: hub, send: make(chan outboundFrame, 10)}
+
+	client.handleHello(&Message{Type: MessageTypeHello, Version: protocolVersion + 1})
+
+	replies := drainMessages(client)
+	if len(replies) != 1 || replies[0].Type != MessageTypeError {
+		t.Fatalf("Expected an error reply, got %+v", replies)
+	}
+	if !strings.Contains(replies[0].Error, "Unsupported protocol version 2") {
+		t.Errorf("Expected a clear version error, got %q", replies[0].Error)
+	}
+	if client.ProtocolVersion() != 0 {
+		t.Error("Expected the client to stay a legacy client")
+	}
+}
+
+func TestHub_CapabilitiesGateDelivery(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	defer hub.Stop()
+
+	legacy := &Client{hub: hub, send: make(chan outboundFrame, 10), displayName: "Legacy"}
+	opted := &Client{hub: hub, send: make(chan outboundFrame, 10), displayName: "Opted"}
+	minimal := &Client{hub: hub, send: make(chan outboundFrame, 10), displayName: "Minimal"}
+	for _, client := range []*Client{legacy, opted, minimal} {
+		hub.mu.Lock()
+		hub.userList[client] = client.displayName
+		hub.clientsByName[client.displayName] = client
+		hub.mu.Unlock()
+		hub.register <- client
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	opted.handleHello(&Message{Type: MessageTypeHello, Version: 1, Capabilities: []string{CapabilityReactions}})
+	minimal.handleHello(&Message{Type: MessageTypeHello, Version: 1})
+	drainMessages(opted)
+	drainMessages(minimal)
+
+	update := Message{Type: MessageTypeReaction, MessageID: "m1", Emoji: "👍", Reactions: map[string]int{"👍": 1}}
+	update.SetTimestamp()
+	hub.BroadcastMessage(update)
+	hub.sendToLocalUsers(update, "Legacy", "Opted", "Minimal")
+
+	chat := Message{Type: MessageTypeChat, From: "Legacy", Content: "still here"}
+	chat.SetTimestamp()
+	hub.BroadcastMessage(chat)
+
+	time.Sleep(20 * time.Millisecond)
+	count := func(client *Client) (reactions, chats int) {
+		for _, message := range drainMessages(client) {
+			switch message.Type {
+			case MessageTypeReaction:
+				reactions++
+			case MessageTypeChat:
+				chats++
+			}
+		}
+		return reactions, chats
+	}
+
+	for client, want := range map[*Client]int{legacy: 0, opted: 2, minimal: 0} {
+		reactions, chats := count(client)
+		if reactions != want {
+			t.Errorf("%s: expected %d reaction updates, got %d", client.displayName, want, reactions)
+		}
+		if chats != 1 {
+			t.Errorf("%s: expected the chat message, got %d", client.displayName, chats)
+		}
+	}
+}
+
+func TestHello_UnknownVersionOverWebSocket(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	defer hub.Stop()
+
+	server := newNodeServer(hub)
+	defer server.Close()
+
+	client := dialCodecTestClient(t, server.URL, JSONCodec{})
+	client.send(t, &Message{Type: MessageTypeHello, Version: 7, Capabilities: []string{CapabilityReactions}})
+
+	reply, _ := client.waitFor(t, func(m Message) bool { return m.Type == MessageTypeError })
+	if !strings.Contains(reply.Error, "Unsupported protocol version 7") {
+		t.Errorf("Expected a version error, got %q", reply.Error)
+	}
+
+	client.send(t, &Message{Type: MessageTypeHello, Version: 1, Capabilities: []string{CapabilityReactions}})
+	hello, _ := client.waitFor(t, func(m Message) bool { return m.Type == MessageTypeHello })
+	if !reflect.DeepEqual(hello.Capabilities, []string{CapabilityReactions}) {
+		t.Errorf("Unexpected capabilities %v", hello.Capabilities)
+	}
+}
+
+func TestHarness_LegacyClientGetsBaselineProtocol(t *testing.T) {
+	h := newChatHarness(t)
+	if err := h.hub.SetBotAccounts([]BotAccount{{Name: "Helper", Token: helperToken}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A client from before hello existed, reading raw frames
+	serverEnd, clientEnd := NewPipe(h.clock)
+	serveClient(NewClient(h.hub, serverEnd))
+	t.Cleanup(func() { clientEnd.Close() })
+	frames := make(chan []byte, 256)
+	go func() {
+		defer close(frames)
+		for {
+			_, data, err := clientEnd.ReadMessage()
+			if err != nil {
+				return
+			}
+			frames <- data
+		}
+	}()
+	old := &fakeClient{t: t, conn: clientEnd, name: "Old"}
+	old.send(Message{Type: MessageTypeJoin, Content: "Old"})
+
+	alice := h.join("Alice")
+	bob := h.join("Bob")
+	helper := h.connect()
+	helper.send(Message{Type: MessageTypeJoin, Content: "Helper", Token: helperToken})
+	alice.waitFor(func(m Message) bool { return m.Type == MessageTypeUserList && contains(m.Bots, "Helper") })
+
+	// Every feature added since: mentions, reactions, threads, receipts,
+	// blocks and bots
+	alice.send(Message{Type: MessageTypeChat, From: "Alice", Content: "hi @Old"})
+	var root Message
+	alice.waitFor(func(m Message) bool {
+		if m.Type == MessageTypeChat && m.ID != "" {
+			root = m
+			return true
+		}
+		return false
+	})
+	bob.send(Message{Type: MessageTypeReact, MessageID: root.ID, Emoji: "👍"})
+	bob.send(Message{Type: MessageTypeChat, From: "Bob", Content: "agreed", ReplyTo: root.ID})
+	alice.send(Message{Type: MessageTypePrivate, From: "Alice", To: "Old", Content: "psst"})
+	alice.waitFor(func(m Message) bool { return m.Type == MessageTypeReceipt })
+	old.send(Message{Type: MessageTypeBlock, To: "Bob"})
+	old.send(Message{Type: MessageTypeTyping})
+	helper.send(Message{Type: MessageTypeChat, From: "Helper", Content: "beep"})
+	alice.waitFor(func(m Message) bool { return m.Type == MessageTypeChat && m.Content == "beep" && m.Bot })
+	alice.send(Message{Type: MessageTypeChat, From: "Alice", Content: "done"})
+
+	baselineTypes := map[string]bool{
+		MessageTypeChat: true, MessageTypePrivate: true, MessageTypeSystem: true,
+		MessageTypeUserList: true, MessageTypeError: true,
+	}
+	baselineKeys := map[string]bool{"type": true, "from": true, "to": true, "content": true, "users": true, "error": true, "timestamp": true}
+	seen := make(map[string]bool)
+	limit := time.After(5 * time.Second)
+	for !(seen["hi @Old"] && seen["agreed"] && seen["psst"] && seen["beep"] && seen["done"]) {
+		var data []byte
+		select {
+		case data = <-frames:
+		case <-limit:
+			t.Fatalf("Expected every message to reach the legacy client, got %v", seen)
+		}
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(data, &fields); err != nil {
+			t.Fatalf("Expected one message per frame, got %q", data)
+		}
+		for key := range fields {
+			if !baselineKeys[key] {
+				t.Errorf("Unexpected field %q in %s", key, data)
+			}
+		}
+		var message Message
+		json.Unmarshal(data, &message)
+		if !baselineTypes[message.Type] {
+			t.Errorf("Unexpected message type in %s", data)
+		}
+		seen[message.Content] = true
+	}
+}
+
+func TestHarness_PresenceDiffs(t *testing.T) {
+	h := newChatHarness(t)
+	watcher := h.connectLegacy()
+	watcher.name = "Watcher"
+	watcher.capabilities = []string{CapabilityPresenceDiffs}
+	watcher.hello()
+	watcher.send(Message{Type: MessageTypeJoin, Content: "Watcher"})
+	watcher.waitFor(func(m Message) bool { return m.Type == MessageTypeUserList && contains(m.Users, "Watcher") })
+
+	// After the first full list, only who joined and left is sent
+	bob := h.join("Bob")
+	watcher.waitFor(func(m Message) bool {
+		return m.Type == MessageTypePresence && reflect.DeepEqual(m.Users, []string{"Bob"}) && len(m.Left) == 0
+	})
+	bob.conn.Close()
+	watcher.waitFor(func(m Message) bool {
+		return m.Type == MessageTypePresence && len(m.Users) == 0 && reflect.DeepEqual(m.Left, []string{"Bob"})
+	})
+	if n := watcher.count(func(m Message) bool { return m.Type == MessageTypeUserList }); n != 1 {
+		t.Errorf("Expected one full user list, got %d", n)
+	}
+}
+
+func TestHub_EncodeBroadcast_StripsOncePerProfile(t *testing.T) {
+	hub := NewHub()
+	first := &Client{hub: hub, send: make(chan outboundFrame, 10)}
+	second := &Client{hub: hub, send: make(chan outboundFrame, 10)}
+	opted := &Client{hub: hub, send: make(chan outboundFrame, 10)}
+	current := &Client{hub: hub, send: make(chan outboundFrame, 10)}
+	negotiateContent(current)
+	for _, client := range []*Client{first, second, opted, current} {
+		hub.assignShard(client)
+	}
+	opted.handleHello(&Message{Type: MessageTypeHello, Version: 1, Capabilities: []string{CapabilityReactions}})
+
+	chat := &Message{Type: MessageTypeChat, ID: "m1", From: "Alice", Content: "hi", Reactions: map[string]int{"👍": 1}}
+	frame, err := hub.encodeBroadcast(chat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frame.stripped) != 2 {
+		t.Fatalf("Expected a variant for the legacy and reactions profiles, got %d", len(frame.stripped))
+	}
+
+	// Legacy clients share one prepared variant without the new fields
+	a, ok := first.adapt(frame)
+	b, _ := second.adapt(frame)
+	if !ok || a.prepared == nil || a.prepared != b.prepared {
+		t.Fatal("Expected legacy clients to share a prepared variant")
+	}
+	if strings.Contains(string(a.data), `"id"`) || strings.Contains(string(a.data), `"reactions"`) {
+		t.Errorf("Expected new fields to be stripped, got %s", a.data)
+	}
+	if c, _ := opted.adapt(frame); c.prepared == nil || !strings.Contains(string(c.data), `"reactions"`) {
+		t.Errorf("Expected the reactions profile to keep reactions, got %s", c.data)
+	}
+	if d, _ := current.adapt(frame); d.prepared != frame.prepared {
+		t.Error("Expected clients with every capability to get the frame unchanged")
+	}
+
+	update, err := hub.encodeBroadcast(&Message{Type: MessageTypeReaction, MessageID: "m1", Emoji: "👍"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := first.adapt(update); ok {
+		t.Error("Expected legacy clients not to be sent reaction updates")
+	}
+	if _, ok := opted.adapt(update); !ok {
+		t.Error("Expected the reactions profile to be sent reaction updates")
+	}
+}
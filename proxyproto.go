@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long a proxy has to send the PROXY header after connecting
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxyV2Signature starts every PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Longest PROXY protocol v1 line, including CRLF
+const proxyV1MaxLength = 107
+
+var (
+	errInvalidProxyHeader = errors.New("invalid PROXY protocol header")
+	errMissingProxyHeader = errors.New("missing PROXY protocol header")
+)
+
+// ProxyListener accepts connections that may start with a PROXY protocol
+// v1 or v2 header, as sent by load balancers that pass TCP through. The
+// header is only read from trusted proxies; their connections report the
+// client address it carries and are dropped without one, so a misconfigured
+// proxy cannot have every client share its address. Other peers are served
+// as they are.
+type ProxyListener struct {
+	net.Listener
+	trusted []netip.Prefix
+}
+
+// NewProxyListener wraps a listener to read PROXY headers from the trusted
+// proxies
+func NewProxyListener(inner net.Listener, trusted []netip.Prefix) *ProxyListener {
+	return &ProxyListener{Listener: inner, trusted: trusted}
+}
+
+// Accept returns the next connection. The header is read lazily, on the
+// connection's goroutine, so a slow proxy cannot hold up Accept.
+func (l *ProxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	peer := parseRemoteIP(conn.RemoteAddr().String())
+	for _, proxy := range l.trusted {
+		if proxy.Contains(peer) {
+			return &proxyConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+		}
+	}
+	return conn, nil
+}
+
+// proxyConn is a connection from a trusted proxy
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+// readHeader consumes the PROXY header, dropping the connection without one
+func (c *proxyConn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+
+		c.remote, c.err = readProxyHeader(c.reader)
+		if c.err != nil {
+			log.Printf("[PROXY] Dropping connection from %s: %v", c.Conn.RemoteAddr(), c.err)
+			c.Conn.Close()
+		}
+	})
+}
+
+// Read returns data after the PROXY header
+func (c *proxyConn) Read(p []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(p)
+}
+
+// RemoteAddr returns the client address from the PROXY header, or the
+// proxy's own address for headers without one
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader reads a v1 or v2 header, which the stream must start
+// with. It returns a nil address for a header without a usable source, such
+// as a health check sent as LOCAL or UNKNOWN.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	// A short peek still holds a v1 header's prefix
+	start, _ := r.Peek(len(proxyV2Signature))
+	switch {
+	case bytes.HasPrefix(start, proxyV2Signature):
+		return readProxyV2(r)
+	case bytes.HasPrefix(start, []byte("PROXY ")):
+		return readProxyV1(r)
+	}
+	return nil, errMissingProxyHeader
+}
+
+// readProxyV1 parses "PROXY TCP4 src dst sport dport\r\n"
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, errInvalidProxyHeader
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errInvalidProxyHeader
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errInvalidProxyHeader
+	}
+	src, err := netip.ParseAddr(fields[2])
+	if err != nil || src.Is4() != (fields[1] == "TCP4") {
+		return nil, errInvalidProxyHeader
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, errInvalidProxyHeader
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, uint16(port))), nil
+}
+
+// readProxyV2 parses the binary header: signature, version and command,
+// address family, length and addresses, followed by TLVs that are skipped
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, errInvalidProxyHeader
+	}
+	versionCommand, family := header[12], header[13]
+	length := int(binary.BigEndian.Uint16(header[14:16]))
+	if versionCommand>>4 != 2 {
+		return nil, errInvalidProxyHeader
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, errInvalidProxyHeader
+	}
+
+	// LOCAL connections come from the proxy itself
+	if versionCommand&0x0f == 0 {
+		return nil, nil
+	}
+	if versionCommand&0x0f != 1 {
+		return nil, errInvalidProxyHeader
+	}
+
+	switch family >> 4 {
+	case 1: // IPv4: source, destination, source port, destination port
+		if length < 12 {
+			return nil, errInvalidProxyHeader
+		}
+		src := netip.AddrFrom4(*(*[4]byte)(body[0:4]))
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, binary.BigEndian.Uint16(body[8:10]))), nil
+	case 2: // IPv6
+		if length < 36 {
+			return nil, errInvalidProxyHeader
+		}
+		src := netip.AddrFrom16(*(*[16]byte)(body[0:16])).Unmap()
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, binary.BigEndian.Uint16(body[32:34]))), nil
+	}
+	// Unix sockets and unspecified families carry no client IP
+	return nil, nil
+}
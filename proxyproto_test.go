@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+// proxyV2Header builds a v2 PROXY header for a TCP source and destination
+func proxyV2Header(command byte, src, dst netip.AddrPort) []byte {
+	var body bytes.Buffer
+	family := byte(0x11)
+	if src.Addr().Is6() {
+		family = 0x21
+		srcIP, dstIP := src.Addr().As16(), dst.Addr().As16()
+		body.Write(srcIP[:])
+		body.Write(dstIP[:])
+	} else {
+		srcIP, dstIP := src.Addr().As4(), dst.Addr().As4()
+		body.Write(srcIP[:])
+		body.Write(dstIP[:])
+	}
+	binary.Write(&body, binary.BigEndian, src.Port())
+	binary.Write(&body, binary.BigEndian, dst.Port())
+	// A TLV the parser must skip
+	body.Write([]byte{0x04, 0x00, 0x02, 'h', 'i'})
+
+	header := append([]byte(nil), proxyV2Signature...)
+	header = append(header, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(body.Len()))
+	return append(header, body.Bytes()...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	src4 := netip.MustParseAddrPort("203.0.113.9:51000")
+	dst4 := netip.MustParseAddrPort("192.0.2.1:443")
+	src6 := netip.MustParseAddrPort("[2001:db8::9]:51000")
+	dst6 := netip.MustParseAddrPort("[2001:db8::1]:443")
+
+	tests := []struct {
+		name   string
+		stream []byte
+		want   string
+		err    bool
+	}{
+		{"v1 TCP4", []byte("PROXY TCP4 203.0.113.9 192.0.2.1 51000 443\r\nGET /"), "203.0.113.9:51000", false},
+		{"v1 TCP6", []byte("PROXY TCP6 2001:db8::9 2001:db8::1 51000 443\r\nGET /"), "[2001:db8::9]:51000", false},
+		{"v1 UNKNOWN", []byte("PROXY UNKNOWN\r\nGET /"), "", false},
+		{"v1 family mismatch", []byte("PROXY TCP4 2001:db8::9 2001:db8::1 51000 443\r\n"), "", true},
+		{"v1 without CRLF", []byte("PROXY TCP4 203.0.113.9 192.0.2.1 51000 443\n"), "", true},
+		{"v1 too long", []byte("PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n"), "", true},
+		{"v2 IPv4", append(proxyV2Header(1, src4, dst4), "GET /"...), "203.0.113.9:51000", false},
+		{"v2 IPv6", append(proxyV2Header(1, src6, dst6), "GET /"...), "[2001:db8::9]:51000", false},
+		{"v2 LOCAL", append(proxyV2Header(0, src4, dst4), "GET /"...), "", false},
+		{"v2 truncated", proxyV2Header(1, src4, dst4)[:20], "", true},
+		{"no header", []byte("GET / HTTP/1.1\r\n\r\n"), "", true},
+		{"empty stream", nil, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := bufio.NewReader(bytes.NewReader(tt.stream))
+			addr, err := readProxyHeader(reader)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("Expected an error, got %v", addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			got := ""
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != tt.want {
+				t.Errorf("Expected %q, got %q", tt.want, got)
+			}
+
+			// What follows the header is left for the application
+			rest, _ := io.ReadAll(reader)
+			if !bytes.HasPrefix(rest, []byte("GET /")) {
+				t.Errorf("Expected the request to follow the header, got %q", rest)
+			}
+		})
+	}
+}
+
+// serveRemoteAddr serves the request's remote address over a listener
+// wrapped for the given trusted proxies
+func serveRemoteAddr(t *testing.T, trusted string) string {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxies, _ := ParseTrustedProxies(trusted)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.RemoteAddr)
+	})}
+	go server.Serve(NewProxyListener(inner, proxies))
+	t.Cleanup(func() { server.Close() })
+	return inner.Addr().String()
+}
+
+func TestProxyListener(t *testing.T) {
+	request := "PROXY TCP4 203.0.113.9 192.0.2.1 51000 80\r\nGET / HTTP/1.1\r\nHost: chat\r\nConnection: close\r\n\r\n"
+
+	send := func(addr string) *http.Response {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Write([]byte(request))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		return resp
+	}
+
+	resp := send(serveRemoteAddr(t, "127.0.0.0/8"))
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "203.0.113.9:51000" {
+		t.Errorf("Expected the address from the PROXY header, got %q", body)
+	}
+
+	// Untrusted peers cannot send a header; theirs is a malformed request
+	resp = send(serveRemoteAddr(t, "10.0.0.0/8"))
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected a PROXY header from an untrusted peer to be refused, got %d", resp.StatusCode)
+	}
+
+	// Connections from trusted proxies must start with a header, so clients
+	// bypassing the proxy do not all share its address
+	if _, err := http.Get("http://" + serveRemoteAddr(t, "127.0.0.0/8")); err == nil {
+		t.Error("Expected a trusted peer's connection without a header to be dropped")
+	}
+}
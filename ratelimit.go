@@ -0,0 +1,315 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimitKind names one of a client's rate-limit budgets
+type RateLimitKind string
+
+const (
+	RateLimitChat     RateLimitKind = "chat"
+	RateLimitPrivate  RateLimitKind = "private"
+	RateLimitTyping   RateLimitKind = "typing"
+	RateLimitReaction RateLimitKind = "reaction"
+)
+
+// rateLimitKinds lists every budget a client has
+var rateLimitKinds = []RateLimitKind{RateLimitChat, RateLimitPrivate, RateLimitTyping, RateLimitReaction}
+
+// RateBudget is a token bucket: a client may send Burst messages at once and
+// earns one more every Refill, up to Burst again
+type RateBudget struct {
+	Burst  int
+	Refill time.Duration
+}
+
+// String formats the budget as burst/refill, as ParseRateBudgets reads it
+func (b RateBudget) String() string {
+	return strconv.Itoa(b.Burst) + "/" + b.Refill.String()
+}
+
+// RateLimitConfig holds the per-kind budgets and the penalties for clients
+// that keep exceeding them
+type RateLimitConfig struct {
+	Budgets map[RateLimitKind]RateBudget
+
+	// MuteAfter violations within ViolationWindow mute the client for
+	// MuteDuration. Each further mute doubles, up to MaxMuteDuration, until
+	// the client goes ForgiveAfter without being muted.
+	MuteAfter       int
+	ViolationWindow time.Duration
+	MuteDuration    time.Duration
+	MaxMuteDuration time.Duration
+	ForgiveAfter    time.Duration
+}
+
+// DefaultRateLimitConfig returns budgets of 30 messages a minute for chat
+// and private messages, short bursts of typing notifications and reactions,
+// and mutes starting at 30 seconds after five violations in a minute
+func DefaultRateLimitConfig() RateLimitConfig {
+	return RateLimitConfig{
+		Budgets: map[RateLimitKind]RateBudget{
+			RateLimitChat:     {Burst: 30, Refill: 2 * time.Second},
+			RateLimitPrivate:  {Burst: 30, Refill: 2 * time.Second},
+			RateLimitTyping:   {Burst: 3, Refill: 2 * time.Second},
+			RateLimitReaction: {Burst: 20, Refill: time.Second},
+		},
+		MuteAfter:       5,
+		ViolationWindow: time.Minute,
+		MuteDuration:    30 * time.Second,
+		MaxMuteDuration: 10 * time.Minute,
+		ForgiveAfter:    time.Hour,
+	}
+}
+
+// Validate checks that every kind has a usable budget and that the
+// penalties are consistent
+func (c RateLimitConfig) Validate() error {
+	for _, kind := range rateLimitKinds {
+		budget, ok := c.Budgets[kind]
+		if !ok {
+			return fmt.Errorf("missing %s rate limit budget", kind)
+		}
+		if budget.Burst < 1 || budget.Refill <= 0 {
+			return fmt.Errorf("%s rate limit needs a burst of at least 1 and a positive refill", kind)
+		}
+	}
+	if c.MuteAfter < 1 {
+		return errors.New("rate limit mute threshold must be at least 1")
+	}
+	if c.ViolationWindow <= 0 || c.MuteDuration <= 0 || c.ForgiveAfter <= 0 {
+		return errors.New("rate limit violation window, mute duration and forgiveness must be positive")
+	}
+	if c.MaxMuteDuration < c.MuteDuration {
+		return errors.New("maximum mute duration cannot be shorter than the first mute")
+	}
+	return nil
+}
+
+// ParseRateBudgets reads budgets written as kind=burst/refill separated by
+// commas, e.g. "chat=10/3s,typing=5/1s", over the given defaults
+func ParseRateBudgets(spec string, defaults map[RateLimitKind]RateBudget) (map[RateLimitKind]RateBudget, error) {
+	budgets := make(map[RateLimitKind]RateBudget, len(defaults))
+	for kind, budget := range defaults {
+		budgets[kind] = budget
+	}
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(entry, "=")
+		kind := RateLimitKind(strings.ToLower(strings.TrimSpace(name)))
+		if _, known := defaults[kind]; !ok || !known {
+			return nil, errors.New("unknown rate limit budget: " + entry)
+		}
+		burstText, refillText, ok := strings.Cut(value, "/")
+		if !ok {
+			return nil, errors.New("rate limit budget must be burst/refill: " + entry)
+		}
+		burst, err := strconv.Atoi(strings.TrimSpace(burstText))
+		if err != nil {
+			return nil, errors.New("invalid rate limit burst: " + entry)
+		}
+		refill, err := time.ParseDuration(strings.TrimSpace(refillText))
+		if err != nil {
+			return nil, errors.New("invalid rate limit refill: " + entry)
+		}
+		budgets[kind] = RateBudget{Burst: burst, Refill: refill}
+	}
+	return budgets, nil
+}
+
+// SetRateLimits replaces the rate-limit budgets and penalties. It must be
+// called before clients connect.
+func (h *Hub) SetRateLimits(config RateLimitConfig) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	h.rateLimits = config
+	return nil
+}
+
+// tokenBucket is one budget's state. Tokens are counted fractionally so
+// refill is continuous.
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// newTokenBucket returns a full bucket
+func newTokenBucket(budget RateBudget, now time.Time) *tokenBucket {
+	return &tokenBucket{tokens: float64(budget.Burst), updated: now}
+}
+
+// refill adds the tokens earned since the last update, up to the burst
+func (b *tokenBucket) refill(budget RateBudget, now time.Time) {
+	if elapsed := now.Sub(b.updated); elapsed > 0 {
+		b.tokens += float64(elapsed) / float64(budget.Refill)
+		if b.tokens > float64(budget.Burst) {
+			b.tokens = float64(budget.Burst)
+		}
+		b.updated = now
+	}
+}
+
+// wait returns how long until the bucket holds a whole token
+func (b *tokenBucket) wait(budget RateBudget) time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) * float64(budget.Refill))
+}
+
+// rateLimiter tracks a client's buckets and penalties. The zero value is
+// ready to use; buckets start full.
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[RateLimitKind]*tokenBucket
+
+	violations    int
+	lastViolation time.Time
+	mutes         int
+	mutedUntil    time.Time
+}
+
+// rateDecision is the outcome of asking for a token
+type rateDecision struct {
+	allowed bool
+
+	// How long until the client may try again
+	retryAfter time.Duration
+
+	// muted is set while the client is muted; mutedNow when this request
+	// caused the mute
+	muted    bool
+	mutedNow bool
+}
+
+// bucket returns the kind's bucket refilled up to now
+func (l *rateLimiter) bucket(kind RateLimitKind, budget RateBudget, now time.Time) *tokenBucket {
+	if l.buckets == nil {
+		l.buckets = make(map[RateLimitKind]*tokenBucket, len(rateLimitKinds))
+	}
+	b, ok := l.buckets[kind]
+	if !ok {
+		b = newTokenBucket(budget, now)
+		l.buckets[kind] = b
+	}
+	b.refill(budget, now)
+	return b
+}
+
+// take spends a token from the kind's budget. Refusals count as
+// violations, except for typing notifications, which are simply dropped.
+func (l *rateLimiter) take(kind RateLimitKind, config RateLimitConfig, now time.Time) rateDecision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Before(l.mutedUntil) {
+		return rateDecision{retryAfter: l.mutedUntil.Sub(now), muted: true}
+	}
+
+	budget := config.Budgets[kind]
+	b := l.bucket(kind, budget, now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return rateDecision{allowed: true}
+	}
+	decision := rateDecision{retryAfter: b.wait(budget)}
+	if kind == RateLimitTyping {
+		return decision
+	}
+
+	// Repeat offenders are forgiven after a long enough quiet spell
+	if l.mutes > 0 && now.Sub(l.mutedUntil) >= config.ForgiveAfter {
+		l.mutes = 0
+	}
+	if now.Sub(l.lastViolation) > config.ViolationWindow {
+		l.violations = 0
+	}
+	l.violations++
+	l.lastViolation = now
+	if l.violations < config.MuteAfter {
+		return decision
+	}
+
+	mute := config.MuteDuration
+	for i := 0; i < l.mutes && mute < config.MaxMuteDuration; i++ {
+		mute *= 2
+	}
+	if mute > config.MaxMuteDuration {
+		mute = config.MaxMuteDuration
+	}
+	l.mutes++
+	l.violations = 0
+	l.mutedUntil = now.Add(mute)
+	return rateDecision{retryAfter: mute, muted: true, mutedNow: true}
+}
+
+// remaining returns the whole tokens left in the kind's budget
+func (l *rateLimiter) remaining(kind RateLimitKind, config RateLimitConfig, now time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.bucket(kind, config.Budgets[kind], now).tokens)
+}
+
+// rateLimits returns the budgets the client is held to
+func (c *Client) rateLimits() RateLimitConfig {
+	if c.bot && c.hub != nil && c.hub.botRateLimits.Budgets != nil {
+		return c.hub.botRateLimits
+	}
+	if c.hub != nil && c.hub.rateLimits.Budgets != nil {
+		return c.hub.rateLimits
+	}
+	return DefaultRateLimitConfig()
+}
+
+// checkRateLimit spends a token from the kind's budget. When it returns
+// false it has already told the client why and when to retry, except for
+// typing notifications, which are dropped silently.
+func (c *Client) checkRateLimit(kind RateLimitKind) bool {
+	decision := c.limiter.take(kind, c.rateLimits(), c.now())
+	if decision.allowed {
+		return true
+	}
+
+	switch {
+	case kind == RateLimitTyping:
+	case decision.mutedNow:
+		log.Printf("[RATE_LIMIT] Muted %s (%s) for %v after repeated violations", c.GetDisplayName(), c.remoteAddress(), decision.retryAfter)
+		c.sendRateLimitError(fmt.Sprintf("You are muted for %v for repeatedly exceeding the rate limit.", decision.retryAfter), decision.retryAfter)
+	case decision.muted:
+		c.sendRateLimitError("You are muted for repeatedly exceeding the rate limit.", decision.retryAfter)
+	default:
+		log.Printf("[RATE_LIMIT] %s budget exceeded by %s (%s), retry after %v", kind, c.GetDisplayName(), c.remoteAddress(), decision.retryAfter)
+		c.sendRateLimitError("Rate limit exceeded. Please slow down your messages.", decision.retryAfter)
+	}
+	return false
+}
+
+// getRemainingRateLimit returns how many messages of a kind the client can
+// send right now
+func (c *Client) getRemainingRateLimit(kind RateLimitKind) int {
+	return c.limiter.remaining(kind, c.rateLimits(), c.now())
+}
+
+// sendRateLimitError tells the client it was refused and how many seconds
+// to wait, rounded up
+func (c *Client) sendRateLimitError(text string, retryAfter time.Duration) {
+	errorMsg := &Message{
+		Type:       MessageTypeError,
+		Error:      text,
+		RetryAfter: int((retryAfter + time.Second - 1) / time.Second),
+	}
+	errorMsg.SetTimestampAt(c.now())
+	c.sendErrorMessage(errorMsg)
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// SetAllowedReactions restricts reactions to the given emoji. An empty list
+// allows any single grapheme cluster.
+func (h *Hub) SetAllowedReactions(emoji []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(emoji) == 0 {
+		h.allowedReactions = nil
+		return
+	}
+	h.allowedReactions = make(map[string]bool, len(emoji))
+	for _, e := range emoji {
+		h.allowedReactions[e] = true
+	}
+}
+
+// isAllowedReaction checks an emoji against the configured reaction set
+func (h *Hub) isAllowedReaction(emoji string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if h.allowedReactions == nil {
+		return true
+	}
+	return h.allowedReactions[emoji]
+}
+
+// validateReactionEmoji checks that a reaction is a single grapheme cluster
+func validateReactionEmoji(emoji string) error {
+	if emoji == "" {
+		return errors.New("reaction emoji is required")
+	}
+	if len(emoji) > 64 || !utf8.ValidString(emoji) {
+		return errors.New("reaction emoji is invalid")
+	}
+	if !isSingleGrapheme(emoji) {
+		return errors.New("reaction must be a single emoji or character")
+	}
+	return nil
+}
+
+// isSingleGrapheme reports whether s forms one user-perceived character.
+// It covers the emoji forms clients send: a base character followed by
+// combining marks, variation selectors, skin tone modifiers, keycaps or tag
+// sequences, ZWJ-joined sequences and regional indicator flag pairs.
+func isSingleGrapheme(s string) bool {
+	runes := []rune(s)
+	if len(runes) == 0 {
+		return false
+	}
+
+	// Flags are exactly two regional indicators
+	if isRegionalIndicator(runes[0]) {
+		return len(runes) == 2 && isRegionalIndicator(runes[1])
+	}
+
+	expectBase := true
+	for _, r := range runes {
+		if expectBase {
+			if unicode.IsControl(r) || unicode.IsSpace(r) || isGraphemeExtender(r) || r == zeroWidthJoiner {
+				return false
+			}
+			expectBase = false
+			continue
+		}
+
+		switch {
+		case r == zeroWidthJoiner:
+			expectBase = true
+		case isGraphemeExtender(r):
+			// Extends the current character
+		default:
+			return false
+		}
+	}
+
+	// A trailing joiner leaves the sequence incomplete
+	return !expectBase
+}
+
+const zeroWidthJoiner = '\u200d'
+
+// isRegionalIndicator reports whether r is a flag letter
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1F1E6 && r <= 0x1F1FF
+}
+
+// isGraphemeExtender reports whether r attaches to the preceding character
+func isGraphemeExtender(r rune) bool {
+	switch {
+	case unicode.Is(unicode.Mn, r), unicode.Is(unicode.Me, r):
+		return true
+	case r >= 0xFE00 && r <= 0xFE0F: // variation selectors
+		return true
+	case r >= 0x1F3FB && r <= 0x1F3FF: // skin tone modifiers
+		return true
+	case r >= 0xE0020 && r <= 0xE007F: // tag sequences
+		return true
+	}
+	return false
+}
+
+// AddReaction records that user reacted to a message with emoji and returns
+// the updated counts and their version
+func (s *MessageStore) AddReaction(id, emoji, user string) (map[string]int, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.messages[id]
+	if !ok {
+		return nil, 0, errors.New("message not found")
+	}
+
+	users, ok := stored.reactions[emoji]
+	if !ok {
+		users = make(map[string]bool)
+		stored.reactions[emoji] = users
+	}
+	users[user] = true
+	stored.reactionVersion++
+
+	return stored.reactionCounts(), stored.reactionVersion, nil
+}
+
+// RemoveReaction removes user's emoji reaction from a message and returns
+// the updated counts and their version
+func (s *MessageStore) RemoveReaction(id, emoji, user string) (map[string]int, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.messages[id]
+	if !ok {
+		return nil, 0, errors.New("message not found")
+	}
+
+	if users, ok := stored.reactions[emoji]; ok {
+		delete(users, user)
+		if len(users) == 0 {
+			delete(stored.reactions, emoji)
+		}
+	}
+	stored.reactionVersion++
+
+	return stored.reactionCounts(), stored.reactionVersion, nil
+}
+
+// Reactions returns the aggregated reaction counts for a message
+func (s *MessageStore) Reactions(id string) map[string]int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stored, ok := s.messages[id]
+	if !ok {
+		return nil
+	}
+	return stored.reactionCounts()
+}
+
+// reactionCounts aggregates the per-emoji reaction sets into counts
+func (m *storedMessage) reactionCounts() map[string]int {
+	counts := make(map[string]int, len(m.reactions))
+	for emoji, users := range m.reactions {
+		counts[emoji] = len(users)
+	}
+	return counts
+}
+
+// canSee reports whether user is part of the audience of a stored message
+func (h *Hub) canSee(message Message, user string) bool {
+	switch message.Type {
+	case MessageTypePrivate:
+		return message.From == user || message.To == user
+	case MessageTypeGroupMessage:
+		conv, ok := h.GetConversation(message.ConversationID)
+		return ok && conv.hasParticipant(user)
+	}
+	return true
+}
+
+// ApplyReaction adds or removes a user's reaction and fans the updated counts
+// out to everyone who can see the target message. Concurrent updates can
+// arrive in either order, so each carries the version of its counts and
+// clients keep the highest. Reactions are counted by the node the message
+// was posted on, so every node sends the same counts and versions.
+func (h *Hub) ApplyReaction(user, messageID, emoji string, add bool) error {
+	if !h.isAllowedReaction(emoji) {
+		return errors.New("reaction not allowed")
+	}
+
+	target, ok := h.store.Get(messageID)
+	if !ok || !h.canSee(target, user) {
+		return errors.New("message not found")
+	}
+
+	if node := h.messageNode(messageID); node != h.nodeID {
+		action := reactionRemove
+		if add {
+			action = reactionAdd
+		}
+		h.publish(BrokerEvent{Kind: BrokerEventReaction, Target: node, Content: action,
+			Message: Message{From: user, MessageID: messageID, Emoji: emoji}})
+		return nil
+	}
+	return h.react(target, user, emoji, add)
+}
+
+// messageNode returns the node a message was posted on, from the prefix of
+// its ID
+func (h *Hub) messageNode(id string) string {
+	if h.broker == nil {
+		return h.nodeID
+	}
+	if i := strings.LastIndex(id, "-"); i > 0 {
+		return id[:i]
+	}
+	return h.nodeID
+}
+
+// applyRemoteReaction counts a reaction made on another node to a message
+// posted on this one
+func (h *Hub) applyRemoteReaction(reaction Message, add bool) {
+	target, ok := h.store.Get(reaction.MessageID)
+	if !ok || !h.canSee(target, reaction.From) {
+		log.Printf("[REACTION] Remote reaction not applied: message=%s reason=not_found", reaction.MessageID)
+		return
+	}
+	if err := h.react(target, reaction.From, reaction.Emoji, add); err != nil {
+		log.Printf("[REACTION] Remote reaction not applied: message=%s error=%v", reaction.MessageID, err)
+	}
+}
+
+// react records a reaction in the store and sends the updated counts to
+// the target's audience on every node
+func (h *Hub) react(target Message, user, emoji string, add bool) error {
+	var counts map[string]int
+	var version int
+	var err error
+	if add {
+		counts, version, err = h.store.AddReaction(target.ID, emoji, user)
+	} else {
+		counts, version, err = h.store.RemoveReaction(target.ID, emoji, user)
+	}
+	if err != nil {
+		return err
+	}
+
+	update := &Message{
+		Type:      MessageTypeReaction,
+		From:      user,
+		MessageID: target.ID,
+		Emoji:     emoji,
+		Reactions: counts,
+
+		ReactionVersion: version,
+	}
+	update.SetTimestampAt(h.now())
+
+	log.Printf("[REACTION] user=%s message=%s emoji=%s add=%t", user, target.ID, emoji, add)
+
+	switch target.Type {
+	case MessageTypePrivate:
+		h.sendToUsers(*update, target.From, target.To)
+	case MessageTypeGroupMessage:
+		conv, _ := h.GetConversation(target.ConversationID)
+		update.ConversationID = target.ConversationID
+		h.sendToUsers(*update, conv.Participants...)
+	default:
+		h.BroadcastMessage(*update)
+	}
+	return nil
+}
+
+// sendToUsers delivers a message to the named users that are online,
+// forwarding to other nodes for users connected there
+func (h *Hub) sendToUsers(message Message, names ...string) {
+	remote := make([]string, 0)
+	for _, name := range names {
+		if _, local := h.GetClientByName(name); local {
+			continue
+		}
+		if _, ok := h.remoteNodeOf(name); ok {
+			remote = append(remote, name)
+		}
+	}
+	if len(remote) > 0 {
+		h.publish(BrokerEvent{Kind: BrokerEventDirect, Users: remote, Message: message})
+	}
+
+	h.sendToLocalUsers(message, names...)
+}
+
+// sendToLocalUsers delivers a message to the named users connected to this node
+func (h *Hub) sendToLocalUsers(message Message, names ...string) {
+	jsonData, err := message.ToJSON()
+	if err != nil {
+		log.Printf("Error converting message to JSON: %v", err)
+		return
+	}
+
+	frame := newFrame(jsonData)
+	frame.capability = requiredCapability(&message)
+	for _, name := range names {
+		client, ok := h.GetClientByName(name)
+		if !ok {
+			continue
+		}
+		if !h.deliver(client, frame) {
+			log.Printf("Failed to deliver %s message to %s: send channel full", message.Type, name)
+		}
+	}
+}
+
+// handleReaction processes react and unreact messages from the client
+func (c *Client) handleReaction(message *Message) {
+	add := message.Type == MessageTypeReact
+	if err := c.hub.ApplyReaction(c.displayName, message.MessageID, message.Emoji, add); err != nil {
+		c.sendError("Reaction failed: " + err.Error())
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestValidateReactionEmoji(t *testing.T) {
+	tests := []struct {
+		name    string
+		emoji   string
+		wantErr bool
+	}{
+		{"simple emoji", "👍", false},
+		{"emoji with variation selector", "❤️", false},
+		{"skin tone modifier", "👍🏽", false},
+		{"zwj family sequence", "👨‍👩‍👧", false},
+		{"flag", "🇰🇪", false},
+		{"keycap", "1️⃣", false},
+		{"single letter", "a", false},
+		{"letter with combining accent", "é", false},
+		{"empty", "", true},
+		{"two emoji", "👍👍", true},
+		{"word", "ok", true},
+		{"trailing joiner", "👨‍", true},
+		{"single regional indicator", "🇰", true},
+		{"space", " ", true},
+		{"control character", "\x07", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateReactionEmoji(tt.emoji)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateReactionEmoji(%q) error = %v, wantErr %v", tt.emoji, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMessage_ValidateReaction(t *testing.T) {
+	valid := Message{Type: MessageTypeReact, MessageID: "1", Emoji: "👍"}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("Expected valid react message, got %v", err)
+	}
+
+	missingTarget := Message{Type: MessageTypeUnreact, Emoji: "👍"}
+	if err := missingTarget.Validate(); err == nil {
+		t.Error("Expected error for reaction without message_id")
+	}
+
+	badEmoji := Message{Type: MessageTypeReact, MessageID: "1", Emoji: "nope"}
+	if err := badEmoji.Validate(); err == nil {
+		t.Error("Expected error for multi-character reaction")
+	}
+}
+
+func TestMessageStore_Reactions(t *testing.T) {
+	store := NewMessageStore(10)
+	message := &Message{Type: MessageTypeChat, From: "Alice", Content: "hi"}
+	store.Add(message)
+
+	if message.ID == "" {
+		t.Fatal("Expected store to assign a message ID")
+	}
+
+	store.AddReaction(message.ID, "👍", "Bob")
+	store.AddReaction(message.ID, "👍", "Bob") // duplicate is idempotent
+	counts, version, err := store.AddReaction(message.ID, "👍", "Carol")
+	if err != nil {
+		t.Fatalf("AddReaction failed: %v", err)
+	}
+	if counts["👍"] != 2 {
+		t.Errorf("Expected 2 reactions, got %d", counts["👍"])
+	}
+	if version != 3 {
+		t.Errorf("Expected every change to bump the version, got %d", version)
+	}
+
+	store.RemoveReaction(message.ID, "👍", "Bob")
+	counts, _, _ = store.RemoveReaction(message.ID, "👍", "Carol")
+	if _, ok := counts["👍"]; ok {
+		t.Errorf("Expected emoji removed once no users remain, got %v", counts)
+	}
+
+	if _, _, err := store.AddReaction("missing", "👍", "Bob"); err == nil {
+		t.Error("Expected error reacting to unknown message")
+	}
+}
+
+func TestMessageStore_Eviction(t *testing.T) {
+	store := NewMessageStore(2)
+	first := &Message{Type: MessageTypeChat, Content: "one"}
+	store.Add(first)
+	store.Add(&Message{Type: MessageTypeChat, Content: "two"})
+	store.Add(&Message{Type: MessageTypeChat, Content: "three"})
+
+	if store.Len() != 2 {
+		t.Errorf("Expected 2 stored messages, got %d", store.Len())
+	}
+	if _, ok := store.Get(first.ID); ok {
+		t.Error("Expected oldest message to be evicted")
+	}
+}
+
+func TestHub_ApplyReaction_PrivateAudience(t *testing.T) {
+	hub := NewHub()
+
+	alice := &Client{hub: hub, send: make(chan outboundFrame, 10), displayName: "Alice"}
+	bob := &Client{hub: hub, send: make(chan outboundFrame, 10), displayName: "Bob"}
+	carol := &Client{hub: hub, send: make(chan outboundFrame, 10), displayName: "Carol"}
+	negotiateContent(alice, bob, carol)
+	hub.UpdateClientName(alice, "Alice")
+	hub.UpdateClientName(bob, "Bob")
+	hub.UpdateClientName(carol, "Carol")
+
+	message := &Message{Type: MessageTypePrivate, From: "Alice", To: "Bob", Content: "secret"}
+	hub.store.Add(message)
+
+	if err := hub.ApplyReaction("Carol", message.ID, "👍", true); err == nil {
+		t.Error("Expected non-participant reaction to be rejected")
+	}
+
+	if err := hub.ApplyReaction("Bob", message.ID, "👍", true); err != nil {
+		t.Fatalf("ApplyReaction failed: %v", err)
+	}
+
+	for _, client := range []*Client{alice, bob} {
+		select {
+		case frame := <-client.send:
+			data := frame.data
+			var update Message
+			json.Unmarshal(data, &update)
+			if update.Type != MessageTypeReaction || update.MessageID != message.ID {
+				t.Errorf("%s: unexpected update %+v", client.displayName, update)
+			}
+			if update.Reactions["👍"] != 1 {
+				t.Errorf("%s: expected count 1, got %v", client.displayName, update.Reactions)
+			}
+		case <-time.After(100 * time.Millisecond):
+			t.Errorf("%s did not receive reaction update", client.displayName)
+		}
+	}
+
+	select {
+	case <-carol.send:
+		t.Error("Non-participant should not receive private reaction update")
+	default:
+	}
+}
+
+func TestHub_ApplyReaction_AllowedSet(t *testing.T) {
+	hub := NewHub()
+	hub.SetAllowedReactions([]string{"👍"})
+
+	message := &Message{Type: MessageTypePrivate, From: "Alice", To: "Bob", Content: "hi"}
+	hub.store.Add(message)
+
+	if err := hub.ApplyReaction("Bob", message.ID, "🎉", true); err == nil {
+		t.Error("Expected reaction outside allowed set to be rejected")
+	}
+	if err := hub.ApplyReaction("Bob", message.ID, "👍", true); err != nil {
+		t.Errorf("Expected allowed reaction to succeed, got %v", err)
+	}
+}
+
+func TestHub_ApplyReaction_PublicBroadcast(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	defer hub.Stop()
+
+	alice := &Client{hub: hub, send: make(chan outboundFrame, 10), displayName: "Alice"}
+	bob := &Client{hub: hub, send: make(chan outboundFrame, 10), displayName: "Bob"}
+	negotiateContent(alice, bob)
+	hub.assignShard(alice)
+	hub.assignShard(bob)
+
+	message := &Message{Type: MessageTypeChat, From: "Alice", Content: "hello"}
+	hub.store.Add(message)
+
+	if err := hub.ApplyReaction("Bob", message.ID, "🎉", true); err != nil {
+		t.Fatalf("ApplyReaction failed: %v", err)
+	}
+
+	for _, client := range []*Client{alice, bob} {
+		select {
+		case frame := <-client.send:
+			data := frame.data
+			var update Message
+			json.Unmarshal(data, &update)
+			if update.Reactions["🎉"] != 1 {
+				t.Errorf("%s: expected count 1, got %v", client.displayName, update.Reactions)
+			}
+		case <-time.After(200 * time.Millisecond):
+			t.Errorf("%s did not receive reaction broadcast", client.displayName)
+		}
+	}
+}
+
+func TestHub_ApplyReaction_ConcurrentReactorsConverge(t *testing.T) {
+	hub := NewShardedHub(4)
+	go hub.Run()
+	defer hub.Stop()
+
+	const reactors = 40
+	clients := make([]*Client, 8)
+	for i := range clients {
+		clients[i] = &Client{hub: hub, send: make(chan outboundFrame, 4*reactors), displayName: fmt.Sprintf("Watcher%d", i)}
+		negotiateContent(clients[i])
+		hub.assignShard(clients[i])
+	}
+
+	message := &Message{Type: MessageTypeChat, From: "Alice", Content: "vote"}
+	hub.store.Add(message)
+
+	// Every reactor adds two reactions and takes one back at once
+	var wg sync.WaitGroup
+	for i := 0; i < reactors; i++ {
+		wg.Add(1)
+		go func(user string) {
+			defer wg.Done()
+			hub.ApplyReaction(user, message.ID, "👍", true)
+			hub.ApplyReaction(user, message.ID, "🎉", true)
+			hub.ApplyReaction(user, message.ID, "👍", false)
+		}(fmt.Sprintf("User%d", i))
+	}
+	wg.Wait()
+
+	for _, client := range clients {
+		// Apply updates the way clients do, ignoring older versions
+		var seen Message
+		for n := 0; n < 3*reactors; n++ {
+			select {
+			case frame := <-client.send:
+				var update Message
+				json.Unmarshal(frame.data, &update)
+				if update.ReactionVersion > seen.ReactionVersion {
+					seen = update
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("%s received %d of %d reaction updates", client.displayName, n, 3*reactors)
+			}
+		}
+		if seen.ReactionVersion != 3*reactors {
+			t.Errorf("%s: expected version %d, got %d", client.displayName, 3*reactors, seen.ReactionVersion)
+		}
+		if len(seen.Reactions) != 1 || seen.Reactions["🎉"] != reactors {
+			t.Errorf("%s: expected %d 🎉 and no 👍, got %v", client.displayName, reactors, seen.Reactions)
+		}
+	}
+}
+
+func TestHub_UndeliveredPrivateMessageNotStored(t *testing.T) {
+	hub := NewHub()
+	alice := &Client{hub: hub, send: make(chan outboundFrame, 10), displayName: "Alice"}
+	bob := &Client{hub: hub, send: make(chan outboundFrame), displayName: "Bob"}
+	hub.UpdateClientName(alice, "Alice")
+	hub.UpdateClientName(bob, "Bob")
+	close(bob.send)
+
+	message := Message{Type: MessageTypePrivate, From: "Alice", To: "Bob", Content: "lost"}
+	if err := hub.SendPrivateMessage("Alice", "Bob", message); err == nil {
+		t.Fatal("Expected delivery to a disconnecting recipient to fail")
+	}
+	if hub.store.Len() != 0 {
+		t.Error("Expected the undelivered message not to be stored for reactions or replies")
+	}
+
+	bob.send = make(chan outboundFrame, 10)
+	if err := hub.SendPrivateMessage("Alice", "Bob", message); err != nil {
+		t.Fatalf("SendPrivateMessage failed: %v", err)
+	}
+	if hub.store.Len() != 1 {
+		t.Errorf("Expected the delivered message to be stored, got %d", hub.store.Len())
+	}
+}
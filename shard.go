@@ -0,0 +1,164 @@
+package main
+
+import (
+	"log"
+	"runtime"
+	"time"
+)
+
+const (
+	// Operations a shard can queue before senders wait for it
+	shardInboxSize = 1024
+)
+
+// shardOpKind identifies the operation queued for a shard
+type shardOpKind int
+
+const (
+	shardAdd shardOpKind = iota
+	shardRemove
+	shardBroadcast
+)
+
+// shardOp is a unit of work for a shard's event loop
+type shardOp struct {
+	kind     shardOpKind
+	client   *Client
+	outbound outboundBroadcast
+}
+
+// hubShard owns a subset of the hub's clients and fans broadcasts out to
+// them on its own goroutine, so delivery to large rooms runs in parallel
+type hubShard struct {
+	hub   *Hub
+	inbox chan shardOp
+
+	// Clients owned by this shard; only touched by the shard's goroutine
+	clients map[*Client]bool
+}
+
+// defaultShardCount returns the number of shards used by NewHub
+func defaultShardCount() int {
+	return runtime.GOMAXPROCS(0)
+}
+
+// newHubShard creates an idle shard for hub
+func newHubShard(hub *Hub) *hubShard {
+	return &hubShard{
+		hub:     hub,
+		inbox:   make(chan shardOp, shardInboxSize),
+		clients: make(map[*Client]bool),
+	}
+}
+
+// run processes queued operations until the hub stops
+func (s *hubShard) run() {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Hub shard panic recovered: %v", r)
+			time.Sleep(1 * time.Second)
+			go s.run()
+		}
+	}()
+
+	for {
+		select {
+		case <-s.hub.stop:
+			return
+		case op := <-s.inbox:
+			switch op.kind {
+			case shardAdd:
+				s.clients[op.client] = true
+			case shardRemove:
+				if s.clients[op.client] {
+					delete(s.clients, op.client)
+					s.closeSend(op.client)
+				}
+			case shardBroadcast:
+				s.deliver(op.outbound)
+			}
+		}
+	}
+}
+
+// deliver sends an encoded message to every client in the shard. Clients
+// that are full are handled by the hub's slow-consumer policy.
+func (s *hubShard) deliver(outbound outboundBroadcast) {
+	for client := range s.clients {
+		frame := outbound.frame
+		if len(outbound.perUser) > 0 {
+			if alt, ok := outbound.perUser[s.hub.displayNameOf(client)]; ok {
+				frame = alt
+			}
+		}
+		s.hub.deliver(client, frame)
+	}
+}
+
+// closeSend closes a client's send channel, tolerating one already closed
+func (s *hubShard) closeSend(client *Client) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Error closing client send channel: %v", r)
+		}
+	}()
+	close(client.send)
+}
+
+// startShards launches the shard goroutines once per hub
+func (h *Hub) startShards() {
+	h.shardsOnce.Do(func() {
+		for _, shard := range h.shards {
+			go shard.run()
+		}
+	})
+}
+
+// assignShard records a newly registered client and hands it to a shard.
+// Clients are spread round-robin so shards stay evenly loaded.
+func (h *Hub) assignShard(client *Client) {
+	h.clientsMu.Lock()
+	if h.clients[client] {
+		h.clientsMu.Unlock()
+		return
+	}
+	shard := h.shards[h.nextShard%len(h.shards)]
+	h.nextShard++
+	h.clients[client] = true
+	h.clientShards[client] = shard
+	h.trackCodec(client, 1)
+	h.trackProfile(client, 1)
+	h.clientsMu.Unlock()
+
+	shard.inbox <- shardOp{kind: shardAdd, client: client}
+}
+
+// releaseShard removes a client from the hub and its shard, which closes the
+// client's send channel. It reports whether the client was registered.
+func (h *Hub) releaseShard(client *Client) bool {
+	h.clientsMu.Lock()
+	shard, ok := h.clientShards[client]
+	if ok {
+		delete(h.clients, client)
+		delete(h.clientShards, client)
+		h.trackCodec(client, -1)
+		h.trackProfile(client, -1)
+	}
+	h.clientsMu.Unlock()
+
+	if ok {
+		shard.inbox <- shardOp{kind: shardRemove, client: client}
+	}
+	return ok
+}
+
+// fanOut queues an encoded message on every shard. Broadcasts come from
+// many goroutines, so they are queued one at a time to give every shard,
+// and so every client, the same order.
+func (h *Hub) fanOut(outbound outboundBroadcast) {
+	h.fanOutMu.Lock()
+	defer h.fanOutMu.Unlock()
+	for _, shard := range h.shards {
+		shard.inbox <- shardOp{kind: shardBroadcast, outbound: outbound}
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewShardedHub(t *testing.T) {
+	if hub := NewShardedHub(0); len(hub.shards) != 1 {
+		t.Errorf("Expected at least one shard, got %d", len(hub.shards))
+	}
+	if hub := NewShardedHub(8); len(hub.shards) != 8 {
+		t.Errorf("Expected 8 shards, got %d", len(hub.shards))
+	}
+	if hub := NewHub(); len(hub.shards) != defaultShardCount() {
+		t.Errorf("Expected one shard per CPU, got %d", len(hub.shards))
+	}
+}
+
+func TestHub_ShardsSpreadClients(t *testing.T) {
+	hub := NewShardedHub(4)
+	go hub.Run()
+	defer hub.Stop()
+
+	for i := 0; i < 8; i++ {
+		hub.register <- &Client{hub: hub, send: make(chan outboundFrame, 10)}
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	perShard := make(map[*hubShard]int)
+	hub.clientsMu.RLock()
+	for _, shard := range hub.clientShards {
+		perShard[shard]++
+	}
+	hub.clientsMu.RUnlock()
+
+	if len(perShard) != 4 {
+		t.Fatalf("Expected clients on all 4 shards, got %d", len(perShard))
+	}
+	for _, count := range perShard {
+		if count != 2 {
+			t.Errorf("Expected 2 clients per shard, got %d", count)
+		}
+	}
+}
+
+func TestHub_ShardedBroadcastReachesAllClients(t *testing.T) {
+	hub := NewShardedHub(4)
+	go hub.Run()
+	defer hub.Stop()
+
+	clients := make([]*Client, 50)
+	for i := range clients {
+		clients[i] = &Client{hub: hub, send: make(chan outboundFrame, 10)}
+		hub.register <- clients[i]
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	message := Message{Type: MessageTypeSystem, Content: "hello shards"}
+	message.SetTimestamp()
+	hub.BroadcastMessage(message)
+
+	for i, client := range clients {
+		select {
+		case frame := <-client.send:
+			data := frame.data
+			var received Message
+			json.Unmarshal(data, &received)
+			if received.Content != "hello shards" {
+				t.Errorf("Client %d received unexpected message %+v", i, received)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Client %d did not receive broadcast", i)
+		}
+	}
+}
+
+func TestHub_ShardDropsSlowClient(t *testing.T) {
+	hub := NewShardedHub(2)
+	go hub.Run()
+	defer hub.Stop()
+
+	slow := &Client{hub: hub, send: make(chan outboundFrame), displayName: "Slow"}
+	hub.mu.Lock()
+	hub.userList[slow] = "Slow"
+	hub.clientsByName["Slow"] = slow
+	hub.mu.Unlock()
+	hub.register <- slow
+	time.Sleep(10 * time.Millisecond)
+
+	message := Message{Type: MessageTypeSystem, Content: "nobody is reading"}
+	message.SetTimestamp()
+	hub.BroadcastMessage(message)
+
+	if !waitUntil(time.Second, func() bool { return hub.GetClientCount() == 0 }) {
+		t.Fatal("Expected slow client to be dropped")
+	}
+	if _, ok := hub.GetClientByName("Slow"); ok {
+		t.Error("Expected slow client's name to be released")
+	}
+	if _, open := <-slow.send; open {
+		t.Error("Expected slow client's send channel to be closed")
+	}
+}
+
+// benchSendBuffer is the send buffer of simulated clients. It is larger than
+// a real client's so the benchmark measures the hub rather than evictions.
+const benchSendBuffer = 1024
+
+// benchWindow bounds how many broadcasts may be in flight at once
+const benchWindow = 32
+
+// BenchmarkHubBroadcast measures fan-out throughput and delivery latency.
+// With one shard every delivery runs on a single goroutine, like the hub's
+// original event loop; the other cases use one shard per CPU.
+func BenchmarkHubBroadcast(b *testing.B) {
+	shardCounts := []int{1}
+	if defaultShardCount() > 1 {
+		shardCounts = append(shardCounts, defaultShardCount())
+	}
+	for _, clients := range []int{1000, 10000} {
+		for _, shards := range shardCounts {
+			b.Run(fmt.Sprintf("clients=%d/shards=%d", clients, shards), func(b *testing.B) {
+				benchmarkBroadcast(b, clients, shards)
+			})
+		}
+	}
+}
+
+func benchmarkBroadcast(b *testing.B, numClients, shards int) {
+	hub := NewShardedHub(shards)
+	go hub.Run()
+	defer hub.Stop()
+
+	// Broadcast i carries its sequence number; sentAt[i] is when it was sent
+	sentAt := make([]int64, b.N+1)
+	var delivered int64
+	done := make(chan struct{})
+	var stopOnce sync.Once
+	stopDrainers := func() { stopOnce.Do(func() { close(done) }) }
+	defer stopDrainers()
+
+	// Every 10th client samples delivery latency
+	const sampleEvery = 10
+	samples := make([][]time.Duration, (numClients+sampleEvery-1)/sampleEvery)
+	var drainers sync.WaitGroup
+
+	for i := 0; i < numClients; i++ {
+		client := &Client{hub: hub, send: make(chan outboundFrame, benchSendBuffer)}
+		hub.register <- client
+
+		sample := -1
+		if i%sampleEvery == 0 {
+			sample = i / sampleEvery
+		}
+		drainers.Add(1)
+		go func(client *Client, sample int) {
+			defer drainers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				case frame, ok := <-client.send:
+					if !ok {
+						return
+					}
+					if sample >= 0 {
+						seq, _ := strconv.Atoi(string(frame.data))
+						latency := time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&sentAt[seq]))
+						samples[sample] = append(samples[sample], latency)
+					}
+					atomic.AddInt64(&delivered, 1)
+				}
+			}
+		}(client, sample)
+	}
+
+	waitDelivered := func(target int64) {
+		deadline := time.Now().Add(30 * time.Second)
+		for atomic.LoadInt64(&delivered) < target {
+			if time.Now().After(deadline) {
+				b.Fatalf("Timed out waiting for deliveries: %d of %d", atomic.LoadInt64(&delivered), target)
+			}
+			time.Sleep(10 * time.Microsecond)
+		}
+	}
+
+	// Warm up: once every client has the first broadcast, all are on a shard
+	if !waitUntil(10*time.Second, func() bool { return hub.GetClientCount() == numClients }) {
+		b.Fatalf("Only %d of %d clients registered", hub.GetClientCount(), numClients)
+	}
+	time.Sleep(10 * time.Millisecond)
+	atomic.StoreInt64(&sentAt[0], time.Now().UnixNano())
+	hub.fanOut(outboundBroadcast{frame: newPreparedFrame([]byte("0"))})
+	waitDelivered(int64(numClients))
+
+	b.ResetTimer()
+	start := time.Now()
+	for seq := 1; seq <= b.N; seq++ {
+		if seq > benchWindow {
+			waitDelivered(int64(seq-benchWindow) * int64(numClients))
+		}
+		atomic.StoreInt64(&sentAt[seq], time.Now().UnixNano())
+		hub.fanOut(outboundBroadcast{frame: newPreparedFrame([]byte(strconv.Itoa(seq)))})
+	}
+	waitDelivered(int64(b.N+1) * int64(numClients))
+	elapsed := time.Since(start)
+	b.StopTimer()
+
+	stopDrainers()
+	drainers.Wait()
+
+	latencies := make([]time.Duration, 0)
+	for _, sample := range samples {
+		if len(sample) > 1 {
+			// Skip the warm-up broadcast
+			latencies = append(latencies, sample[1:]...)
+		}
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	b.ReportMetric(float64(b.N)*float64(numClients)/elapsed.Seconds(), "deliveries/s")
+	if len(latencies) > 0 {
+		b.ReportMetric(float64(latencies[len(latencies)/2].Nanoseconds()), "p50-ns")
+		b.ReportMetric(float64(latencies[len(latencies)*99/100].Nanoseconds()), "p99-ns")
+	}
+}
+
+func TestHub_ShardsDeliverBroadcastsInOneOrder(t *testing.T) {
+	// Senders must run in parallel for shards to see them interleaved
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	hub := NewShardedHub(4)
+	go hub.Run()
+	defer hub.Stop()
+
+	const senders, perSender = 16, 100
+	clients := make([]*Client, 8)
+	for i := range clients {
+		clients[i] = &Client{hub: hub, send: make(chan outboundFrame, senders*perSender)}
+		hub.register <- clients[i]
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	// Concurrent broadcasts, as from many ReadPumps
+	var wg sync.WaitGroup
+	for s := 0; s < senders; s++ {
+		wg.Add(1)
+		go func(s int) {
+			defer wg.Done()
+			for n := 0; n < perSender; n++ {
+				message := Message{Type: MessageTypeSystem, Content: fmt.Sprintf("%d-%d", s, n)}
+				message.SetTimestamp()
+				hub.BroadcastMessage(message)
+			}
+		}(s)
+	}
+	wg.Wait()
+
+	var want []string
+	for i, client := range clients {
+		var got []string
+		for len(got) < senders*perSender {
+			select {
+			case frame := <-client.send:
+				var received Message
+				json.Unmarshal(frame.data, &received)
+				got = append(got, received.Content)
+			case <-time.After(time.Second):
+				t.Fatalf("Client %d received %d of %d broadcasts", i, len(got), senders*perSender)
+			}
+		}
+		if want == nil {
+			want = got
+			continue
+		}
+		for n := range got {
+			if got[n] != want[n] {
+				t.Fatalf("Client %d saw %s where client 0 saw %s at position %d", i, got[n], want[n], n)
+			}
+		}
+	}
+}
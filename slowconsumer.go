@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
+
+// SlowConsumerPolicy decides what happens when a client's send buffer is
+// full and another message is queued for it
+type SlowConsumerPolicy int
+
+const (
+	// Disconnect the client with a close code and announce its departure
+	SlowConsumerDisconnect SlowConsumerPolicy = iota
+
+	// Discard the oldest queued message to make room
+	SlowConsumerDropOldest
+
+	// Discard the new message and tell the client how many it missed once
+	// its buffer drains
+	SlowConsumerDropNewest
+
+	// Keep only the latest user list aside until the buffer drains; other
+	// messages disconnect the client
+	SlowConsumerCoalesce
+)
+
+// slowConsumerPolicyNames maps configuration names to policies
+var slowConsumerPolicyNames = map[string]SlowConsumerPolicy{
+	"disconnect":  SlowConsumerDisconnect,
+	"drop_oldest": SlowConsumerDropOldest,
+	"drop_newest": SlowConsumerDropNewest,
+	"coalesce":    SlowConsumerCoalesce,
+}
+
+// ParseSlowConsumerPolicy parses a policy name such as "drop_oldest"
+func ParseSlowConsumerPolicy(name string) (SlowConsumerPolicy, error) {
+	policy, ok := slowConsumerPolicyNames[strings.ToLower(strings.TrimSpace(name))]
+	if !ok {
+		return SlowConsumerDisconnect, errors.New("unknown slow consumer policy: " + name)
+	}
+	return policy, nil
+}
+
+// String returns the policy's configuration name
+func (p SlowConsumerPolicy) String() string {
+	for name, policy := range slowConsumerPolicyNames {
+		if policy == p {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// slowConsumerStats counts how often each policy action was taken
+type slowConsumerStats struct {
+	disconnects   int64
+	droppedOldest int64
+	droppedNewest int64
+	coalesced     int64
+}
+
+// SetSlowConsumerPolicy sets how the hub treats clients that fall behind
+func (h *Hub) SetSlowConsumerPolicy(policy SlowConsumerPolicy) {
+	h.slowPolicy = policy
+}
+
+// deliver queues a frame for a client, applying the slow-consumer policy if
+// its send buffer is full. It reports whether the frame was queued.
+func (h *Hub) deliver(client *Client, frame outboundFrame) (queued bool) {
+	// Features the client did not ask for are never sent to it
+	if frame.capability != "" && !client.hasCapability(frame.capability) {
+		return true
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			// The client's send channel was closed while disconnecting
+			queued = false
+		}
+	}()
+
+	select {
+	case client.send <- frame:
+		return true
+	default:
+	}
+
+	if atomic.LoadInt32(&client.evicting) != 0 {
+		return false
+	}
+
+	switch h.slowPolicy {
+	case SlowConsumerDropOldest:
+		select {
+		case <-client.send:
+			atomic.AddInt64(&h.slowStats.droppedOldest, 1)
+		default:
+		}
+		select {
+		case client.send <- frame:
+			return true
+		default:
+			return false
+		}
+
+	case SlowConsumerDropNewest:
+		atomic.AddInt64(&client.missed, 1)
+		atomic.AddInt64(&h.slowStats.droppedNewest, 1)
+		return false
+
+	case SlowConsumerCoalesce:
+		if frame.presence {
+			client.setPendingPresence(frame)
+			atomic.AddInt64(&h.slowStats.coalesced, 1)
+			return true
+		}
+	}
+
+	h.disconnectSlowConsumer(client)
+	return false
+}
+
+// disconnectSlowConsumer closes a client that cannot keep up. It leaves the
+// hub through the normal unregister path so the departure is announced.
+func (h *Hub) disconnectSlowConsumer(client *Client) {
+	if !h.evict(client, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "Too slow to keep up")) {
+		return
+	}
+	atomic.AddInt64(&h.slowStats.disconnects, 1)
+	log.Printf("[SLOW_CONSUMER] Disconnecting %s (%s): send buffer full", client.GetDisplayName(), client.remoteAddress())
+}
+
+// evict disconnects a client with the given close frame, through the
+// normal unregister path so the departure is announced. It reports false
+// if the client is already being disconnected.
+func (h *Hub) evict(client *Client, closeMessage []byte) bool {
+	if !atomic.CompareAndSwapInt32(&client.evicting, 0, 1) {
+		return false
+	}
+
+	// Written by WritePump once the hub closes the send channel
+	client.closeMessage = closeMessage
+
+	go func() {
+		select {
+		case h.unregister <- client:
+		case <-h.stop:
+		}
+	}()
+	return true
+}
+
+// setPendingPresence holds a user list aside, replacing any older one
+func (c *Client) setPendingPresence(frame outboundFrame) {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	c.pendingPresence = &frame
+}
+
+// writeDeferred writes what was held back while the send buffer was full:
+// the latest coalesced user list and a note about dropped messages
+func (c *Client) writeDeferred() error {
+	c.pendingMu.Lock()
+	pending := c.pendingPresence
+	c.pendingPresence = nil
+	c.pendingMu.Unlock()
+
+	if pending != nil {
+		if frame, ok := c.adapt(*pending); ok {
+			if err := c.writeFrame(frame); err != nil {
+				return err
+			}
+		}
+	}
+
+	if missed := atomic.SwapInt64(&c.missed, 0); missed > 0 {
+		notice := &Message{
+			Type:    MessageTypeSystem,
+			Content: fmt.Sprintf("You missed %d messages because your connection fell behind", missed),
+			Missed:  int(missed),
+		}
+		notice.SetTimestampAt(c.now())
+		data, err := notice.ToJSON()
+		if err != nil {
+			return err
+		}
+		if frame, ok := c.adapt(newFrame(data)); ok {
+			return c.writeFrame(frame)
+		}
+	}
+	return nil
+}
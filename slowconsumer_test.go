@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestParseSlowConsumerPolicy(t *testing.T) {
+	for name, want := range map[string]SlowConsumerPolicy{
+		"disconnect":   SlowConsumerDisconnect,
+		"drop_oldest":  SlowConsumerDropOldest,
+		" DROP_NEWEST": SlowConsumerDropNewest,
+		"coalesce":     SlowConsumerCoalesce,
+	} {
+		policy, err := ParseSlowConsumerPolicy(name)
+		if err != nil || policy != want {
+			t.Errorf("%q: expected %v, got %v (%v)", name, want, policy, err)
+		}
+	}
+
+	if _, err := ParseSlowConsumerPolicy("ignore"); err == nil {
+		t.Error("Expected unknown policy to be rejected")
+	}
+	if SlowConsumerDropOldest.String() != "drop_oldest" {
+		t.Errorf("Unexpected policy name %s", SlowConsumerDropOldest)
+	}
+}
+
+func TestHub_Deliver_DropOldest(t *testing.T) {
+	hub := NewHub()
+	hub.SetSlowConsumerPolicy(SlowConsumerDropOldest)
+	client := &Client{hub: hub, send: make(chan outboundFrame, 2)}
+
+	for _, data := range []string{"a", "b", "c"} {
+		if !hub.deliver(client, newFrame([]byte(data))) {
+			t.Errorf("Expected %s to be queued", data)
+		}
+	}
+
+	for _, want := range []string{"b", "c"} {
+		if frame := <-client.send; string(frame.data) != want {
+			t.Errorf("Expected %s, got %s", want, frame.data)
+		}
+	}
+	if hub.slowStats.droppedOldest != 1 {
+		t.Errorf("Expected 1 dropped message, got %d", hub.slowStats.droppedOldest)
+	}
+}
+
+func TestHub_Deliver_DropNewest(t *testing.T) {
+	hub := NewHub()
+	hub.SetSlowConsumerPolicy(SlowConsumerDropNewest)
+	client := &Client{hub: hub, send: make(chan outboundFrame, 1)}
+
+	hub.deliver(client, newFrame([]byte("a")))
+	if hub.deliver(client, newFrame([]byte("b"))) {
+		t.Error("Expected the newest message to be dropped")
+	}
+	if hub.deliver(client, newFrame([]byte("c"))) {
+		t.Error("Expected the newest message to be dropped")
+	}
+
+	if frame := <-client.send; string(frame.data) != "a" {
+		t.Errorf("Expected the queued message to be kept, got %s", frame.data)
+	}
+	if client.missed != 2 || hub.slowStats.droppedNewest != 2 {
+		t.Errorf("Expected 2 missed messages, got client=%d stats=%d", client.missed, hub.slowStats.droppedNewest)
+	}
+}
+
+func TestHub_Deliver_CoalescePresence(t *testing.T) {
+	hub := NewHub()
+	hub.SetSlowConsumerPolicy(SlowConsumerCoalesce)
+	client := &Client{hub: hub, send: make(chan outboundFrame, 1), displayName: "Slow"}
+	hub.deliver(client, newFrame([]byte("chat")))
+
+	for _, data := range []string{"list-1", "list-2"} {
+		frame := newFrame([]byte(data))
+		frame.presence = true
+		if !hub.deliver(client, frame) {
+			t.Errorf("Expected user list %s to be held aside", data)
+		}
+	}
+	if client.pendingPresence == nil || string(client.pendingPresence.data) != "list-2" {
+		t.Error("Expected only the latest user list to be kept")
+	}
+	if hub.slowStats.coalesced != 2 {
+		t.Errorf("Expected 2 coalesced updates, got %d", hub.slowStats.coalesced)
+	}
+
+	// Anything else still disconnects the client
+	if hub.deliver(client, newFrame([]byte("chat"))) {
+		t.Error("Expected a chat message to a full client to fail")
+	}
+	if atomic.LoadInt32(&client.evicting) != 1 {
+		t.Error("Expected the client to be disconnected")
+	}
+}
+
+func TestHub_Deliver_DisconnectAnnouncesLeave(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	defer hub.Stop()
+
+	slow := &Client{hub: hub, send: make(chan outboundFrame, 1), displayName: "Slow"}
+	watcher := &Client{hub: hub, send: make(chan outboundFrame, 50), displayName: "Watcher"}
+	for _, client := range []*Client{slow, watcher} {
+		hub.mu.Lock()
+		hub.userList[client] = client.displayName
+		hub.clientsByName[client.displayName] = client
+		hub.mu.Unlock()
+		hub.register <- client
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	slow.send <- newFrame([]byte("backlog"))
+	message := Message{Type: MessageTypeSystem, Content: "one too many"}
+	message.SetTimestamp()
+	hub.BroadcastMessage(message)
+
+	announced := waitUntil(time.Second, func() bool {
+		for _, received := range drainMessages(watcher) {
+			if received.Type == MessageTypeSystem && received.Content == "Slow has left the chat" {
+				return true
+			}
+		}
+		return false
+	})
+	if !announced {
+		t.Fatal("Expected the slow client's departure to be announced")
+	}
+	if hub.GetClientCount() != 1 {
+		t.Errorf("Expected only the watcher to remain, got %d clients", hub.GetClientCount())
+	}
+	if hub.slowStats.disconnects != 1 {
+		t.Errorf("Expected 1 disconnect, got %d", hub.slowStats.disconnects)
+	}
+
+	code, reason := websocket.CloseTryAgainLater, "Too slow to keep up"
+	if string(slow.closeMessage) != string(websocket.FormatCloseMessage(code, reason)) {
+		t.Errorf("Unexpected close frame %q", slow.closeMessage)
+	}
+
+	stats := hub.GetConnectionStats()
+	if stats["slow_consumer_disconnects"] != int64(1) || stats["slow_consumer_policy"] != "disconnect" {
+		t.Errorf("Unexpected slow consumer stats %v", stats)
+	}
+}
+
+func TestWritePump_WritesDeferredMessages(t *testing.T) {
+	client, browser := newWritePumpPair(t)
+
+	presence := newFrame([]byte(`{"type":"user_list","users":["Alice"]}`))
+	presence.presence = true
+	client.setPendingPresence(presence)
+	client.missed = 3
+	negotiateContent(client)
+	client.send <- newFrame([]byte(`{"type":"chat","content":"latest"}`))
+	go client.WritePump()
+
+	received := make([]Message, 0)
+	browser.SetReadDeadline(time.Now().Add(time.Second))
+	for len(received) < 3 {
+		_, data, err := browser.ReadMessage()
+		if err != nil {
+			t.Fatalf("Read failed after %d messages: %v", len(received), err)
+		}
+		for _, messageData := range splitFrame(data) {
+			var message Message
+			json.Unmarshal(messageData, &message)
+			received = append(received, message)
+		}
+	}
+
+	if received[0].Content != "latest" || received[1].Type != MessageTypeUserList {
+		t.Errorf("Expected queued message then coalesced user list, got %+v", received)
+	}
+	if received[2].Type != MessageTypeSystem || received[2].Missed != 3 {
+		t.Errorf("Expected missed-messages notice, got %+v", received[2])
+	}
+}
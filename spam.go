@@ -0,0 +1,492 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+// SpamAction is a step in the escalation against a sender scored as a
+// spammer
+type SpamAction int
+
+const (
+	// Tell the sender to stop; the message is still delivered
+	SpamWarn SpamAction = iota + 1
+
+	// Refuse the sender's messages for a while
+	SpamMute
+
+	// Close the sender's connection
+	SpamDisconnect
+)
+
+// String returns the action's name as shown in decisions
+func (a SpamAction) String() string {
+	switch a {
+	case SpamWarn:
+		return "warn"
+	case SpamMute:
+		return "mute"
+	case SpamDisconnect:
+		return "disconnect"
+	}
+	return "none"
+}
+
+// MarshalText writes the action's name in JSON
+func (a SpamAction) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+// SpamConfig weighs the signals that make a sender look like a spammer.
+// Each message earns points; scores decay with HalfLife, and a sender
+// reaching Threshold is escalated against: warned first, then muted, then
+// disconnected. The zero value leaves detection off.
+type SpamConfig struct {
+	// Sending content already sent within Window, to anyone, earns
+	// DuplicatePoints. Messages shorter than MinDuplicateLength, such as
+	// "ok" or "thanks", are not compared.
+	Window             time.Duration
+	MinDuplicateLength int
+	DuplicatePoints    float64
+
+	// Each message beyond BurstMessages within BurstWindow earns
+	// BurstPoints
+	BurstWindow   time.Duration
+	BurstMessages int
+	BurstPoints   float64
+
+	// Each recipient beyond FanoutRecipients within Window earns
+	// FanoutPoints
+	FanoutRecipients int
+	FanoutPoints     float64
+
+	// Clients connected for less than NewClientAge earn NewClientFactor
+	// times the points
+	NewClientAge    time.Duration
+	NewClientFactor float64
+
+	HalfLife  time.Duration
+	Threshold float64
+
+	// How long a mute lasts, and how long a sender must go without being
+	// escalated against to start again from a warning
+	MuteDuration time.Duration
+	ForgiveAfter time.Duration
+
+	// Decisions kept for review
+	HistorySize int
+}
+
+// DefaultSpamConfig returns weights that leave ordinary conversation
+// alone: a new client pasting one message into three conversations is
+// warned, and muted if it carries on
+func DefaultSpamConfig() SpamConfig {
+	return SpamConfig{
+		Window:             time.Minute,
+		MinDuplicateLength: 10,
+		DuplicatePoints:    3,
+		BurstWindow:        10 * time.Second,
+		BurstMessages:      8,
+		BurstPoints:        2,
+		FanoutRecipients:   5,
+		FanoutPoints:       2,
+		NewClientAge:       5 * time.Minute,
+		NewClientFactor:    2,
+		HalfLife:           time.Minute,
+		Threshold:          10,
+		MuteDuration:       5 * time.Minute,
+		ForgiveAfter:       time.Hour,
+		HistorySize:        500,
+	}
+}
+
+// enabled reports whether detection is on
+func (c SpamConfig) enabled() bool {
+	return c.Threshold > 0
+}
+
+// Validate checks that the windows, weights and threshold are usable
+func (c SpamConfig) Validate() error {
+	if !c.enabled() {
+		return nil
+	}
+	if c.Window <= 0 || c.BurstWindow <= 0 || c.HalfLife <= 0 || c.MuteDuration <= 0 || c.ForgiveAfter <= 0 {
+		return errors.New("spam detection windows and durations must be positive")
+	}
+	if c.DuplicatePoints < 0 || c.BurstPoints < 0 || c.FanoutPoints < 0 {
+		return errors.New("spam points cannot be negative")
+	}
+	if c.MinDuplicateLength < 0 || c.BurstMessages < 0 || c.FanoutRecipients < 0 || c.HistorySize < 0 {
+		return errors.New("spam detection limits cannot be negative")
+	}
+	if c.NewClientFactor < 1 {
+		return errors.New("new client factor must be at least 1")
+	}
+	return nil
+}
+
+// SetSpamDetection turns spam detection on with the given weights, or off
+// with the zero config. It must be called before clients connect.
+func (h *Hub) SetSpamDetection(config SpamConfig) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	h.spamConfig = config
+	h.spamLog = newSpamLog(config.HistorySize)
+	h.spamSenders = newSpamSenders()
+	return nil
+}
+
+// Recipient of public chat messages when scoring fan-out
+const spamRecipientPublic = "*"
+
+// spamDigest tracks one piece of content a sender has sent recently
+type spamDigest struct {
+	count      int
+	recipients map[string]bool
+	last       time.Time
+}
+
+// spamEscalation is how far escalation against a sender has gone
+type spamEscalation struct {
+	strikes    int
+	lastStrike time.Time
+	mutedUntil time.Time
+}
+
+// spamTracker is a sender's spam score, the history it is computed from
+// and the escalation against it. The zero value is ready to use.
+type spamTracker struct {
+	mu      sync.Mutex
+	score   float64
+	updated time.Time
+
+	recent     []time.Time
+	recipients map[string]time.Time
+	digests    map[uint64]*spamDigest
+
+	spamEscalation
+}
+
+// spamSenders keeps spam trackers in the hub so that reconnecting does not
+// reset them. Trackers are per display name; escalations are also kept per
+// client IP, as connection limits are, and carried over to new names from
+// that address.
+type spamSenders struct {
+	mu     sync.Mutex
+	byName map[string]*spamTracker
+	byIP   map[netip.Addr]spamEscalation
+}
+
+// newSpamSenders creates an empty set of trackers
+func newSpamSenders() *spamSenders {
+	return &spamSenders{
+		byName: make(map[string]*spamTracker),
+		byIP:   make(map[netip.Addr]spamEscalation),
+	}
+}
+
+// tracker returns the tracker for a display name, creating it with the
+// escalation against the client IP if there is none
+func (s *spamSenders) tracker(name string, ip netip.Addr) *spamTracker {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := strings.ToLower(name)
+	tracker, ok := s.byName[key]
+	if !ok {
+		tracker = &spamTracker{}
+		if ip.IsValid() {
+			tracker.spamEscalation = s.byIP[ip]
+		}
+		s.byName[key] = tracker
+	}
+	return tracker
+}
+
+// escalated records a tracker's escalation against the client IP
+func (s *spamSenders) escalated(ip netip.Addr, tracker *spamTracker) {
+	if !ip.IsValid() {
+		return
+	}
+	tracker.mu.Lock()
+	escalation := tracker.spamEscalation
+	tracker.mu.Unlock()
+
+	s.mu.Lock()
+	s.byIP[ip] = escalation
+	s.mu.Unlock()
+}
+
+// prune drops trackers and escalations that are muted no longer and have
+// been quiet long enough to be forgiven
+func (s *spamSenders) prune(config SpamConfig, now time.Time) {
+	forgiven := func(e spamEscalation, last time.Time) bool {
+		return !now.Before(e.mutedUntil) && now.Sub(last) >= config.ForgiveAfter
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, tracker := range s.byName {
+		tracker.mu.Lock()
+		stale := forgiven(tracker.spamEscalation, tracker.updated)
+		tracker.mu.Unlock()
+		if stale {
+			delete(s.byName, name)
+		}
+	}
+	for ip, escalation := range s.byIP {
+		if forgiven(escalation, escalation.lastStrike) {
+			delete(s.byIP, ip)
+		}
+	}
+}
+
+// spamVerdict is the outcome of scoring one message
+type spamVerdict struct {
+	action  SpamAction
+	score   float64
+	reasons []string
+
+	// Set while a mute is running, with how long it has left
+	muted      bool
+	retryAfter time.Duration
+}
+
+// contentDigest hashes content so that changes in case, spacing or
+// lookalike letters do not make a copy look new
+func contentDigest(content string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(strings.Join(strings.Fields(foldConfusables(content)), " ")))
+	return hash.Sum64()
+}
+
+// observe scores a message to a recipient and decides whether to escalate
+func (t *spamTracker) observe(content, recipient string, connectedAt time.Time, config SpamConfig, now time.Time) spamVerdict {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if now.Before(t.mutedUntil) {
+		return spamVerdict{muted: true, retryAfter: t.mutedUntil.Sub(now)}
+	}
+	t.forget(config, now)
+
+	var points float64
+	var reasons []string
+
+	// The same content again, possibly to someone else
+	if utf8.RuneCountInString(strings.TrimSpace(content)) >= config.MinDuplicateLength {
+		key := contentDigest(content)
+		digest, ok := t.digests[key]
+		if !ok {
+			digest = &spamDigest{recipients: make(map[string]bool)}
+			t.digests[key] = digest
+		}
+		digest.count++
+		digest.recipients[recipient] = true
+		digest.last = now
+		if digest.count > 1 {
+			points += config.DuplicatePoints
+			reasons = append(reasons, fmt.Sprintf("same message sent %d times to %d recipients", digest.count, len(digest.recipients)))
+		}
+	}
+
+	// Many messages in a short time
+	t.recent = append(t.recent, now)
+	if config.BurstMessages > 0 && len(t.recent) > config.BurstMessages {
+		points += config.BurstPoints
+		reasons = append(reasons, fmt.Sprintf("%d messages in %v", len(t.recent), config.BurstWindow))
+	}
+
+	// Messages to many different people
+	if _, ok := t.recipients[recipient]; !ok && config.FanoutRecipients > 0 && len(t.recipients) >= config.FanoutRecipients {
+		points += config.FanoutPoints
+		reasons = append(reasons, fmt.Sprintf("messages to %d recipients in %v", len(t.recipients)+1, config.Window))
+	}
+	t.recipients[recipient] = now
+
+	if points > 0 && now.Sub(connectedAt) < config.NewClientAge {
+		points *= config.NewClientFactor
+		reasons = append(reasons, "new connection")
+	}
+
+	// Decay the score since the last message, then add this one's points
+	if !t.updated.IsZero() {
+		t.score *= math.Pow(0.5, float64(now.Sub(t.updated))/float64(config.HalfLife))
+	}
+	t.score += points
+	t.updated = now
+
+	verdict := spamVerdict{score: t.score, reasons: reasons}
+	if t.score < config.Threshold {
+		return verdict
+	}
+
+	// Escalate one step, starting over after a long enough quiet spell
+	if t.strikes > 0 && now.Sub(t.lastStrike) >= config.ForgiveAfter {
+		t.strikes = 0
+	}
+	t.strikes++
+	t.lastStrike = now
+	t.score = 0
+	switch t.strikes {
+	case 1:
+		verdict.action = SpamWarn
+	case 2:
+		verdict.action = SpamMute
+		verdict.retryAfter = config.MuteDuration
+		t.mutedUntil = now.Add(config.MuteDuration)
+	default:
+		verdict.action = SpamDisconnect
+	}
+	return verdict
+}
+
+// forget drops history that has left its window
+func (t *spamTracker) forget(config SpamConfig, now time.Time) {
+	if t.digests == nil {
+		t.digests = make(map[uint64]*spamDigest)
+		t.recipients = make(map[string]time.Time)
+	}
+	for key, digest := range t.digests {
+		if now.Sub(digest.last) > config.Window {
+			delete(t.digests, key)
+		}
+	}
+	for recipient, last := range t.recipients {
+		if now.Sub(last) > config.Window {
+			delete(t.recipients, recipient)
+		}
+	}
+	kept := t.recent[:0]
+	for _, sent := range t.recent {
+		if now.Sub(sent) <= config.BurstWindow {
+			kept = append(kept, sent)
+		}
+	}
+	t.recent = kept
+}
+
+// SpamDecision records an escalation for review
+type SpamDecision struct {
+	Time    time.Time  `json:"time"`
+	User    string     `json:"user"`
+	Address string     `json:"address"`
+	Action  SpamAction `json:"action"`
+	Score   float64    `json:"score"`
+	Reasons []string   `json:"reasons"`
+
+	// The start of the message that triggered it
+	Content string `json:"content"`
+}
+
+// Longest excerpt of a message kept in a decision, in runes
+const spamExcerptLength = 100
+
+// contentExcerpt returns the start of a message's content, as kept in
+// decisions and sent in moderation events
+func contentExcerpt(content string) string {
+	if utf8.RuneCountInString(content) > spamExcerptLength {
+		return string([]rune(content)[:spamExcerptLength])
+	}
+	return content
+}
+
+// spamLog keeps the latest decisions
+type spamLog struct {
+	mu        sync.Mutex
+	decisions []SpamDecision
+	limit     int
+}
+
+// newSpamLog creates a log keeping up to limit decisions
+func newSpamLog(limit int) *spamLog {
+	return &spamLog{limit: limit}
+}
+
+// add records a decision, forgetting the oldest once the log is full
+func (l *spamLog) add(decision SpamDecision) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limit == 0 {
+		return
+	}
+	l.decisions = append(l.decisions, decision)
+	if len(l.decisions) > l.limit {
+		l.decisions = l.decisions[len(l.decisions)-l.limit:]
+	}
+}
+
+// SpamDecisions returns up to limit decisions, newest first, about one
+// user or, if user is empty, about anyone. A limit of 0 returns them all.
+func (h *Hub) SpamDecisions(user string, limit int) []SpamDecision {
+	decisions := make([]SpamDecision, 0)
+	if h.spamLog == nil {
+		return decisions
+	}
+	h.spamLog.mu.Lock()
+	defer h.spamLog.mu.Unlock()
+	for i := len(h.spamLog.decisions) - 1; i >= 0; i-- {
+		if limit > 0 && len(decisions) == limit {
+			break
+		}
+		if decision := h.spamLog.decisions[i]; user == "" || strings.EqualFold(decision.User, user) {
+			decisions = append(decisions, decision)
+		}
+	}
+	return decisions
+}
+
+// checkSpam scores a message the client is about to send to a recipient:
+// a user, a group conversation or the public room. It returns false if the
+// message must not be delivered, having told the client why.
+func (c *Client) checkSpam(message *Message, recipient string) bool {
+	config := c.hub.spamConfig
+	if !config.enabled() {
+		return true
+	}
+	tracker := c.hub.spamSenders.tracker(c.displayName, c.ip)
+	verdict := tracker.observe(message.Content, recipient, c.GetConnectedAt(), config, c.now())
+	if verdict.muted {
+		c.sendRateLimitError("You are muted for sending spam.", verdict.retryAfter)
+		return false
+	}
+	if verdict.action == 0 {
+		return true
+	}
+	c.hub.spamSenders.escalated(c.ip, tracker)
+
+	decision := SpamDecision{
+		Time:    c.now(),
+		User:    c.displayName,
+		Address: c.remoteAddress(),
+		Action:  verdict.action,
+		Score:   verdict.score,
+		Reasons: verdict.reasons,
+		Content: contentExcerpt(message.Content),
+	}
+	c.hub.spamLog.add(decision)
+	log.Printf("[SPAM] %s %s (%s): score=%.1f reasons=%s", decision.Action, decision.User, decision.Address,
+		decision.Score, strings.Join(decision.Reasons, "; "))
+	c.emitModeration("spam", decision.Action.String(), strings.Join(decision.Reasons, "; "), message)
+
+	switch verdict.action {
+	case SpamWarn:
+		c.sendError("Your messages look like spam. Keep this up and you will be muted.")
+		return true
+	case SpamMute:
+		c.sendRateLimitError(fmt.Sprintf("You are muted for %v for sending spam.", verdict.retryAfter), verdict.retryAfter)
+		return false
+	}
+	c.hub.evict(c, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "Disconnected for spam"))
+	return false
+}
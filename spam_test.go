@@ -0,0 +1,305 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// spamTestConfig isolates one signal at a time: only the points given are
+// earned, and a score of 10 escalates
+func spamTestConfig() SpamConfig {
+	config := DefaultSpamConfig()
+	config.DuplicatePoints = 0
+	config.BurstPoints = 0
+	config.FanoutPoints = 0
+	config.NewClientFactor = 1
+	return config
+}
+
+func TestSpamTracker_DuplicatesAcrossRecipients(t *testing.T) {
+	config := spamTestConfig()
+	config.DuplicatePoints = 5
+	now := time.Unix(1700000000, 0)
+	var tracker spamTracker
+
+	// Short replies are never compared
+	for i := 0; i < 5; i++ {
+		if v := tracker.observe("thanks!", "Bob", time.Time{}, config, now); v.score != 0 {
+			t.Fatalf("Expected short messages to score nothing, got %.1f", v.score)
+		}
+	}
+
+	// Copies differing only in case, spacing and lookalikes are the same
+	copies := []string{"Buy cheap followers now", "buy  CHEAP followers now", "Buy cheap fоllowers now"}
+	var verdict spamVerdict
+	for i, content := range copies {
+		verdict = tracker.observe(content, fmt.Sprintf("user-%d", i), time.Time{}, config, now)
+	}
+	if verdict.action != SpamWarn {
+		t.Fatalf("Expected a warning after the third copy, got %+v", verdict)
+	}
+	if want := "same message sent 3 times to 3 recipients"; verdict.reasons[0] != want {
+		t.Errorf("Expected reason %q, got %q", want, verdict.reasons[0])
+	}
+
+	// Copies fall out of the window
+	now = now.Add(config.Window + time.Second)
+	if v := tracker.observe("Buy cheap followers now", "Dan", time.Time{}, config, now); v.score != 0 {
+		t.Errorf("Expected a copy outside the window to score nothing, got %.1f", v.score)
+	}
+}
+
+func TestSpamTracker_BurstAndFanout(t *testing.T) {
+	config := spamTestConfig()
+	config.BurstPoints = 1
+	now := time.Unix(1700000000, 0)
+	var tracker spamTracker
+
+	var verdict spamVerdict
+	for i := 0; i < config.BurstMessages+2; i++ {
+		verdict = tracker.observe(fmt.Sprintf("message %d", i), "Bob", time.Time{}, config, now)
+	}
+	if verdict.score != 2 {
+		t.Errorf("Expected a point for each of the 2 messages over the burst, got %.1f", verdict.score)
+	}
+
+	config = spamTestConfig()
+	config.FanoutPoints = 1
+	tracker = spamTracker{}
+	for i := 0; i < config.FanoutRecipients+3; i++ {
+		verdict = tracker.observe(fmt.Sprintf("hello %d", i), fmt.Sprintf("user-%d", i), time.Time{}, config, now)
+		now = now.Add(5 * time.Second)
+	}
+	if verdict.score < 2.5 || verdict.score >= 3 {
+		t.Errorf("Expected just under a point for each of the 3 extra recipients after decay, got %.2f", verdict.score)
+	}
+	if want := fmt.Sprintf("messages to %d recipients in 1m0s", config.FanoutRecipients+3); verdict.reasons[0] != want {
+		t.Errorf("Expected reason %q, got %q", want, verdict.reasons[0])
+	}
+}
+
+func TestSpamTracker_NewClientsAndDecay(t *testing.T) {
+	config := spamTestConfig()
+	config.DuplicatePoints = 3
+	config.NewClientFactor = 2
+	now := time.Unix(1700000000, 0)
+
+	var fresh, established spamTracker
+	for i := 0; i < 2; i++ {
+		fresh.observe("the same message again", "Bob", now, config, now)
+		established.observe("the same message again", "Bob", now.Add(-time.Hour), config, now)
+	}
+	if fresh.score != 6 || established.score != 3 {
+		t.Errorf("Expected new clients to score double, got %.1f and %.1f", fresh.score, established.score)
+	}
+
+	// A half-life later the score has halved before the next points land
+	now = now.Add(config.HalfLife)
+	verdict := established.observe("something different", "Bob", now.Add(-time.Hour), config, now)
+	if verdict.score != 1.5 {
+		t.Errorf("Expected the score to halve, got %.2f", verdict.score)
+	}
+}
+
+func TestSpamTracker_Escalation(t *testing.T) {
+	config := spamTestConfig()
+	config.DuplicatePoints = config.Threshold
+	now := time.Unix(1700000000, 0)
+	var tracker spamTracker
+	spam := func() spamVerdict {
+		return tracker.observe("the same message again", "Bob", time.Time{}, config, now)
+	}
+
+	spam()
+	if v := spam(); v.action != SpamWarn {
+		t.Fatalf("Expected a warning, got %+v", v)
+	}
+	if v := spam(); v.action != SpamMute || v.retryAfter != config.MuteDuration {
+		t.Fatalf("Expected a mute, got %+v", v)
+	}
+
+	// Muted senders are refused without being scored
+	now = now.Add(time.Minute)
+	if v := spam(); !v.muted || v.retryAfter != config.MuteDuration-time.Minute {
+		t.Fatalf("Expected the mute to hold, got %+v", v)
+	}
+
+	now = now.Add(config.MuteDuration)
+	spam()
+	if v := spam(); v.action != SpamDisconnect {
+		t.Fatalf("Expected a disconnect, got %+v", v)
+	}
+
+	// A long enough quiet spell starts over from a warning
+	now = now.Add(config.ForgiveAfter)
+	spam()
+	if v := spam(); v.action != SpamWarn {
+		t.Errorf("Expected a warning after forgiveness, got %+v", v)
+	}
+}
+
+func TestSpamConfig_Validate(t *testing.T) {
+	if err := DefaultSpamConfig().Validate(); err != nil {
+		t.Fatalf("Expected the defaults to be valid: %v", err)
+	}
+	if err := (SpamConfig{}).Validate(); err != nil {
+		t.Errorf("Expected the zero config, detection off, to be valid: %v", err)
+	}
+
+	invalid := []func(*SpamConfig){
+		func(c *SpamConfig) { c.Window = 0 },
+		func(c *SpamConfig) { c.HalfLife = -time.Second },
+		func(c *SpamConfig) { c.DuplicatePoints = -1 },
+		func(c *SpamConfig) { c.BurstMessages = -1 },
+		func(c *SpamConfig) { c.NewClientFactor = 0.5 },
+	}
+	for i, change := range invalid {
+		config := DefaultSpamConfig()
+		change(&config)
+		if err := config.Validate(); err == nil {
+			t.Errorf("Expected invalid config %d to be refused", i)
+		}
+	}
+}
+
+func TestSpamLog(t *testing.T) {
+	hub := NewHub()
+	if decisions := hub.SpamDecisions("", 0); len(decisions) != 0 {
+		t.Fatalf("Expected no decisions with detection off, got %v", decisions)
+	}
+
+	config := DefaultSpamConfig()
+	config.HistorySize = 3
+	hub.SetSpamDetection(config)
+	for i, user := range []string{"Ann", "Bob", "Ann", "Bob"} {
+		hub.spamLog.add(SpamDecision{User: user, Score: float64(i)})
+	}
+
+	decisions := hub.SpamDecisions("", 0)
+	if len(decisions) != 3 || decisions[0].Score != 3 || decisions[2].Score != 1 {
+		t.Errorf("Expected the 3 newest decisions, newest first, got %+v", decisions)
+	}
+	if decisions := hub.SpamDecisions("ann", 0); len(decisions) != 1 || decisions[0].Score != 2 {
+		t.Errorf("Expected Ann's remaining decision, got %+v", decisions)
+	}
+	if decisions := hub.SpamDecisions("", 1); len(decisions) != 1 || decisions[0].Score != 3 {
+		t.Errorf("Expected the newest decision, got %+v", decisions)
+	}
+}
+
+func TestSpam_PastingDirectMessagesEscalates(t *testing.T) {
+	h := newChatHarness(t)
+	config := DefaultSpamConfig()
+	config.MuteDuration = 30 * time.Second
+	if err := h.hub.SetSpamDetection(config); err != nil {
+		t.Fatal(err)
+	}
+	targets := h.joinMany("user", 6)
+	spammer := h.join("Spammer")
+
+	isError := func(text string) func(Message) bool {
+		return func(m Message) bool { return m.Type == MessageTypeError && m.Error == text }
+	}
+	paste := func(target *fakeClient) {
+		spammer.send(Message{Type: MessageTypePrivate, From: "Spammer", To: target.name, Content: "Visit my shop for cheap followers"})
+	}
+
+	isPaste := func(m Message) bool { return m.Type == MessageTypePrivate && m.From == "Spammer" }
+
+	// A new client pasting into three conversations is warned, but the
+	// third copy is still delivered
+	for _, target := range targets[:3] {
+		paste(target)
+		target.waitFor(isPaste)
+	}
+	spammer.waitFor(isError("Your messages look like spam. Keep this up and you will be muted."))
+
+	// Carrying on gets it muted, and the copy that did it is held back
+	paste(targets[3])
+	targets[3].waitFor(isPaste)
+	paste(targets[4])
+	spammer.waitFor(func(m Message) bool { return m.Type == MessageTypeError && m.RetryAfter == 30 })
+	paste(targets[5])
+	spammer.waitFor(isError("You are muted for sending spam."))
+	spammer.keepAlive()
+	for _, target := range targets[4:] {
+		target.keepAlive()
+		if n := target.count(isPaste); n != 0 {
+			t.Errorf("Expected %s to get nothing from a muted sender, got %d", target.name, n)
+		}
+	}
+
+	// After the mute, the next escalation disconnects
+	for _, client := range append([]*fakeClient{spammer}, targets...) {
+		client.keepAlive()
+	}
+	h.clock.Advance(config.MuteDuration)
+	paste(targets[0])
+	targets[0].waitForN(isPaste, 2)
+	paste(targets[1])
+	if !spammer.disconnected() {
+		t.Fatal("Expected the spammer to be disconnected")
+	}
+
+	decisions := h.hub.SpamDecisions("Spammer", 0)
+	if len(decisions) != 3 || decisions[0].Action != SpamDisconnect || decisions[1].Action != SpamMute || decisions[2].Action != SpamWarn {
+		t.Fatalf("Expected warn, mute and disconnect decisions, got %+v", decisions)
+	}
+	if decisions[2].Content != "Visit my shop for cheap followers" {
+		t.Errorf("Expected the triggering message in the decision, got %q", decisions[2].Content)
+	}
+}
+
+func TestSpam_MuteSurvivesReconnecting(t *testing.T) {
+	h := newChatHarness(t)
+	config := spamTestConfig()
+	config.DuplicatePoints = config.Threshold
+	if err := h.hub.SetSpamDetection(config); err != nil {
+		t.Fatal(err)
+	}
+	target := h.join("Target")
+	spammer := h.join("Spammer")
+	paste := func(spammer *fakeClient) {
+		spammer.send(Message{Type: MessageTypeChat, From: "Spammer", Content: "Visit my shop for cheap followers"})
+	}
+	isMuted := func(m Message) bool {
+		return m.Type == MessageTypeError && m.Error == "You are muted for sending spam."
+	}
+
+	// Warned, then muted
+	for i := 0; i < 4; i++ {
+		paste(spammer)
+	}
+	spammer.waitFor(func(m Message) bool { return m.Type == MessageTypeError && m.RetryAfter > 0 })
+
+	// Coming back under the same name does not lift the mute
+	spammer.conn.Close()
+	target.waitFor(func(m Message) bool { return m.Type == MessageTypeSystem && m.Content == "Spammer has left the chat" })
+	spammer = h.join("Spammer")
+	paste(spammer)
+	spammer.waitFor(isMuted)
+
+	// Nor does coming back from the same address under another name
+	senders := h.hub.spamSenders
+	ip := netip.MustParseAddr("203.0.113.7")
+	tracker := senders.tracker("Spammer", ip)
+	senders.escalated(ip, tracker)
+	if v := senders.tracker("Spammer2", ip).observe("hello", "*", time.Time{}, config, h.clock.Now()); !v.muted {
+		t.Errorf("Expected a new name from a muted address to be muted, got %+v", v)
+	}
+	if v := senders.tracker("Bystander", netip.MustParseAddr("203.0.113.8")).observe("hello", "*", time.Time{}, config, h.clock.Now()); v.muted {
+		t.Errorf("Expected other addresses to be unaffected, got %+v", v)
+	}
+
+	// Trackers are forgotten once the mute is over and the sender forgiven
+	h.clock.Advance(config.ForgiveAfter)
+	senders.prune(config, h.clock.Now())
+	senders.mu.Lock()
+	remaining := len(senders.byName) + len(senders.byIP)
+	senders.mu.Unlock()
+	if remaining != 0 {
+		t.Errorf("Expected forgiven senders to be pruned, %d remain", remaining)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+)
+
+const (
+	// Number of chat and private messages kept in memory
+	defaultStoreLimit = 1000
+)
+
+// storedMessage is a message held by the store along with its reactions
+type storedMessage struct {
+	message Message
+
+	// emoji -> set of display names that reacted with it, and how many
+	// times the reactions changed
+	reactions       map[string]map[string]bool
+	reactionVersion int
+
+	// IDs of replies, in order, when this message is a thread root
+	replies []string
+}
+
+// MessageStore keeps a bounded in-memory history of chat and private messages
+type MessageStore struct {
+	mu       sync.RWMutex
+	messages map[string]*storedMessage
+	order    []string
+	limit    int
+	nextID   uint64
+
+	// Prefix keeping IDs unique across server instances
+	idPrefix string
+}
+
+// NewMessageStore creates a store holding at most limit messages
+func NewMessageStore(limit int) *MessageStore {
+	if limit <= 0 {
+		limit = defaultStoreLimit
+	}
+	return &MessageStore{
+		messages: make(map[string]*storedMessage),
+		order:    make([]string, 0, limit),
+		limit:    limit,
+	}
+}
+
+// Add assigns the message a new ID and records it, evicting the oldest
+// message once the store is full
+func (s *MessageStore) Add(message *Message) {
+	s.AssignID(message)
+	s.Insert(*message)
+}
+
+// AssignID gives a message a new ID without recording it, for messages
+// that are only kept once delivered
+func (s *MessageStore) AssignID(message *Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	message.ID = s.idPrefix + strconv.FormatUint(s.nextID, 10)
+}
+
+// Insert records a message that was assigned an ID, evicting the oldest
+// message once the store is full
+func (s *MessageStore) Insert(message Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.messages[message.ID] = &storedMessage{
+		message:   message,
+		reactions: make(map[string]map[string]bool),
+	}
+	s.order = append(s.order, message.ID)
+
+	// Link replies to their thread root
+	if message.ThreadID != "" {
+		if root, ok := s.messages[message.ThreadID]; ok {
+			root.replies = append(root.replies, message.ID)
+			root.message.ReplyCount = len(root.replies)
+		}
+	}
+
+	// Evict oldest messages beyond the limit
+	for len(s.order) > s.limit {
+		delete(s.messages, s.order[0])
+		s.order = s.order[1:]
+	}
+}
+
+// SetIDPrefix sets the prefix of IDs assigned to new messages
+func (s *MessageStore) SetIDPrefix(prefix string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.idPrefix = prefix
+}
+
+// Get returns the stored message with the given ID
+func (s *MessageStore) Get(id string) (Message, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stored, ok := s.messages[id]
+	if !ok {
+		return Message{}, false
+	}
+	return stored.message, true
+}
+
+// Len returns the number of messages currently stored
+func (s *MessageStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.order)
+}
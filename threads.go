@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"log"
+)
+
+// Thread returns a thread's root followed by its replies in order. The root
+// carries the current reply count.
+func (s *MessageStore) Thread(rootID string) ([]Message, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	root, ok := s.messages[rootID]
+	if !ok {
+		return nil, false
+	}
+
+	messages := make([]Message, 0, len(root.replies)+1)
+	messages = append(messages, root.message)
+	for _, id := range root.replies {
+		// Replies may have been evicted before their root
+		if reply, ok := s.messages[id]; ok {
+			messages = append(messages, reply.message)
+		}
+	}
+	return messages, true
+}
+
+// ThreadParticipants returns the root author and everyone who replied, in
+// order of first participation
+func (s *MessageStore) ThreadParticipants(rootID string) []string {
+	messages, ok := s.Thread(rootID)
+	if !ok {
+		return nil
+	}
+
+	seen := make(map[string]bool, len(messages))
+	participants := make([]string, 0, len(messages))
+	for _, message := range messages {
+		if message.From != "" && !seen[message.From] {
+			seen[message.From] = true
+			participants = append(participants, message.From)
+		}
+	}
+	return participants
+}
+
+// PrepareReply resolves the thread a reply belongs to and sets its ThreadID.
+// Replies must stay in the conversation of the message they answer.
+func (h *Hub) PrepareReply(user string, message *Message) error {
+	message.ThreadID = ""
+	if message.ReplyTo == "" {
+		return nil
+	}
+
+	parent, ok := h.store.Get(message.ReplyTo)
+	if !ok || !h.canSee(parent, user) {
+		return errors.New("message being replied to was not found")
+	}
+
+	if parent.Type != message.Type {
+		return errors.New("replies must stay in the same conversation")
+	}
+	if message.Type == MessageTypePrivate && !sameConversation(parent, *message) {
+		return errors.New("replies must stay in the same conversation")
+	}
+	if message.Type == MessageTypeGroupMessage && parent.ConversationID != message.ConversationID {
+		return errors.New("replies must stay in the same conversation")
+	}
+
+	// Replies to replies join the parent's thread
+	message.ThreadID = parent.ThreadID
+	if message.ThreadID == "" {
+		message.ThreadID = parent.ID
+	}
+	return nil
+}
+
+// sameConversation reports whether two private messages share participants
+func sameConversation(a, b Message) bool {
+	return (a.From == b.From && a.To == b.To) || (a.From == b.To && a.To == b.From)
+}
+
+// notifyThread tells the other participants of a thread about a new reply
+func (h *Hub) notifyThread(reply Message) {
+	if reply.ThreadID == "" {
+		return
+	}
+
+	messages, ok := h.store.Thread(reply.ThreadID)
+	if !ok {
+		return
+	}
+	root := messages[0]
+
+	recipients := make([]string, 0)
+	for _, name := range h.store.ThreadParticipants(reply.ThreadID) {
+		if name != reply.From && h.canSee(root, name) {
+			recipients = append(recipients, name)
+		}
+	}
+	recipients = h.withoutBlockers(reply.From, recipients)
+	if len(recipients) == 0 {
+		return
+	}
+
+	notification := &Message{
+		Type:       MessageTypeThreadReply,
+		From:       reply.From,
+		Content:    reply.Content,
+		MessageID:  reply.ID,
+		ThreadID:   reply.ThreadID,
+		ReplyCount: root.ReplyCount,
+	}
+	notification.SetTimestampAt(h.now())
+
+	log.Printf("[THREAD] Reply notification: thread=%s from=%s recipients=%d",
+		reply.ThreadID, reply.From, len(recipients))
+	h.sendToUsers(*notification, recipients...)
+}
+
+// handleGetThread answers a client's request for a thread's messages
+func (c *Client) handleGetThread(message *Message) {
+	if c.displayName == "" {
+		c.sendError("Must join chat before reading threads")
+		return
+	}
+
+	root, ok := c.hub.store.Get(message.MessageID)
+	if ok && root.ThreadID != "" {
+		// Requests for a reply return the whole thread
+		root, ok = c.hub.store.Get(root.ThreadID)
+	}
+	if !ok || !c.hub.canSee(root, c.displayName) {
+		c.sendError("Thread not found")
+		return
+	}
+
+	messages, ok := c.hub.store.Thread(root.ID)
+	if !ok {
+		c.sendError("Thread not found")
+		return
+	}
+
+	response := &Message{
+		Type:       MessageTypeThread,
+		MessageID:  root.ID,
+		ThreadID:   root.ID,
+		ReplyCount: messages[0].ReplyCount,
+		Messages:   messages,
+	}
+	response.SetTimestampAt(c.now())
+	c.sendMessage(response)
+}
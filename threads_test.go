@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// newTestThread stores a public root with a reply and returns both
+func newTestThread(t *testing.T, hub *Hub) (*Message, *Message) {
+	root := &Message{Type: MessageTypeChat, From: "Alice", Content: "question"}
+	hub.store.Add(root)
+
+	reply := &Message{Type: MessageTypeChat, From: "Bob", Content: "answer", ReplyTo: root.ID}
+	if err := hub.PrepareReply("Bob", reply); err != nil {
+		t.Fatalf("PrepareReply failed: %v", err)
+	}
+	hub.store.Add(reply)
+	return root, reply
+}
+
+func TestMessageStore_Thread(t *testing.T) {
+	hub := NewHub()
+	root, reply := newTestThread(t, hub)
+
+	if reply.ThreadID != root.ID {
+		t.Errorf("Expected reply thread %s, got %s", root.ID, reply.ThreadID)
+	}
+
+	// A reply to a reply joins the root's thread
+	nested := &Message{Type: MessageTypeChat, From: "Carol", Content: "me too", ReplyTo: reply.ID}
+	if err := hub.PrepareReply("Carol", nested); err != nil {
+		t.Fatalf("PrepareReply failed: %v", err)
+	}
+	if nested.ThreadID != root.ID {
+		t.Errorf("Expected nested reply in thread %s, got %s", root.ID, nested.ThreadID)
+	}
+	hub.store.Add(nested)
+
+	messages, ok := hub.store.Thread(root.ID)
+	if !ok {
+		t.Fatal("Thread not found")
+	}
+	if len(messages) != 3 {
+		t.Fatalf("Expected 3 thread messages, got %d", len(messages))
+	}
+	if messages[0].ReplyCount != 2 {
+		t.Errorf("Expected root reply count 2, got %d", messages[0].ReplyCount)
+	}
+	if messages[1].ID != reply.ID || messages[2].ID != nested.ID {
+		t.Error("Expected replies in posting order")
+	}
+
+	participants := hub.store.ThreadParticipants(root.ID)
+	expected := []string{"Alice", "Bob", "Carol"}
+	if len(participants) != len(expected) {
+		t.Fatalf("Expected participants %v, got %v", expected, participants)
+	}
+	for i, name := range expected {
+		if participants[i] != name {
+			t.Errorf("Expected participant %d to be %s, got %s", i, name, participants[i])
+		}
+	}
+}
+
+func TestHub_PrepareReply_Errors(t *testing.T) {
+	hub := NewHub()
+
+	private := &Message{Type: MessageTypePrivate, From: "Alice", To: "Bob", Content: "psst"}
+	hub.store.Add(private)
+
+	tests := []struct {
+		name    string
+		user    string
+		message Message
+	}{
+		{
+			name:    "unknown parent",
+			user:    "Bob",
+			message: Message{Type: MessageTypeChat, From: "Bob", ReplyTo: "missing"},
+		},
+		{
+			name:    "parent not visible",
+			user:    "Carol",
+			message: Message{Type: MessageTypePrivate, From: "Carol", To: "Alice", ReplyTo: private.ID},
+		},
+		{
+			name:    "public reply to private message",
+			user:    "Bob",
+			message: Message{Type: MessageTypeChat, From: "Bob", ReplyTo: private.ID},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := hub.PrepareReply(tt.user, &tt.message); err == nil {
+				t.Error("Expected PrepareReply to fail")
+			}
+		})
+	}
+
+	// Replying inside the same private conversation is allowed
+	reply := &Message{Type: MessageTypePrivate, From: "Bob", To: "Alice", ReplyTo: private.ID}
+	if err := hub.PrepareReply("Bob", reply); err != nil {
+		t.Errorf("Expected private reply to succeed, got %v", err)
+	}
+}
+
+func TestHub_NotifyThread(t *testing.T) {
+	hub := NewHub()
+
+	alice := &Client{hub: hub, send: make(chan outboundFrame, 10), displayName: "Alice"}
+	bob := &Client{hub: hub, send: make(chan outboundFrame, 10), displayName: "Bob"}
+	carol := &Client{hub: hub, send: make(chan outboundFrame, 10), displayName: "Carol"}
+	negotiateContent(alice, bob, carol)
+	hub.UpdateClientName(alice, "Alice")
+	hub.UpdateClientName(bob, "Bob")
+	hub.UpdateClientName(carol, "Carol")
+
+	root, reply := newTestThread(t, hub)
+	hub.notifyThread(*reply)
+
+	select {
+	case frame := <-alice.send:
+		data := frame.data
+		var notification Message
+		json.Unmarshal(data, &notification)
+		if notification.Type != MessageTypeThreadReply {
+			t.Errorf("Expected thread_reply, got %s", notification.Type)
+		}
+		if notification.ThreadID != root.ID || notification.ReplyCount != 1 {
+			t.Errorf("Unexpected notification %+v", notification)
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Error("Thread root author did not receive notification")
+	}
+
+	select {
+	case <-bob.send:
+		t.Error("Reply author should not be notified of their own reply")
+	default:
+	}
+
+	select {
+	case <-carol.send:
+		t.Error("Non-participant should not receive thread notification")
+	default:
+	}
+}
+
+func TestClient_HandleGetThread(t *testing.T) {
+	hub := NewHub()
+	root, reply := newTestThread(t, hub)
+
+	client := &Client{hub: hub, send: make(chan outboundFrame, 10), displayName: "Carol"}
+
+	// Asking for a reply returns the whole thread
+	client.handleGetThread(&Message{Type: MessageTypeGetThread, MessageID: reply.ID})
+
+	select {
+	case frame := <-client.send:
+		data := frame.data
+		var response Message
+		json.Unmarshal(data, &response)
+		if response.Type != MessageTypeThread || response.MessageID != root.ID {
+			t.Errorf("Unexpected thread response %+v", response)
+		}
+		if len(response.Messages) != 2 || response.ReplyCount != 1 {
+			t.Errorf("Expected root and one reply, got %d messages", len(response.Messages))
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("Client did not receive thread response")
+	}
+
+	client.handleGetThread(&Message{Type: MessageTypeGetThread, MessageID: "missing"})
+	select {
+	case frame := <-client.send:
+		data := frame.data
+		var response Message
+		json.Unmarshal(data, &response)
+		if response.Type != MessageTypeError {
+			t.Errorf("Expected error for unknown thread, got %s", response.Type)
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("Client did not receive error response")
+	}
+}
+
+func TestMessage_ResetServerFields(t *testing.T) {
+	message := Message{
+		Type:       MessageTypeChat,
+		ID:         "42",
+		ThreadID:   "7",
+		ReplyTo:    "7",
+		ReplyCount: 3,
+		Reactions:  map[string]int{"👍": 100},
+	}
+	message.resetServerFields()
+
+	if message.ID != "" || message.ThreadID != "" || message.ReplyCount != 0 || message.Reactions != nil {
+		t.Errorf("Expected server fields cleared, got %+v", message)
+	}
+	if message.ReplyTo != "7" {
+		t.Error("Expected client-provided reply_to to be kept")
+	}
+}
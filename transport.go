@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Transport is the connection a client is served over. It follows the
+// message-oriented API of *websocket.Conn, which implements it directly;
+// the HTTP fallback transports emulate it so the hub, rate limiting and
+// validation behave the same whichever transport a client uses.
+type Transport interface {
+	// ReadMessage blocks until the next message from the client arrives
+	ReadMessage() (messageType int, data []byte, err error)
+
+	// WriteMessage sends a data, ping or close message to the client
+	WriteMessage(messageType int, data []byte) error
+
+	// NextWriter returns a writer for the next data message
+	NextWriter(messageType int) (io.WriteCloser, error)
+
+	SetReadLimit(limit int64)
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+
+	// SetPongHandler sets the function called when the client proves it is
+	// still there
+	SetPongHandler(h func(appData string) error)
+
+	RemoteAddr() net.Addr
+	Close() error
+}
+
+// preparedTransport is implemented by transports that can reuse frames
+// prepared once for many recipients
+type preparedTransport interface {
+	WritePreparedMessage(pm *websocket.PreparedMessage) error
+}
+
+// compressingTransport is implemented by transports that support
+// permessage-deflate
+type compressingTransport interface {
+	SetCompressionLevel(level int) error
+	EnableWriteCompression(enable bool)
+}
+
+var (
+	_ Transport            = (*websocket.Conn)(nil)
+	_ preparedTransport    = (*websocket.Conn)(nil)
+	_ compressingTransport = (*websocket.Conn)(nil)
+)
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Messages from the client waiting for ReadPump
+	httpInboxSize = 16
+
+	// Messages waiting for the client's event stream or next poll
+	httpOutboxSize = 256
+
+	// How long a poll waits for something to deliver
+	pollWait = 25 * time.Second
+)
+
+var (
+	errTransportClosed  = errors.New("transport closed")
+	errTransportTimeout = errors.New("transport deadline exceeded")
+	errMessageTooLarge  = errors.New("message exceeds read limit")
+)
+
+// httpEventKind distinguishes what the HTTP side should send to the client
+type httpEventKind int
+
+const (
+	httpEventData httpEventKind = iota
+	httpEventPing
+	httpEventClose
+)
+
+// httpEvent is a message queued for the client's stream or poll
+type httpEvent struct {
+	kind httpEventKind
+	data []byte
+}
+
+// httpAddr is the remote address of an HTTP client
+type httpAddr string
+
+func (a httpAddr) Network() string { return "tcp" }
+func (a httpAddr) String() string  { return string(a) }
+
+// httpTransport serves a client over plain HTTP: messages from the client
+// arrive as POSTs and messages to it leave through an SSE stream or long
+// polls. Pings succeed when the client is reachable, standing in for pongs.
+type httpTransport struct {
+	id     string
+	remote net.Addr
+
+	inbox  chan []byte
+	outbox chan httpEvent
+
+	done      chan struct{}
+	closeOnce sync.Once
+	onClose   func()
+
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readLimit     int64
+	pongHandler   func(string) error
+}
+
+// newHTTPTransport creates a transport identified by a random session ID
+func newHTTPTransport(remoteAddr string) (*httpTransport, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	return &httpTransport{
+		id:     hex.EncodeToString(id),
+		remote: httpAddr(remoteAddr),
+		inbox:  make(chan []byte, httpInboxSize),
+		outbox: make(chan httpEvent, httpOutboxSize),
+		done:   make(chan struct{}),
+	}, nil
+}
+
+// deadlineTimer returns a channel that fires at the deadline, or nil if
+// there is none
+func deadlineTimer(deadline time.Time) (<-chan time.Time, func() bool) {
+	if deadline.IsZero() {
+		return nil, func() bool { return false }
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	return timer.C, timer.Stop
+}
+
+// ReadMessage returns the next message posted by the client. A deadline
+// extended while waiting, as the pong handler does, is honoured.
+func (t *httpTransport) ReadMessage() (int, []byte, error) {
+	for {
+		t.mu.Lock()
+		deadline := t.readDeadline
+		t.mu.Unlock()
+
+		expired, stop := deadlineTimer(deadline)
+		select {
+		case data := <-t.inbox:
+			stop()
+			return websocket.TextMessage, data, nil
+		case <-t.done:
+			stop()
+			return 0, nil, errTransportClosed
+		case <-expired:
+			t.mu.Lock()
+			extended := t.readDeadline.After(deadline)
+			t.mu.Unlock()
+			if !extended {
+				return 0, nil, errTransportTimeout
+			}
+		}
+	}
+}
+
+// WriteMessage queues a message for the client, waiting for room until the
+// write deadline
+func (t *httpTransport) WriteMessage(messageType int, data []byte) error {
+	event := httpEvent{kind: httpEventData, data: data}
+	switch messageType {
+	case websocket.PingMessage:
+		event.kind = httpEventPing
+	case websocket.CloseMessage:
+		event.kind = httpEventClose
+	case websocket.PongMessage:
+		return nil
+	}
+
+	t.mu.Lock()
+	deadline := t.writeDeadline
+	t.mu.Unlock()
+
+	expired, stop := deadlineTimer(deadline)
+	defer stop()
+	select {
+	case t.outbox <- event:
+		return nil
+	case <-t.done:
+		return errTransportClosed
+	case <-expired:
+		return errTransportTimeout
+	}
+}
+
+// httpMessageWriter buffers a message until it is closed
+type httpMessageWriter struct {
+	transport   *httpTransport
+	messageType int
+	buf         bytes.Buffer
+}
+
+func (w *httpMessageWriter) Write(p []byte) (int, error) { return w.buf.Write(p) }
+
+func (w *httpMessageWriter) Close() error {
+	return w.transport.WriteMessage(w.messageType, w.buf.Bytes())
+}
+
+// NextWriter returns a writer that queues the message once closed
+func (t *httpTransport) NextWriter(messageType int) (io.WriteCloser, error) {
+	return &httpMessageWriter{transport: t, messageType: messageType}, nil
+}
+
+// SetReadLimit sets the largest message the client may post
+func (t *httpTransport) SetReadLimit(limit int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.readLimit = limit
+}
+
+// SetReadDeadline sets when ReadMessage gives up waiting
+func (t *httpTransport) SetReadDeadline(deadline time.Time) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.readDeadline = deadline
+	return nil
+}
+
+// SetWriteDeadline sets when WriteMessage gives up waiting for room
+func (t *httpTransport) SetWriteDeadline(deadline time.Time) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.writeDeadline = deadline
+	return nil
+}
+
+// SetPongHandler sets the function called when the client is seen alive
+func (t *httpTransport) SetPongHandler(h func(string) error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pongHandler = h
+}
+
+// RemoteAddr returns the address of the client's HTTP requests
+func (t *httpTransport) RemoteAddr() net.Addr { return t.remote }
+
+// Close ends the session; pending and later reads and writes fail
+func (t *httpTransport) Close() error {
+	t.closeOnce.Do(func() {
+		close(t.done)
+		if t.onClose != nil {
+			t.onClose()
+		}
+	})
+	return nil
+}
+
+// pong reports that the client is reachable
+func (t *httpTransport) pong() {
+	t.mu.Lock()
+	handler := t.pongHandler
+	t.mu.Unlock()
+	if handler != nil {
+		handler("")
+	}
+}
+
+// receive hands a message posted by the client to ReadPump
+func (t *httpTransport) receive(ctx context.Context, data []byte) error {
+	t.mu.Lock()
+	limit := t.readLimit
+	t.mu.Unlock()
+	if limit > 0 && int64(len(data)) > limit {
+		return errMessageTooLarge
+	}
+
+	select {
+	case t.inbox <- data:
+		return nil
+	case <-t.done:
+		return errTransportClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// closeReason extracts the reason from a close frame payload
+func closeReason(payload []byte) string {
+	if len(payload) < 2 {
+		return ""
+	}
+	return fmt.Sprintf("%d %s", binary.BigEndian.Uint16(payload), payload[2:])
+}
+
+// HTTPTransportServer serves clients that cannot use WebSockets. A client
+// opens a session with an SSE stream (GET /sse) or a polling session
+// (POST /poll), receives through the stream or GET /poll and sends each
+// message with POST /send, always passing the session ID.
+type HTTPTransportServer struct {
+	hub *Hub
+
+	mu       sync.Mutex
+	sessions map[string]*httpTransport
+}
+
+// NewHTTPTransportServer creates the fallback transport endpoints for a hub
+func NewHTTPTransportServer(hub *Hub) *HTTPTransportServer {
+	return &HTTPTransportServer{
+		hub:      hub,
+		sessions: make(map[string]*httpTransport),
+	}
+}
+
+// open creates a session and starts its client. It writes an error
+// response and returns nil if the session cannot be created.
+func (s *HTTPTransportServer) open(w http.ResponseWriter, r *http.Request) *httpTransport {
+	ip := s.hub.clientIP(r)
+	if !s.hub.CanAcceptNewConnection() {
+		log.Printf("Connection limit reached, rejecting HTTP session from %s", ip)
+		http.Error(w, "Server at capacity", http.StatusServiceUnavailable)
+		return nil
+	}
+	if _, ok := s.hub.admitConnection(w, r); !ok {
+		return nil
+	}
+
+	transport, err := newHTTPTransport(r.RemoteAddr)
+	if err != nil {
+		s.hub.connLimits.release(ip)
+		log.Printf("Failed to create HTTP session for %s: %v", ip, err)
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return nil
+	}
+	transport.onClose = func() {
+		s.mu.Lock()
+		delete(s.sessions, transport.id)
+		s.mu.Unlock()
+	}
+
+	s.mu.Lock()
+	s.sessions[transport.id] = transport
+	s.mu.Unlock()
+
+	client := NewClient(s.hub, transport)
+	client.ip = ip
+	serveClient(client)
+	LogClientActivity("connected", "unknown", client.remoteAddress())
+	return transport
+}
+
+// session looks up the session named by the request, writing a 404 if
+// there is none
+func (s *HTTPTransportServer) session(w http.ResponseWriter, r *http.Request) *httpTransport {
+	s.mu.Lock()
+	transport, ok := s.sessions[r.URL.Query().Get("session")]
+	s.mu.Unlock()
+	if !ok {
+		http.Error(w, "Unknown session", http.StatusNotFound)
+		return nil
+	}
+	return transport
+}
+
+// HandleSSE opens a session and streams messages to the client as
+// Server-Sent Events. The first event carries the session ID.
+func (s *HTTPTransportServer) HandleSSE(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	transport := s.open(w, r)
+	if transport == nil {
+		return
+	}
+	defer transport.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	fmt.Fprintf(w, "event: session\ndata: %s\n\n", transport.id)
+	flusher.Flush()
+
+	for {
+		select {
+		case event := <-transport.outbox:
+			if !writeSSE(w, flusher, transport, event) {
+				return
+			}
+		case <-transport.done:
+			// Send what was queued before the session closed
+			for {
+				select {
+				case event := <-transport.outbox:
+					if !writeSSE(w, flusher, transport, event) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// writeSSE writes one event to the stream. It reports whether the stream
+// should stay open.
+func writeSSE(w io.Writer, flusher http.Flusher, transport *httpTransport, event httpEvent) bool {
+	var err error
+	switch event.kind {
+	case httpEventPing:
+		_, err = io.WriteString(w, ": ping\n\n")
+	case httpEventClose:
+		fmt.Fprintf(w, "event: close\ndata: %s\n\n", closeReason(event.data))
+		flusher.Flush()
+		return false
+	default:
+		// Batched frames span several lines, which the browser joins back
+		// together with newlines
+		for _, line := range bytes.Split(event.data, frameSeparator) {
+			if _, err = fmt.Fprintf(w, "data: %s\n", line); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			_, err = io.WriteString(w, "\n")
+		}
+	}
+	if err != nil {
+		return false
+	}
+	flusher.Flush()
+	if event.kind == httpEventPing {
+		transport.pong()
+	}
+	return true
+}
+
+// HandlePoll opens a polling session on POST and answers GET polls with
+// the queued messages, one JSON message per line. A poll waits up to
+// pollWait for something to deliver and returns 410 once the session ends.
+func (s *HTTPTransportServer) HandlePoll(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		transport := s.open(w, r)
+		if transport == nil {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"session": transport.id})
+		return
+	case http.MethodGet:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	transport := s.session(w, r)
+	if transport == nil {
+		return
+	}
+	transport.pong()
+
+	var body bytes.Buffer
+	closed := false
+	add := func(event httpEvent) {
+		switch event.kind {
+		case httpEventData:
+			if body.Len() > 0 {
+				body.Write(frameSeparator)
+			}
+			body.Write(event.data)
+		case httpEventClose:
+			closed = true
+		}
+	}
+
+	timer := time.NewTimer(pollWait)
+	defer timer.Stop()
+wait:
+	for body.Len() == 0 && !closed {
+		select {
+		case event := <-transport.outbox:
+			add(event)
+		case <-transport.done:
+			break wait
+		case <-timer.C:
+			break wait
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	// Take whatever else is already queued
+drain:
+	for !closed {
+		select {
+		case event := <-transport.outbox:
+			add(event)
+		default:
+			break drain
+		}
+	}
+
+	if body.Len() == 0 {
+		select {
+		case <-transport.done:
+			closed = true
+		default:
+		}
+		if closed {
+			http.Error(w, "Session closed", http.StatusGone)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Write(body.Bytes())
+}
+
+// HandleSend passes one message posted by the client to its session
+func (s *HTTPTransportServer) HandleSend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	transport := s.session(w, r)
+	if transport == nil {
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxMessageSize+1))
+	if err == nil {
+		err = transport.receive(r.Context(), data)
+	}
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusAccepted)
+	case errors.Is(err, errTransportClosed):
+		http.Error(w, "Session closed", http.StatusGone)
+	case errors.Is(err, errMessageTooLarge) || len(data) > maxMessageSize:
+		http.Error(w, "Message too large", http.StatusRequestEntityTooLarge)
+	default:
+		http.Error(w, "Failed to read message", http.StatusBadRequest)
+	}
+}
+
+var _ Transport = (*httpTransport)(nil)
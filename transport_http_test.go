@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newFallbackServer serves a hub over WebSockets and the HTTP fallback
+func newFallbackServer(hub *Hub) *httptest.Server {
+	fallback := NewHTTPTransportServer(hub)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		handleWebSocket(hub, w, r)
+	})
+	mux.HandleFunc("/sse", fallback.HandleSSE)
+	mux.HandleFunc("/poll", fallback.HandlePoll)
+	mux.HandleFunc("/send", fallback.HandleSend)
+	return httptest.NewServer(mux)
+}
+
+// sseTestEvent is one parsed Server-Sent Event
+type sseTestEvent struct {
+	name string
+	data string
+}
+
+// dialSSE opens an event stream and returns its session ID and events
+func dialSSE(t *testing.T, ctx context.Context, url string) (string, <-chan sseTestEvent) {
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url+"/sse", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("SSE request failed: %v", err)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Unexpected content type %q", ct)
+	}
+
+	events := make(chan sseTestEvent, 100)
+	go func() {
+		defer resp.Body.Close()
+		defer close(events)
+		scanner := bufio.NewScanner(resp.Body)
+		event := sseTestEvent{name: "message"}
+		var data []string
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				if len(data) > 0 {
+					event.data = strings.Join(data, "\n")
+					events <- event
+				}
+				event, data = sseTestEvent{name: "message"}, nil
+			case strings.HasPrefix(line, "event: "):
+				event.name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				data = append(data, strings.TrimPrefix(line, "data: "))
+			}
+		}
+	}()
+
+	first := <-events
+	if first.name != "session" || first.data == "" {
+		t.Fatalf("Expected a session event first, got %+v", first)
+	}
+	return first.data, events
+}
+
+// postMessage sends a message through the fallback transport
+func postMessage(t *testing.T, url, session string, body string) int {
+	resp, err := http.Post(url+"/send?session="+session, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("POST failed: %v", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// waitForSSE returns the first message on the stream matching the predicate
+func waitForSSE(t *testing.T, events <-chan sseTestEvent, match func(Message) bool) Message {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				t.Fatal("Event stream ended")
+			}
+			for _, line := range strings.Split(event.data, "\n") {
+				var message Message
+				if json.Unmarshal([]byte(line), &message) == nil && match(message) {
+					return message
+				}
+			}
+		case <-timeout:
+			t.Fatal("Timed out waiting for event")
+		}
+	}
+}
+
+func TestSSE_InteroperatesWithWebSocketClients(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	defer hub.Stop()
+
+	server := newFallbackServer(hub)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	session, events := dialSSE(t, ctx, server.URL)
+	web := dialCodecTestClient(t, server.URL, JSONCodec{})
+
+	if status := postMessage(t, server.URL, session, `{"type":"join","content":"Proxied"}`); status != http.StatusAccepted {
+		t.Fatalf("Expected 202, got %d", status)
+	}
+	web.send(t, &Message{Type: MessageTypeJoin, Content: "Direct"})
+	waitForSSE(t, events, func(m Message) bool { return m.Type == MessageTypeUserList && len(m.Users) == 2 })
+
+	web.send(t, &Message{Type: MessageTypeChat, From: "Direct", Content: "over websocket"})
+	waitForSSE(t, events, func(m Message) bool { return m.Type == MessageTypeChat && m.Content == "over websocket" })
+
+	postMessage(t, server.URL, session, `{"type":"chat","from":"Proxied","content":"over sse"}`)
+	web.waitFor(t, func(m Message) bool {
+		return m.Type == MessageTypeChat && m.Content == "over sse" && m.From == "Proxied"
+	})
+
+	// Validation runs exactly as it does for WebSocket clients
+	postMessage(t, server.URL, session, `{"type":"chat","from":"Proxied"}`)
+	invalid := waitForSSE(t, events, func(m Message) bool { return m.Type == MessageTypeError })
+	if !strings.Contains(invalid.Error, "Message validation failed") {
+		t.Errorf("Unexpected error %q", invalid.Error)
+	}
+
+	// Dropping the stream ends the session and announces the departure
+	cancel()
+	web.waitFor(t, func(m Message) bool { return m.Type == MessageTypeSystem && m.Content == "Proxied has left the chat" })
+	if status := postMessage(t, server.URL, session, `{"type":"chat","from":"Proxied","content":"late"}`); status != http.StatusNotFound {
+		t.Errorf("Expected 404 for a closed session, got %d", status)
+	}
+}
+
+func TestLongPoll_DeliversQueuedMessages(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	defer hub.Stop()
+
+	server := newFallbackServer(hub)
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"/poll", "application/json", nil)
+	if err != nil {
+		t.Fatalf("Opening a poll session failed: %v", err)
+	}
+	var opened struct{ Session string }
+	json.NewDecoder(resp.Body).Decode(&opened)
+	resp.Body.Close()
+	if opened.Session == "" {
+		t.Fatal("Expected a session ID")
+	}
+
+	postMessage(t, server.URL, opened.Session, `{"type":"join","content":"Poller"}`)
+
+	received := make([]Message, 0)
+	deadline := time.Now().Add(2 * time.Second)
+	for !hasUserList(received, "Poller") && time.Now().Before(deadline) {
+		resp, err := http.Get(server.URL + "/poll?session=" + opened.Session)
+		if err != nil {
+			t.Fatalf("Poll failed: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", resp.StatusCode)
+		}
+		for _, line := range strings.Split(string(body), "\n") {
+			var message Message
+			if json.Unmarshal([]byte(line), &message) == nil {
+				received = append(received, message)
+			}
+		}
+	}
+	if !hasUserList(received, "Poller") {
+		t.Fatalf("Expected the user list, got %+v", received)
+	}
+
+	resp, _ = http.Get(server.URL + "/poll?session=unknown")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown session, got %d", resp.StatusCode)
+	}
+
+	huge := `{"type":"chat","from":"Poller","content":"` + strings.Repeat("x", maxMessageSize) + `"}`
+	if status := postMessage(t, server.URL, opened.Session, huge); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for an oversized message, got %d", status)
+	}
+}
+
+// hasUserList reports whether a user list naming the user was received
+func hasUserList(messages []Message, name string) bool {
+	for _, message := range messages {
+		if message.Type == MessageTypeUserList && contains(message.Users, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestHTTPTransport_ReadDeadline(t *testing.T) {
+	transport, err := newHTTPTransport("127.0.0.1:1")
+	if err != nil {
+		t.Fatalf("newHTTPTransport failed: %v", err)
+	}
+
+	transport.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, _, err := transport.ReadMessage(); err != errTransportTimeout {
+		t.Errorf("Expected a timeout, got %v", err)
+	}
+
+	// A pong while waiting extends the deadline, as it does for WebSockets
+	transport.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	transport.SetPongHandler(func(string) error {
+		return transport.SetReadDeadline(time.Now().Add(time.Second))
+	})
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		transport.pong()
+		time.Sleep(30 * time.Millisecond)
+		transport.receive(context.Background(), []byte("late but fine"))
+	}()
+	if _, data, err := transport.ReadMessage(); err != nil || string(data) != "late but fine" {
+		t.Errorf("Expected the message after the extended deadline, got %q (%v)", data, err)
+	}
+
+	transport.Close()
+	if _, _, err := transport.ReadMessage(); err != errTransportClosed {
+		t.Errorf("Expected closed transport error, got %v", err)
+	}
+}
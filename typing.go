@@ -0,0 +1,14 @@
+package main
+
+// handleTyping relays a typing notification to everyone in the chat.
+// Notifications are best-effort: the membership and rate limit hooks drop
+// ones from clients that have not joined or are over their typing budget
+// without an error.
+func (c *Client) handleTyping() {
+	notification := &Message{
+		Type: MessageTypeTyping,
+		From: c.GetDisplayName(),
+	}
+	notification.SetTimestampAt(c.now())
+	c.hub.BroadcastMessage(*notification)
+}
@@ -0,0 +1,42 @@
+package main
+
+import "testing"
+
+func TestTyping_RelayedAndSilentlyLimited(t *testing.T) {
+	h := newChatHarness(t)
+	alice := h.join("Alice")
+	bob := h.join("Bob")
+	budget := DefaultRateLimitConfig().Budgets[RateLimitTyping]
+
+	for i := 0; i < budget.Burst+5; i++ {
+		alice.send(Message{Type: MessageTypeTyping})
+	}
+	isTyping := func(m Message) bool { return m.Type == MessageTypeTyping && m.From == "Alice" }
+	bob.waitForN(isTyping, budget.Burst)
+
+	// The hello reply shows everything Alice sent has been handled
+	alice.keepAlive()
+	if n := bob.count(isTyping); n != budget.Burst {
+		t.Errorf("Expected %d typing notifications, got %d", budget.Burst, n)
+	}
+	if n := alice.count(func(m Message) bool { return m.Type == MessageTypeError }); n != 0 {
+		t.Errorf("Expected typing over budget to be dropped silently, got %d errors", n)
+	}
+
+	h.clock.Advance(budget.Refill)
+	alice.send(Message{Type: MessageTypeTyping})
+	bob.waitForN(isTyping, budget.Burst+1)
+}
+
+func TestTyping_RequiresJoin(t *testing.T) {
+	h := newChatHarness(t)
+	bob := h.join("Bob")
+	stranger := h.connect()
+
+	stranger.send(Message{Type: MessageTypeTyping})
+	stranger.keepAlive()
+	bob.keepAlive()
+	if n := bob.count(func(m Message) bool { return m.Type == MessageTypeTyping }); n != 0 {
+		t.Errorf("Expected no typing notification from a client that has not joined, got %d", n)
+	}
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebhookEvent names a kind of chat activity sent to webhooks
+type WebhookEvent string
+
+const (
+	WebhookEventMessage    WebhookEvent = "message"
+	WebhookEventJoin       WebhookEvent = "join"
+	WebhookEventLeave      WebhookEvent = "leave"
+	WebhookEventMention    WebhookEvent = "mention"
+	WebhookEventModeration WebhookEvent = "moderation"
+)
+
+// webhookEvents lists every event webhooks can subscribe to
+var webhookEvents = []WebhookEvent{
+	WebhookEventMessage,
+	WebhookEventJoin,
+	WebhookEventLeave,
+	WebhookEventMention,
+	WebhookEventModeration,
+}
+
+// Headers sent with every webhook request
+const (
+	WebhookSignatureHeader = "X-Chat-Signature"
+	WebhookEventHeader     = "X-Chat-Event"
+	WebhookDeliveryHeader  = "X-Chat-Delivery"
+)
+
+// Failed deliveries kept for review
+const webhookDeadLetterLimit = 200
+
+// ParseWebhookEvents parses a comma-separated list of event names, e.g.
+// "message,mention"
+func ParseWebhookEvents(list string) ([]WebhookEvent, error) {
+	var events []WebhookEvent
+	for _, name := range strings.Split(list, ",") {
+		event := WebhookEvent(strings.ToLower(strings.TrimSpace(name)))
+		if event == "" {
+			continue
+		}
+		if !event.valid() {
+			return nil, errors.New("unknown webhook event: " + string(event))
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// valid reports whether webhooks can subscribe to the event
+func (e WebhookEvent) valid() bool {
+	for _, event := range webhookEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookConfig configures an endpoint that chat events are POSTed to
+type WebhookConfig struct {
+	// URL receives the events
+	URL string
+
+	// Secret signs every request body with HMAC-SHA256
+	Secret string
+
+	// Events sent to the endpoint; all of them if empty
+	Events []WebhookEvent
+
+	// QueueSize bounds the events waiting for delivery. Events arriving
+	// while it is full go straight to the dead-letter log.
+	QueueSize int
+
+	// MaxAttempts bounds deliveries of each event, the first included
+	MaxAttempts int
+
+	// Retries wait InitialBackoff, doubling after each failure up to
+	// MaxBackoff
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	// Timeout bounds each request
+	Timeout time.Duration
+
+	// IncludePrivateContent sends the content of private and group messages
+	// in moderation events; without it only public content is sent
+	IncludePrivateContent bool
+}
+
+// DefaultWebhookConfig returns the delivery settings used unless
+// configured otherwise. URL and Secret must still be set.
+func DefaultWebhookConfig() WebhookConfig {
+	return WebhookConfig{
+		QueueSize:      256,
+		MaxAttempts:    5,
+		InitialBackoff: time.Second,
+		MaxBackoff:     time.Minute,
+		Timeout:        10 * time.Second,
+	}
+}
+
+// Validate checks the endpoint and delivery settings are usable
+func (c WebhookConfig) Validate() error {
+	endpoint, err := url.Parse(c.URL)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return errors.New("webhook URL must be an absolute http or https URL")
+	}
+	if c.Secret == "" {
+		return errors.New("webhook secret must not be empty")
+	}
+	for _, event := range c.Events {
+		if !event.valid() {
+			return errors.New("unknown webhook event: " + string(event))
+		}
+	}
+	if c.QueueSize < 1 {
+		return errors.New("webhook queue size must be positive")
+	}
+	if c.MaxAttempts < 1 {
+		return errors.New("webhook attempts must be positive")
+	}
+	if c.InitialBackoff <= 0 || c.MaxBackoff < c.InitialBackoff {
+		return errors.New("webhook backoff must be positive and no more than its maximum")
+	}
+	if c.Timeout <= 0 {
+		return errors.New("webhook timeout must be positive")
+	}
+	return nil
+}
+
+// WebhookPayload is the JSON body POSTed for an event
+type WebhookPayload struct {
+	ID        string       `json:"id"`
+	Event     WebhookEvent `json:"event"`
+	Timestamp time.Time    `json:"timestamp"`
+
+	// User who joined, left, sent the message or was moderated
+	User string `json:"user,omitempty"`
+
+	// Message sent, as delivered to clients, for message and mention
+	// events
+	Message *Message `json:"message,omitempty"`
+
+	// Mentioned users, for mention events
+	Mentioned []string `json:"mentioned,omitempty"`
+
+	// Moderation taken, for moderation events
+	Moderation *WebhookModeration `json:"moderation,omitempty"`
+}
+
+// WebhookModeration describes an automatic moderation action
+type WebhookModeration struct {
+	// Source is "filter" or "spam"
+	Source string `json:"source"`
+
+	// Action is the filter action (mask, reject, drop) or the spam
+	// escalation (warn, mute, disconnect)
+	Action string `json:"action"`
+	Reason string `json:"reason"`
+
+	// Content is the start of the message moderated. Private and group
+	// content is only sent to webhooks configured to include it.
+	Content string `json:"content,omitempty"`
+	private bool
+}
+
+// SignWebhookPayload returns the signature header value for a request
+// body: "sha256=" and the hex HMAC-SHA256 of body keyed with secret
+func SignWebhookPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhookSignature reports whether a signature header value matches
+// a request body, for receivers
+func VerifyWebhookSignature(secret string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(SignWebhookPayload(secret, body)), []byte(signature))
+}
+
+// WebhookDeadLetter is an event that could not be delivered
+type WebhookDeadLetter struct {
+	Time     time.Time       `json:"time"`
+	URL      string          `json:"url"`
+	Delivery string          `json:"delivery"`
+	Event    WebhookEvent    `json:"event"`
+	Attempts int             `json:"attempts"`
+	Error    string          `json:"error"`
+	Payload  json.RawMessage `json:"payload"`
+}
+
+// webhookDeadLetterLog keeps the most recent failed deliveries
+type webhookDeadLetterLog struct {
+	mu      sync.Mutex
+	letters []WebhookDeadLetter
+}
+
+// add records a failed delivery, forgetting the oldest beyond the limit
+func (l *webhookDeadLetterLog) add(letter WebhookDeadLetter) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.letters = append(l.letters, letter)
+	if len(l.letters) > webhookDeadLetterLimit {
+		l.letters = l.letters[len(l.letters)-webhookDeadLetterLimit:]
+	}
+}
+
+// webhookDelivery is an event waiting to be POSTed
+type webhookDelivery struct {
+	id    string
+	event WebhookEvent
+	body  []byte
+}
+
+// webhook delivers events to one endpoint, in order, from a single
+// goroutine. A delivery being retried holds back the events behind it.
+type webhook struct {
+	config      WebhookConfig
+	events      map[WebhookEvent]bool
+	queue       chan webhookDelivery
+	client      *http.Client
+	deadLetters *webhookDeadLetterLog
+
+	// hub whose clock times retries and dead letters
+	hub *Hub
+}
+
+// newWebhook creates a webhook for a validated config
+func newWebhook(config WebhookConfig, hub *Hub, deadLetters *webhookDeadLetterLog) *webhook {
+	events := make(map[WebhookEvent]bool)
+	for _, event := range config.Events {
+		events[event] = true
+	}
+	if len(events) == 0 {
+		for _, event := range webhookEvents {
+			events[event] = true
+		}
+	}
+	return &webhook{
+		config:      config,
+		events:      events,
+		queue:       make(chan webhookDelivery, config.QueueSize),
+		client:      &http.Client{Timeout: config.Timeout},
+		deadLetters: deadLetters,
+		hub:         hub,
+	}
+}
+
+// enqueue queues a delivery without waiting, dead-lettering it if the
+// queue is full
+func (w *webhook) enqueue(delivery webhookDelivery) {
+	select {
+	case w.queue <- delivery:
+	default:
+		w.deadLetter(delivery, 0, errors.New("queue full"))
+	}
+}
+
+// run delivers queued events until stop is closed
+func (w *webhook) run(stop <-chan struct{}) {
+	for {
+		select {
+		case delivery := <-w.queue:
+			w.deliver(delivery, stop)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// deliver POSTs an event, retrying with backoff until it is accepted, the
+// attempts run out or the failure is permanent
+func (w *webhook) deliver(delivery webhookDelivery, stop <-chan struct{}) {
+	backoff := w.config.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := w.post(delivery)
+		if err == nil {
+			return
+		}
+		if !retry || attempt == w.config.MaxAttempts {
+			w.deadLetter(delivery, attempt, err)
+			return
+		}
+		log.Printf("[WEBHOOK] Delivery %s of %s to %s failed (attempt %d), retrying in %v: %v",
+			delivery.id, delivery.event, w.config.URL, attempt, backoff, err)
+
+		timer := w.hub.clockSource().NewTimer(backoff)
+		select {
+		case <-timer.C():
+		case <-stop:
+			timer.Stop()
+			return
+		}
+		backoff *= 2
+		if backoff > w.config.MaxBackoff {
+			backoff = w.config.MaxBackoff
+		}
+	}
+}
+
+// post sends one request. Network errors, 429 and 5xx responses are worth
+// retrying; other failures are not.
+func (w *webhook) post(delivery webhookDelivery) (retry bool, err error) {
+	request, err := http.NewRequest(http.MethodPost, w.config.URL, bytes.NewReader(delivery.body))
+	if err != nil {
+		return false, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "realtime-chatroom-webhook")
+	request.Header.Set(WebhookSignatureHeader, SignWebhookPayload(w.config.Secret, delivery.body))
+	request.Header.Set(WebhookEventHeader, string(delivery.event))
+	request.Header.Set(WebhookDeliveryHeader, delivery.id)
+
+	response, err := w.client.Do(request)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64*1024))
+	response.Body.Close()
+
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return false, nil
+	}
+	err = fmt.Errorf("endpoint responded %s", response.Status)
+	return response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500, err
+}
+
+// deadLetter records a delivery given up on
+func (w *webhook) deadLetter(delivery webhookDelivery, attempts int, err error) {
+	log.Printf("[WEBHOOK] Giving up on delivery %s of %s to %s after %d attempts: %v",
+		delivery.id, delivery.event, w.config.URL, attempts, err)
+	w.deadLetters.add(WebhookDeadLetter{
+		Time:     w.hub.now(),
+		URL:      w.config.URL,
+		Delivery: delivery.id,
+		Event:    delivery.event,
+		Attempts: attempts,
+		Error:    err.Error(),
+		Payload:  json.RawMessage(delivery.body),
+	})
+}
+
+// AddWebhook starts sending events to an endpoint until the hub stops. It
+// must be called before clients connect.
+func (h *Hub) AddWebhook(config WebhookConfig) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	if h.webhookDeadLetters == nil {
+		h.webhookDeadLetters = &webhookDeadLetterLog{}
+	}
+	hook := newWebhook(config, h, h.webhookDeadLetters)
+	h.webhooks = append(h.webhooks, hook)
+	go hook.run(h.stop)
+	return nil
+}
+
+// emitWebhook queues an event for every webhook subscribed to it
+func (h *Hub) emitWebhook(payload WebhookPayload) {
+	if len(h.webhooks) == 0 {
+		return
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		log.Printf("[WEBHOOK] Failed to create delivery ID: %v", err)
+		return
+	}
+	payload.ID = hex.EncodeToString(id)
+	payload.Timestamp = h.now()
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("[WEBHOOK] Failed to encode %s event: %v", payload.Event, err)
+		return
+	}
+
+	// Webhooks not trusted with private content get the event without it
+	redacted := body
+	if moderation := payload.Moderation; moderation != nil && moderation.private && moderation.Content != "" {
+		withoutContent := *moderation
+		withoutContent.Content = ""
+		payload.Moderation = &withoutContent
+		if redacted, err = json.Marshal(payload); err != nil {
+			log.Printf("[WEBHOOK] Failed to encode %s event: %v", payload.Event, err)
+			return
+		}
+	}
+
+	for _, hook := range h.webhooks {
+		if !hook.events[payload.Event] {
+			continue
+		}
+		delivery := webhookDelivery{id: payload.ID, event: payload.Event, body: body}
+		if !hook.config.IncludePrivateContent {
+			delivery.body = redacted
+		}
+		hook.enqueue(delivery)
+	}
+}
+
+// emitModeration sends a moderation event about a client's message, with
+// an excerpt of its content
+func (c *Client) emitModeration(source, action, reason string, message *Message) {
+	c.hub.emitModeration(c.displayName, source, action, reason, message)
+}
+
+// emitModeration sends a moderation event about a user's message
+func (h *Hub) emitModeration(user, source, action, reason string, message *Message) {
+	h.emitWebhook(WebhookPayload{
+		Event: WebhookEventModeration,
+		User:  user,
+		Moderation: &WebhookModeration{
+			Source:  source,
+			Action:  action,
+			Reason:  reason,
+			Content: contentExcerpt(message.Content),
+			private: message.Type == MessageTypePrivate || message.Type == MessageTypeGroupMessage,
+		},
+	})
+}
+
+// sendMessageWebhooks sends message and mention events for a public
+// message once it has been broadcast
+func sendMessageWebhooks(ctx *MessageContext) {
+	if ctx.Message.Type == MessageTypeChat {
+		ctx.Client.hub.emitMessageWebhooks(*ctx.Message)
+	}
+}
+
+// emitMessageWebhooks sends the message event for a public message, and a
+// mention event if it mentions anyone
+func (h *Hub) emitMessageWebhooks(message Message) {
+	h.emitWebhook(WebhookPayload{Event: WebhookEventMessage, User: message.From, Message: &message})
+	if len(message.Mentions) > 0 {
+		h.emitWebhook(WebhookPayload{
+			Event:     WebhookEventMention,
+			User:      message.From,
+			Message:   &message,
+			Mentioned: message.Mentions,
+		})
+	}
+}
+
+// WebhookDeadLetters returns up to limit failed deliveries, newest first.
+// A limit of 0 returns them all.
+func (h *Hub) WebhookDeadLetters(limit int) []WebhookDeadLetter {
+	letters := make([]WebhookDeadLetter, 0)
+	if h.webhookDeadLetters == nil {
+		return letters
+	}
+	h.webhookDeadLetters.mu.Lock()
+	defer h.webhookDeadLetters.mu.Unlock()
+	for i := len(h.webhookDeadLetters.letters) - 1; i >= 0; i-- {
+		if limit > 0 && len(letters) == limit {
+			break
+		}
+		letters = append(letters, h.webhookDeadLetters.letters[i])
+	}
+	return letters
+}
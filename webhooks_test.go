@@ -0,0 +1,358 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver is a local endpoint recording the events POSTed to it.
+// Its handler answers each request with the next status, then 200.
+type webhookReceiver struct {
+	server *httptest.Server
+
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	payloads []WebhookPayload
+	bodies   [][]byte
+}
+
+// newWebhookReceiver starts a receiver that is closed when the test ends
+func newWebhookReceiver(t *testing.T, statuses ...int) *webhookReceiver {
+	receiver := &webhookReceiver{statuses: statuses}
+	receiver.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var payload WebhookPayload
+		json.Unmarshal(body, &payload)
+
+		receiver.mu.Lock()
+		receiver.requests = append(receiver.requests, r)
+		receiver.payloads = append(receiver.payloads, payload)
+		receiver.bodies = append(receiver.bodies, body)
+		status := http.StatusOK
+		if len(receiver.statuses) > 0 {
+			status, receiver.statuses = receiver.statuses[0], receiver.statuses[1:]
+		}
+		receiver.mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(receiver.server.Close)
+	return receiver
+}
+
+// received returns how many requests have arrived
+func (r *webhookReceiver) received() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.requests)
+}
+
+// events returns the events received, in order
+func (r *webhookReceiver) events() []WebhookEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	events := make([]WebhookEvent, len(r.payloads))
+	for i, payload := range r.payloads {
+		events[i] = payload.Event
+	}
+	return events
+}
+
+// newWebhookHub creates a stopped-at-cleanup hub on a fake clock with one
+// webhook, without running it, so the only timers are webhook backoffs
+func newWebhookHub(t *testing.T, config WebhookConfig) (*Hub, *FakeClock) {
+	clock := NewFakeClock(time.Unix(1700000000, 0))
+	hub := NewHub()
+	hub.SetClock(clock)
+	t.Cleanup(hub.Stop)
+	if err := hub.AddWebhook(config); err != nil {
+		t.Fatal(err)
+	}
+	return hub, clock
+}
+
+func testWebhookConfig(url string) WebhookConfig {
+	config := DefaultWebhookConfig()
+	config.URL = url
+	config.Secret = "hunter2"
+	return config
+}
+
+func TestWebhookConfig_Validate(t *testing.T) {
+	valid := testWebhookConfig("https://hooks.example.com/chat")
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("Expected a valid config: %v", err)
+	}
+
+	invalid := []func(*WebhookConfig){
+		func(c *WebhookConfig) { c.URL = "" },
+		func(c *WebhookConfig) { c.URL = "ftp://hooks.example.com" },
+		func(c *WebhookConfig) { c.URL = "/relative" },
+		func(c *WebhookConfig) { c.Secret = "" },
+		func(c *WebhookConfig) { c.Events = []WebhookEvent{"typing"} },
+		func(c *WebhookConfig) { c.QueueSize = 0 },
+		func(c *WebhookConfig) { c.MaxAttempts = 0 },
+		func(c *WebhookConfig) { c.MaxBackoff = c.InitialBackoff / 2 },
+		func(c *WebhookConfig) { c.Timeout = 0 },
+	}
+	for i, change := range invalid {
+		config := valid
+		change(&config)
+		if err := config.Validate(); err == nil {
+			t.Errorf("Expected invalid config %d to be refused", i)
+		}
+	}
+
+	events, err := ParseWebhookEvents(" Message, mention,,moderation")
+	if err != nil || len(events) != 3 || events[0] != WebhookEventMessage || events[2] != WebhookEventModeration {
+		t.Errorf("Expected three events, got %v (%v)", events, err)
+	}
+	if _, err := ParseWebhookEvents("message,typing"); err == nil {
+		t.Error("Expected an unknown event to be refused")
+	}
+}
+
+func TestWebhook_SignedDelivery(t *testing.T) {
+	receiver := newWebhookReceiver(t)
+	config := testWebhookConfig(receiver.server.URL)
+	config.Events = []WebhookEvent{WebhookEventJoin}
+	hub, _ := newWebhookHub(t, config)
+
+	// Only subscribed events are sent
+	hub.emitWebhook(WebhookPayload{Event: WebhookEventLeave, User: "Ann"})
+	hub.emitWebhook(WebhookPayload{Event: WebhookEventJoin, User: "Ann"})
+	if !waitUntil(5*time.Second, func() bool { return receiver.received() == 1 }) {
+		t.Fatalf("Expected one delivery, got %d", receiver.received())
+	}
+
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	request, payload, body := receiver.requests[0], receiver.payloads[0], receiver.bodies[0]
+	if payload.Event != WebhookEventJoin || payload.User != "Ann" || payload.ID == "" || payload.Timestamp.IsZero() {
+		t.Errorf("Unexpected payload %+v", payload)
+	}
+	if request.Method != http.MethodPost || request.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("Expected a JSON POST, got %s %s", request.Method, request.Header.Get("Content-Type"))
+	}
+	if request.Header.Get(WebhookEventHeader) != "join" || request.Header.Get(WebhookDeliveryHeader) != payload.ID {
+		t.Errorf("Unexpected event headers %v", request.Header)
+	}
+	signature := request.Header.Get(WebhookSignatureHeader)
+	if !VerifyWebhookSignature("hunter2", body, signature) {
+		t.Errorf("Expected signature %q to verify", signature)
+	}
+	if VerifyWebhookSignature("wrong", body, signature) {
+		t.Error("Expected a signature to fail with the wrong secret")
+	}
+}
+
+func TestWebhook_RetriesWithBackoff(t *testing.T) {
+	receiver := newWebhookReceiver(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	hub, clock := newWebhookHub(t, testWebhookConfig(receiver.server.URL))
+	waitForBackoff := func() {
+		t.Helper()
+		if !waitUntil(5*time.Second, func() bool { return clock.Timers() == 1 }) {
+			t.Fatal("Expected a retry to be scheduled")
+		}
+	}
+
+	hub.emitWebhook(WebhookPayload{Event: WebhookEventJoin, User: "Ann"})
+	hub.emitWebhook(WebhookPayload{Event: WebhookEventLeave, User: "Ann"})
+	waitForBackoff()
+	clock.Advance(time.Second)
+
+	// The second retry waits twice as long, holding back the next event
+	waitForBackoff()
+	clock.Advance(time.Second)
+	if receiver.received() != 2 || clock.Timers() != 1 {
+		t.Fatalf("Expected the retry to wait 2s, got %d requests", receiver.received())
+	}
+	clock.Advance(time.Second)
+
+	if !waitUntil(5*time.Second, func() bool { return receiver.received() == 4 }) {
+		t.Fatalf("Expected 4 requests, got %d", receiver.received())
+	}
+	events := receiver.events()
+	if events[2] != WebhookEventJoin || events[3] != WebhookEventLeave {
+		t.Errorf("Expected events in order after retries, got %v", events)
+	}
+	if letters := hub.WebhookDeadLetters(0); len(letters) != 0 {
+		t.Errorf("Expected no dead letters, got %+v", letters)
+	}
+}
+
+func TestWebhook_DeadLetters(t *testing.T) {
+	receiver := newWebhookReceiver(t, http.StatusInternalServerError, http.StatusInternalServerError, http.StatusBadRequest)
+	config := testWebhookConfig(receiver.server.URL)
+	config.MaxAttempts = 2
+	hub, clock := newWebhookHub(t, config)
+
+	// Retries run out
+	hub.emitWebhook(WebhookPayload{Event: WebhookEventJoin, User: "Ann"})
+	if !waitUntil(5*time.Second, func() bool { return clock.Timers() == 1 }) {
+		t.Fatal("Expected a retry to be scheduled")
+	}
+	clock.Advance(time.Second)
+
+	// Client errors are not retried
+	hub.emitWebhook(WebhookPayload{Event: WebhookEventLeave, User: "Ann"})
+	if !waitUntil(5*time.Second, func() bool { return len(hub.WebhookDeadLetters(0)) == 2 }) {
+		t.Fatalf("Expected two dead letters, got %+v", hub.WebhookDeadLetters(0))
+	}
+
+	letters := hub.WebhookDeadLetters(0)
+	if letters[1].Event != WebhookEventJoin || letters[1].Attempts != 2 || letters[1].Error != "endpoint responded 500 Internal Server Error" {
+		t.Errorf("Unexpected dead letter %+v", letters[1])
+	}
+	if letters[0].Event != WebhookEventLeave || letters[0].Attempts != 1 || letters[0].URL != receiver.server.URL {
+		t.Errorf("Unexpected dead letter %+v", letters[0])
+	}
+	var payload WebhookPayload
+	if err := json.Unmarshal(letters[0].Payload, &payload); err != nil || payload.User != "Ann" {
+		t.Errorf("Expected the payload to be kept, got %s", letters[0].Payload)
+	}
+	if n := len(hub.WebhookDeadLetters(1)); n != 1 {
+		t.Errorf("Expected the limit to apply, got %d", n)
+	}
+}
+
+func TestWebhook_QueueFull(t *testing.T) {
+	release := make(chan struct{})
+	arrived := make(chan struct{}, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	config := testWebhookConfig(server.URL)
+	config.QueueSize = 1
+	hub, _ := newWebhookHub(t, config)
+
+	// One event is being delivered and one waits; the next has no room
+	hub.emitWebhook(WebhookPayload{Event: WebhookEventJoin, User: "Ann"})
+	<-arrived
+	hub.emitWebhook(WebhookPayload{Event: WebhookEventJoin, User: "Bob"})
+	hub.emitWebhook(WebhookPayload{Event: WebhookEventJoin, User: "Cat"})
+
+	letters := hub.WebhookDeadLetters(0)
+	if len(letters) != 1 || letters[0].Error != "queue full" || letters[0].Attempts != 0 {
+		t.Fatalf("Expected the overflowing event to be dead-lettered, got %+v", letters)
+	}
+}
+
+func TestWebhook_ChatEvents(t *testing.T) {
+	receiver := newWebhookReceiver(t)
+	h := newChatHarness(t)
+	filters := DefaultFilterConfig()
+	filters.BannedWords = []string{"darn"}
+	if err := h.hub.SetContentFilters(filters); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.hub.AddWebhook(testWebhookConfig(receiver.server.URL)); err != nil {
+		t.Fatal(err)
+	}
+	clients := h.joinMany("user", 2)
+	waitForEvents := func(n int) []WebhookEvent {
+		t.Helper()
+		if !waitUntil(5*time.Second, func() bool { return receiver.received() == n }) {
+			t.Fatalf("Expected %d events, got %v", n, receiver.events())
+		}
+		return receiver.events()
+	}
+	waitForEvents(2)
+
+	clients[0].send(Message{Type: MessageTypeChat, From: "user-0", Content: "darn it @user-1"})
+	clients[1].waitFor(func(m Message) bool { return m.Type == MessageTypeMention })
+	events := waitForEvents(5)
+	if events[2] != WebhookEventModeration || events[3] != WebhookEventMessage || events[4] != WebhookEventMention {
+		t.Fatalf("Expected moderation, message and mention events, got %v", events)
+	}
+
+	receiver.mu.Lock()
+	moderation, message, mention := receiver.payloads[2], receiver.payloads[3], receiver.payloads[4]
+	receiver.mu.Unlock()
+	if m := moderation.Moderation; m == nil || m.Source != "filter" || m.Action != "mask" || m.Content != "darn it @user-1" {
+		t.Errorf("Unexpected moderation %+v", moderation.Moderation)
+	}
+	if message.User != "user-0" || message.Message == nil || message.Message.Content != "**** it @user-1" || message.Message.ID == "" {
+		t.Errorf("Unexpected message event %+v", message)
+	}
+	if len(mention.Mentioned) != 1 || mention.Mentioned[0] != "user-1" {
+		t.Errorf("Expected user-1 to be mentioned, got %v", mention.Mentioned)
+	}
+
+	clients[1].conn.Close()
+	if events := waitForEvents(6); events[5] != WebhookEventLeave {
+		t.Errorf("Expected a leave event, got %v", events)
+	}
+}
+
+func TestWebhook_ModerationContent(t *testing.T) {
+	h := newChatHarness(t)
+	filters := DefaultFilterConfig()
+	filters.BannedWords = []string{"darn"}
+	if err := h.hub.SetContentFilters(filters); err != nil {
+		t.Fatal(err)
+	}
+	redacting, trusted := newWebhookReceiver(t), newWebhookReceiver(t)
+	for _, receiver := range []*webhookReceiver{redacting, trusted} {
+		config := testWebhookConfig(receiver.server.URL)
+		config.Events = []WebhookEvent{WebhookEventModeration}
+		config.IncludePrivateContent = receiver == trusted
+		if err := h.hub.AddWebhook(config); err != nil {
+			t.Fatal(err)
+		}
+	}
+	clients := h.joinMany("user", 2)
+
+	long := "darn " + strings.Repeat("x", 200)
+	clients[0].send(Message{Type: MessageTypeChat, From: "user-0", Content: long})
+	clients[0].send(Message{Type: MessageTypePrivate, From: "user-0", To: "user-1", Content: "darn secret"})
+	for _, receiver := range []*webhookReceiver{redacting, trusted} {
+		receiver := receiver
+		if !waitUntil(5*time.Second, func() bool { return receiver.received() == 2 }) {
+			t.Fatalf("Expected 2 moderation events, got %v", receiver.events())
+		}
+	}
+
+	// Content is cut to an excerpt, and private content only goes to
+	// webhooks that opted in
+	for receiver, private := range map[*webhookReceiver]string{redacting: "", trusted: "darn secret"} {
+		receiver.mu.Lock()
+		public, direct := receiver.payloads[0].Moderation, receiver.payloads[1].Moderation
+		receiver.mu.Unlock()
+		if public == nil || public.Content != long[:spamExcerptLength] {
+			t.Errorf("Expected a %d character excerpt of public content, got %+v", spamExcerptLength, public)
+		}
+		if direct == nil || direct.Content != private {
+			t.Errorf("Expected private content %q, got %+v", private, direct)
+		}
+	}
+}
+
+func TestWebhook_UsesClockSetAfterAdding(t *testing.T) {
+	receiver := newWebhookReceiver(t, http.StatusBadRequest)
+	hub := NewHub()
+	t.Cleanup(hub.Stop)
+	if err := hub.AddWebhook(testWebhookConfig(receiver.server.URL)); err != nil {
+		t.Fatal(err)
+	}
+	clock := NewFakeClock(time.Unix(1700000000, 0))
+	hub.SetClock(clock)
+
+	hub.emitWebhook(WebhookPayload{Event: WebhookEventJoin, User: "Ann"})
+	if !waitUntil(5*time.Second, func() bool { return len(hub.WebhookDeadLetters(0)) == 1 }) {
+		t.Fatal("Expected the refused event to be dead-lettered")
+	}
+	if letter := hub.WebhookDeadLetters(0)[0]; !letter.Time.Equal(clock.Now()) {
+		t.Errorf("Expected the dead letter on the hub's current clock, got %v", letter.Time)
+	}
+}